@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"os"
 
+	// Commands and database backends register themselves when imported
 	_ "github.com/remram44/vogon/internal/apiserver"
 	_ "github.com/remram44/vogon/internal/client"
 	"github.com/remram44/vogon/internal/commands"
@@ -0,0 +1,480 @@
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Kinds of the objects configuring admission webhooks, see
+// AdmissionWebhookSpec
+const (
+	MutatingWebhookKind   = "github.com/remram44/vogon/schemas/MutatingWebhook"
+	ValidatingWebhookKind = "github.com/remram44/vogon/schemas/ValidatingWebhook"
+)
+
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+const (
+	// Reject the write if the webhook can't be reached or its response is
+	// invalid
+	FailurePolicyFail = "fail"
+	// Carry on as if the webhook wasn't configured
+	FailurePolicyIgnore = "ignore"
+)
+
+const (
+	defaultAdmissionTimeout = 10 * time.Second
+	// Writes wait for webhooks, don't let one stall them for too long
+	maxAdmissionTimeout = 30 * time.Second
+)
+
+// Spec of a MutatingWebhook or ValidatingWebhook object, a service called
+// before objects are written. Mutating webhooks are called first, in the
+// order of their names, and can change the object. Validating webhooks are
+// called next, and can only accept or deny the write.
+//
+// Like role bindings, webhooks only apply to the objects under their own
+// namespace: a webhook named "team-a/policy" is called for "team-a/job", but
+// not for "team-b/job" or "team-a" itself. Webhooks at the top level apply to
+// every object.
+//
+// Webhook objects themselves are not sent to webhooks, so a broken webhook
+// can always be removed. Since the server sends objects to their URL, only
+// admins can write them when authorization is enabled.
+type AdmissionWebhookSpec struct {
+	// URL the AdmissionReview is POSTed to, it must answer with an
+	// AdmissionResponse
+	Url string `json:"url"`
+	// Kinds of the objects, empty or "*" for all
+	Kinds []string `json:"kinds,omitempty"`
+	// Names relative to the namespace of the webhook, it applies to those
+	// objects and everything under them. Empty for the whole namespace.
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Operations to call the webhook for, defaults to create and update
+	Operations []string `json:"operations,omitempty"`
+	// Maximum time for the webhook to answer, e.g. "5s", defaults to 10s, at
+	// most 30s
+	Timeout string `json:"timeout,omitempty"`
+	// "fail" (the default) or "ignore"
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+}
+
+// Sent to webhooks
+type AdmissionReview struct {
+	// "create", "update", or "delete"
+	Operation string
+	Name      string
+	Kind      string
+	User      string
+	Groups    []string
+	// The object to be written, nil on delete
+	Object *database.Object
+	// The current object, nil on create
+	OldObject *database.Object
+}
+
+// Answer from webhooks
+type AdmissionResponse struct {
+	Allowed bool
+	// Reason for denying the write, shown to the user
+	Message string
+	// Changes to make to the Object, only from mutating webhooks
+	Patch []JsonPatchOperation
+}
+
+type admissionWebhook struct {
+	name     string
+	mutating bool
+	spec     AdmissionWebhookSpec
+	timeout  time.Duration
+	// Absolute names, or the namespace if empty
+	prefixes  []string
+	namespace string
+}
+
+func isWebhookKind(kind string) bool {
+	return kind == MutatingWebhookKind || kind == ValidatingWebhookKind
+}
+
+// Read a webhook object, checking its spec
+func parseWebhook(object database.Object) (admissionWebhook, error) {
+	invalid := func(message string) error {
+		return &database.Invalid{
+			Reason:  database.ReasonInvalid,
+			Name:    object.Metadata.Name,
+			Message: message,
+		}
+	}
+	hook := admissionWebhook{
+		name:      object.Metadata.Name,
+		mutating:  object.Kind == MutatingWebhookKind,
+		timeout:   defaultAdmissionTimeout,
+		namespace: namespaceOf(object.Metadata.Name),
+	}
+	if err := decodeSpec(object, &hook.spec); err != nil {
+		return hook, err
+	}
+	target, err := url.Parse(hook.spec.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return hook, invalid(fmt.Sprintf("Invalid webhook URL %#v", hook.spec.Url))
+	}
+	for _, prefix := range hook.spec.Prefixes {
+		if err := database.ValidateName(prefix); err != nil {
+			return hook, invalid(fmt.Sprintf("Invalid prefix %#v", prefix))
+		}
+		hook.prefixes = append(hook.prefixes, joinName(hook.namespace, prefix))
+	}
+	if len(hook.spec.Operations) == 0 {
+		hook.spec.Operations = []string{OperationCreate, OperationUpdate}
+	}
+	for _, operation := range hook.spec.Operations {
+		switch operation {
+		case OperationCreate, OperationUpdate, OperationDelete:
+		default:
+			return hook, invalid(fmt.Sprintf("Unknown operation %#v, expected one of %v, %v, %v", operation, OperationCreate, OperationUpdate, OperationDelete))
+		}
+	}
+	if hook.spec.Timeout != "" {
+		hook.timeout, err = time.ParseDuration(hook.spec.Timeout)
+		if err != nil || hook.timeout <= 0 {
+			return hook, invalid(fmt.Sprintf("Invalid timeout %#v", hook.spec.Timeout))
+		} else if hook.timeout > maxAdmissionTimeout {
+			return hook, invalid(fmt.Sprintf("Timeout %#v is longer than %v", hook.spec.Timeout, maxAdmissionTimeout))
+		}
+	}
+	switch hook.spec.FailurePolicy {
+	case "":
+		hook.spec.FailurePolicy = FailurePolicyFail
+	case FailurePolicyFail, FailurePolicyIgnore:
+	default:
+		return hook, invalid(fmt.Sprintf("Invalid failure policy %#v, expected %v or %v", hook.spec.FailurePolicy, FailurePolicyFail, FailurePolicyIgnore))
+	}
+	return hook, nil
+}
+
+// Whether the webhook applies to this object, for some operation
+func (h *admissionWebhook) matches(name string, kind string) bool {
+	if len(h.spec.Kinds) > 0 && !slices.Contains(h.spec.Kinds, "*") && !slices.Contains(h.spec.Kinds, kind) {
+		return false
+	}
+	if len(h.prefixes) == 0 {
+		return database.HasPrefix(name, h.namespace)
+	}
+	for _, prefix := range h.prefixes {
+		if name == prefix || database.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Call the webhook
+func (h *admissionWebhook) call(ctx context.Context, client *http.Client, review AdmissionReview) (AdmissionResponse, error) {
+	var response AdmissionResponse
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	body, err := json.Marshal(review)
+	if err != nil {
+		return response, err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", h.spec.Url, bytes.NewReader(body))
+	if err != nil {
+		return response, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	result, err := client.Do(request)
+	if err != nil {
+		return response, err
+	}
+	defer result.Body.Close()
+	if result.StatusCode != 200 {
+		return response, fmt.Errorf("Webhook returned %v", result.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(result.Body, 1<<20)).Decode(&response)
+	if err != nil {
+		return response, fmt.Errorf("Invalid response from webhook: %w", err)
+	}
+	return response, nil
+}
+
+// Apply the patch from a mutating webhook
+func patchObject(object database.Object, patch []JsonPatchOperation) (database.Object, error) {
+	var document any
+	data, err := json.Marshal(object)
+	if err == nil {
+		err = json.Unmarshal(data, &document)
+	}
+	if err == nil {
+		document, err = jsonPatch(document, patch)
+	}
+	if err == nil {
+		data, err = json.Marshal(document)
+	}
+	var patched database.Object
+	if err == nil {
+		err = json.Unmarshal(data, &patched)
+	}
+	if err != nil {
+		return object, err
+	}
+	if patched.Metadata.Name != object.Metadata.Name {
+		return object, fmt.Errorf("The name of the object cannot be changed")
+	}
+	// Authorization was checked for the original kind
+	if patched.Kind != object.Kind {
+		return object, fmt.Errorf("The kind of the object cannot be changed")
+	}
+	// The write is still conditional on the original revision
+	patched.Metadata.Id = object.Metadata.Id
+	patched.Metadata.Revision = object.Metadata.Revision
+	return patched, nil
+}
+
+// Calls the admission webhooks before writing
+type admissionDatabase struct {
+	db     database.Database
+	client http.Client
+
+	mutex sync.Mutex
+	// Loaded on demand, reset when webhook objects change
+	webhooks []admissionWebhook
+	loaded   bool
+	tracker  *kindTracker
+}
+
+func newAdmissionDatabase(db database.Database) *admissionDatabase {
+	return &admissionDatabase{
+		db: db,
+		client: http.Client{
+			// Only call the configured URL
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		tracker: newKindTracker(db),
+	}
+}
+
+// Get the webhooks, mutating ones first
+func (d *admissionDatabase) getWebhooks(ctx context.Context) ([]admissionWebhook, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.loaded {
+		changed, err := d.tracker.changed(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			return d.webhooks, nil
+		}
+	}
+	err := d.tracker.reset(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []admissionWebhook
+	for _, kind := range []string{MutatingWebhookKind, ValidatingWebhookKind} {
+		objects, err := d.tracker.list(ctx, kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			hook, err := parseWebhook(object)
+			if err != nil {
+				slog.Warn("ignoring invalid webhook", "name", object.Metadata.Name, "error", err)
+				continue
+			}
+			webhooks = append(webhooks, hook)
+		}
+	}
+	d.webhooks = webhooks
+	d.loaded = true
+	return webhooks, nil
+}
+
+// Forget the webhooks after they were written, without waiting for the change
+// feed
+func (d *admissionDatabase) invalidate() {
+	d.mutex.Lock()
+	d.webhooks = nil
+	d.loaded = false
+	d.mutex.Unlock()
+}
+
+// Get the current object, nil if it doesn't exist
+func (d *admissionDatabase) getExisting(ctx context.Context, name string) (*database.Object, error) {
+	object, err := d.db.Get(ctx, name)
+	var doesNotExist *database.DoesNotExist
+	if errors.As(err, &doesNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &object, nil
+}
+
+// Run the webhooks for a write. The object is nil for deletes, otherwise the
+// object to write is returned, possibly changed by mutating webhooks. Also
+// returns whether the webhooks might change.
+func (d *admissionDatabase) admit(ctx context.Context, name string, object *database.Object, replace bool) (*database.Object, bool, error) {
+	if object != nil && isWebhookKind(object.Kind) {
+		_, err := parseWebhook(*object)
+		return object, true, err
+	}
+	webhooks, err := d.getWebhooks(ctx)
+	if err != nil || len(webhooks) == 0 {
+		return object, false, err
+	}
+
+	existing, err := d.getExisting(ctx, name)
+	if err != nil {
+		return nil, false, err
+	}
+	var operation, kind string
+	if object == nil {
+		if existing == nil {
+			// Let the database report the error
+			return nil, false, nil
+		}
+		operation, kind = OperationDelete, existing.Kind
+	} else if existing == nil || !replace {
+		operation, kind = OperationCreate, object.Kind
+	} else {
+		operation, kind = OperationUpdate, object.Kind
+	}
+	if existing != nil && isWebhookKind(existing.Kind) {
+		return object, true, nil
+	}
+
+	identity := identityFromContext(ctx)
+	for _, hook := range webhooks {
+		if !slices.Contains(hook.spec.Operations, operation) || !hook.matches(name, kind) {
+			continue
+		}
+		response, err := hook.call(ctx, &d.client, AdmissionReview{
+			Operation: operation,
+			Name:      name,
+			Kind:      kind,
+			User:      identity.User,
+			Groups:    identity.Groups,
+			Object:    object,
+			OldObject: existing,
+		})
+		if err == nil && response.Allowed && hook.mutating && len(response.Patch) > 0 && object != nil {
+			var patched database.Object
+			patched, err = patchObject(*object, response.Patch)
+			if err == nil {
+				object = &patched
+			}
+		}
+		if err != nil {
+			if hook.spec.FailurePolicy == FailurePolicyIgnore {
+				slog.Warn("ignoring webhook error", "webhook", hook.name, "name", name, "error", err)
+				continue
+			}
+			return nil, false, fmt.Errorf("Admission webhook %v: %w", hook.name, err)
+		}
+		if !response.Allowed {
+			message := fmt.Sprintf("Denied by admission webhook %v", hook.name)
+			if response.Message != "" {
+				message += ": " + response.Message
+			}
+			return nil, false, &database.Forbidden{
+				Name:    name,
+				Message: message,
+			}
+		}
+	}
+	return object, false, nil
+}
+
+func (d *admissionDatabase) Create(ctx context.Context, object database.Object, replace bool) (database.MetadataResponse, error) {
+	admitted, changesWebhooks, err := d.admit(ctx, object.Metadata.Name, &object, replace)
+	if err != nil {
+		return database.MetadataResponse{}, err
+	}
+	recordAdmitted(ctx, *admitted)
+	if changesWebhooks {
+		defer d.invalidate()
+	}
+	return d.db.Create(ctx, *admitted, replace)
+}
+
+func (d *admissionDatabase) Update(ctx context.Context, object database.Object) (database.MetadataResponse, error) {
+	admitted, changesWebhooks, err := d.admit(ctx, object.Metadata.Name, &object, true)
+	if err != nil {
+		return database.MetadataResponse{}, err
+	}
+	recordAdmitted(ctx, *admitted)
+	if changesWebhooks {
+		defer d.invalidate()
+	}
+	return d.db.Update(ctx, *admitted)
+}
+
+func (d *admissionDatabase) Get(ctx context.Context, name string) (database.Object, error) {
+	return d.db.Get(ctx, name)
+}
+
+func (d *admissionDatabase) List(ctx context.Context, options database.ListOptions) (database.ListResult, error) {
+	return d.db.List(ctx, options)
+}
+
+func (d *admissionDatabase) Delete(ctx context.Context, name string, id string, revision string) (database.MetadataResponse, error) {
+	_, changesWebhooks, err := d.admit(ctx, name, nil, false)
+	if err != nil {
+		return database.MetadataResponse{}, err
+	}
+	if changesWebhooks {
+		defer d.invalidate()
+	}
+	return d.db.Delete(ctx, name, id, revision)
+}
+
+// Webhooks see each object as it is before the batch, not as changed by
+// previous operations
+func (d *admissionDatabase) Batch(ctx context.Context, operations []database.BatchOperation) ([]database.MetadataResponse, error) {
+	admitted := make([]database.BatchOperation, len(operations))
+	changesWebhooks := false
+	for i, op := range operations {
+		var changes bool
+		var err error
+		switch op.Operation {
+		case database.BatchCreate, database.BatchUpdate:
+			var object *database.Object
+			replace := op.Operation == database.BatchUpdate || op.Replace
+			object, changes, err = d.admit(ctx, op.Object.Metadata.Name, &op.Object, replace)
+			if err == nil {
+				op.Object = *object
+				recordAdmitted(ctx, *object)
+			}
+		case database.BatchDelete:
+			_, changes, err = d.admit(ctx, op.Name, nil, false)
+		}
+		if err != nil {
+			return nil, &database.BatchError{Index: i, Err: err}
+		}
+		admitted[i] = op
+		changesWebhooks = changesWebhooks || changes
+	}
+	if changesWebhooks {
+		defer d.invalidate()
+	}
+	return d.db.Batch(ctx, admitted)
+}
@@ -0,0 +1,369 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Start a webhook answering with the function, returns its URL
+func startWebhook(t *testing.T, answer func(review AdmissionReview) AdmissionResponse) string {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var review AdmissionReview
+		err := json.NewDecoder(req.Body).Decode(&review)
+		if err != nil {
+			t.Error(err)
+			res.WriteHeader(400)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(answer(review))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestAdmission(t *testing.T) {
+	ctx := withIdentity(context.Background(), Identity{User: "alice"})
+	db := newAdmissionDatabase(database.NewInMemoryDatabase())
+
+	var reviews []AdmissionReview
+	labeler := startWebhook(t, func(review AdmissionReview) AdmissionResponse {
+		reviews = append(reviews, review)
+		return AdmissionResponse{
+			Allowed: true,
+			Patch: []JsonPatchOperation{
+				{Op: "add", Path: "/Metadata/Labels", Value: map[string]any{"team": "a"}},
+			},
+		}
+	})
+	validator := startWebhook(t, func(review AdmissionReview) AdmissionResponse {
+		if review.Object != nil {
+			spec, _ := review.Object.Spec.(map[string]any)
+			if spec["value"] == "bad" {
+				return AdmissionResponse{Message: "value is bad"}
+			}
+			if review.Object.Metadata.Labels["team"] != "a" {
+				return AdmissionResponse{Message: "not labeled"}
+			}
+		} else if spec, _ := review.OldObject.Spec.(map[string]any); spec["value"] == "protected" {
+			return AdmissionResponse{Message: "object is protected"}
+		}
+		return AdmissionResponse{Allowed: true}
+	})
+
+	mustWrite := func(object database.Object) {
+		t.Helper()
+		_, err := db.Create(ctx, object, true)
+		if err != nil {
+			t.Fatalf("create %v: %v", object.Metadata.Name, err)
+		}
+	}
+	isForbidden := func(err error, message string) bool {
+		var forbidden *database.Forbidden
+		return errors.As(err, &forbidden) && strings.Contains(forbidden.Message, message)
+	}
+
+	mustWrite(rbacObject(MutatingWebhookKind, "labeler", map[string]any{
+		"url":      labeler,
+		"prefixes": []any{"team-a"},
+	}))
+	mustWrite(rbacObject(ValidatingWebhookKind, "validator", map[string]any{
+		"url":        validator,
+		"kinds":      []any{testObject("").Kind},
+		"prefixes":   []any{"team-a"},
+		"operations": []any{"create", "update", "delete"},
+	}))
+
+	// Invalid webhooks are rejected
+	_, err := db.Create(ctx, rbacObject(ValidatingWebhookKind, "bad", map[string]any{
+		"url":           "ftp://example.org",
+		"failurePolicy": "retry",
+	}), false)
+	var invalid *database.Invalid
+	if !errors.As(err, &invalid) {
+		t.Fatalf("invalid webhook: %v", err)
+	}
+
+	// Created objects are mutated then validated
+	mustWrite(testObject("team-a/example"))
+	object, err := db.Get(ctx, "team-a/example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Metadata.Labels["team"] != "a" {
+		t.Fatalf("object was not mutated: %#v", object.Metadata)
+	}
+	if len(reviews) != 1 || reviews[0].Operation != "create" || reviews[0].User != "alice" || reviews[0].OldObject != nil {
+		t.Fatalf("wrong review: %#v", reviews)
+	}
+
+	// Updates come with the old object
+	object = testObject("team-a/example")
+	object.Spec = map[string]any{"value": "bad"}
+	_, err = db.Update(ctx, object)
+	if !isForbidden(err, "value is bad") {
+		t.Fatalf("bad update: %v", err)
+	}
+	if len(reviews) != 2 || reviews[1].Operation != "update" || reviews[1].OldObject == nil || reviews[1].OldObject.Metadata.Labels["team"] != "a" {
+		t.Fatalf("wrong review: %#v", reviews[1])
+	}
+
+	// Mutations can't change the kind, which authorization was checked for
+	kindChanger := startWebhook(t, func(review AdmissionReview) AdmissionResponse {
+		return AdmissionResponse{
+			Allowed: true,
+			Patch: []JsonPatchOperation{
+				{Op: "replace", Path: "/Kind", Value: RoleBindingKind},
+			},
+		}
+	})
+	mustWrite(rbacObject(MutatingWebhookKind, "team-c/hook", map[string]any{"url": kindChanger}))
+	_, err = db.Create(ctx, testObject("team-c/example"), false)
+	if err == nil || !strings.Contains(err.Error(), "kind of the object cannot be changed") {
+		t.Fatalf("kind change: %v", err)
+	}
+
+	// Batches are checked operation by operation
+	bad := testObject("team-a/other")
+	bad.Spec = map[string]any{"value": "bad"}
+	_, err = db.Batch(ctx, []database.BatchOperation{
+		{Operation: database.BatchCreate, Object: testObject("team-a/one")},
+		{Operation: database.BatchCreate, Object: bad},
+	})
+	var batchErr *database.BatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 1 || !isForbidden(err, "value is bad") {
+		t.Fatalf("bad batch: %v", err)
+	}
+
+	// Deletes are only sent to hooks that ask for them
+	object = testObject("team-a/protected")
+	object.Spec = map[string]any{"value": "protected"}
+	mustWrite(object)
+	_, err = db.Delete(ctx, "team-a/protected", "", "")
+	if !isForbidden(err, "object is protected") {
+		t.Fatalf("delete protected: %v", err)
+	}
+
+	// Objects that don't match are not sent
+	reviews = nil
+	mustWrite(testObject("team-b/example"))
+	other := testObject("team-a/job")
+	other.Kind = "example.org/Job"
+	mustWrite(other)
+	if len(reviews) != 1 || reviews[0].Name != "team-a/job" {
+		t.Fatalf("wrong reviews: %#v", reviews)
+	}
+	object, err = db.Get(ctx, "team-b/example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Metadata.Labels != nil {
+		t.Fatalf("object was mutated: %#v", object.Metadata)
+	}
+
+	// Deleting the webhooks applies immediately
+	for _, name := range []string{"labeler", "validator"} {
+		_, err = db.Delete(ctx, name, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Delete(ctx, "team-a/protected", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmissionFailurePolicy(t *testing.T) {
+	ctx := context.Background()
+	db := newAdmissionDatabase(database.NewInMemoryDatabase())
+	done := make(chan struct{})
+	slow := startWebhook(t, func(review AdmissionReview) AdmissionResponse {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-done:
+		}
+		return AdmissionResponse{Allowed: true}
+	})
+	// Runs before the server is closed, which waits for requests
+	t.Cleanup(func() { close(done) })
+
+	hook := rbacObject(ValidatingWebhookKind, "slow", map[string]any{
+		"url":     slow,
+		"timeout": "50ms",
+	})
+	_, err := db.Create(ctx, hook, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Create(ctx, testObject("example"), true)
+	if err == nil || !strings.Contains(err.Error(), "Admission webhook slow") {
+		t.Fatalf("no error from timeout: %v", err)
+	}
+
+	hook.Spec.(map[string]any)["failurePolicy"] = "ignore"
+	_, err = db.Create(ctx, hook, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Create(ctx, testObject("example"), true)
+	if err != nil {
+		t.Fatalf("error with ignore policy: %v", err)
+	}
+
+	// Timeouts are limited
+	hook.Spec.(map[string]any)["timeout"] = "1h"
+	_, err = db.Create(ctx, hook, true)
+	var invalid *database.Invalid
+	if !errors.As(err, &invalid) {
+		t.Fatalf("long timeout: %v", err)
+	}
+
+	// Redirects are not followed
+	allow := startWebhook(t, func(review AdmissionReview) AdmissionResponse {
+		return AdmissionResponse{Allowed: true}
+	})
+	redirect := httptest.NewServer(http.RedirectHandler(allow, http.StatusTemporaryRedirect))
+	t.Cleanup(redirect.Close)
+	_, err = db.Create(ctx, rbacObject(ValidatingWebhookKind, "slow", map[string]any{
+		"url": redirect.URL,
+	}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Create(ctx, testObject("example"), true)
+	if err == nil || !strings.Contains(err.Error(), "307") {
+		t.Fatalf("redirect was followed: %v", err)
+	}
+}
+
+func TestAdmissionNamespaces(t *testing.T) {
+	ctx := context.Background()
+	raw := database.NewInMemoryDatabase()
+	authz := newAuthorizer(raw, AuthorizationConfig{AdminUsers: []string{"root"}})
+	db := &authorizedDatabase{db: newAdmissionDatabase(raw), authz: authz}
+	root := withIdentity(ctx, Identity{User: "root"})
+	alice := withIdentity(ctx, Identity{User: "alice"})
+
+	var reviews []string
+	hook := startWebhook(t, func(review AdmissionReview) AdmissionResponse {
+		reviews = append(reviews, review.Name)
+		return AdmissionResponse{
+			Allowed: true,
+			Patch: []JsonPatchOperation{
+				{Op: "replace", Path: "/Spec", Value: "pwned"},
+			},
+		}
+	})
+
+	mustCreate := func(ctx context.Context, object database.Object) {
+		t.Helper()
+		_, err := db.Create(ctx, object, false)
+		if err != nil {
+			t.Fatalf("create %v: %v", object.Metadata.Name, err)
+		}
+	}
+	mustCreate(root, rbacObject(RoleKind, "team-a/owner", map[string]any{
+		"rules": []any{map[string]any{"verbs": []any{"*"}}},
+	}))
+	mustCreate(root, rbacObject(RoleBindingKind, "team-a/alice", map[string]any{
+		"role":  "owner",
+		"users": []any{"alice"},
+	}))
+
+	// Only admins can configure webhooks, even in namespaces users own
+	webhook := rbacObject(MutatingWebhookKind, "team-a/hook", map[string]any{"url": hook})
+	_, err := db.Create(alice, webhook, false)
+	var forbidden *database.Forbidden
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("alice create webhook: %v", err)
+	}
+
+	// Webhooks only intercept writes under their namespace, whatever the
+	// prefixes
+	mustCreate(root, webhook)
+	mustCreate(root, rbacObject(MutatingWebhookKind, "team-a/jobs-hook", map[string]any{
+		"url":      hook,
+		"prefixes": []any{"jobs"},
+	}))
+	_, err = db.Update(alice, webhook)
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("alice update webhook: %v", err)
+	}
+	_, err = db.Delete(alice, "team-a/hook", "", "")
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("alice delete webhook: %v", err)
+	}
+
+	mustCreate(root, testObject("team-b/secret"))
+	mustCreate(root, testObject("secret"))
+	mustCreate(root, testObject("team-a"))
+	mustCreate(root, testObject("team-a/example"))
+	mustCreate(root, testObject("team-a/jobs/one"))
+	expected := []string{"team-a/example", "team-a/jobs/one", "team-a/jobs/one"}
+	if !slices.Equal(reviews, expected) {
+		t.Fatalf("wrong reviews: %v", reviews)
+	}
+	for _, name := range []string{"team-b/secret", "secret", "team-a"} {
+		object, err := db.Get(root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := object.Spec.(map[string]any); !ok {
+			t.Errorf("%v was mutated: %#v", name, object.Spec)
+		}
+	}
+}
+
+func TestAdmissionOtherProcess(t *testing.T) {
+	ctx := context.Background()
+	directory := t.TempDir()
+	raw, err := database.NewFilesDatabase(directory, database.FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newAdmissionDatabase(raw)
+	other, err := database.NewFilesDatabase(directory, database.FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denier := startWebhook(t, func(review AdmissionReview) AdmissionResponse {
+		return AdmissionResponse{Message: "denied"}
+	})
+
+	_, err = db.Create(ctx, testObject("one"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A webhook added by another process sharing the directory applies
+	_, err = other.Create(ctx, rbacObject(ValidatingWebhookKind, "denier", map[string]any{
+		"url": denier,
+	}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Create(ctx, testObject("two"), false)
+	var forbidden *database.Forbidden
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("create with webhook: %v", err)
+	}
+
+	_, err = other.Delete(ctx, "denier", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Create(ctx, testObject("two"), false)
+	if err != nil {
+		t.Fatalf("create after deleting webhook: %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+package apiserver
+
+import (
+	"context"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/remram44/vogon/internal/client"
+	"github.com/remram44/vogon/internal/commands"
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Run "vogon apply" on the objects against the server, returns the result
+// printed for each object and the error that would be the exit status
+func runApply(t *testing.T, uri string, objects []database.Object, args ...string) (map[string]client.ApplyResult, error) {
+	t.Helper()
+	t.Setenv("VOGON_SERVER_URI", uri)
+	t.Setenv("VOGON_CONFIG", filepath.Join(t.TempDir(), "config.yaml"))
+
+	path := filepath.Join(t.TempDir(), "manifests.yaml")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := yaml.NewEncoder(file)
+	for _, object := range objects {
+		err = encoder.Encode(object)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	encoder.Close()
+	file.Close()
+
+	// Capture the output
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+	stdout := os.Stdout
+	os.Stdout = writer
+	err = commands.Get("apply").Run(append([]string{"apply", "-f", path}, args...))
+	os.Stdout = stdout
+	writer.Close()
+
+	results := make(map[string]client.ApplyResult)
+	lines := strings.Split(strings.TrimSpace(<-output), "\n")
+	// The last line is the summary
+	for _, line := range lines[:len(lines)-1] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			t.Fatalf("invalid output line: %q", line)
+		}
+		results[fields[0]] = client.ApplyResult(strings.TrimSuffix(fields[1], ":"))
+	}
+	return results, err
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	_, c, uri := startTestServer(t)
+
+	changed := func(name string) database.Object {
+		object := testObject(name)
+		object.Spec = map[string]any{"value": "changed"}
+		return object
+	}
+	tests := []struct {
+		name   string
+		exists bool
+		// Called with the metadata of the existing object, if any
+		manifest func(meta database.MetadataResponse) database.Object
+		result   client.ApplyResult
+	}{
+		{
+			name:     "created",
+			manifest: func(database.MetadataResponse) database.Object { return testObject("created") },
+			result:   client.ApplyCreated,
+		},
+		{
+			name:     "configured",
+			exists:   true,
+			manifest: func(database.MetadataResponse) database.Object { return changed("configured") },
+			result:   client.ApplyConfigured,
+		},
+		{
+			name:     "unchanged",
+			exists:   true,
+			manifest: func(database.MetadataResponse) database.Object { return testObject("unchanged") },
+			result:   client.ApplyUnchanged,
+		},
+		{
+			name:   "current revision",
+			exists: true,
+			manifest: func(meta database.MetadataResponse) database.Object {
+				object := changed("current")
+				object.Metadata.Id = meta.Id
+				object.Metadata.Revision = meta.Revision
+				return object
+			},
+			result: client.ApplyConfigured,
+		},
+		{
+			name:   "wrong revision, changed",
+			exists: true,
+			manifest: func(meta database.MetadataResponse) database.Object {
+				object := changed("old-changed")
+				object.Metadata.Id = meta.Id
+				object.Metadata.Revision = "old"
+				return object
+			},
+			result: client.ApplyFailed,
+		},
+		{
+			name:   "wrong revision, same content",
+			exists: true,
+			manifest: func(meta database.MetadataResponse) database.Object {
+				object := testObject("old-same")
+				object.Metadata.Id = meta.Id
+				object.Metadata.Revision = "old"
+				return object
+			},
+			result: client.ApplyFailed,
+		},
+		{
+			name:   "wrong id, same content",
+			exists: true,
+			manifest: func(meta database.MetadataResponse) database.Object {
+				object := testObject("other-id")
+				object.Metadata.Id = "other"
+				return object
+			},
+			result: client.ApplyFailed,
+		},
+	}
+
+	var manifests []database.Object
+	for _, test := range tests {
+		var meta database.MetadataResponse
+		manifest := test.manifest(meta)
+		if test.exists {
+			var err error
+			meta, err = c.WriteObject(ctx, testObject(manifest.Metadata.Name), client.Create)
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest = test.manifest(meta)
+		}
+		manifests = append(manifests, manifest)
+	}
+	results, err := runApply(t, uri, manifests)
+	for i, test := range tests {
+		name := manifests[i].Metadata.Name
+		if results[name] != test.result {
+			t.Errorf("%v: expected %v, got %v", test.name, test.result, results[name])
+		}
+	}
+	if err == nil || err.Error() != "3 objects failed" {
+		t.Fatalf("wrong exit status: %v", err)
+	}
+
+	// Nothing to do the second time, so the exit status is 0
+	results, err = runApply(t, uri, []database.Object{changed("configured"), testObject("created")})
+	if err != nil {
+		t.Fatalf("wrong exit status: %v", err)
+	}
+	if results["configured"] != client.ApplyUnchanged || results["created"] != client.ApplyUnchanged {
+		t.Fatalf("wrong results: %v", results)
+	}
+}
+
+// Records the deletes, to check their preconditions
+type recordingDatabase struct {
+	database.Database
+	mutex   sync.Mutex
+	deletes []database.ObjectMetadata
+}
+
+func (d *recordingDatabase) Delete(ctx context.Context, name string, id string, revision string) (database.MetadataResponse, error) {
+	d.mutex.Lock()
+	d.deletes = append(d.deletes, database.ObjectMetadata{Name: name, Id: id, Revision: revision})
+	d.mutex.Unlock()
+	return d.Database.Delete(ctx, name, id, revision)
+}
+
+func TestApplyPrune(t *testing.T) {
+	ctx := context.Background()
+	labeled := func(name string, app string) database.Object {
+		object := testObject(name)
+		object.Metadata.Labels = map[string]string{"app": app}
+		return object
+	}
+
+	tests := []struct {
+		name      string
+		manifests []database.Object
+		args      []string
+		results   map[string]client.ApplyResult
+		failed    bool
+		remaining []string
+		deleted   []string
+	}{
+		{
+			name:      "selector",
+			manifests: []database.Object{labeled("web-1", "web")},
+			results:   map[string]client.ApplyResult{"web-1": client.ApplyUnchanged, "web-2": client.ApplyPruned},
+			remaining: []string{"db", "web-1"},
+			deleted:   []string{"web-2"},
+		},
+		{
+			name: "applied objects are kept",
+			manifests: []database.Object{
+				labeled("web-1", "web"),
+				labeled("web-3", "web"),
+			},
+			results: map[string]client.ApplyResult{
+				"web-1": client.ApplyUnchanged,
+				"web-2": client.ApplyPruned,
+				"web-3": client.ApplyCreated,
+			},
+			remaining: []string{"db", "web-1", "web-3"},
+			deleted:   []string{"web-2"},
+		},
+		{
+			name:      "dry run",
+			manifests: []database.Object{labeled("web-1", "web")},
+			args:      []string{"--dry-run"},
+			results:   map[string]client.ApplyResult{"web-1": client.ApplyUnchanged, "web-2": client.ApplyPruned},
+			remaining: []string{"db", "web-1", "web-2"},
+		},
+		{
+			name: "failed apply",
+			manifests: []database.Object{
+				labeled("web-1", "web"),
+				labeled("web-3", "web"),
+			},
+			// Can't create web-3
+			args:      []string{"--no-create"},
+			results:   map[string]client.ApplyResult{"web-1": client.ApplyUnchanged, "web-3": client.ApplyFailed},
+			failed:    true,
+			remaining: []string{"db", "web-1", "web-2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, c, uri := startTestServer(t)
+			db := &recordingDatabase{Database: server.db}
+			server.db = db
+			existing := make(map[string]database.MetadataResponse)
+			for _, object := range []database.Object{
+				labeled("web-1", "web"),
+				labeled("web-2", "web"),
+				labeled("db", "db"),
+			} {
+				meta, err := c.WriteObject(ctx, object, client.Create)
+				if err != nil {
+					t.Fatal(err)
+				}
+				existing[object.Metadata.Name] = meta
+			}
+
+			args := append([]string{"--prune", "-l", "app=web"}, test.args...)
+			results, err := runApply(t, uri, test.manifests, args...)
+			if (err != nil) != test.failed {
+				t.Fatalf("wrong exit status: %v", err)
+			}
+			if !maps.Equal(results, test.results) {
+				t.Fatalf("wrong results: %v", results)
+			}
+
+			var remaining []string
+			iterator := c.IterateObjects(ctx, database.ListOptions{})
+			for iterator.Next() {
+				remaining = append(remaining, iterator.Object().Metadata.Name)
+			}
+			if iterator.Err() != nil {
+				t.Fatal(iterator.Err())
+			}
+			if !slices.Equal(remaining, test.remaining) {
+				t.Fatalf("wrong remaining objects: %v", remaining)
+			}
+
+			// Only the version that was listed gets deleted
+			var deleted []string
+			for _, meta := range db.deletes {
+				deleted = append(deleted, meta.Name)
+				listed := existing[meta.Name]
+				if meta.Id != listed.Id || meta.Revision != listed.Revision {
+					t.Errorf("delete without preconditions: %#v", meta)
+				}
+			}
+			if !slices.Equal(deleted, test.deleted) {
+				t.Fatalf("wrong deletes: %v", deleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+const (
+	AuditLevelMetadata = "metadata"
+	AuditLevelFull     = "full"
+)
+
+type AuditConfig struct {
+	// "metadata" (the default) to only record who changed what, or "full"
+	// to also record the objects written and the responses
+	Level string `yaml:"level"`
+	// Where to send the records, at least one is required
+	File    *AuditFileConfig    `yaml:"file"`
+	Webhook *AuditWebhookConfig `yaml:"webhook"`
+}
+
+type AuditFileConfig struct {
+	// Records are appended as JSON lines
+	Path string `yaml:"path"`
+	// Size in bytes after which the file is rotated, defaults to 100MB
+	MaxSize int64 `yaml:"max_size"`
+	// Number of rotated files to keep, named <path>.1 (the most recent) to
+	// <path>.<n>, defaults to 5
+	MaxBackups int `yaml:"max_backups"`
+}
+
+type AuditWebhookConfig struct {
+	// Records are POSTed in batches, as {"records": [...]}
+	Url string `yaml:"url"`
+	// Timeout of each request, defaults to 10s
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+const (
+	defaultAuditMaxSize    = 100 << 20
+	defaultAuditMaxBackups = 5
+	defaultWebhookTimeout  = 10 * time.Second
+	// Records waiting to be sent to the webhook, more are dropped
+	auditWebhookQueue = 10000
+	// Maximum number of records in one webhook request
+	auditWebhookBatch = 100
+)
+
+// A write to the database, whether it succeeded or not
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Groups     []string  `json:"groups,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	// HTTP method, or gRPC method name
+	Method string `json:"method"`
+	// "create", "update", or "delete"
+	Operation string `json:"operation"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind,omitempty"`
+	// Revision that was replaced or deleted, only if the write succeeded
+	OldRevision string `json:"old_revision,omitempty"`
+	NewRevision string `json:"new_revision,omitempty"`
+	// "success" or "failure"
+	Outcome string          `json:"outcome"`
+	Reason  database.Reason `json:"reason,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	// Only at the full level. The object is the one written, as changed by
+	// the admission webhooks, or the requested one if the write failed.
+	Object   *database.Object `json:"object,omitempty"`
+	Response any              `json:"response,omitempty"`
+}
+
+// Destination of audit records
+type auditSink interface {
+	write(record AuditRecord)
+}
+
+type requestInfoKey struct{}
+
+// Information about the request, for the audit log
+type requestInfo struct {
+	remoteAddr string
+	method     string
+}
+
+func withRequestInfo(ctx context.Context, remoteAddr string, method string) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, requestInfo{
+		remoteAddr: remoteAddr,
+		method:     method,
+	})
+}
+
+type admittedKey struct{}
+
+// Objects as changed by the admission webhooks, in the order they were
+// admitted, so the audit log shows what was actually written
+type admittedObjects struct {
+	objects []database.Object
+}
+
+func withAdmitted(ctx context.Context) (context.Context, *admittedObjects) {
+	admitted := &admittedObjects{}
+	return context.WithValue(ctx, admittedKey{}, admitted), admitted
+}
+
+// Record the object about to be written, after admission
+func recordAdmitted(ctx context.Context, object database.Object) {
+	if admitted, ok := ctx.Value(admittedKey{}).(*admittedObjects); ok {
+		admitted.objects = append(admitted.objects, object)
+	}
+}
+
+// The i-th object admitted, nil if there was no admission
+func (a *admittedObjects) get(i int) *database.Object {
+	if i >= len(a.objects) {
+		return nil
+	}
+	return &a.objects[i]
+}
+
+// Records every write in the audit log
+type auditedDatabase struct {
+	db    database.Database
+	full  bool
+	sinks []auditSink
+}
+
+func newAuditedDatabase(db database.Database, config AuditConfig) (*auditedDatabase, error) {
+	audited := &auditedDatabase{
+		db: db,
+	}
+	switch config.Level {
+	case "", AuditLevelMetadata:
+	case AuditLevelFull:
+		audited.full = true
+	default:
+		return nil, fmt.Errorf("Invalid audit level %#v, expected %v or %v", config.Level, AuditLevelMetadata, AuditLevelFull)
+	}
+	if config.File != nil {
+		sink, err := newAuditFile(*config.File)
+		if err != nil {
+			return nil, err
+		}
+		audited.sinks = append(audited.sinks, sink)
+	}
+	if config.Webhook != nil {
+		sink, err := newAuditWebhook(*config.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		audited.sinks = append(audited.sinks, sink)
+	}
+	if len(audited.sinks) == 0 {
+		return nil, fmt.Errorf("Audit config requires a file or a webhook")
+	}
+	return audited, nil
+}
+
+// Start a record for a write
+func (d *auditedDatabase) newRecord(ctx context.Context, operation string, name string, object *database.Object) AuditRecord {
+	identity := identityFromContext(ctx)
+	info, _ := ctx.Value(requestInfoKey{}).(requestInfo)
+	record := AuditRecord{
+		Time:       time.Now().UTC(),
+		User:       identity.User,
+		Groups:     identity.Groups,
+		RemoteAddr: info.remoteAddr,
+		Method:     info.method,
+		Operation:  operation,
+		Name:       name,
+	}
+	if object != nil {
+		record.Kind = object.Kind
+		if d.full {
+			record.Object = object
+		}
+	}
+	return record
+}
+
+// Complete a record with the result and send it. The admitted object
+// replaces the requested one if it is set and the write succeeded.
+func (d *auditedDatabase) finish(record AuditRecord, admitted *database.Object, meta database.MetadataResponse, err error) {
+	if err != nil {
+		details := errorDetails(err)
+		record.Outcome = "failure"
+		record.Reason = details.Reason
+		record.Error = details.Message
+		if d.full {
+			record.Response = details
+		}
+	} else {
+		record.Outcome = "success"
+		// Read by the database while writing, so it is the version that was
+		// actually replaced
+		record.OldRevision = meta.PreviousRevision
+		if record.Kind == "" {
+			record.Kind = meta.PreviousKind
+		}
+		if record.Operation != "delete" {
+			record.NewRevision = meta.Revision
+		}
+		if d.full {
+			if admitted != nil {
+				record.Object = admitted
+			}
+			record.Response = meta
+		}
+	}
+	for _, sink := range d.sinks {
+		sink.write(record)
+	}
+}
+
+func (d *auditedDatabase) Create(ctx context.Context, object database.Object, replace bool) (database.MetadataResponse, error) {
+	record := d.newRecord(ctx, "create", object.Metadata.Name, &object)
+	ctx, admitted := withAdmitted(ctx)
+	meta, err := d.db.Create(ctx, object, replace)
+	d.finish(record, admitted.get(0), meta, err)
+	return meta, err
+}
+
+func (d *auditedDatabase) Update(ctx context.Context, object database.Object) (database.MetadataResponse, error) {
+	record := d.newRecord(ctx, "update", object.Metadata.Name, &object)
+	ctx, admitted := withAdmitted(ctx)
+	meta, err := d.db.Update(ctx, object)
+	d.finish(record, admitted.get(0), meta, err)
+	return meta, err
+}
+
+func (d *auditedDatabase) Get(ctx context.Context, name string) (database.Object, error) {
+	return d.db.Get(ctx, name)
+}
+
+func (d *auditedDatabase) List(ctx context.Context, options database.ListOptions) (database.ListResult, error) {
+	return d.db.List(ctx, options)
+}
+
+func (d *auditedDatabase) Delete(ctx context.Context, name string, id string, revision string) (database.MetadataResponse, error) {
+	record := d.newRecord(ctx, "delete", name, nil)
+	meta, err := d.db.Delete(ctx, name, id, revision)
+	d.finish(record, nil, meta, err)
+	return meta, err
+}
+
+// Records each operation. If the batch failed, they all failed.
+func (d *auditedDatabase) Batch(ctx context.Context, operations []database.BatchOperation) ([]database.MetadataResponse, error) {
+	records := make([]AuditRecord, 0, len(operations))
+	for _, op := range operations {
+		switch op.Operation {
+		case database.BatchDelete:
+			records = append(records, d.newRecord(ctx, "delete", op.Name, nil))
+		default:
+			records = append(records, d.newRecord(ctx, string(op.Operation), op.Object.Metadata.Name, &op.Object))
+		}
+	}
+	ctx, admitted := withAdmitted(ctx)
+	results, err := d.db.Batch(ctx, operations)
+	// Deletes are not admitted
+	next := 0
+	for i, record := range records {
+		var meta database.MetadataResponse
+		if err == nil {
+			meta = results[i]
+		}
+		var object *database.Object
+		if operations[i].Operation != database.BatchDelete {
+			object = admitted.get(next)
+			next++
+		}
+		d.finish(record, object, meta, err)
+	}
+	return results, err
+}
+
+// Appends records to a file, rotating it when it gets too big
+type auditFile struct {
+	config AuditFileConfig
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+}
+
+func newAuditFile(config AuditFileConfig) (*auditFile, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("Audit file config requires a path")
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultAuditMaxSize
+	}
+	if config.MaxBackups <= 0 {
+		config.MaxBackups = defaultAuditMaxBackups
+	}
+	sink := &auditFile{config: config}
+	err := sink.open()
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *auditFile) open() error {
+	file, err := os.OpenFile(s.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Move path to path.1, path.1 to path.2, etc, dropping the oldest
+func (s *auditFile) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+	backup := func(n int) string {
+		return fmt.Sprintf("%v.%d", s.config.Path, n)
+	}
+	err = os.Remove(backup(s.config.MaxBackups))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for n := s.config.MaxBackups - 1; n >= 1; n-- {
+		err = os.Rename(backup(n), backup(n+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	err = os.Rename(s.config.Path, backup(1))
+	if err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *auditFile) write(record AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("error encoding audit record", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file != nil && s.size > 0 && s.size+int64(len(line)) > s.config.MaxSize {
+		err = s.rotate()
+		if err != nil {
+			slog.Error("error rotating audit file", "error", err)
+		}
+	}
+	if s.file == nil {
+		// Opening failed after rotating, try again
+		if err = s.open(); err != nil {
+			slog.Error("error opening audit file", "error", err)
+			return
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		slog.Error("error writing audit record", "error", err)
+	}
+}
+
+// Sends records to a webhook in the background, in batches
+type auditWebhook struct {
+	config  AuditWebhookConfig
+	client  http.Client
+	records chan AuditRecord
+}
+
+func newAuditWebhook(config AuditWebhookConfig) (*auditWebhook, error) {
+	if config.Url == "" {
+		return nil, fmt.Errorf("Audit webhook config requires a url")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+	sink := &auditWebhook{
+		config: config,
+		client: http.Client{
+			Timeout: config.Timeout,
+		},
+		records: make(chan AuditRecord, auditWebhookQueue),
+	}
+	go sink.run()
+	return sink, nil
+}
+
+func (s *auditWebhook) write(record AuditRecord) {
+	select {
+	case s.records <- record:
+	default:
+		slog.Error("audit webhook queue is full, dropping record", "name", record.Name, "user", record.User)
+	}
+}
+
+func (s *auditWebhook) run() {
+	for record := range s.records {
+		batch := []AuditRecord{record}
+		// Add the records that are already waiting
+	collect:
+		for len(batch) < auditWebhookBatch {
+			select {
+			case record := <-s.records:
+				batch = append(batch, record)
+			default:
+				break collect
+			}
+		}
+		err := s.send(batch)
+		if err != nil {
+			slog.Error("error sending audit records", "records", len(batch), "error", err)
+		}
+	}
+}
+
+func (s *auditWebhook) send(records []AuditRecord) error {
+	body, err := json.Marshal(struct {
+		Records []AuditRecord `json:"records"`
+	}{records})
+	if err != nil {
+		return err
+	}
+	response, err := s.client.Post(s.config.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook returned %v", response.Status)
+	}
+	return nil
+}
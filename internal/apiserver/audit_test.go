@@ -0,0 +1,302 @@
+package apiserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/remram44/vogon/internal/client"
+	"github.com/remram44/vogon/internal/database"
+)
+
+func readAuditFile(t *testing.T, filename string) []AuditRecord {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record AuditRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	authenticators, err := newAuthenticators(Config{TokenFile: writeTokenFile(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := database.NewInMemoryDatabase()
+	authz := newAuthorizer(raw, AuthorizationConfig{AdminUsers: []string{"alice"}})
+	db, err := newAuditedDatabase(
+		&authorizedDatabase{db: raw, authz: authz},
+		AuditConfig{File: &AuditFileConfig{Path: filename}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(&ApiServer{
+		db:             db,
+		authenticators: authenticators,
+		authz:          authz,
+	})
+	t.Cleanup(server.Close)
+	newClient := func(token string) *client.Client {
+		c, err := client.NewClient(ctx, client.ClientOptions{
+			Uri:   server.URL,
+			Token: token,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	alice := newClient("alice-token")
+	bob := newClient("bob-token")
+
+	created, err := alice.WriteObject(ctx, testObject("example"), client.Create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := testObject("example")
+	object.Metadata.Id = created.Id
+	object.Metadata.Revision = created.Revision
+	updated, err := alice.WriteObject(ctx, object, client.Replace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bob.DeleteObject(ctx, "example", "", "")
+	var forbidden *database.Forbidden
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("bob delete: %v", err)
+	}
+	_, err = alice.DeleteObject(ctx, "example", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reads are not recorded
+	_, err = alice.GetObject(ctx, "example")
+	var notFound *database.DoesNotExist
+	if !errors.As(err, &notFound) {
+		t.Fatalf("get deleted: %v", err)
+	}
+
+	records := readAuditFile(t, filename)
+	type summary struct {
+		user, method, operation, oldRevision, newRevision, outcome string
+	}
+	expected := []summary{
+		{"alice", "PUT", "create", "", created.Revision, "success"},
+		{"alice", "PUT", "update", created.Revision, updated.Revision, "success"},
+		// Nothing was replaced
+		{"bob", "DELETE", "delete", "", "", "failure"},
+		{"alice", "DELETE", "delete", updated.Revision, "", "success"},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("wrong number of records: %#v", records)
+	}
+	for i, record := range records {
+		actual := summary{record.User, record.Method, record.Operation, record.OldRevision, record.NewRevision, record.Outcome}
+		if actual != expected[i] {
+			t.Errorf("record %d: %#v", i, actual)
+		}
+		// Deletes only know the kind once done
+		kind := testObject("example").Kind
+		if record.Outcome == "failure" {
+			kind = ""
+		}
+		if record.Name != "example" || record.Kind != kind || record.RemoteAddr == "" || record.Time.IsZero() {
+			t.Errorf("record %d: %#v", i, record)
+		}
+		if record.Object != nil || record.Response != nil {
+			t.Errorf("record %d has bodies at metadata level", i)
+		}
+	}
+	if records[2].Reason != database.ReasonForbidden {
+		t.Errorf("wrong reason: %v", records[2].Reason)
+	}
+}
+
+func TestAuditFull(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	raw := database.NewInMemoryDatabase()
+	db, err := newAuditedDatabase(raw, AuditConfig{
+		Level: AuditLevelFull,
+		File:  &AuditFileConfig{Path: filename},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Batch(ctx, []database.BatchOperation{
+		{Operation: database.BatchCreate, Object: testObject("one")},
+		{Operation: database.BatchCreate, Object: testObject("two")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readAuditFile(t, filename)
+	if len(records) != 2 {
+		t.Fatalf("wrong number of records: %#v", records)
+	}
+	for i, name := range []string{"one", "two"} {
+		record := records[i]
+		if record.Name != name || record.User != "anonymous" || record.Outcome != "success" {
+			t.Errorf("record %d: %#v", i, record)
+		}
+		if record.Object == nil || record.Object.Metadata.Name != name {
+			t.Errorf("record %d has wrong object: %#v", i, record.Object)
+		}
+		response, _ := record.Response.(map[string]any)
+		if response["Revision"] != record.NewRevision {
+			t.Errorf("record %d has wrong response: %#v", i, record.Response)
+		}
+	}
+
+	_, err = newAuditedDatabase(raw, AuditConfig{Level: "everything", File: &AuditFileConfig{Path: filename}})
+	if err == nil {
+		t.Fatal("no error for unknown level")
+	}
+	_, err = newAuditedDatabase(raw, AuditConfig{})
+	if err == nil {
+		t.Fatal("no error without sinks")
+	}
+}
+
+func TestAuditFileRotation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := newAuditFile(AuditFileConfig{
+		Path:       filename,
+		MaxSize:    100,
+		MaxBackups: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each record is bigger than the limit, so each goes in a new file
+	for _, name := range []string{"one", "two", "three", "four"} {
+		sink.write(AuditRecord{Name: name, User: "alice", Outcome: "success"})
+	}
+
+	for suffix, name := range map[string]string{"": "four", ".1": "three", ".2": "two"} {
+		records := readAuditFile(t, filename+suffix)
+		if len(records) != 1 || records[0].Name != name {
+			t.Errorf("audit.log%v: %#v", suffix, records)
+		}
+	}
+	_, err = os.Stat(filename + ".3")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("too many backups: %v", err)
+	}
+}
+
+func TestAuditWebhook(t *testing.T) {
+	received := make(chan AuditRecord, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Records []AuditRecord `json:"records"`
+		}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			t.Error(err)
+			res.WriteHeader(400)
+			return
+		}
+		for _, record := range body.Records {
+			received <- record
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	sink, err := newAuditWebhook(AuditWebhookConfig{Url: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"one", "two", "three"} {
+		sink.write(AuditRecord{Name: name})
+	}
+	for _, name := range []string{"one", "two", "three"} {
+		select {
+		case record := <-received:
+			if record.Name != name {
+				t.Fatalf("wrong record: %#v", record)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for webhook")
+		}
+	}
+}
+
+func TestAuditAdmission(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	raw := database.NewInMemoryDatabase()
+	db, err := newAuditedDatabase(newAdmissionDatabase(raw), AuditConfig{
+		Level: AuditLevelFull,
+		File:  &AuditFileConfig{Path: filename},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := startWebhook(t, func(review AdmissionReview) AdmissionResponse {
+		return AdmissionResponse{
+			Allowed: true,
+			Patch: []JsonPatchOperation{
+				{Op: "replace", Path: "/Spec/value", Value: "mutated"},
+			},
+		}
+	})
+	_, err = db.Create(ctx, rbacObject(MutatingWebhookKind, "hook", map[string]any{"url": hook}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Create(ctx, testObject("one"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Batch(ctx, []database.BatchOperation{
+		{Operation: database.BatchDelete, Name: "one"},
+		{Operation: database.BatchCreate, Object: testObject("two")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The records have the objects that were written, not the requested ones
+	records := readAuditFile(t, filename)
+	if len(records) != 4 {
+		t.Fatalf("wrong number of records: %#v", records)
+	}
+	for _, record := range []AuditRecord{records[1], records[3]} {
+		spec, _ := record.Object.Spec.(map[string]any)
+		if spec["value"] != "mutated" {
+			t.Errorf("record for %v has the requested object: %#v", record.Name, record.Object)
+		}
+	}
+	if records[2].Operation != "delete" || records[2].Object != nil {
+		t.Errorf("wrong delete record: %#v", records[2])
+	}
+}
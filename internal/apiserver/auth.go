@@ -0,0 +1,157 @@
+package apiserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The user making a request
+type Identity struct {
+	User   string
+	Groups []string
+}
+
+// Identity of requests without credentials, when authentication is not
+// configured
+var anonymous = Identity{User: "anonymous"}
+
+// Recognizes the tokens from one source of credentials
+type authenticator interface {
+	// Returns nil if the token is not one of ours
+	authenticateToken(ctx context.Context, token string) (*Identity, error)
+}
+
+// Returned when a request doesn't have valid credentials
+type authError struct {
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+// Check the credentials from an Authorization header. If no authenticators
+// are configured, everyone is anonymous.
+func authenticate(ctx context.Context, authenticators []authenticator, header string) (Identity, error) {
+	if len(authenticators) == 0 {
+		return anonymous, nil
+	}
+	if header == "" {
+		return Identity{}, &authError{"Authentication required"}
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return Identity{}, &authError{"Invalid Authorization header, expected a bearer token"}
+	}
+	for _, auth := range authenticators {
+		identity, err := auth.authenticateToken(ctx, token)
+		if err != nil {
+			return Identity{}, err
+		}
+		if identity != nil {
+			return *identity, nil
+		}
+	}
+	return Identity{}, &authError{"Invalid token"}
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// Get the authenticated user making the request
+func identityFromContext(ctx context.Context) Identity {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	if !ok {
+		return anonymous
+	}
+	return identity
+}
+
+// Static tokens, read from the token file:
+//
+//	tokens:
+//	  - token: "3e1ef0e5..."
+//	    user: alice
+//	    groups: [admins]
+type tokenFile struct {
+	Tokens []struct {
+		Token  string   `yaml:"token"`
+		User   string   `yaml:"user"`
+		Groups []string `yaml:"groups"`
+	} `yaml:"tokens"`
+}
+
+type tokenAuthenticator struct {
+	// Indexed by hash, so the lookup doesn't leak the tokens through timing
+	tokens map[[sha256.Size]byte]Identity
+}
+
+func loadTokenFile(filename string) (*tokenAuthenticator, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	var file tokenFile
+	err = decoder.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("Reading token file: %w", err)
+	}
+
+	auth := &tokenAuthenticator{
+		tokens: make(map[[sha256.Size]byte]Identity),
+	}
+	for i, entry := range file.Tokens {
+		if entry.Token == "" || entry.User == "" {
+			return nil, fmt.Errorf("Token %d in token file is missing token or user", i)
+		}
+		hash := sha256.Sum256([]byte(entry.Token))
+		if _, ok := auth.tokens[hash]; ok {
+			return nil, fmt.Errorf("Token %d in token file is a duplicate", i)
+		}
+		auth.tokens[hash] = Identity{
+			User:   entry.User,
+			Groups: entry.Groups,
+		}
+	}
+	return auth, nil
+}
+
+func (a *tokenAuthenticator) authenticateToken(ctx context.Context, token string) (*Identity, error) {
+	identity, ok := a.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, nil
+	}
+	return &identity, nil
+}
+
+// Build the authenticators from the config
+func newAuthenticators(config Config) ([]authenticator, error) {
+	var authenticators []authenticator
+	if config.TokenFile != "" {
+		auth, err := loadTokenFile(config.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth)
+	}
+	if config.Oidc != nil {
+		auth, err := newJwtAuthenticator(*config.Oidc)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth)
+	}
+	return authenticators, nil
+}
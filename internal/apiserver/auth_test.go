@@ -0,0 +1,166 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/remram44/vogon/internal/client"
+	"github.com/remram44/vogon/internal/database"
+)
+
+func writeTokenFile(t *testing.T) string {
+	filename := filepath.Join(t.TempDir(), "tokens.yaml")
+	err := os.WriteFile(filename, []byte(""+
+		"tokens:\n"+
+		"  - token: alice-token\n"+
+		"    user: alice\n"+
+		"    groups: [admins, dev]\n"+
+		"  - token: bob-token\n"+
+		"    user: bob\n",
+	), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	authenticators, err := newAuthenticators(Config{TokenFile: writeTokenFile(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := authenticate(ctx, authenticators, "Bearer alice-token")
+	if err != nil || identity.User != "alice" || !slices.Equal(identity.Groups, []string{"admins", "dev"}) {
+		t.Fatalf("alice: %#v %v", identity, err)
+	}
+	identity, err = authenticate(ctx, authenticators, "bearer bob-token")
+	if err != nil || identity.User != "bob" || len(identity.Groups) != 0 {
+		t.Fatalf("bob: %#v %v", identity, err)
+	}
+	for _, header := range []string{"", "Bearer wrong", "Basic YWxpY2U6cGFzcw==", "Bearer "} {
+		_, err = authenticate(ctx, authenticators, header)
+		var authErr *authError
+		if !errors.As(err, &authErr) {
+			t.Fatalf("%#v: %v", header, err)
+		}
+	}
+
+	identity, err = authenticate(ctx, nil, "")
+	if err != nil || identity.User != anonymous.User {
+		t.Fatalf("no authentication: %#v %v", identity, err)
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"missing-user": "tokens:\n  - token: abc\n",
+		"duplicate":    "tokens:\n  - token: abc\n    user: a\n  - token: abc\n    user: b\n",
+		"unknown-key":  "tokens:\n  - token: abc\n    user: a\n    password: b\n",
+	} {
+		filename := filepath.Join(dir, name+".yaml")
+		err := os.WriteFile(filename, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = loadTokenFile(filename)
+		if err == nil {
+			t.Errorf("%v: no error", name)
+		}
+	}
+}
+
+func TestAuthenticatedServer(t *testing.T) {
+	ctx := context.Background()
+	authenticators, err := newAuthenticators(Config{TokenFile: writeTokenFile(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := database.NewInMemoryDatabase()
+	server := httptest.NewServer(&ApiServer{
+		db:             db,
+		authenticators: authenticators,
+	})
+	t.Cleanup(server.Close)
+
+	grpcServer := newGrpcServer(db, db, nil, GrpcConfig{}, 0, authenticators, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	for _, uri := range []string{server.URL, client.GrpcScheme + listener.Addr().String()} {
+		c, err := client.NewClient(ctx, client.ClientOptions{
+			Uri:   uri,
+			Token: "alice-token",
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", uri, err)
+		}
+		_, err = c.WriteObject(ctx, testObject("one"), client.CreateOrReplace)
+		c.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", uri, err)
+		}
+
+		for _, token := range []string{"", "wrong"} {
+			_, err = client.NewClient(ctx, client.ClientOptions{
+				Uri:   uri,
+				Token: token,
+			})
+			var serverError *client.ServerError
+			if !errors.As(err, &serverError) || serverError.Details.Reason != database.ReasonUnauthorized {
+				t.Fatalf("%v with token %#v: %#v", uri, token, err)
+			}
+		}
+	}
+
+	response, err := http.Get(server.URL + "/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized || response.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("GET without token: %v %v", response.Status, response.Header)
+	}
+}
+
+func TestIdentityInContext(t *testing.T) {
+	authenticators, err := newAuthenticators(Config{TokenFile: writeTokenFile(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen Identity
+	server := &ApiServer{
+		db:             &identityDatabase{Database: database.NewInMemoryDatabase(), seen: &seen},
+		authenticators: authenticators,
+	}
+	request := httptest.NewRequest("GET", "/one", nil)
+	request.Header.Set("Authorization", "Bearer alice-token")
+	server.ServeHTTP(httptest.NewRecorder(), request)
+	if seen.User != "alice" {
+		t.Fatalf("wrong identity: %#v", seen)
+	}
+}
+
+// Records the identity of the last request
+type identityDatabase struct {
+	database.Database
+	seen *Identity
+}
+
+func (db *identityDatabase) Get(ctx context.Context, name string) (database.Object, error) {
+	*db.seen = identityFromContext(ctx)
+	return db.Database.Get(ctx, name)
+}
@@ -1,11 +1,13 @@
 package apiserver
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/mapstructure"
 	"gopkg.in/yaml.v3"
@@ -38,58 +40,43 @@ type Config struct {
 	ListenAddr string                `yaml:"listen_addr"`
 	ListenPort int                   `yaml:"listen_port"`
 	Database   DatabaseConfigWrapper `yaml:"database"`
-}
-
-type DatabaseConfig interface {
-	Connect() (database.Database, error)
+	// Serve HTTPS with this certificate and key (PEM files), if set. This
+	// applies to the gRPC API as well.
+	TlsCert string `yaml:"tls_cert"`
+	TlsKey  string `yaml:"tls_key"`
+	// Require clients to present a certificate signed by one of the CAs in
+	// this PEM bundle, if set
+	ClientCa string `yaml:"client_ca"`
+	// Require clients to authenticate with one of the bearer tokens in this
+	// file, if set
+	TokenFile string `yaml:"token_file"`
+	// Accept JWTs from an OpenID Connect identity provider, if set
+	Oidc *OidcConfig `yaml:"oidc"`
+	// Only allow what the Role and RoleBinding objects grant, if set
+	Authorization *AuthorizationConfig `yaml:"authorization"`
+	// Record every write in an audit log, if set
+	Audit *AuditConfig `yaml:"audit"`
+	// Maximum time to handle a request, e.g. "30s", 0 for no limit
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// Serve a Kubernetes-compatible API under /api and /apis, if set
+	Kubernetes *KubernetesConfig `yaml:"kubernetes"`
+	// Serve the API over gRPC as well, if set
+	Grpc *GrpcConfig `yaml:"grpc"`
+	// Schemas of the known kinds, included in the OpenAPI document
+	Schemas []KindSchema `yaml:"schemas"`
 }
 
 type DatabaseConfigWrapper struct {
-	DatabaseConfig
-}
-
-type InMemoryDatabaseConfig struct {
-}
-
-func (*InMemoryDatabaseConfig) Connect() (database.Database, error) {
-	slog.Debug("open InMemoryDatabase")
-	return database.NewInMemoryDatabase(), nil
-}
-
-type FilesDatabaseConfig struct {
-	Directory string `yaml:"directory"`
-}
-
-func (db *FilesDatabaseConfig) Connect() (database.Database, error) {
-	slog.Debug("open FilesDatabase", "config", db)
-	return database.NewFilesDatabase(db.Directory)
-}
-
-func (db *FilesDatabaseConfig) LogValue() slog.Value {
-	return slog.GroupValue(
-		slog.String("directory", db.Directory),
-	)
-}
-
-type EtcdDatabaseConfig struct {
-	Hostname   string `yaml:"hostname"`
-	CaCert     string `yaml:"ca_cert"`
-	ClientCert string `yaml:"client_cert"`
-	ClientKey  string `yaml:"client_key"`
-}
-
-func (db *EtcdDatabaseConfig) Connect() (database.Database, error) {
-	slog.Debug("open EtcdDatabase", "config", db)
-	return nil, fmt.Errorf("Not implemented")
+	Type   string
+	Config any
 }
 
-func (db *EtcdDatabaseConfig) LogValue() slog.Value {
-	return slog.GroupValue(
-		slog.String("hostname", db.Hostname),
-		slog.String("ca_cert", db.CaCert),
-		slog.String("client_cert", db.ClientCert),
-		slog.String("client_key", db.ClientKey),
-	)
+func (db *DatabaseConfigWrapper) Connect() (database.Database, error) {
+	backend := database.GetBackend(db.Type)
+	if backend == nil {
+		return nil, fmt.Errorf("Unknown database type %v", db.Type)
+	}
+	return backend.Connect(db.Config)
 }
 
 func (db *DatabaseConfigWrapper) UnmarshalYAML(value *yaml.Node) error {
@@ -107,28 +94,20 @@ func (db *DatabaseConfigWrapper) UnmarshalYAML(value *yaml.Node) error {
 	}
 	delete(raw, "type")
 
-	switch typeString {
-	case "in_memory":
-		var finalValue InMemoryDatabaseConfig
-		if err := transmute("InMemoryDatabaseConfig", raw, &finalValue); err != nil {
-			return err
-		}
-		db.DatabaseConfig = &finalValue
-	case "files":
-		var finalValue FilesDatabaseConfig
-		if err := transmute("FilesDatabaseConfig", raw, &finalValue); err != nil {
-			return err
-		}
-		db.DatabaseConfig = &finalValue
-	case "etcd":
-		var finalValue EtcdDatabaseConfig
-		if err := transmute("EtcdDatabaseConfig", raw, &finalValue); err != nil {
-			return err
-		}
-		db.DatabaseConfig = &finalValue
-	default:
-		return fmt.Errorf("Unknown database type %v", typeString)
+	backend := database.GetBackend(typeString)
+	if backend == nil {
+		return fmt.Errorf(
+			"Unknown database type %v (available: %v)",
+			typeString,
+			strings.Join(database.BackendNames(), ", "),
+		)
+	}
+	config := backend.NewConfig()
+	if err := transmute(fmt.Sprintf("%v database config", typeString), raw, config); err != nil {
+		return err
 	}
+	db.Type = typeString
+	db.Config = config
 	return nil
 }
 
@@ -172,9 +151,29 @@ func Run(args []string) error {
 	return nil
 }
 
+func compactJournal(args []string) error {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "Missing database directory\n")
+		os.Exit(2)
+	}
+
+	return database.CompactJournal(context.Background(), args[1])
+}
+
 func init() {
 	commands.Register("apiserver", &commands.Command{
 		PrintUsage: PrintUsage,
 		Run:        Run,
 	})
+	commands.Register("compact-journal", &commands.Command{
+		PrintUsage: func(w io.Writer) {
+			fmt.Fprintf(
+				w,
+				""+
+					"  compact-journal <directory>\n"+
+					"    Compact the change journal of a files database\n",
+			)
+		},
+		Run: compactJournal,
+	})
 }
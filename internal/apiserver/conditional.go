@@ -0,0 +1,130 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Entity tag of a version of an object, used with If-Match and If-None-Match
+func objectETag(metadata database.ObjectMetadata) string {
+	return fmt.Sprintf("%q", metadata.Id+":"+metadata.Revision)
+}
+
+func metadataETag(metadata database.MetadataResponse) string {
+	return fmt.Sprintf("%q", metadata.Id+":"+metadata.Revision)
+}
+
+// Get the id and revision from an If-Match header with a single entity tag
+func parseETag(header string) (string, string, bool) {
+	unquoted, err := strconv.Unquote(strings.TrimSpace(header))
+	if err != nil {
+		return "", "", false
+	}
+	id, revision, ok := strings.Cut(unquoted, ":")
+	return id, revision, ok
+}
+
+// Whether an entity tag is in the list from an If-Match or If-None-Match
+// header. Weak tags only match with the weak comparison of If-None-Match.
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPreconditions(req *http.Request) bool {
+	return len(req.Header.Values("If-Match")) > 0 || len(req.Header.Values("If-None-Match")) > 0
+}
+
+// Returned by checkPreconditions when the client already has the object
+var errNotModified = errors.New("Not modified")
+
+// Evaluate the If-Match and If-None-Match headers against the current object,
+// nil if it doesn't exist
+func checkPreconditions(req *http.Request, name string, current *database.Object) error {
+	if ifMatch := strings.Join(req.Header.Values("If-Match"), ","); ifMatch != "" {
+		if current == nil {
+			return &database.Conflict{
+				Reason:  database.ReasonPreconditionFailed,
+				Name:    name,
+				Message: fmt.Sprintf("Object %s does not exist, If-Match failed", name),
+			}
+		}
+		if !etagMatches(ifMatch, objectETag(current.Metadata), false) {
+			// Give the same details as the database, if we can
+			if id, revision, ok := parseETag(ifMatch); ok {
+				conflict := &database.Conflict{
+					Reason:           database.ReasonRevisionMismatch,
+					Name:             name,
+					ExpectedId:       id,
+					ActualId:         current.Metadata.Id,
+					ExpectedRevision: revision,
+					ActualRevision:   current.Metadata.Revision,
+					Message:          fmt.Sprintf("Object %s does not have the expected revision", name),
+				}
+				if id != current.Metadata.Id {
+					conflict.Reason = database.ReasonIdMismatch
+					conflict.Message = fmt.Sprintf("Object %s does not have the expected id", name)
+				}
+				return conflict
+			}
+			return &database.Conflict{
+				Reason:         database.ReasonPreconditionFailed,
+				Name:           name,
+				ActualId:       current.Metadata.Id,
+				ActualRevision: current.Metadata.Revision,
+				Message:        fmt.Sprintf("Object %s does not match If-Match", name),
+			}
+		}
+	}
+	if ifNoneMatch := strings.Join(req.Header.Values("If-None-Match"), ","); ifNoneMatch != "" {
+		if current != nil && etagMatches(ifNoneMatch, objectETag(current.Metadata), true) {
+			if req.Method == "GET" || req.Method == "HEAD" {
+				return errNotModified
+			}
+			return &database.Conflict{
+				Reason:         database.ReasonPreconditionFailed,
+				Name:           name,
+				ActualId:       current.Metadata.Id,
+				ActualRevision: current.Metadata.Revision,
+				Message:        fmt.Sprintf("Object %s matches If-None-Match", name),
+			}
+		}
+	}
+	return nil
+}
+
+// Get the current object, nil if it doesn't exist, and check the
+// preconditions against it
+//
+// Writes should then use its Id and Revision, so that they fail if the object
+// changed in the meantime.
+func (s *ApiServer) getForPreconditions(ctx context.Context, req *http.Request, name string) (*database.Object, error) {
+	var current *database.Object
+	object, err := s.db.Get(ctx, name)
+	if err == nil {
+		current = &object
+	} else if _, ok := err.(*database.DoesNotExist); !ok {
+		return nil, err
+	}
+	return current, checkPreconditions(req, name, current)
+}
@@ -0,0 +1,99 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Non-standard status used when the client went away, from nginx
+const statusClientClosedRequest = 499
+
+var reasonStatus = map[database.Reason]int{
+	database.ReasonNotFound:           http.StatusNotFound,
+	database.ReasonAlreadyExists:      http.StatusConflict,
+	database.ReasonIdMismatch:         http.StatusPreconditionFailed,
+	database.ReasonRevisionMismatch:   http.StatusPreconditionFailed,
+	database.ReasonPreconditionFailed: http.StatusPreconditionFailed,
+	database.ReasonInvalid:            http.StatusUnprocessableEntity,
+	database.ReasonInvalidName:        http.StatusUnprocessableEntity,
+	database.ReasonBadRequest:         http.StatusBadRequest,
+	database.ReasonUnauthorized:       http.StatusUnauthorized,
+	database.ReasonForbidden:          http.StatusForbidden,
+	database.ReasonExpired:            http.StatusGone,
+	database.ReasonTimeout:            http.StatusGatewayTimeout,
+	database.ReasonCancelled:          statusClientClosedRequest,
+	database.ReasonInternalError:      http.StatusInternalServerError,
+}
+
+func statusForReason(reason database.Reason) int {
+	status, ok := reasonStatus[reason]
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// Reason sent with a message, when it doesn't come from an error
+var statusReason = map[int]database.Reason{
+	http.StatusBadRequest:           database.ReasonBadRequest,
+	http.StatusUnauthorized:         database.ReasonUnauthorized,
+	http.StatusForbidden:            database.ReasonForbidden,
+	http.StatusNotFound:             database.ReasonNotFound,
+	http.StatusMethodNotAllowed:     database.ReasonBadRequest,
+	http.StatusNotAcceptable:        database.ReasonBadRequest,
+	http.StatusUnsupportedMediaType: database.ReasonBadRequest,
+	http.StatusUnprocessableEntity:  database.ReasonInvalid,
+	http.StatusInternalServerError:  database.ReasonInternalError,
+	http.StatusGatewayTimeout:       database.ReasonTimeout,
+}
+
+func sendErrorDetails(res http.ResponseWriter, req *http.Request, details database.ErrorDetails) {
+	err := sendObject(res, req, statusForReason(details.Reason), details)
+	if err != nil {
+		slog.Info("Error sending message", "error", err)
+	}
+}
+
+func sendMessage(res http.ResponseWriter, req *http.Request, status int, message string) {
+	err := sendObject(res, req, status, database.ErrorDetails{
+		Message: message,
+		Reason:  statusReason[status],
+	})
+	if err != nil {
+		slog.Info("Error sending message", "error", err)
+	}
+}
+
+// Get the details of an error returned by the database, logging it if it
+// is not one we can describe to the client
+func errorDetails(err error) database.ErrorDetails {
+	details, ok := database.GetErrorDetails(err)
+	if ok {
+		return details
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		return database.ErrorDetails{
+			Message: "Timeout",
+			Reason:  database.ReasonTimeout,
+		}
+	} else if errors.Is(err, context.Canceled) {
+		return database.ErrorDetails{
+			Message: "Request cancelled",
+			Reason:  database.ReasonCancelled,
+		}
+	} else {
+		slog.Error("database error", "error", err)
+		return database.ErrorDetails{
+			Message: "Internal error",
+			Reason:  database.ReasonInternalError,
+		}
+	}
+}
+
+// Send an error returned by the database, with the appropriate status
+func sendError(res http.ResponseWriter, req *http.Request, err error) {
+	sendErrorDetails(res, req, errorDetails(err))
+}
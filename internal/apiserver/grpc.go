@@ -0,0 +1,463 @@
+package apiserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/remram44/vogon/internal/database"
+	"github.com/remram44/vogon/internal/grpcapi"
+	"github.com/remram44/vogon/internal/versioning"
+)
+
+type GrpcConfig struct {
+	ListenAddr string `yaml:"listen_addr"`
+	ListenPort int    `yaml:"listen_port"`
+	// How often watches check the change feed of the database, defaults to 1s
+	WatchInterval time.Duration `yaml:"watch_interval"`
+}
+
+const defaultWatchInterval = time.Second
+
+// Serves the same objects as the HTTP API, over gRPC
+type grpcServer struct {
+	grpcapi.UnimplementedVogonServer
+	db database.Database
+	// Set if the database has one, to serve watches
+	feed database.ChangeFeed
+	// Set if authorization is enabled, in which case db checks it
+	authz          *authorizer
+	requestTimeout time.Duration
+	watchInterval  time.Duration
+	authenticators []authenticator
+}
+
+// Serves in cleartext if tlsConfig is nil
+func newGrpcServer(db database.Database, feed database.ChangeFeed, authz *authorizer, config GrpcConfig, requestTimeout time.Duration, authenticators []authenticator, tlsConfig *tls.Config) *grpc.Server {
+	vogonServer := &grpcServer{
+		db:             db,
+		feed:           feed,
+		authz:          authz,
+		requestTimeout: requestTimeout,
+		watchInterval:  config.WatchInterval,
+		authenticators: authenticators,
+	}
+	if vogonServer.watchInterval <= 0 {
+		vogonServer.watchInterval = defaultWatchInterval
+	}
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(vogonServer.unaryInterceptor),
+		grpc.StreamInterceptor(vogonServer.streamInterceptor),
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	grpcapi.RegisterVogonServer(server, vogonServer)
+	return server
+}
+
+func runGrpcServer(server *grpc.Server, config GrpcConfig) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("%v:%v", config.ListenAddr, config.ListenPort))
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+// Authenticate and log a request, returning the context to handle it with
+func (s *grpcServer) startRequest(ctx context.Context, method string) (context.Context, error) {
+	var header string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			header = values[0]
+		}
+	}
+	identity, authErr := authenticate(ctx, s.authenticators, header)
+
+	remoteAddr := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+	slog.Info(
+		"request",
+		"remote_addr", remoteAddr,
+		"method", "gRPC",
+		"path", method,
+		"user", identity.User,
+	)
+
+	if authErr != nil {
+		slog.Info("authentication error", "remote_addr", remoteAddr, "error", authErr)
+		return nil, grpcapi.StatusFromDetails(database.ErrorDetails{
+			Message: authErr.Error(),
+			Reason:  database.ReasonUnauthorized,
+		}).Err()
+	}
+	ctx = withIdentity(ctx, identity)
+	return withRequestInfo(ctx, remoteAddr, method), nil
+}
+
+func (s *grpcServer) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.startRequest(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if s.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+	}
+	return handler(ctx, req)
+}
+
+// Streams are not subject to the request timeout, watches last until the
+// client goes away
+func (s *grpcServer) streamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.startRequest(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+}
+
+// A stream with the context changed, to pass the identity to the handler
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// Convert an error returned by the database to a gRPC status
+func grpcError(err error) error {
+	return grpcapi.StatusFromDetails(errorDetails(err)).Err()
+}
+
+func (s *grpcServer) GetVersion(ctx context.Context, request *grpcapi.GetVersionRequest) (*grpcapi.GetVersionResponse, error) {
+	return &grpcapi.GetVersionResponse{
+		Version: versioning.NameAndVersionString(),
+	}, nil
+}
+
+func (s *grpcServer) Get(ctx context.Context, request *grpcapi.GetRequest) (*grpcapi.Object, error) {
+	object, err := s.db.Get(ctx, request.Name)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	result, err := grpcapi.FromObject(object)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return result, nil
+}
+
+func (s *grpcServer) Create(ctx context.Context, request *grpcapi.CreateRequest) (*grpcapi.MetadataResponse, error) {
+	meta, err := s.db.Create(ctx, grpcapi.ToObject(request.Object), request.Replace)
+	if err != nil {
+		slog.Info("gRPC Create error", "name", request.Object.GetMetadata().GetName(), "error", err)
+		return nil, grpcError(err)
+	}
+	return grpcapi.FromMetadata(meta), nil
+}
+
+func (s *grpcServer) Update(ctx context.Context, request *grpcapi.UpdateRequest) (*grpcapi.MetadataResponse, error) {
+	meta, err := s.db.Update(ctx, grpcapi.ToObject(request.Object))
+	if err != nil {
+		slog.Info("gRPC Update error", "name", request.Object.GetMetadata().GetName(), "error", err)
+		return nil, grpcError(err)
+	}
+	return grpcapi.FromMetadata(meta), nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, request *grpcapi.DeleteRequest) (*grpcapi.MetadataResponse, error) {
+	meta, err := s.db.Delete(ctx, request.Name, request.Id, request.Revision)
+	if err != nil {
+		slog.Info("gRPC Delete error", "name", request.Name, "error", err)
+		return nil, grpcError(err)
+	}
+	return grpcapi.FromMetadata(meta), nil
+}
+
+func (s *grpcServer) List(ctx context.Context, request *grpcapi.ListRequest) (*grpcapi.ListResponse, error) {
+	options := database.ListOptions{
+		Prefix:   request.Prefix,
+		Limit:    defaultListLimit,
+		Continue: request.Continue,
+	}
+	if request.Limit < 0 {
+		return nil, grpcError(&database.Invalid{
+			Reason:  database.ReasonBadRequest,
+			Message: "Invalid limit",
+		})
+	} else if request.Limit > 0 {
+		options.Limit = min(int(request.Limit), maxListLimit)
+	}
+	selector, err := parseSelectors(request.Labels, request.Fields)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	options.Selector = selector
+
+	result, err := s.db.List(ctx, options)
+	if err != nil {
+		slog.Info("gRPC List error", "prefix", options.Prefix, "error", err)
+		return nil, grpcError(err)
+	}
+	response := &grpcapi.ListResponse{
+		Continue: result.Continue,
+	}
+	for _, object := range result.Objects {
+		converted, err := grpcapi.FromObject(object)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		response.Objects = append(response.Objects, converted)
+	}
+	return response, nil
+}
+
+// Watches follow the change feed of the database, getting the objects that
+// changed through the database so the user only sees what they can watch
+func (s *grpcServer) Watch(request *grpcapi.WatchRequest, stream grpcapi.Vogon_WatchServer) error {
+	ctx := withReadVerb(stream.Context(), VerbWatch)
+	if s.feed == nil {
+		return grpcError(&database.Invalid{
+			Reason:  database.ReasonBadRequest,
+			Message: "This database doesn't support watching",
+		})
+	}
+	selector, err := parseSelectors(request.Labels, request.Fields)
+	if err != nil {
+		return grpcError(err)
+	}
+	watcher := &objectWatcher{
+		server:   s,
+		ctx:      ctx,
+		stream:   stream,
+		prefix:   request.Prefix,
+		selector: selector,
+		sequence: request.Since,
+		known:    make(map[string]database.Object),
+		resumed:  request.Since != 0,
+	}
+	if watcher.resumed {
+		// Listing would check this otherwise
+		err = s.checkWatch(ctx, request.Prefix)
+	} else {
+		err = watcher.sendExisting()
+	}
+	if err != nil {
+		return watcher.end(err)
+	}
+
+	ticker := time.NewTicker(s.watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		err = watcher.sendChanges()
+		if err != nil {
+			return watcher.end(err)
+		}
+	}
+}
+
+// The state of a watch, the objects the client knows about and where we are
+// in the change feed
+type objectWatcher struct {
+	server   *grpcServer
+	ctx      context.Context
+	stream   grpcapi.Vogon_WatchServer
+	prefix   string
+	selector database.Selector
+	sequence uint64
+	// Last version of the objects sent, and whether the client might know
+	// about others (resumed watch)
+	known   map[string]database.Object
+	resumed bool
+}
+
+func (w *objectWatcher) send(eventType grpcapi.WatchEvent_Type, object database.Object, sequence uint64) error {
+	converted, err := grpcapi.FromObject(object)
+	if err != nil {
+		return grpcError(err)
+	}
+	return w.stream.Send(&grpcapi.WatchEvent{
+		Type:     eventType,
+		Object:   converted,
+		Sequence: sequence,
+	})
+}
+
+// Convert the error that stopped the watch, nothing if the client went away
+func (w *objectWatcher) end(err error) error {
+	if w.ctx.Err() != nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return grpcError(err)
+}
+
+// Send the objects that exist, only the last one has the sequence number to
+// resume from. Changes made during the listing are sent again after.
+func (w *objectWatcher) sendExisting() error {
+	sequence, err := w.server.feed.LastSequence(w.ctx)
+	if err != nil {
+		return err
+	}
+	w.sequence = sequence
+	var pending *database.Object
+	options := database.ListOptions{
+		Prefix:   w.prefix,
+		Limit:    maxListLimit,
+		Selector: w.selector,
+	}
+	for {
+		result, err := w.server.db.List(w.ctx, options)
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Objects {
+			if pending != nil {
+				err = w.send(grpcapi.WatchEvent_ADDED, *pending, 0)
+				if err != nil {
+					return err
+				}
+			}
+			w.known[object.Metadata.Name] = object
+			pending = &object
+		}
+		if result.Continue == "" {
+			break
+		}
+		options.Continue = result.Continue
+	}
+	if pending != nil {
+		return w.send(grpcapi.WatchEvent_ADDED, *pending, sequence)
+	}
+	return nil
+}
+
+// Send the objects that changed since the last call
+func (w *objectWatcher) sendChanges() error {
+	entries, err := w.server.feed.ChangesSince(w.ctx, w.sequence)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// Objects are only sent once, in the order of their last change, so the
+	// sequence number of each event is a valid resume point
+	last := make(map[string]database.JournalEntry)
+	for _, entry := range entries {
+		if database.HasPrefix(entry.Name, w.prefix) {
+			last[entry.Name] = entry
+		}
+	}
+	for _, entry := range entries {
+		if last[entry.Name] != entry {
+			continue
+		}
+		err = w.sendChange(entry)
+		if err != nil {
+			return err
+		}
+	}
+	w.sequence = entries[len(entries)-1].Sequence
+	return nil
+}
+
+func (w *objectWatcher) sendChange(entry database.JournalEntry) error {
+	name := entry.Name
+	previous, known := w.known[name]
+
+	// Objects the user can't see are reported as missing
+	object, err := w.server.db.Get(w.ctx, name)
+	var doesNotExist *database.DoesNotExist
+	var forbidden *database.Forbidden
+	if errors.As(err, &doesNotExist) || errors.As(err, &forbidden) {
+		if known {
+			delete(w.known, name)
+			return w.send(grpcapi.WatchEvent_DELETED, previous, entry.Sequence)
+		} else if w.resumed && entry.Operation == database.JournalDelete {
+			// The client might have had it, send what we know
+			allowed, err := w.server.canWatch(w.ctx, name)
+			if err != nil || !allowed {
+				return err
+			}
+			deleted := database.Object{Metadata: database.ObjectMetadata{Name: name}}
+			return w.send(grpcapi.WatchEvent_DELETED, deleted, entry.Sequence)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !w.selector.Matches(object) {
+		if known {
+			delete(w.known, name)
+			return w.send(grpcapi.WatchEvent_DELETED, previous, entry.Sequence)
+		}
+		return nil
+	}
+	w.known[name] = object
+	if !known {
+		return w.send(grpcapi.WatchEvent_ADDED, object, entry.Sequence)
+	} else if previous.Metadata.Id != object.Metadata.Id {
+		// Deleted and created again
+		err = w.send(grpcapi.WatchEvent_DELETED, previous, 0)
+		if err != nil {
+			return err
+		}
+		return w.send(grpcapi.WatchEvent_ADDED, object, entry.Sequence)
+	} else if previous.Metadata.Revision != object.Metadata.Revision {
+		return w.send(grpcapi.WatchEvent_MODIFIED, object, entry.Sequence)
+	}
+	// Already sent, e.g. changed while we were listing
+	return nil
+}
+
+// Return a *database.Forbidden error unless the user can watch some objects
+// under the prefix
+func (s *grpcServer) checkWatch(ctx context.Context, prefix string) error {
+	identity := identityFromContext(ctx)
+	if s.authz == nil || s.authz.isAdmin(identity) {
+		return nil
+	}
+	policy, err := s.authz.getPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	if !policy.allowsSomeUnder(identity, VerbWatch, prefix) {
+		return forbidden(identity, VerbWatch, prefix)
+	}
+	return nil
+}
+
+// Whether the user can watch an object of some kind with this name
+func (s *grpcServer) canWatch(ctx context.Context, name string) (bool, error) {
+	if s.authz == nil {
+		return true, nil
+	}
+	return s.authz.allowed(ctx, identityFromContext(ctx), VerbWatch, name, "")
+}
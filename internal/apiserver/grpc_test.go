@@ -0,0 +1,234 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/remram44/vogon/internal/client"
+	"github.com/remram44/vogon/internal/database"
+)
+
+func newGrpcTestServer(t *testing.T) *client.Client {
+	db := database.NewInMemoryDatabase()
+	server := newGrpcServer(db, db, nil, GrpcConfig{
+		WatchInterval: 10 * time.Millisecond,
+	}, 0, nil, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	c, err := client.NewClient(context.Background(), client.ClientOptions{
+		Uri: client.GrpcScheme + listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestGrpc(t *testing.T) {
+	ctx := context.Background()
+	c := newGrpcTestServer(t)
+
+	_, err := c.GetObject(ctx, "one")
+	var doesNotExist *database.DoesNotExist
+	if !errors.As(err, &doesNotExist) || doesNotExist.Name != "one" {
+		t.Fatalf("GET missing: %#v", err)
+	}
+
+	object := testObject("one")
+	object.Metadata.Labels = map[string]string{"app": "web"}
+	object.Spec = map[string]any{"value": "yay", "replicas": 3.0, "list": []any{"a", true}}
+	meta, err := c.WriteObject(ctx, object, client.Create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := c.GetObject(ctx, "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := read.Spec.(map[string]any)
+	if read.Metadata.Id != meta.Id ||
+		read.Metadata.Revision != meta.Revision ||
+		read.Metadata.CreationTime.IsZero() ||
+		read.Metadata.Labels["app"] != "web" ||
+		spec["replicas"] != 3.0 ||
+		!slices.Equal(spec["list"].([]any), []any{"a", true}) {
+		t.Fatalf("wrong object: %#v", read)
+	}
+
+	_, err = c.WriteObject(ctx, object, client.Create)
+	var conflict *database.Conflict
+	if !errors.As(err, &conflict) || conflict.Reason != database.ReasonAlreadyExists {
+		t.Fatalf("create existing: %#v", err)
+	}
+	object.Metadata.Id = meta.Id
+	object.Metadata.Revision = "wrong"
+	_, err = c.WriteObject(ctx, object, client.Replace)
+	if !errors.As(err, &conflict) ||
+		conflict.Reason != database.ReasonRevisionMismatch ||
+		conflict.ActualRevision != meta.Revision {
+		t.Fatalf("replace wrong revision: %#v", err)
+	}
+
+	object = testObject("one")
+	object.Spec = []any{"not", "an", "object"}
+	_, err = c.WriteObject(ctx, object, client.CreateOrReplace)
+	if err == nil {
+		t.Fatal("wrote a spec that is not an object")
+	}
+
+	for _, name := range []string{"a", "a/b", "a/c", "b"} {
+		_, err := c.WriteObject(ctx, testObject(name), client.Create)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var names []string
+	iterator := c.IterateObjects(ctx, database.ListOptions{Limit: 2})
+	for iterator.Next() {
+		names = append(names, iterator.Object().Metadata.Name)
+	}
+	if iterator.Err() != nil {
+		t.Fatal(iterator.Err())
+	}
+	if !slices.Equal(names, []string{"a", "a/b", "a/c", "b", "one"}) {
+		t.Fatalf("wrong objects: %v", names)
+	}
+	selector, err := database.ParseLabelSelector("app=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.ListObjects(ctx, database.ListOptions{Selector: selector})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Metadata.Name != "one" {
+		t.Fatalf("wrong filtered objects: %#v", result)
+	}
+
+	deleted, err := c.DeleteObject(ctx, "one", meta.Id, meta.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != meta {
+		t.Fatalf("wrong metadata for deleted object: %#v", deleted)
+	}
+	_, err = c.DeleteObject(ctx, "one", "", "")
+	if !errors.As(err, &doesNotExist) {
+		t.Fatalf("delete missing: %#v", err)
+	}
+}
+
+func TestGrpcWatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := newGrpcTestServer(t)
+
+	for _, name := range []string{"a/one", "a/two", "b/one"} {
+		_, err := c.WriteObject(ctx, testObject(name), client.Create)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	watcher, err := c.WatchObjects(ctx, database.ListOptions{Prefix: "a"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	var sequence uint64
+	expect := func(eventType client.WatchEventType, name string) database.Object {
+		t.Helper()
+		if !watcher.Next() {
+			t.Fatalf("watch ended: %v", watcher.Err())
+		}
+		event := watcher.Event()
+		if event.Type != eventType || event.Object.Metadata.Name != name {
+			t.Fatalf("expected %v %v, got %v %v", eventType, name, event.Type, event.Object.Metadata.Name)
+		}
+		sequence = event.Sequence
+		return event.Object
+	}
+	expect(client.Added, "a/one")
+	if sequence != 0 {
+		t.Fatal("can resume in the middle of the initial objects")
+	}
+	two := expect(client.Added, "a/two")
+	if sequence != 3 {
+		t.Fatalf("wrong sequence after the initial objects: %v", sequence)
+	}
+
+	object := testObject("a/two")
+	object.Spec = map[string]any{"value": "changed"}
+	_, err = c.WriteObject(ctx, object, client.Replace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := expect(client.Modified, "a/two")
+	if modified.Metadata.Revision == two.Metadata.Revision || modified.Spec.(map[string]any)["value"] != "changed" {
+		t.Fatalf("wrong modified object: %#v", modified)
+	}
+
+	_, err = c.WriteObject(ctx, testObject("b/two"), client.Create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.DeleteObject(ctx, "a/one", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(client.Deleted, "a/one")
+	_, err = c.WriteObject(ctx, testObject("a/three"), client.Create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(client.Added, "a/three")
+
+	// Resume after a disconnection, changes made in the meantime are sent
+	watcher.Close()
+	for _, name := range []string{"a/four", "a/five"} {
+		_, err = c.WriteObject(ctx, testObject(name), client.Create)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = c.DeleteObject(ctx, "a/three", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.DeleteObject(ctx, "a/five", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err = c.WatchObjects(ctx, database.ListOptions{Prefix: "a"}, sequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	expect(client.Added, "a/four")
+	deleted := expect(client.Deleted, "a/three")
+	if deleted.Kind != "" {
+		t.Fatalf("wrong deleted object: %#v", deleted)
+	}
+	expect(client.Deleted, "a/five")
+
+	// Resuming from a sequence the server doesn't have fails
+	watcher, err = c.WatchObjects(ctx, database.ListOptions{}, sequence+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	var expired *database.Expired
+	if watcher.Next() || !errors.As(watcher.Err(), &expired) {
+		t.Fatalf("resumed from the future: %v", watcher.Err())
+	}
+}
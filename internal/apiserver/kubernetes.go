@@ -0,0 +1,934 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+// The Kubernetes facade serves objects in the shape expected by kubectl and
+// client-go, under /api and /apis. Each configured resource maps a
+// Kubernetes group and kind to a vogon kind, and namespaces map to name
+// prefixes, so that "/apis/example.org/v1/namespaces/team-a/jobs/build" is
+// the vogon object "team-a/build".
+
+type KubernetesConfig struct {
+	Resources []KubernetesResource `yaml:"resources"`
+	// Prefix of the object names in each namespace, e.g. "team-a: teams/a".
+	// Namespaces that are not listed map to the prefix with the same name,
+	// except "default" which maps to objects at the top level.
+	Namespaces map[string]string `yaml:"namespaces"`
+}
+
+type KubernetesResource struct {
+	Group string `yaml:"group"`
+	// Kubernetes kind, e.g. "Job"
+	Kind string `yaml:"kind"`
+	// Lowercase plural used in paths, e.g. "jobs"
+	Plural string `yaml:"plural"`
+	// Lowercase singular, defaults to the lowercase kind
+	Singular string `yaml:"singular"`
+	// Versions served, the first one is preferred
+	Versions []string `yaml:"versions"`
+	// Kind of the vogon objects, defaults to "<group>/<kind>"
+	VogonKind string `yaml:"vogon_kind"`
+}
+
+type kubernetesFacade struct {
+	db         database.Database
+	resources  []KubernetesResource
+	namespaces map[string]string
+}
+
+func newKubernetesFacade(db database.Database, config KubernetesConfig) (*kubernetesFacade, error) {
+	facade := &kubernetesFacade{
+		db:         db,
+		namespaces: config.Namespaces,
+	}
+	for _, resource := range config.Resources {
+		if resource.Group == "" || resource.Kind == "" || resource.Plural == "" {
+			return nil, fmt.Errorf("Kubernetes resources need a group, kind, and plural")
+		}
+		if len(resource.Versions) == 0 {
+			return nil, fmt.Errorf("No versions for Kubernetes resource %v", resource.Plural)
+		}
+		if resource.Singular == "" {
+			resource.Singular = strings.ToLower(resource.Kind)
+		}
+		if resource.VogonKind == "" {
+			resource.VogonKind = resource.Group + "/" + resource.Kind
+		}
+		for _, other := range facade.resources {
+			if other.Group == resource.Group && other.Plural == resource.Plural {
+				return nil, fmt.Errorf("Duplicate Kubernetes resource %v.%v", resource.Plural, resource.Group)
+			}
+		}
+		facade.resources = append(facade.resources, resource)
+	}
+	prefixes := make(map[string]string)
+	for namespace, prefix := range config.Namespaces {
+		if prefix != "" {
+			if err := database.ValidateName(prefix); err != nil {
+				return nil, fmt.Errorf("Invalid prefix for namespace %v: %w", namespace, err)
+			}
+		}
+		if other, ok := prefixes[prefix]; ok {
+			return nil, fmt.Errorf("Namespaces %v and %v have the same prefix", namespace, other)
+		}
+		prefixes[prefix] = namespace
+	}
+	return facade, nil
+}
+
+// Get the prefix of object names in a namespace
+func (k *kubernetesFacade) namespacePrefix(namespace string) (string, bool) {
+	if prefix, ok := k.namespaces[namespace]; ok {
+		return prefix, true
+	}
+	if namespace == "default" {
+		return "", true
+	}
+	if strings.Contains(namespace, "/") || database.ValidateName(namespace) != nil {
+		return "", false
+	}
+	return namespace, true
+}
+
+// Get the namespace and Kubernetes name of a vogon object
+func (k *kubernetesFacade) splitName(name string) (string, string, bool) {
+	prefix := ""
+	localName := name
+	if index := strings.LastIndex(name, "/"); index != -1 {
+		prefix = name[:index]
+		localName = name[index+1:]
+	}
+	candidates := []string{prefix}
+	if prefix == "" {
+		candidates = []string{"default"}
+	}
+	for namespace, p := range k.namespaces {
+		if p == prefix {
+			candidates = []string{namespace}
+		}
+	}
+	for _, namespace := range candidates {
+		if p, ok := k.namespacePrefix(namespace); ok && p == prefix {
+			return namespace, localName, true
+		}
+	}
+	return "", "", false
+}
+
+func (k *kubernetesFacade) objectName(namespace string, name string) (string, bool) {
+	prefix, ok := k.namespacePrefix(namespace)
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	if prefix == "" {
+		return name, true
+	}
+	return prefix + "/" + name, true
+}
+
+func (k *kubernetesFacade) findResource(group string, version string, plural string) (KubernetesResource, bool) {
+	for _, resource := range k.resources {
+		if resource.Group == group && resource.Plural == plural && slices.Contains(resource.Versions, version) {
+			return resource, true
+		}
+	}
+	return KubernetesResource{}, false
+}
+
+type kubernetesMetadata struct {
+	Name              string            `json:"name,omitempty"`
+	Namespace         string            `json:"namespace,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Uid               string            `json:"uid,omitempty"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	CreationTimestamp *time.Time        `json:"creationTimestamp,omitempty"`
+}
+
+type kubernetesObject struct {
+	ApiVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Metadata   kubernetesMetadata `json:"metadata"`
+	Spec       any                `json:"spec,omitempty"`
+	Status     any                `json:"status,omitempty"`
+}
+
+type kubernetesList struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Continue string `json:"continue,omitempty"`
+	} `json:"metadata"`
+	Items []kubernetesObject `json:"items"`
+}
+
+func (k *kubernetesFacade) toKubernetes(resource KubernetesResource, object database.Object) (kubernetesObject, bool) {
+	namespace, name, ok := k.splitName(object.Metadata.Name)
+	if !ok {
+		return kubernetesObject{}, false
+	}
+	result := kubernetesObject{
+		ApiVersion: resource.Group + "/" + object.Version,
+		Kind:       resource.Kind,
+		Metadata: kubernetesMetadata{
+			Name:            name,
+			Namespace:       namespace,
+			Labels:          object.Metadata.Labels,
+			Uid:             object.Metadata.Id,
+			ResourceVersion: object.Metadata.Revision,
+		},
+		Spec:   object.Spec,
+		Status: object.Status,
+	}
+	if !object.Metadata.CreationTime.IsZero() {
+		creationTime := object.Metadata.CreationTime.UTC().Truncate(time.Second)
+		result.Metadata.CreationTimestamp = &creationTime
+	}
+	return result, true
+}
+
+func (k *kubernetesFacade) fromKubernetes(resource KubernetesResource, version string, namespace string, object kubernetesObject) (database.Object, error) {
+	invalid := func(message string) error {
+		return &database.Invalid{
+			Reason:  database.ReasonInvalid,
+			Name:    object.Metadata.Name,
+			Message: message,
+		}
+	}
+	if object.ApiVersion != resource.Group+"/"+version {
+		return database.Object{}, invalid(fmt.Sprintf("apiVersion should be %v/%v", resource.Group, version))
+	}
+	if object.Kind != resource.Kind {
+		return database.Object{}, invalid(fmt.Sprintf("kind should be %v", resource.Kind))
+	}
+	if object.Metadata.Namespace != "" && object.Metadata.Namespace != namespace {
+		return database.Object{}, invalid("Namespace does not match the request")
+	}
+	name, ok := k.objectName(namespace, object.Metadata.Name)
+	if !ok {
+		return database.Object{}, invalid("Invalid name")
+	}
+	return database.Object{
+		Kind:    resource.VogonKind,
+		Version: version,
+		Metadata: database.ObjectMetadata{
+			Name:     name,
+			Labels:   object.Metadata.Labels,
+			Id:       object.Metadata.Uid,
+			Revision: object.Metadata.ResourceVersion,
+		},
+		Spec:   object.Spec,
+		Status: object.Status,
+	}, nil
+}
+
+type kubernetesStatusDetails struct {
+	Name  string `json:"name,omitempty"`
+	Group string `json:"group,omitempty"`
+	Kind  string `json:"kind,omitempty"`
+}
+
+type kubernetesStatus struct {
+	ApiVersion string                   `json:"apiVersion"`
+	Kind       string                   `json:"kind"`
+	Metadata   struct{}                 `json:"metadata"`
+	Status     string                   `json:"status"`
+	Message    string                   `json:"message,omitempty"`
+	Reason     string                   `json:"reason,omitempty"`
+	Details    *kubernetesStatusDetails `json:"details,omitempty"`
+	Code       int                      `json:"code"`
+}
+
+// Kubernetes reasons for our reasons, and the status code if different
+var kubernetesReasons = map[database.Reason]struct {
+	reason string
+	status int
+}{
+	database.ReasonNotFound:           {"NotFound", 0},
+	database.ReasonAlreadyExists:      {"AlreadyExists", 0},
+	database.ReasonIdMismatch:         {"Conflict", http.StatusConflict},
+	database.ReasonRevisionMismatch:   {"Conflict", http.StatusConflict},
+	database.ReasonPreconditionFailed: {"Conflict", http.StatusConflict},
+	database.ReasonInvalid:            {"Invalid", 0},
+	database.ReasonInvalidName:        {"Invalid", 0},
+	database.ReasonBadRequest:         {"BadRequest", 0},
+	database.ReasonUnauthorized:       {"Unauthorized", 0},
+	database.ReasonForbidden:          {"Forbidden", 0},
+	database.ReasonExpired:            {"Expired", 0},
+	database.ReasonTimeout:            {"Timeout", 0},
+	database.ReasonInternalError:      {"InternalError", 0},
+}
+
+func sendKubernetesStatus(res http.ResponseWriter, status int, reason string, message string, details *kubernetesStatusDetails) {
+	err := sendJson(res, status, kubernetesStatus{
+		ApiVersion: "v1",
+		Kind:       "Status",
+		Status:     "Failure",
+		Message:    message,
+		Reason:     reason,
+		Details:    details,
+		Code:       status,
+	})
+	if err != nil {
+		slog.Info("Error sending JSON message", "error", err)
+	}
+}
+
+// Send an error returned by the database as a Kubernetes Status
+func sendKubernetesError(res http.ResponseWriter, err error, resource KubernetesResource, name string) {
+	details := errorDetails(err)
+	status := statusForReason(details.Reason)
+	reason := "InternalError"
+	if mapped, ok := kubernetesReasons[details.Reason]; ok {
+		reason = mapped.reason
+		if mapped.status != 0 {
+			status = mapped.status
+		}
+	}
+	sendKubernetesStatus(res, status, reason, details.Message, &kubernetesStatusDetails{
+		Name:  name,
+		Group: resource.Group,
+		Kind:  resource.Plural,
+	})
+}
+
+// Whether the path is handled by the Kubernetes facade, objects named "api"
+// or "apis" can't be reached through the vogon API when it is enabled
+func isKubernetesPath(path string) bool {
+	return path == "/api" || path == "/apis" ||
+		strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/apis/")
+}
+
+var kubernetesVerbs = []string{"create", "delete", "get", "list", "patch", "update"}
+
+func (k *kubernetesFacade) ServeHTTP(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+
+	if segments[0] == "api" {
+		k.serveCore(res, req, segments[1:])
+		return
+	}
+
+	// /apis/<group>/<version>/namespaces/<namespace>/<plural>/<name>
+	switch len(segments) {
+	case 1:
+		k.serveGroupList(res, req)
+		return
+	case 2:
+		k.serveGroup(res, req, segments[1])
+		return
+	case 3:
+		k.serveResourceList(res, req, segments[1], segments[2])
+		return
+	}
+	group, version := segments[1], segments[2]
+	rest := segments[3:]
+	namespace := ""
+	if len(rest) >= 3 && rest[0] == "namespaces" {
+		namespace = rest[1]
+		rest = rest[2:]
+	}
+	if len(rest) > 2 {
+		sendKubernetesStatus(res, 404, "NotFound", "Not found", nil)
+		return
+	}
+	resource, ok := k.findResource(group, version, rest[0])
+	if !ok {
+		sendKubernetesStatus(res, 404, "NotFound", fmt.Sprintf("The server could not find the requested resource %v", req.URL.Path), nil)
+		return
+	}
+	if namespace != "" {
+		if _, ok := k.namespacePrefix(namespace); !ok {
+			sendKubernetesStatus(res, 404, "NotFound", fmt.Sprintf("namespaces %#v not found", namespace), &kubernetesStatusDetails{
+				Name: namespace,
+				Kind: "namespaces",
+			})
+			return
+		}
+	}
+
+	if req.URL.Query().Get("watch") != "" {
+		sendKubernetesStatus(res, 405, "MethodNotAllowed", "Watching is not supported", nil)
+		return
+	}
+
+	if len(rest) == 1 {
+		switch req.Method {
+		case "GET":
+			k.serveList(ctx, res, req, resource, version, namespace)
+		case "POST":
+			if namespace == "" {
+				sendKubernetesStatus(res, 405, "MethodNotAllowed", "Objects have to be created in a namespace", nil)
+				return
+			}
+			k.serveCreate(ctx, res, req, resource, version, namespace)
+		default:
+			sendKubernetesStatus(res, 405, "MethodNotAllowed", "Method not allowed", nil)
+		}
+		return
+	}
+
+	if namespace == "" {
+		sendKubernetesStatus(res, 404, "NotFound", "Not found", nil)
+		return
+	}
+	name, ok := k.objectName(namespace, rest[1])
+	if !ok {
+		sendKubernetesStatus(res, 422, "Invalid", "Invalid name", &kubernetesStatusDetails{
+			Name:  rest[1],
+			Group: resource.Group,
+			Kind:  resource.Plural,
+		})
+		return
+	}
+	switch req.Method {
+	case "GET":
+		k.serveGet(ctx, res, resource, rest[1], name)
+	case "PUT":
+		k.serveUpdate(ctx, res, req, resource, version, namespace, rest[1], name)
+	case "PATCH":
+		k.servePatch(ctx, res, req, resource, version, namespace, rest[1], name)
+	case "DELETE":
+		k.serveDelete(ctx, res, req, resource, rest[1], name)
+	default:
+		sendKubernetesStatus(res, 405, "MethodNotAllowed", "Method not allowed", nil)
+	}
+}
+
+type apiResource struct {
+	Name         string   `json:"name"`
+	SingularName string   `json:"singularName"`
+	Namespaced   bool     `json:"namespaced"`
+	Kind         string   `json:"kind"`
+	Verbs        []string `json:"verbs"`
+}
+
+type apiResourceList struct {
+	ApiVersion   string        `json:"apiVersion"`
+	Kind         string        `json:"kind"`
+	GroupVersion string        `json:"groupVersion"`
+	Resources    []apiResource `json:"resources"`
+}
+
+type groupVersion struct {
+	GroupVersion string `json:"groupVersion"`
+	Version      string `json:"version"`
+}
+
+type apiGroup struct {
+	ApiVersion       string         `json:"apiVersion,omitempty"`
+	Kind             string         `json:"kind,omitempty"`
+	Name             string         `json:"name"`
+	Versions         []groupVersion `json:"versions"`
+	PreferredVersion groupVersion   `json:"preferredVersion"`
+}
+
+type apiGroupList struct {
+	ApiVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Groups     []apiGroup `json:"groups"`
+}
+
+func (k *kubernetesFacade) groups() []apiGroup {
+	var groups []apiGroup
+	for _, resource := range k.resources {
+		index := slices.IndexFunc(groups, func(g apiGroup) bool { return g.Name == resource.Group })
+		if index == -1 {
+			groups = append(groups, apiGroup{
+				Name: resource.Group,
+				PreferredVersion: groupVersion{
+					GroupVersion: resource.Group + "/" + resource.Versions[0],
+					Version:      resource.Versions[0],
+				},
+			})
+			index = len(groups) - 1
+		}
+		for _, version := range resource.Versions {
+			if !slices.ContainsFunc(groups[index].Versions, func(v groupVersion) bool { return v.Version == version }) {
+				groups[index].Versions = append(groups[index].Versions, groupVersion{
+					GroupVersion: resource.Group + "/" + version,
+					Version:      version,
+				})
+			}
+		}
+	}
+	return groups
+}
+
+func (k *kubernetesFacade) serveGroupList(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		sendKubernetesStatus(res, 405, "MethodNotAllowed", "Method not allowed", nil)
+		return
+	}
+	groups := k.groups()
+	if groups == nil {
+		groups = []apiGroup{}
+	}
+	sendJson(res, 200, apiGroupList{
+		ApiVersion: "v1",
+		Kind:       "APIGroupList",
+		Groups:     groups,
+	})
+}
+
+func (k *kubernetesFacade) serveGroup(res http.ResponseWriter, req *http.Request, name string) {
+	if req.Method != "GET" {
+		sendKubernetesStatus(res, 405, "MethodNotAllowed", "Method not allowed", nil)
+		return
+	}
+	for _, group := range k.groups() {
+		if group.Name == name {
+			group.ApiVersion = "v1"
+			group.Kind = "APIGroup"
+			sendJson(res, 200, group)
+			return
+		}
+	}
+	sendKubernetesStatus(res, 404, "NotFound", "Not found", nil)
+}
+
+func (k *kubernetesFacade) serveResourceList(res http.ResponseWriter, req *http.Request, group string, version string) {
+	if req.Method != "GET" {
+		sendKubernetesStatus(res, 405, "MethodNotAllowed", "Method not allowed", nil)
+		return
+	}
+	list := apiResourceList{
+		ApiVersion:   "v1",
+		Kind:         "APIResourceList",
+		GroupVersion: group + "/" + version,
+		Resources:    []apiResource{},
+	}
+	for _, resource := range k.resources {
+		if resource.Group == group && slices.Contains(resource.Versions, version) {
+			list.Resources = append(list.Resources, apiResource{
+				Name:         resource.Plural,
+				SingularName: resource.Singular,
+				Namespaced:   true,
+				Kind:         resource.Kind,
+				Verbs:        kubernetesVerbs,
+			})
+		}
+	}
+	if len(list.Resources) == 0 {
+		sendKubernetesStatus(res, 404, "NotFound", "Not found", nil)
+		return
+	}
+	sendJson(res, 200, list)
+}
+
+type kubernetesNamespace struct {
+	ApiVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Metadata   kubernetesMetadata `json:"metadata"`
+	Status     struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+func newKubernetesNamespace(name string) kubernetesNamespace {
+	namespace := kubernetesNamespace{
+		ApiVersion: "v1",
+		Kind:       "Namespace",
+		Metadata:   kubernetesMetadata{Name: name},
+	}
+	namespace.Status.Phase = "Active"
+	return namespace
+}
+
+// Serve the core API, only namespaces are available
+func (k *kubernetesFacade) serveCore(res http.ResponseWriter, req *http.Request, segments []string) {
+	if req.Method != "GET" {
+		sendKubernetesStatus(res, 405, "MethodNotAllowed", "Method not allowed", nil)
+		return
+	}
+	switch {
+	case len(segments) == 0:
+		sendJson(res, 200, struct {
+			Kind     string   `json:"kind"`
+			Versions []string `json:"versions"`
+		}{
+			Kind:     "APIVersions",
+			Versions: []string{"v1"},
+		})
+	case len(segments) == 1 && segments[0] == "v1":
+		sendJson(res, 200, apiResourceList{
+			ApiVersion:   "v1",
+			Kind:         "APIResourceList",
+			GroupVersion: "v1",
+			Resources: []apiResource{{
+				Name:         "namespaces",
+				SingularName: "namespace",
+				Namespaced:   false,
+				Kind:         "Namespace",
+				Verbs:        []string{"get", "list"},
+			}},
+		})
+	case len(segments) == 2 && segments[0] == "v1" && segments[1] == "namespaces":
+		names := []string{"default"}
+		for namespace := range k.namespaces {
+			if namespace != "default" {
+				names = append(names, namespace)
+			}
+		}
+		slices.Sort(names)
+		items := make([]kubernetesNamespace, 0, len(names))
+		for _, name := range names {
+			if _, ok := k.namespacePrefix(name); ok {
+				items = append(items, newKubernetesNamespace(name))
+			}
+		}
+		sendJson(res, 200, struct {
+			ApiVersion string                `json:"apiVersion"`
+			Kind       string                `json:"kind"`
+			Metadata   struct{}              `json:"metadata"`
+			Items      []kubernetesNamespace `json:"items"`
+		}{
+			ApiVersion: "v1",
+			Kind:       "NamespaceList",
+			Items:      items,
+		})
+	case len(segments) == 3 && segments[0] == "v1" && segments[1] == "namespaces":
+		if _, ok := k.namespacePrefix(segments[2]); !ok {
+			sendKubernetesStatus(res, 404, "NotFound", fmt.Sprintf("namespaces %#v not found", segments[2]), &kubernetesStatusDetails{
+				Name: segments[2],
+				Kind: "namespaces",
+			})
+			return
+		}
+		sendJson(res, 200, newKubernetesNamespace(segments[2]))
+	default:
+		sendKubernetesStatus(res, 404, "NotFound", "Not found", nil)
+	}
+}
+
+func (k *kubernetesFacade) serveList(ctx context.Context, res http.ResponseWriter, req *http.Request, resource KubernetesResource, version string, namespace string) {
+	query := req.URL.Query()
+	// Like Kubernetes, return everything unless the client asks for pages
+	paged := false
+	options := database.ListOptions{
+		Limit:    maxListLimit,
+		Continue: query.Get("continue"),
+		Selector: database.Selector{{
+			Field:    "kind",
+			Operator: database.OpEquals,
+			Values:   []string{resource.VogonKind},
+		}},
+	}
+	if namespace != "" {
+		options.Prefix, _ = k.namespacePrefix(namespace)
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			sendKubernetesStatus(res, 400, "BadRequest", "invalid query parameter 'limit'", nil)
+			return
+		}
+		if limit > 0 {
+			options.Limit = min(limit, maxListLimit)
+			paged = true
+		}
+	}
+	if labels := query.Get("labelSelector"); labels != "" {
+		selector, err := database.ParseLabelSelector(labels)
+		if err != nil {
+			sendKubernetesError(res, err, resource, "")
+			return
+		}
+		options.Selector = append(options.Selector, selector...)
+	}
+
+	list := kubernetesList{
+		ApiVersion: resource.Group + "/" + version,
+		Kind:       resource.Kind + "List",
+		Items:      make([]kubernetesObject, 0),
+	}
+	for {
+		result, err := k.db.List(ctx, options)
+		if err != nil {
+			slog.Info("Kubernetes LIST error", "resource", resource.Plural, "error", err)
+			sendKubernetesError(res, err, resource, "")
+			return
+		}
+		for _, object := range result.Objects {
+			converted, ok := k.toKubernetes(resource, object)
+			// Objects nested deeper than a namespace are not visible
+			if !ok || (namespace != "" && converted.Metadata.Namespace != namespace) {
+				continue
+			}
+			list.Items = append(list.Items, converted)
+		}
+		if paged || result.Continue == "" {
+			list.Metadata.Continue = result.Continue
+			break
+		}
+		options.Continue = result.Continue
+	}
+	err := sendJson(res, 200, list)
+	if err != nil {
+		slog.Info("Kubernetes LIST send error", "resource", resource.Plural, "error", err)
+	}
+}
+
+// Get an object and send it to the client
+func (k *kubernetesFacade) sendObject(ctx context.Context, res http.ResponseWriter, status int, resource KubernetesResource, localName string, name string) {
+	object, err := k.db.Get(ctx, name)
+	if err != nil {
+		sendKubernetesError(res, err, resource, localName)
+		return
+	}
+	if object.Kind != resource.VogonKind {
+		sendKubernetesError(res, &database.DoesNotExist{
+			Name:    name,
+			Message: fmt.Sprintf("%v.%v %#v not found", resource.Plural, resource.Group, localName),
+		}, resource, localName)
+		return
+	}
+	converted, ok := k.toKubernetes(resource, object)
+	if !ok {
+		sendKubernetesStatus(res, 500, "InternalError", "Object is not in a namespace", nil)
+		return
+	}
+	err = sendJson(res, status, converted)
+	if err != nil {
+		slog.Info("Kubernetes send error", "name", name, "error", err)
+	}
+}
+
+func (k *kubernetesFacade) serveGet(ctx context.Context, res http.ResponseWriter, resource KubernetesResource, localName string, name string) {
+	k.sendObject(ctx, res, 200, resource, localName, name)
+}
+
+func readKubernetesObject(req *http.Request) (kubernetesObject, error) {
+	var object kubernetesObject
+	// Like Kubernetes, ignore the fields we don't know, such as annotations
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(&object)
+	if err != nil {
+		return object, &database.Invalid{
+			Reason:  database.ReasonBadRequest,
+			Message: fmt.Sprintf("error reading input: %v", err),
+		}
+	}
+	return object, nil
+}
+
+func (k *kubernetesFacade) serveCreate(ctx context.Context, res http.ResponseWriter, req *http.Request, resource KubernetesResource, version string, namespace string) {
+	input, err := readKubernetesObject(req)
+	if err != nil {
+		sendKubernetesError(res, err, resource, "")
+		return
+	}
+	object, err := k.fromKubernetes(resource, version, namespace, input)
+	if err != nil {
+		sendKubernetesError(res, err, resource, input.Metadata.Name)
+		return
+	}
+	object.Metadata.Id = ""
+	object.Metadata.Revision = ""
+	_, err = k.db.Create(ctx, object, false)
+	if err != nil {
+		slog.Info("Kubernetes CREATE error", "name", object.Metadata.Name, "error", err)
+		sendKubernetesError(res, err, resource, input.Metadata.Name)
+		return
+	}
+	k.sendObject(ctx, res, 201, resource, input.Metadata.Name, object.Metadata.Name)
+}
+
+// Write an object that already exists, resourceVersion is used as a
+// precondition if set, otherwise the write fails if the object changed since
+// current was read
+func (k *kubernetesFacade) writeExisting(ctx context.Context, object database.Object, current database.Object) error {
+	// Kubernetes clients don't always send the uid with the
+	// resourceVersion, but we need both
+	if object.Metadata.Id == "" {
+		object.Metadata.Id = current.Metadata.Id
+	}
+	if object.Metadata.Revision == "" {
+		object.Metadata.Revision = current.Metadata.Revision
+	}
+	_, err := k.db.Update(ctx, object)
+	return err
+}
+
+func (k *kubernetesFacade) serveUpdate(ctx context.Context, res http.ResponseWriter, req *http.Request, resource KubernetesResource, version string, namespace string, localName string, name string) {
+	input, err := readKubernetesObject(req)
+	if err != nil {
+		sendKubernetesError(res, err, resource, localName)
+		return
+	}
+	if input.Metadata.Name != localName {
+		sendKubernetesStatus(res, 400, "BadRequest", "The name of the object does not match the request", nil)
+		return
+	}
+	object, err := k.fromKubernetes(resource, version, namespace, input)
+	if err != nil {
+		sendKubernetesError(res, err, resource, localName)
+		return
+	}
+
+	// Don't overwrite objects of other kinds
+	current, err := k.db.Get(ctx, name)
+	if err == nil && current.Kind != resource.VogonKind {
+		err = &database.DoesNotExist{
+			Name:    name,
+			Message: fmt.Sprintf("%v.%v %#v not found", resource.Plural, resource.Group, localName),
+		}
+	}
+	if err != nil {
+		sendKubernetesError(res, err, resource, localName)
+		return
+	}
+	err = k.writeExisting(ctx, object, current)
+	if err != nil {
+		slog.Info("Kubernetes UPDATE error", "name", name, "error", err)
+		sendKubernetesError(res, err, resource, localName)
+		return
+	}
+	k.sendObject(ctx, res, 200, resource, localName, name)
+}
+
+func (k *kubernetesFacade) servePatch(ctx context.Context, res http.ResponseWriter, req *http.Request, resource KubernetesResource, version string, namespace string, localName string, name string) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/merge-patch+json" {
+		sendKubernetesStatus(
+			res,
+			http.StatusUnsupportedMediaType,
+			"UnsupportedMediaType",
+			fmt.Sprintf("the body of the request was in an unknown format - accepted media types include: application/merge-patch+json"),
+			nil,
+		)
+		return
+	}
+	var patch any
+	err := json.NewDecoder(req.Body).Decode(&patch)
+	if err != nil {
+		sendKubernetesStatus(res, 400, "BadRequest", fmt.Sprintf("error reading patch: %v", err), nil)
+		return
+	}
+
+	current, err := k.db.Get(ctx, name)
+	if err == nil && current.Kind != resource.VogonKind {
+		err = &database.DoesNotExist{
+			Name:    name,
+			Message: fmt.Sprintf("%v.%v %#v not found", resource.Plural, resource.Group, localName),
+		}
+	}
+	if err != nil {
+		sendKubernetesError(res, err, resource, localName)
+		return
+	}
+	converted, ok := k.toKubernetes(resource, current)
+	if !ok {
+		sendKubernetesStatus(res, 500, "InternalError", "Object is not in a namespace", nil)
+		return
+	}
+
+	// Apply the patch on the JSON document, then read it back
+	var document any
+	data, err := json.Marshal(converted)
+	if err == nil {
+		err = json.Unmarshal(data, &document)
+	}
+	if err == nil {
+		data, err = json.Marshal(mergePatch(document, patch))
+	}
+	var patched kubernetesObject
+	if err == nil {
+		err = json.Unmarshal(data, &patched)
+	}
+	if err != nil {
+		sendKubernetesStatus(res, 422, "Invalid", fmt.Sprintf("invalid patch: %v", err), nil)
+		return
+	}
+	if patched.Metadata.Name != localName {
+		sendKubernetesStatus(res, 400, "BadRequest", "The name of the object cannot be changed", nil)
+		return
+	}
+
+	object, err := k.fromKubernetes(resource, version, namespace, patched)
+	if err != nil {
+		sendKubernetesError(res, err, resource, localName)
+		return
+	}
+	// The write fails if the object changed since we read it, unless the
+	// patch sets its own resourceVersion
+	object.Metadata.Id = current.Metadata.Id
+	err = k.writeExisting(ctx, object, current)
+	if err != nil {
+		slog.Info("Kubernetes PATCH error", "name", name, "error", err)
+		sendKubernetesError(res, err, resource, localName)
+		return
+	}
+	k.sendObject(ctx, res, 200, resource, localName, name)
+}
+
+type kubernetesDeleteOptions struct {
+	Preconditions struct {
+		Uid             string `json:"uid"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"preconditions"`
+}
+
+func (k *kubernetesFacade) serveDelete(ctx context.Context, res http.ResponseWriter, req *http.Request, resource KubernetesResource, localName string, name string) {
+	var options kubernetesDeleteOptions
+	body, err := io.ReadAll(req.Body)
+	if err == nil && len(strings.TrimSpace(string(body))) > 0 {
+		err = json.Unmarshal(body, &options)
+	}
+	if err != nil {
+		sendKubernetesStatus(res, 400, "BadRequest", fmt.Sprintf("error reading delete options: %v", err), nil)
+		return
+	}
+
+	current, err := k.db.Get(ctx, name)
+	if err == nil && current.Kind != resource.VogonKind {
+		err = &database.DoesNotExist{
+			Name:    name,
+			Message: fmt.Sprintf("%v.%v %#v not found", resource.Plural, resource.Group, localName),
+		}
+	}
+	if err != nil {
+		sendKubernetesError(res, err, resource, localName)
+		return
+	}
+
+	// Always pass the id, so we don't delete an object of another kind
+	// that was created in the meantime
+	id := current.Metadata.Id
+	if options.Preconditions.Uid != "" {
+		id = options.Preconditions.Uid
+	}
+	_, err = k.db.Delete(ctx, name, id, options.Preconditions.ResourceVersion)
+	if err != nil {
+		slog.Info("Kubernetes DELETE error", "name", name, "error", err)
+		sendKubernetesError(res, err, resource, localName)
+		return
+	}
+	err = sendJson(res, 200, kubernetesStatus{
+		ApiVersion: "v1",
+		Kind:       "Status",
+		Status:     "Success",
+		Details: &kubernetesStatusDetails{
+			Name:  localName,
+			Group: resource.Group,
+			Kind:  resource.Plural,
+		},
+		Code: 200,
+	})
+	if err != nil {
+		slog.Info("Kubernetes DELETE send error", "name", name, "error", err)
+	}
+}
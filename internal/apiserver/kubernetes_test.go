@@ -0,0 +1,247 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newKubernetesTestServer(t *testing.T) *ApiServer {
+	server, _ := newTestServer(t)
+	facade, err := newKubernetesFacade(server.db, KubernetesConfig{
+		Resources: []KubernetesResource{{
+			Group:    "example.org",
+			Kind:     "Job",
+			Plural:   "jobs",
+			Versions: []string{"v1", "v1beta1"},
+		}},
+		Namespaces: map[string]string{
+			"team-a": "teams/a",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.kubernetes = facade
+	return server
+}
+
+func doKubernetesRequest(t *testing.T, server *ApiServer, method string, target string, contentType string, body string) (int, map[string]any) {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	var result map[string]any
+	err := json.NewDecoder(recorder.Body).Decode(&result)
+	if err != nil {
+		t.Fatalf("%v %v: invalid body: %v", method, target, err)
+	}
+	return recorder.Code, result
+}
+
+func jsonPath(value any, path ...string) any {
+	for _, key := range path {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+func TestKubernetesDiscovery(t *testing.T) {
+	server := newKubernetesTestServer(t)
+
+	status, groups := doKubernetesRequest(t, server, "GET", "/apis", "", "")
+	if status != 200 || groups["kind"] != "APIGroupList" {
+		t.Fatalf("group list: %v %#v", status, groups)
+	}
+	group := groups["groups"].([]any)[0]
+	if jsonPath(group, "name") != "example.org" ||
+		jsonPath(group, "preferredVersion", "groupVersion") != "example.org/v1" ||
+		len(jsonPath(group, "versions").([]any)) != 2 {
+		t.Fatalf("wrong group: %#v", group)
+	}
+
+	status, resources := doKubernetesRequest(t, server, "GET", "/apis/example.org/v1beta1", "", "")
+	if status != 200 || resources["groupVersion"] != "example.org/v1beta1" {
+		t.Fatalf("resource list: %v %#v", status, resources)
+	}
+	resource := resources["resources"].([]any)[0]
+	if jsonPath(resource, "name") != "jobs" || jsonPath(resource, "kind") != "Job" || jsonPath(resource, "namespaced") != true {
+		t.Fatalf("wrong resource: %#v", resource)
+	}
+
+	status, _ = doKubernetesRequest(t, server, "GET", "/apis/example.org/v2", "", "")
+	if status != 404 {
+		t.Fatalf("unknown version: %v", status)
+	}
+
+	status, namespace := doKubernetesRequest(t, server, "GET", "/api/v1/namespaces/team-a", "", "")
+	if status != 200 || jsonPath(namespace, "metadata", "name") != "team-a" {
+		t.Fatalf("namespace: %v %#v", status, namespace)
+	}
+}
+
+func TestKubernetesObjects(t *testing.T) {
+	ctx := context.Background()
+	server := newKubernetesTestServer(t)
+	base := "/apis/example.org/v1/namespaces/team-a/jobs"
+
+	job := `{"apiVersion": "example.org/v1", "kind": "Job", "metadata": {"name": "build", "labels": {"app": "web"}, "annotations": {"ignored": "yes"}}, "spec": {"image": "builder", "retries": 3}}`
+	status, created := doKubernetesRequest(t, server, "POST", base, "application/json", job)
+	if status != 201 ||
+		jsonPath(created, "metadata", "namespace") != "team-a" ||
+		jsonPath(created, "metadata", "uid") == nil ||
+		jsonPath(created, "metadata", "resourceVersion") == nil {
+		t.Fatalf("create: %v %#v", status, created)
+	}
+
+	// Stored under the namespace's prefix
+	object, err := server.db.Get(ctx, "teams/a/build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Kind != "example.org/Job" || object.Version != "v1" || object.Metadata.Labels["app"] != "web" {
+		t.Fatalf("wrong object: %#v", object)
+	}
+
+	status, details := doKubernetesRequest(t, server, "POST", base, "application/json", job)
+	if status != 409 || details["kind"] != "Status" || details["reason"] != "AlreadyExists" {
+		t.Fatalf("create existing: %v %#v", status, details)
+	}
+
+	status, list := doKubernetesRequest(t, server, "GET", base+"?labelSelector=app%3Dweb", "", "")
+	if status != 200 || list["kind"] != "JobList" || len(list["items"].([]any)) != 1 {
+		t.Fatalf("list: %v %#v", status, list)
+	}
+	status, list = doKubernetesRequest(t, server, "GET", base+"?labelSelector=app%3Ddb", "", "")
+	if status != 200 || len(list["items"].([]any)) != 0 {
+		t.Fatalf("list with selector: %v %#v", status, list)
+	}
+	status, list = doKubernetesRequest(t, server, "GET", "/apis/example.org/v1/jobs", "", "")
+	if status != 200 || len(list["items"].([]any)) != 1 {
+		t.Fatalf("list all namespaces: %v %#v", status, list)
+	}
+	status, list = doKubernetesRequest(t, server, "GET", "/apis/example.org/v1/namespaces/default/jobs", "", "")
+	if status != 200 || len(list["items"].([]any)) != 0 {
+		t.Fatalf("list other namespace: %v %#v", status, list)
+	}
+
+	status, patched := doKubernetesRequest(t, server, "PATCH", base+"/build", "application/merge-patch+json", `{"spec": {"retries": null, "image": "builder:2"}}`)
+	if status != 200 ||
+		jsonPath(patched, "spec", "image") != "builder:2" ||
+		jsonPath(patched, "spec", "retries") != nil ||
+		jsonPath(patched, "metadata", "resourceVersion") == jsonPath(created, "metadata", "resourceVersion") {
+		t.Fatalf("patch: %v %#v", status, patched)
+	}
+	status, _ = doKubernetesRequest(t, server, "PATCH", base+"/build", "application/strategic-merge-patch+json", `{}`)
+	if status != 415 {
+		t.Fatalf("strategic merge patch: %v", status)
+	}
+
+	// Update with a stale resourceVersion
+	stale := `{"apiVersion": "example.org/v1", "kind": "Job", "metadata": {"name": "build", "resourceVersion": "` +
+		jsonPath(created, "metadata", "resourceVersion").(string) + `"}, "spec": {}}`
+	status, details = doKubernetesRequest(t, server, "PUT", base+"/build", "application/json", stale)
+	if status != 409 || details["reason"] != "Conflict" {
+		t.Fatalf("stale update: %v %#v", status, details)
+	}
+	status, updated := doKubernetesRequest(t, server, "PUT", base+"/build", "application/json", `{"apiVersion": "example.org/v1", "kind": "Job", "metadata": {"name": "build"}, "spec": {"image": "other"}}`)
+	if status != 200 || jsonPath(updated, "spec", "image") != "other" {
+		t.Fatalf("update: %v %#v", status, updated)
+	}
+
+	status, details = doKubernetesRequest(t, server, "DELETE", base+"/build", "", "")
+	if status != 200 || details["status"] != "Success" {
+		t.Fatalf("delete: %v %#v", status, details)
+	}
+	status, details = doKubernetesRequest(t, server, "GET", base+"/build", "", "")
+	if status != 404 || details["reason"] != "NotFound" || jsonPath(details, "details", "name") != "build" {
+		t.Fatalf("get deleted: %v %#v", status, details)
+	}
+
+	// Objects of other kinds are not visible
+	_, err = server.db.Create(ctx, testObject("teams/a/other"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ = doKubernetesRequest(t, server, "GET", base+"/other", "", "")
+	if status != 404 {
+		t.Fatalf("get other kind: %v", status)
+	}
+	status, _ = doKubernetesRequest(t, server, "DELETE", base+"/other", "", "")
+	if status != 404 {
+		t.Fatalf("delete other kind: %v", status)
+	}
+	status, _ = doKubernetesRequest(t, server, "PUT", base+"/other", "application/json", `{"apiVersion": "example.org/v1", "kind": "Job", "metadata": {"name": "other"}, "spec": {}}`)
+	if status != 404 {
+		t.Fatalf("update other kind: %v", status)
+	}
+	status, _ = doKubernetesRequest(t, server, "PATCH", base+"/other", "application/merge-patch+json", `{"spec": {}}`)
+	if status != 404 {
+		t.Fatalf("patch other kind: %v", status)
+	}
+	object, err = server.db.Get(ctx, "teams/a/other")
+	if err != nil || object.Kind != testObject("").Kind {
+		t.Fatalf("other kind was changed: %#v %v", object, err)
+	}
+
+	status, details = doKubernetesRequest(t, server, "POST", base, "application/json", `{"apiVersion": "example.org/v1", "kind": "Other", "metadata": {"name": "x"}}`)
+	if status != 422 || details["reason"] != "Invalid" {
+		t.Fatalf("create wrong kind: %v %#v", status, details)
+	}
+}
+
+func TestKubernetesList(t *testing.T) {
+	ctx := context.Background()
+	server := newKubernetesTestServer(t)
+	base := "/apis/example.org/v1/namespaces/team-a/jobs"
+
+	count := defaultListLimit + 100
+	for i := 0; i < count; i++ {
+		object := testObject(fmt.Sprintf("teams/a/job-%04d", i))
+		object.Kind = "example.org/Job"
+		_, err := server.db.Create(ctx, object, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Everything is returned unless the client asks for pages
+	status, list := doKubernetesRequest(t, server, "GET", base, "", "")
+	if status != 200 || len(list["items"].([]any)) != count || jsonPath(list, "metadata", "continue") != nil {
+		t.Fatalf("list: %v %v %#v", status, len(list["items"].([]any)), list["metadata"])
+	}
+
+	var names []any
+	target := base + "?limit=250"
+	for {
+		status, list = doKubernetesRequest(t, server, "GET", target, "", "")
+		if status != 200 {
+			t.Fatalf("list page: %v %#v", status, list)
+		}
+		items := list["items"].([]any)
+		if len(items) > 250 {
+			t.Fatalf("page too big: %v", len(items))
+		}
+		for _, item := range items {
+			names = append(names, jsonPath(item, "metadata", "name"))
+		}
+		token, _ := jsonPath(list, "metadata", "continue").(string)
+		if token == "" {
+			break
+		}
+		target = base + "?limit=250&continue=" + url.QueryEscape(token)
+	}
+	if len(names) != count || names[count-1] != fmt.Sprintf("job-%04d", count-1) {
+		t.Fatalf("wrong pages: %v names", len(names))
+	}
+}
@@ -0,0 +1,160 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/remram44/vogon/internal/jwt"
+)
+
+type OidcConfig struct {
+	// Expected "iss" claim
+	Issuer string `yaml:"issuer"`
+	// Expected "aud" claim, usually the client ID
+	Audience string `yaml:"audience"`
+	// Keys of the issuer, from a local file or fetched over HTTP(S). One of
+	// them is required.
+	JwksFile string `yaml:"jwks_file"`
+	JwksUrl  string `yaml:"jwks_url"`
+	// Claim with the user name, defaults to "sub"
+	UserClaim string `yaml:"user_claim"`
+	// Claim with the list of groups, defaults to "groups"
+	GroupsClaim string `yaml:"groups_claim"`
+	// Prepended to user and group names, e.g. "oidc:", so they can't be
+	// mistaken for those from other sources
+	Prefix string `yaml:"prefix"`
+}
+
+// Minimum time between fetches of the JWKS, when tokens use unknown keys
+const jwksRefreshInterval = time.Minute
+
+// Validates JWTs from an identity provider
+type jwtAuthenticator struct {
+	config OidcConfig
+
+	mutex     sync.Mutex
+	keys      *jwt.KeySet
+	lastFetch time.Time
+}
+
+func newJwtAuthenticator(config OidcConfig) (*jwtAuthenticator, error) {
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, fmt.Errorf("OIDC config requires issuer and audience")
+	}
+	if (config.JwksFile == "") == (config.JwksUrl == "") {
+		return nil, fmt.Errorf("OIDC config requires one of jwks_file or jwks_url")
+	}
+	if config.UserClaim == "" {
+		config.UserClaim = "sub"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	auth := &jwtAuthenticator{
+		config: config,
+	}
+
+	// Load the keys now, so errors are reported on startup
+	if config.JwksFile != "" {
+		data, err := os.ReadFile(config.JwksFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.keys, err = jwt.ParseKeySet(data)
+		if err != nil {
+			return nil, fmt.Errorf("Reading %v: %w", config.JwksFile, err)
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, err := auth.fetchKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+// Download the keys from the URL
+func (a *jwtAuthenticator) fetchKeys(ctx context.Context) (*jwt.KeySet, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Don't hammer the identity provider if clients send unknown keys
+	if time.Since(a.lastFetch) < jwksRefreshInterval {
+		return a.keys, nil
+	}
+	a.lastFetch = time.Now()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", a.config.JwksUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Fetching JWKS: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("Fetching JWKS: %v", response.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("Fetching JWKS: %w", err)
+	}
+	keys, err := jwt.ParseKeySet(data)
+	if err != nil {
+		return nil, err
+	}
+	a.keys = keys
+	slog.Info("fetched JWKS", "url", a.config.JwksUrl)
+	return keys, nil
+}
+
+func (a *jwtAuthenticator) authenticateToken(ctx context.Context, token string) (*Identity, error) {
+	// Leave tokens that are not from our issuer to other authenticators
+	unverified, err := jwt.UnverifiedClaims(token)
+	if err != nil || unverified.String("iss") != a.config.Issuer {
+		return nil, nil
+	}
+
+	a.mutex.Lock()
+	keys := a.keys
+	a.mutex.Unlock()
+	claims, err := keys.Verify(token)
+	if errors.Is(err, jwt.ErrUnknownKey) && a.config.JwksUrl != "" {
+		// The issuer might have rotated its keys
+		keys, fetchErr := a.fetchKeys(ctx)
+		if fetchErr != nil {
+			slog.Error("error refreshing JWKS", "error", fetchErr)
+		} else {
+			claims, err = keys.Verify(token)
+		}
+	}
+	if err != nil {
+		return nil, &authError{err.Error()}
+	}
+	err = claims.Validate(a.config.Issuer, a.config.Audience, time.Now())
+	if err != nil {
+		return nil, &authError{err.Error()}
+	}
+
+	user := claims.String(a.config.UserClaim)
+	if user == "" {
+		return nil, &authError{fmt.Sprintf("JWT has no %#v claim", a.config.UserClaim)}
+	}
+	identity := &Identity{
+		User: a.config.Prefix + user,
+	}
+	for _, group := range claims.Strings(a.config.GroupsClaim) {
+		identity.Groups = append(identity.Groups, a.config.Prefix+group)
+	}
+	return identity, nil
+}
@@ -0,0 +1,151 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/remram44/vogon/internal/jwt"
+	"github.com/remram44/vogon/internal/jwt/jwttest"
+)
+
+const testIssuer = "https://idp.example.org"
+
+func TestOidc(t *testing.T) {
+	ctx := context.Background()
+	issuer := jwttest.NewIssuer(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(jwksFile, issuer.Jwks(), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticators, err := newAuthenticators(Config{
+		TokenFile: writeTokenFile(t),
+		Oidc: &OidcConfig{
+			Issuer:    testIssuer,
+			Audience:  "vogon",
+			JwksFile:  jwksFile,
+			UserClaim: "email",
+			Prefix:    "oidc:",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := time.Now().Add(time.Hour)
+	claims := jwt.Claims{
+		"iss":    testIssuer,
+		"aud":    "vogon",
+		"sub":    "1234",
+		"email":  "alice@example.org",
+		"groups": []any{"admins", "dev"},
+		"exp":    expiry.Unix(),
+	}
+	identity, err := authenticate(ctx, authenticators, "Bearer "+issuer.Sign(t, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.User != "oidc:alice@example.org" || !slices.Equal(identity.Groups, []string{"oidc:admins", "oidc:dev"}) {
+		t.Fatalf("wrong identity: %#v", identity)
+	}
+
+	// Static tokens still work
+	identity, err = authenticate(ctx, authenticators, "Bearer alice-token")
+	if err != nil || identity.User != "alice" {
+		t.Fatalf("static token: %#v %v", identity, err)
+	}
+
+	for name, change := range map[string]jwt.Claims{
+		"expired":        {"exp": time.Now().Add(-time.Hour).Unix()},
+		"wrong audience": {"aud": "other"},
+		"wrong issuer":   {"iss": "https://other.example.org"},
+		"no user":        {"email": nil},
+	} {
+		modified := jwt.Claims{}
+		for key, value := range claims {
+			modified[key] = value
+		}
+		for key, value := range change {
+			if value == nil {
+				delete(modified, key)
+			} else {
+				modified[key] = value
+			}
+		}
+		_, err := authenticate(ctx, authenticators, "Bearer "+issuer.Sign(t, modified))
+		var authErr *authError
+		if !errors.As(err, &authErr) {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+
+	// Signed by another key
+	other := jwttest.NewIssuer(t)
+	_, err = authenticate(ctx, authenticators, "Bearer "+other.Sign(t, claims))
+	if err == nil {
+		t.Fatal("token signed by another key was accepted")
+	}
+}
+
+func TestOidcJwksUrl(t *testing.T) {
+	ctx := context.Background()
+	var mutex sync.Mutex
+	issuer := jwttest.NewIssuer(t)
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fetches++
+		res.Header().Set("Content-type", "application/json")
+		res.Write(issuer.Jwks())
+	}))
+	t.Cleanup(server.Close)
+
+	auth, err := newJwtAuthenticator(OidcConfig{
+		Issuer:   testIssuer,
+		Audience: "vogon",
+		JwksUrl:  server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.Claims{
+		"iss": testIssuer,
+		"aud": "vogon",
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	identity, err := auth.authenticateToken(ctx, issuer.Sign(t, claims))
+	if err != nil || identity == nil || identity.User != "alice" {
+		t.Fatalf("%#v %v", identity, err)
+	}
+
+	// Rotate the key, the JWKS is fetched again once the interval passed
+	mutex.Lock()
+	issuer = jwttest.NewIssuer(t)
+	issuer.KeyId = "new-key"
+	rotated := issuer.Sign(t, claims)
+	mutex.Unlock()
+	_, err = auth.authenticateToken(ctx, rotated)
+	if err == nil {
+		t.Fatal("JWKS was fetched again too soon")
+	}
+	auth.mutex.Lock()
+	auth.lastFetch = time.Now().Add(-jwksRefreshInterval)
+	auth.mutex.Unlock()
+	identity, err = auth.authenticateToken(ctx, rotated)
+	if err != nil || identity == nil || identity.User != "alice" {
+		t.Fatalf("after rotation: %#v %v", identity, err)
+	}
+	if fetches != 2 {
+		t.Fatalf("JWKS fetched %d times", fetches)
+	}
+}
@@ -0,0 +1,563 @@
+package apiserver
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/remram44/vogon/internal/codec"
+	"github.com/remram44/vogon/internal/versioning"
+)
+
+// JSON schemas of the spec and status of a kind, used to describe the
+// objects of that kind in the OpenAPI document (objects are not validated
+// against them)
+type KindSchema struct {
+	// Kind in URI format, e.g. "github.com/remram44/vogon/schemas/Job"
+	Kind string `yaml:"kind"`
+	// Only describe objects with this version, if set
+	Version string         `yaml:"version"`
+	Spec    map[string]any `yaml:"spec"`
+	Status  map[string]any `yaml:"status"`
+}
+
+func validateKindSchemas(schemas []KindSchema) error {
+	seen := make(map[string]bool)
+	for _, schema := range schemas {
+		if schema.Kind == "" {
+			return fmt.Errorf("Schemas need a kind")
+		}
+		name := kindSchemaName(schema)
+		if seen[name] {
+			return fmt.Errorf("Duplicate schema for kind %v", schema.Kind)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+var schemaNameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Name of the component for a kind, e.g.
+// "github.com.remram44.vogon.schemas.Job.v1"
+func kindSchemaName(schema KindSchema) string {
+	name := schemaNameInvalidChars.ReplaceAllString(schema.Kind, ".")
+	if schema.Version != "" {
+		name += "." + schemaNameInvalidChars.ReplaceAllString(schema.Version, ".")
+	}
+	return name
+}
+
+func schemaRef(name string) map[string]any {
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+// Content of a body in every format the API supports
+func bodyContent(schema map[string]any) map[string]any {
+	content := make(map[string]any)
+	for _, mediaType := range codec.MediaTypes {
+		if mediaType == codec.Yaml {
+			content[mediaType] = map[string]any{"schema": yamlSchema(schema)}
+		} else {
+			content[mediaType] = map[string]any{"schema": schema}
+		}
+	}
+	return content
+}
+
+// Suffix of the components describing the YAML form of a schema
+const yamlSchemaSuffix = ".yaml"
+
+// Convert a schema to describe the YAML encoding, which has lowercase field
+// names. References point to the YAML components. The content of Spec and
+// Status is left alone, as it is free-form.
+func yamlSchema(schema map[string]any) map[string]any {
+	return convertYamlSchema(schema).(map[string]any)
+}
+
+func convertYamlSchema(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		converted := make(map[string]any, len(value))
+		for key, item := range value {
+			switch key {
+			case "$ref":
+				ref := item.(string)
+				if strings.HasPrefix(ref, "#/components/schemas/") {
+					ref += yamlSchemaSuffix
+				}
+				converted[key] = ref
+			case "properties":
+				properties := make(map[string]any)
+				for name, property := range item.(map[string]any) {
+					if name != "Spec" && name != "Status" {
+						property = convertYamlSchema(property)
+					}
+					properties[strings.ToLower(name)] = property
+				}
+				converted[key] = properties
+			case "required":
+				var required []any
+				for _, name := range item.([]any) {
+					required = append(required, strings.ToLower(name.(string)))
+				}
+				converted[key] = required
+			default:
+				converted[key] = convertYamlSchema(item)
+			}
+		}
+		return converted
+	case []any:
+		converted := make([]any, 0, len(value))
+		for _, item := range value {
+			converted = append(converted, convertYamlSchema(item))
+		}
+		return converted
+	default:
+		return value
+	}
+}
+
+func response(description string, schema string) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     bodyContent(schemaRef(schema)),
+	}
+}
+
+func queryParameter(name string, description string, schema map[string]any) map[string]any {
+	return map[string]any{
+		"name":        name,
+		"in":          "query",
+		"description": description,
+		"schema":      schema,
+	}
+}
+
+func requiredParameter(parameter map[string]any) map[string]any {
+	parameter["required"] = true
+	return parameter
+}
+
+func headerParameter(name string, description string) map[string]any {
+	return map[string]any{
+		"name":        name,
+		"in":          "header",
+		"description": description,
+		"schema":      map[string]any{"type": "string"},
+	}
+}
+
+var (
+	stringSchema  = map[string]any{"type": "string"}
+	booleanSchema = map[string]any{"type": "boolean", "default": true}
+	etagHeader    = map[string]any{
+		"ETag": map[string]any{
+			"description": "Entity tag of the new version of the object",
+			"schema":      stringSchema,
+		},
+	}
+)
+
+// Build the OpenAPI 3.1 document describing the API
+func openapiDocument(kindSchemas []KindSchema) map[string]any {
+	errorResponses := map[string]any{
+		"400": response("Invalid request", "ErrorDetails"),
+		"406": response("None of the accepted formats is supported", "ErrorDetails"),
+		"422": response("Invalid object or name", "ErrorDetails"),
+		"500": response("Internal error", "ErrorDetails"),
+		"504": response("Timeout", "ErrorDetails"),
+	}
+	withErrors := func(responses map[string]any) map[string]any {
+		for status, response := range errorResponses {
+			if _, ok := responses[status]; !ok {
+				responses[status] = response
+			}
+		}
+		return responses
+	}
+
+	nameParameter := map[string]any{
+		"name":        "name",
+		"in":          "path",
+		"required":    true,
+		"description": "Name of the object, segments separated by slashes, e.g. \"team-a/job\"",
+		"schema":      stringSchema,
+	}
+	ifMatch := headerParameter("If-Match", "Only proceed if the object has one of these entity tags, \"*\" for any")
+	ifNoneMatch := headerParameter("If-None-Match", "Only proceed if the object doesn't have one of these entity tags, \"*\" if it must not exist")
+
+	paths := map[string]any{
+		"/_version": map[string]any{
+			"get": map[string]any{
+				"operationId": "getVersion",
+				"summary":     "Get the name and version of the server",
+				"responses": withErrors(map[string]any{
+					"200": response("Server version", "Version"),
+				}),
+			},
+		},
+		"/_openapi": map[string]any{
+			"get": map[string]any{
+				"operationId": "getOpenapi",
+				"summary":     "Get this document",
+				"responses": withErrors(map[string]any{
+					"200": map[string]any{
+						"description": "OpenAPI document",
+						"content":     bodyContent(map[string]any{"type": "object"}),
+					},
+				}),
+			},
+		},
+		"/_list": map[string]any{
+			"get": map[string]any{
+				"operationId": "listObjects",
+				"summary":     "List a page of objects, ordered by name",
+				"parameters": []any{
+					queryParameter("prefix", "Only list objects under this path", stringSchema),
+					queryParameter("limit", "Maximum number of objects to return", map[string]any{
+						"type":    "integer",
+						"minimum": 1,
+						"maximum": maxListLimit,
+						"default": defaultListLimit,
+					}),
+					queryParameter("continue", "Token from the previous page", stringSchema),
+					queryParameter("labels", "Label selector, e.g. \"app=web,tier!=db\"", stringSchema),
+					queryParameter("fields", "Field selector, e.g. \"kind=example.org/Job,spec.replicas>2\"", stringSchema),
+				},
+				"responses": withErrors(map[string]any{
+					"200": response("Page of objects", "ListResult"),
+				}),
+			},
+		},
+		"/_batch": map[string]any{
+			"post": map[string]any{
+				"operationId": "batch",
+				"summary":     "Apply several writes atomically",
+				"description": "Operations are applied in order, each seeing the result of the previous ones. If one fails, none are applied, and only that one has a result, with the error.",
+				"requestBody": map[string]any{
+					"required": true,
+					"content":  bodyContent(schemaRef("BatchRequest")),
+				},
+				"responses": withErrors(map[string]any{
+					"200": response("Metadata of each object written or deleted", "BatchResponse"),
+					"404": response("An object to update or delete doesn't exist", "BatchResponse"),
+					"409": response("An object to create already exists", "BatchResponse"),
+					"412": response("An object doesn't have the expected id or revision", "BatchResponse"),
+					"415": response("Unsupported Content-Type", "ErrorDetails"),
+				}),
+			},
+		},
+		"/_can-i": map[string]any{
+			"get": map[string]any{
+				"operationId": "canI",
+				"summary":     "Check whether the authenticated user can do something",
+				"parameters": []any{
+					requiredParameter(queryParameter("verb", "Verb to check", map[string]any{
+						"type": "string",
+						"enum": verbs,
+					})),
+					requiredParameter(queryParameter("name", "Name of the object", stringSchema)),
+					queryParameter("kind", "Kind of the object, any kind if not set", stringSchema),
+				},
+				"responses": withErrors(map[string]any{
+					"200": response("Whether the request would be allowed", "AccessReview"),
+				}),
+			},
+		},
+		"/{name}": map[string]any{
+			"parameters": []any{nameParameter},
+			"get": map[string]any{
+				"operationId": "getObject",
+				"summary":     "Get an object",
+				"parameters":  []any{ifMatch, ifNoneMatch},
+				"responses": withErrors(map[string]any{
+					"200": map[string]any{
+						"description": "The object",
+						"headers":     etagHeader,
+						"content":     bodyContent(schemaRef("Object")),
+					},
+					"304": map[string]any{"description": "The object matches If-None-Match"},
+					"404": response("The object doesn't exist", "ErrorDetails"),
+					"412": response("The object doesn't match If-Match", "ErrorDetails"),
+				}),
+			},
+			"put": map[string]any{
+				"operationId": "writeObject",
+				"summary":     "Create or replace an object",
+				"description": "Replacing only succeeds if the Id and Revision in the metadata are empty or match the current object.",
+				"parameters": []any{
+					queryParameter("create", "Create the object if it doesn't exist", booleanSchema),
+					queryParameter("replace", "Replace the object if it exists", booleanSchema),
+					ifMatch,
+					ifNoneMatch,
+				},
+				"requestBody": map[string]any{
+					"required": true,
+					"content":  bodyContent(schemaRef("Object")),
+				},
+				"responses": withErrors(map[string]any{
+					"200": map[string]any{
+						"description": "Metadata of the new version",
+						"headers":     etagHeader,
+						"content":     bodyContent(schemaRef("MetadataResponse")),
+					},
+					"404": response("The object doesn't exist and create is false", "ErrorDetails"),
+					"409": response("The object exists and replace is false", "ErrorDetails"),
+					"412": response("The object doesn't have the expected id or revision", "ErrorDetails"),
+					"415": response("Unsupported Content-Type", "ErrorDetails"),
+				}),
+			},
+			"patch": map[string]any{
+				"operationId": "patchObject",
+				"summary":     "Update an object with a JSON merge patch (RFC 7386)",
+				"parameters":  []any{ifMatch, ifNoneMatch},
+				"requestBody": map[string]any{
+					"required": true,
+					"content": map[string]any{
+						"application/merge-patch+json": map[string]any{
+							"schema": map[string]any{"type": "object"},
+						},
+					},
+				},
+				"responses": withErrors(map[string]any{
+					"200": map[string]any{
+						"description": "Metadata of the new version",
+						"headers":     etagHeader,
+						"content":     bodyContent(schemaRef("MetadataResponse")),
+					},
+					"404": response("The object doesn't exist", "ErrorDetails"),
+					"412": response("The object changed or doesn't match the preconditions", "ErrorDetails"),
+					"415": response("The body is not a merge patch", "ErrorDetails"),
+				}),
+			},
+			"delete": map[string]any{
+				"operationId": "deleteObject",
+				"summary":     "Delete an object",
+				"parameters": []any{
+					queryParameter("id", "Only delete the object if it has this id", stringSchema),
+					queryParameter("revision", "Only delete the object if it has this revision, requires id", stringSchema),
+					ifMatch,
+					ifNoneMatch,
+				},
+				"responses": withErrors(map[string]any{
+					"200": response("Metadata of the deleted version", "MetadataResponse"),
+					"404": response("The object doesn't exist", "ErrorDetails"),
+					"412": response("The object doesn't have the expected id or revision", "ErrorDetails"),
+				}),
+			},
+		},
+	}
+
+	var reasonNames []string
+	for reason := range reasonStatus {
+		reasonNames = append(reasonNames, string(reason))
+	}
+	slices.Sort(reasonNames)
+	reasons := []any{}
+	for _, reason := range reasonNames {
+		reasons = append(reasons, reason)
+	}
+	schemas := map[string]any{
+		"Version": map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"version": stringSchema},
+		},
+		"ObjectMetadata": map[string]any{
+			"type":     "object",
+			"required": []any{"Name"},
+			"properties": map[string]any{
+				"Name": stringSchema,
+				"Labels": map[string]any{
+					"type":                 []any{"object", "null"},
+					"additionalProperties": stringSchema,
+				},
+				"CreationTime": map[string]any{
+					"type":        "string",
+					"format":      "date-time",
+					"description": "Set by the server on creation",
+				},
+				"Id": map[string]any{
+					"type":        "string",
+					"description": "Unique string that is assigned on creation",
+				},
+				"Revision": map[string]any{
+					"type":        "string",
+					"description": "Unique string that changes every update",
+				},
+			},
+			"additionalProperties": false,
+		},
+		"Object": map[string]any{
+			"type":     "object",
+			"required": []any{"Kind", "Metadata"},
+			"properties": map[string]any{
+				"Kind": map[string]any{
+					"type":        "string",
+					"description": "Kind in URI format, e.g. \"github.com/remram44/vogon/schemas/Job\"",
+				},
+				"Version":  stringSchema,
+				"Metadata": schemaRef("ObjectMetadata"),
+				"Spec": map[string]any{
+					"description": "Description of the desired state",
+				},
+				"Status": map[string]any{
+					"description": "Information about the current state",
+				},
+			},
+			"additionalProperties": false,
+		},
+		"MetadataResponse": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"Id":       stringSchema,
+				"Revision": stringSchema,
+			},
+		},
+		"ListResult": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"Objects": map[string]any{
+					"type":  []any{"array", "null"},
+					"items": schemaRef("Object"),
+				},
+				"Continue": map[string]any{
+					"type":        "string",
+					"description": "Token to get the next page, empty if there are no more objects",
+				},
+			},
+		},
+		"AccessReview": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"Verb": stringSchema,
+				"Name": stringSchema,
+				"Kind": stringSchema,
+				"User": stringSchema,
+				"Groups": map[string]any{
+					"type":  "array",
+					"items": stringSchema,
+				},
+				"Allowed": map[string]any{"type": "boolean"},
+			},
+		},
+		"BatchOperation": map[string]any{
+			"type":     "object",
+			"required": []any{"Operation"},
+			"properties": map[string]any{
+				"Operation": map[string]any{
+					"type": "string",
+					"enum": []any{"create", "update", "delete"},
+				},
+				"Object": map[string]any{
+					"$ref":        "#/components/schemas/Object",
+					"description": "Object to create or update",
+				},
+				"Replace": map[string]any{
+					"type":        "boolean",
+					"description": "Replace the object if it exists (create only)",
+				},
+				"Name": map[string]any{
+					"type":        "string",
+					"description": "Object to delete",
+				},
+				"Id": map[string]any{
+					"type":        "string",
+					"description": "Only delete the object if it has this id",
+				},
+				"Revision": map[string]any{
+					"type":        "string",
+					"description": "Only delete the object if it has this revision, requires Id",
+				},
+			},
+			"additionalProperties": false,
+		},
+		"BatchRequest": map[string]any{
+			"type":     "object",
+			"required": []any{"Operations"},
+			"properties": map[string]any{
+				"Operations": map[string]any{
+					"type":     "array",
+					"items":    schemaRef("BatchOperation"),
+					"maxItems": maxBatchOperations,
+				},
+			},
+			"additionalProperties": false,
+		},
+		"BatchResponse": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"Results": map[string]any{
+					"type": "array",
+					"items": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"Metadata": schemaRef("MetadataResponse"),
+							"Error":    schemaRef("ErrorDetails"),
+						},
+					},
+				},
+			},
+		},
+		"ErrorDetails": map[string]any{
+			"type":     "object",
+			"required": []any{"message"},
+			"properties": map[string]any{
+				"message":           stringSchema,
+				"reason":            map[string]any{"type": "string", "enum": reasons},
+				"name":              stringSchema,
+				"expected_id":       stringSchema,
+				"actual_id":         stringSchema,
+				"expected_revision": stringSchema,
+				"actual_revision":   stringSchema,
+			},
+		},
+	}
+
+	for _, kindSchema := range kindSchemas {
+		properties := map[string]any{
+			"Kind": map[string]any{"const": kindSchema.Kind},
+		}
+		if kindSchema.Version != "" {
+			properties["Version"] = map[string]any{"const": kindSchema.Version}
+		}
+		if kindSchema.Spec != nil {
+			properties["Spec"] = kindSchema.Spec
+		}
+		if kindSchema.Status != nil {
+			properties["Status"] = kindSchema.Status
+		}
+		schemas[kindSchemaName(kindSchema)] = map[string]any{
+			"allOf": []any{
+				schemaRef("Object"),
+				map[string]any{"properties": properties},
+			},
+		}
+	}
+
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		schemas[name+yamlSchemaSuffix] = yamlSchema(schemas[name].(map[string]any))
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "Vogon API",
+			"version": versioning.Version,
+			"description": "Objects are addressed by name, which can contain slashes. " +
+				"Bodies can be sent and received in any of the supported formats, " +
+				"selected with Content-Type and Accept. " +
+				"In YAML, the fields of objects are lowercase, " +
+				"as described by the schemas with the \".yaml\" suffix.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+		},
+	}
+}
@@ -0,0 +1,149 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/remram44/vogon/internal/codec"
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Check that every "$ref" points to a schema of the document
+func checkRefs(t *testing.T, value any, schemas map[string]any) {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, item := range value {
+			if key == "$ref" {
+				name := strings.TrimPrefix(item.(string), "#/components/schemas/")
+				if _, ok := schemas[name]; !ok {
+					t.Errorf("dangling reference %v", item)
+				}
+			} else {
+				checkRefs(t, item, schemas)
+			}
+		}
+	case []any:
+		for _, item := range value {
+			checkRefs(t, item, schemas)
+		}
+	}
+}
+
+func TestOpenapi(t *testing.T) {
+	server := &ApiServer{
+		db: database.NewInMemoryDatabase(),
+		schemas: []KindSchema{
+			{
+				Kind:    "example.org/Job",
+				Version: "v1",
+				Spec: map[string]any{
+					"type":       "object",
+					"properties": map[string]any{"replicas": map[string]any{"type": "integer"}},
+				},
+			},
+		},
+	}
+
+	response := doConditionalRequest(t, server, "GET", "/_openapi", nil, "")
+	if response.Code != 200 {
+		t.Fatalf("GET: %v", response.Code)
+	}
+	var document map[string]any
+	err := json.NewDecoder(response.Body).Decode(&document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document["openapi"] != "3.1.0" {
+		t.Fatalf("wrong version: %v", document["openapi"])
+	}
+
+	paths := document["paths"].(map[string]any)
+	for path, methods := range map[string][]string{
+		"/_version": {"get"},
+		"/_openapi": {"get"},
+		"/_list":    {"get"},
+		"/_batch":   {"post"},
+		"/_can-i":   {"get"},
+		"/{name}":   {"get", "put", "patch", "delete"},
+	} {
+		item, ok := paths[path].(map[string]any)
+		if !ok {
+			t.Fatalf("missing path %v", path)
+		}
+		for _, method := range methods {
+			if _, ok := item[method]; !ok {
+				t.Fatalf("missing %v %v", method, path)
+			}
+		}
+	}
+	var parameters []string
+	for _, parameter := range paths["/{name}"].(map[string]any)["put"].(map[string]any)["parameters"].([]any) {
+		parameters = append(parameters, parameter.(map[string]any)["name"].(string))
+	}
+	if strings.Join(parameters, ",") != "create,replace,If-Match,If-None-Match" {
+		t.Fatalf("wrong PUT parameters: %v", parameters)
+	}
+
+	schemas := document["components"].(map[string]any)["schemas"].(map[string]any)
+	for _, name := range []string{"Object", "ObjectMetadata", "MetadataResponse", "ListResult", "ErrorDetails", "example.org.Job.v1"} {
+		if _, ok := schemas[name]; !ok {
+			t.Fatalf("missing schema %v", name)
+		}
+	}
+	checkRefs(t, document, schemas)
+
+	// YAML bodies are described with their own field names
+	getContent := paths["/{name}"].(map[string]any)["get"].(map[string]any)["responses"].(map[string]any)["200"].(map[string]any)["content"].(map[string]any)
+	if ref := getContent[codec.Yaml].(map[string]any)["schema"].(map[string]any)["$ref"]; ref != "#/components/schemas/Object.yaml" {
+		t.Fatalf("wrong YAML schema: %v", ref)
+	}
+	if ref := getContent[codec.Json].(map[string]any)["schema"].(map[string]any)["$ref"]; ref != "#/components/schemas/Object" {
+		t.Fatalf("wrong JSON schema: %v", ref)
+	}
+	object := testObject("example")
+	object.Metadata.Labels = map[string]string{"app": "web"}
+	object.Metadata.CreationTime = time.Now()
+	object.Metadata.Id = "id"
+	object.Metadata.Revision = "revision"
+	var buffer bytes.Buffer
+	err = codec.Encode(&buffer, codec.Yaml, object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encoded map[string]any
+	err = yaml.Unmarshal(buffer.Bytes(), &encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties := func(name string) map[string]any {
+		return schemas[name].(map[string]any)["properties"].(map[string]any)
+	}
+	for key := range encoded {
+		if _, ok := properties("Object.yaml")[key]; !ok {
+			t.Errorf("field %v is not in the YAML schema", key)
+		}
+	}
+	for key := range encoded["metadata"].(map[string]any) {
+		if _, ok := properties("ObjectMetadata.yaml")[key]; !ok {
+			t.Errorf("field metadata.%v is not in the YAML schema", key)
+		}
+	}
+	// Kind schemas are converted too, keeping the schema of the spec
+	jobProperties := schemas["example.org.Job.v1.yaml"].(map[string]any)["allOf"].([]any)[1].(map[string]any)["properties"].(map[string]any)
+	spec := jobProperties["spec"].(map[string]any)["properties"].(map[string]any)
+	if _, ok := spec["replicas"]; !ok || jobProperties["kind"] == nil {
+		t.Fatalf("wrong YAML kind schema: %v", jobProperties)
+	}
+
+	response = doConditionalRequest(t, server, "GET", "/_openapi", map[string]string{"Accept": "application/yaml"}, "")
+	var yamlDocument map[string]any
+	err = yaml.NewDecoder(response.Body).Decode(&yamlDocument)
+	if err != nil || yamlDocument["openapi"] != "3.1.0" {
+		t.Fatalf("invalid YAML document: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Apply a JSON merge patch (RFC 7386) to a document decoded from JSON
+//
+// The target is not modified, a new document is returned.
+func mergePatch(target any, patch any) any {
+	patchMap, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	result := make(map[string]any)
+	if targetMap, ok := target.(map[string]any); ok {
+		for key, value := range targetMap {
+			result[key] = value
+		}
+	}
+	for key, value := range patchMap {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = mergePatch(result[key], value)
+		}
+	}
+	return result
+}
+
+// An operation of a JSON patch (RFC 6902)
+type JsonPatchOperation struct {
+	// "add", "remove", "replace", "move", "copy", or "test"
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Source of "move" and "copy"
+	From  string `json:"from,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// Apply a JSON patch (RFC 6902) to a document decoded from JSON
+//
+// The target might be modified, use the returned document.
+func jsonPatch(target any, operations []JsonPatchOperation) (any, error) {
+	var err error
+	for i, operation := range operations {
+		target, err = applyPatchOperation(target, operation)
+		if err != nil {
+			return nil, fmt.Errorf("Patch operation %d (%v %v): %w", i, operation.Op, operation.Path, err)
+		}
+	}
+	return target, nil
+}
+
+func applyPatchOperation(target any, operation JsonPatchOperation) (any, error) {
+	path, err := parseJsonPointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch operation.Op {
+	case "add":
+		return patchAdd(target, path, operation.Value)
+	case "remove":
+		target, _, err = patchRemove(target, path)
+		return target, err
+	case "replace":
+		target, _, err = patchRemove(target, path)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(target, path, operation.Value)
+	case "move":
+		from, err := parseJsonPointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > len(from) && slices.Equal(path[:len(from)], from) {
+			return nil, fmt.Errorf("Cannot move a value into itself")
+		}
+		target, value, err := patchRemove(target, from)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(target, path, value)
+	case "copy":
+		from, err := parseJsonPointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := patchGet(target, from)
+		if err != nil {
+			return nil, err
+		}
+		// Copy the value, so later operations don't change both
+		data, err := json.Marshal(value)
+		if err == nil {
+			err = json.Unmarshal(data, &value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(target, path, value)
+	case "test":
+		value, err := patchGet(target, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, operation.Value) {
+			return nil, fmt.Errorf("Test failed")
+		}
+		return target, nil
+	default:
+		return nil, fmt.Errorf("Unknown operation")
+	}
+}
+
+// Split a JSON pointer (RFC 6901) into reference tokens
+func parseJsonPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("Invalid JSON pointer %#v", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// Parse an index into an array. If end is set, the index can be the length
+// of the array, or "-".
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("Invalid array index %#v", token)
+	}
+	if index > length || (index == length && !end) {
+		return 0, fmt.Errorf("Array index %v out of bounds", index)
+	}
+	return index, nil
+}
+
+func patchGet(target any, path []string) (any, error) {
+	for _, token := range path {
+		switch node := target.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("No member %#v", token)
+			}
+			target = value
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			target = node[index]
+		default:
+			return nil, fmt.Errorf("Cannot get %#v from a scalar", token)
+		}
+	}
+	return target, nil
+}
+
+// Change the container holding the last element of the path
+func patchParent(target any, path []string, change func(parent any, token string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return change(target, path[0])
+	}
+	switch node := target.(type) {
+	case map[string]any:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("No member %#v", path[0])
+		}
+		child, err := patchParent(child, path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = child
+		return node, nil
+	case []any:
+		index, err := arrayIndex(path[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := patchParent(node[index], path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = child
+		return node, nil
+	default:
+		return nil, fmt.Errorf("Cannot get %#v from a scalar", path[0])
+	}
+}
+
+func patchAdd(target any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return patchParent(target, path, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			node[token] = value
+			return node, nil
+		case []any:
+			index, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			return slices.Insert(node, index, value), nil
+		default:
+			return nil, fmt.Errorf("Cannot add %#v to a scalar", token)
+		}
+	})
+}
+
+// Remove a value, returns the new document and the removed value
+func patchRemove(target any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("Cannot remove the whole document")
+	}
+	var removed any
+	target, err := patchParent(target, path, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("No member %#v", token)
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[index]
+			return slices.Delete(node, index, index+1), nil
+		default:
+			return nil, fmt.Errorf("Cannot remove %#v from a scalar", token)
+		}
+	})
+	return target, removed, err
+}
@@ -0,0 +1,64 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJsonPatch(t *testing.T) {
+	document := `{"a": {"b": [1, 2, 3]}, "c~/d": "e"}`
+	for _, test := range []struct {
+		patch    string
+		expected string
+	}{
+		{`[{"op": "add", "path": "/f", "value": {"g": null}}]`, `{"a": {"b": [1, 2, 3]}, "c~/d": "e", "f": {"g": null}}`},
+		{`[{"op": "add", "path": "/a/b/1", "value": 4}]`, `{"a": {"b": [1, 4, 2, 3]}, "c~/d": "e"}`},
+		{`[{"op": "add", "path": "/a/b/-", "value": 4}]`, `{"a": {"b": [1, 2, 3, 4]}, "c~/d": "e"}`},
+		{`[{"op": "add", "path": "", "value": [1]}]`, `[1]`},
+		{`[{"op": "remove", "path": "/a/b/0"}]`, `{"a": {"b": [2, 3]}, "c~/d": "e"}`},
+		{`[{"op": "remove", "path": "/c~0~1d"}]`, `{"a": {"b": [1, 2, 3]}}`},
+		{`[{"op": "replace", "path": "/a/b/2", "value": "x"}]`, `{"a": {"b": [1, 2, "x"]}, "c~/d": "e"}`},
+		{`[{"op": "move", "from": "/a/b", "path": "/b"}]`, `{"a": {}, "b": [1, 2, 3], "c~/d": "e"}`},
+		{`[{"op": "copy", "from": "/a/b", "path": "/b"}, {"op": "remove", "path": "/b/0"}]`, `{"a": {"b": [1, 2, 3]}, "b": [2, 3], "c~/d": "e"}`},
+		{`[{"op": "test", "path": "/a/b", "value": [1, 2, 3]}, {"op": "remove", "path": "/a"}]`, `{"c~/d": "e"}`},
+		// Errors
+		{`[{"op": "test", "path": "/a/b/0", "value": 2}]`, ``},
+		{`[{"op": "remove", "path": "/x"}]`, ``},
+		{`[{"op": "replace", "path": "/x", "value": 1}]`, ``},
+		{`[{"op": "add", "path": "/a/b/4", "value": 1}]`, ``},
+		{`[{"op": "add", "path": "/a/b/01", "value": 1}]`, ``},
+		{`[{"op": "add", "path": "/x/y", "value": 1}]`, ``},
+		{`[{"op": "move", "from": "/a", "path": "/a/x"}]`, ``},
+		{`[{"op": "add", "path": "a", "value": 1}]`, ``},
+		{`[{"op": "delete", "path": "/a"}]`, ``},
+	} {
+		var target any
+		if err := json.Unmarshal([]byte(document), &target); err != nil {
+			t.Fatal(err)
+		}
+		var patch []JsonPatchOperation
+		if err := json.Unmarshal([]byte(test.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+		result, err := jsonPatch(target, patch)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("no error for %v", test.patch)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.patch, err)
+			continue
+		}
+		var expected any
+		if err := json.Unmarshal([]byte(test.expected), &expected); err != nil {
+			t.Fatal(err)
+		}
+		actual, _ := json.Marshal(result)
+		wanted, _ := json.Marshal(expected)
+		if string(actual) != string(wanted) {
+			t.Errorf("%v: %s", test.patch, actual)
+		}
+	}
+}
@@ -0,0 +1,983 @@
+package apiserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Kinds of the objects granting access, see RoleSpec and RoleBindingSpec
+const (
+	RoleKind        = "github.com/remram44/vogon/schemas/Role"
+	RoleBindingKind = "github.com/remram44/vogon/schemas/RoleBinding"
+)
+
+const (
+	VerbGet    = "get"
+	VerbList   = "list"
+	VerbWatch  = "watch"
+	VerbCreate = "create"
+	VerbUpdate = "update"
+	VerbDelete = "delete"
+)
+
+var verbs = []string{VerbGet, VerbList, VerbWatch, VerbCreate, VerbUpdate, VerbDelete}
+
+type AuthorizationConfig struct {
+	// Users and groups allowed everything, e.g. to create the first bindings
+	AdminUsers  []string `yaml:"admin_users"`
+	AdminGroups []string `yaml:"admin_groups"`
+}
+
+// Spec of a Role object, a set of permissions that can be granted by
+// bindings in the same namespace or under it
+type RoleSpec struct {
+	Rules []RoleRule `json:"rules"`
+}
+
+type RoleRule struct {
+	// Verbs allowed, "*" for all
+	Verbs []string `json:"verbs"`
+	// Names relative to the namespace of the binding, the rule applies to
+	// those objects and everything under them. Empty for the whole
+	// namespace.
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Kinds of the objects, empty or "*" for all
+	Kinds []string `json:"kinds,omitempty"`
+}
+
+// Spec of a RoleBinding object, granting a role on the objects under the
+// binding's namespace. A binding named "team-a/developers" applies to
+// "team-a/job" and "team-a/sub/job", but not to "team-a" itself. Bindings
+// at the top level apply to every object.
+type RoleBindingSpec struct {
+	// Name of the role, relative to the binding's namespace or one of its
+	// parents, the closest one is used
+	Role   string   `json:"role"`
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Decode the spec of an object, such as a Role or a webhook
+func decodeSpec(object database.Object, spec any) error {
+	data, err := json.Marshal(object.Spec)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(spec)
+	if err != nil {
+		return &database.Invalid{
+			Reason:  database.ReasonInvalid,
+			Name:    object.Metadata.Name,
+			Message: fmt.Sprintf("Invalid spec for %v: %v", object.Kind, err),
+		}
+	}
+	return nil
+}
+
+// Check the spec of a Role or RoleBinding before it is written
+func validateRbacObject(object database.Object) error {
+	invalid := func(message string) error {
+		return &database.Invalid{
+			Reason:  database.ReasonInvalid,
+			Name:    object.Metadata.Name,
+			Message: message,
+		}
+	}
+	switch object.Kind {
+	case RoleKind:
+		var spec RoleSpec
+		if err := decodeSpec(object, &spec); err != nil {
+			return err
+		}
+		for _, rule := range spec.Rules {
+			if len(rule.Verbs) == 0 {
+				return invalid("Rule without verbs")
+			}
+			for _, verb := range rule.Verbs {
+				if verb != "*" && !slices.Contains(verbs, verb) {
+					return invalid(fmt.Sprintf("Unknown verb %#v, expected one of %v", verb, strings.Join(verbs, ", ")))
+				}
+			}
+			for _, prefix := range rule.Prefixes {
+				if err := database.ValidateName(prefix); err != nil {
+					return invalid(fmt.Sprintf("Invalid prefix %#v", prefix))
+				}
+			}
+		}
+	case RoleBindingKind:
+		var spec RoleBindingSpec
+		if err := decodeSpec(object, &spec); err != nil {
+			return err
+		}
+		if err := database.ValidateName(spec.Role); err != nil {
+			return invalid(fmt.Sprintf("Invalid role %#v", spec.Role))
+		}
+	}
+	return nil
+}
+
+// The namespace an object is in, "" for top-level objects
+func namespaceOf(name string) string {
+	idx := strings.LastIndexByte(name, '/')
+	if idx == -1 {
+		return ""
+	}
+	return name[:idx]
+}
+
+func joinName(namespace string, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// A rule granted in a namespace by a binding
+type grant struct {
+	users  []string
+	groups []string
+	verbs  []string
+	kinds  []string
+	// Absolute names, or the namespace if empty
+	prefixes  []string
+	namespace string
+}
+
+func (g *grant) matchesIdentity(identity Identity) bool {
+	if slices.Contains(g.users, identity.User) {
+		return true
+	}
+	for _, group := range identity.Groups {
+		if slices.Contains(g.groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *grant) matchesVerb(verb string) bool {
+	return slices.Contains(g.verbs, "*") || slices.Contains(g.verbs, verb)
+}
+
+// An empty kind matches if the grant applies to any kind
+func (g *grant) matchesKind(kind string) bool {
+	return len(g.kinds) == 0 || slices.Contains(g.kinds, "*") || kind == "" || slices.Contains(g.kinds, kind)
+}
+
+func (g *grant) coversName(name string) bool {
+	if len(g.prefixes) == 0 {
+		return database.HasPrefix(name, g.namespace)
+	}
+	for _, prefix := range g.prefixes {
+		if name == prefix || database.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the grant covers any object under the list prefix
+func (g *grant) overlapsPrefix(prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	// Either path is under the other
+	overlaps := func(path string) bool {
+		return path == "" ||
+			path == prefix ||
+			database.HasPrefix(path, prefix) ||
+			database.HasPrefix(prefix, path)
+	}
+	if len(g.prefixes) == 0 {
+		return overlaps(g.namespace)
+	}
+	for _, path := range g.prefixes {
+		if overlaps(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the grant covers the path and everything under it, or only what is
+// under it if withPath is false
+func (g *grant) coversTree(path string, withPath bool) bool {
+	if len(g.prefixes) == 0 {
+		return (path == g.namespace && !withPath) || database.HasPrefix(path, g.namespace)
+	}
+	for _, prefix := range g.prefixes {
+		if path == prefix || database.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// All the grants from the Role and RoleBinding objects
+type rbacPolicy struct {
+	roles  map[string]RoleSpec
+	grants []grant
+}
+
+// Find the role a binding in the namespace refers to, the closest one with
+// that name
+func (p *rbacPolicy) findRole(namespace string, name string) (RoleSpec, bool) {
+	for search := namespace; ; search = namespaceOf(search) {
+		role, found := p.roles[joinName(search, name)]
+		if found || search == "" {
+			return role, found
+		}
+	}
+}
+
+// Read all the objects of a kind, going through every page
+func listKind(ctx context.Context, db database.Database, kind string) ([]database.Object, error) {
+	selector, err := database.ParseSelector("kind=" + kind)
+	if err != nil {
+		return nil, err
+	}
+	options := database.ListOptions{
+		Limit:    maxListLimit,
+		Selector: selector,
+	}
+	var objects []database.Object
+	for {
+		result, err := db.List(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, result.Objects...)
+		if result.Continue == "" {
+			return objects, nil
+		}
+		options.Continue = result.Continue
+	}
+}
+
+// How long objects loaded by a kindTracker are used before listing them again,
+// so that files edited by hand are picked up even if nothing reads them
+const kindTrackerMaxAge = 30 * time.Second
+
+// Lists objects of some kinds, then tells whether they might have changed by
+// following the change feed of the database, so that changes made by other
+// processes sharing it are seen too
+type kindTracker struct {
+	db database.Database
+	// Nil if the database doesn't have one, then only invalidate() works
+	feed     database.ChangeFeed
+	sequence uint64
+	loaded   time.Time
+	kinds    map[string]struct{}
+	names    map[string]struct{}
+}
+
+func newKindTracker(db database.Database) *kindTracker {
+	feed, _ := db.(database.ChangeFeed)
+	return &kindTracker{db: db, feed: feed}
+}
+
+// Start tracking the changes, call before listing the objects
+func (t *kindTracker) reset(ctx context.Context) error {
+	t.kinds = make(map[string]struct{})
+	t.names = make(map[string]struct{})
+	t.loaded = time.Now()
+	if t.feed == nil {
+		return nil
+	}
+	sequence, err := t.feed.LastSequence(ctx)
+	if err != nil {
+		return err
+	}
+	t.sequence = sequence
+	return nil
+}
+
+// Read all the objects of a kind and track them
+func (t *kindTracker) list(ctx context.Context, kind string) ([]database.Object, error) {
+	objects, err := listKind(ctx, t.db, kind)
+	if err != nil {
+		return nil, err
+	}
+	t.kinds[kind] = struct{}{}
+	for _, object := range objects {
+		t.names[object.Metadata.Name] = struct{}{}
+	}
+	return objects, nil
+}
+
+// Whether objects of the kinds listed might have changed since
+func (t *kindTracker) changed(ctx context.Context) (bool, error) {
+	if time.Since(t.loaded) > kindTrackerMaxAge {
+		return true, nil
+	}
+	if t.feed == nil {
+		return false, nil
+	}
+	entries, err := t.feed.ChangesSince(ctx, t.sequence)
+	var expired *database.Expired
+	if errors.As(err, &expired) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if _, ok := t.names[entry.Name]; ok {
+			return true, nil
+		}
+		if entry.Operation == database.JournalWrite {
+			object, err := t.db.Get(ctx, entry.Name)
+			var doesNotExist *database.DoesNotExist
+			if errors.As(err, &doesNotExist) {
+				continue
+			} else if err != nil {
+				return false, err
+			}
+			if _, ok := t.kinds[object.Kind]; ok {
+				return true, nil
+			}
+		}
+	}
+	if len(entries) > 0 {
+		t.sequence = entries[len(entries)-1].Sequence
+	}
+	return false, nil
+}
+
+// Read the roles and bindings from the database
+func loadRbacPolicy(ctx context.Context, tracker *kindTracker) (*rbacPolicy, error) {
+	roleObjects, err := tracker.list(ctx, RoleKind)
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string]RoleSpec)
+	for _, object := range roleObjects {
+		var spec RoleSpec
+		if err := decodeSpec(object, &spec); err != nil {
+			slog.Warn("ignoring invalid role", "name", object.Metadata.Name, "error", err)
+			continue
+		}
+		roles[object.Metadata.Name] = spec
+	}
+
+	bindings, err := tracker.list(ctx, RoleBindingKind)
+	if err != nil {
+		return nil, err
+	}
+	policy := &rbacPolicy{roles: roles}
+	for _, object := range bindings {
+		var spec RoleBindingSpec
+		if err := decodeSpec(object, &spec); err != nil {
+			slog.Warn("ignoring invalid role binding", "name", object.Metadata.Name, "error", err)
+			continue
+		}
+		namespace := namespaceOf(object.Metadata.Name)
+
+		role, found := policy.findRole(namespace, spec.Role)
+		if !found {
+			slog.Warn("role binding refers to unknown role", "name", object.Metadata.Name, "role", spec.Role)
+			continue
+		}
+
+		for _, rule := range role.Rules {
+			g := grant{
+				users:     spec.Users,
+				groups:    spec.Groups,
+				verbs:     rule.Verbs,
+				kinds:     rule.Kinds,
+				namespace: namespace,
+			}
+			for _, prefix := range rule.Prefixes {
+				g.prefixes = append(g.prefixes, joinName(namespace, prefix))
+			}
+			policy.grants = append(policy.grants, g)
+		}
+	}
+	return policy, nil
+}
+
+// Whether the user can do this to the object. If kind is empty, whether the
+// user can do it to an object of some kind.
+func (p *rbacPolicy) allows(identity Identity, verb string, name string, kind string) bool {
+	for i := range p.grants {
+		g := &p.grants[i]
+		if g.matchesIdentity(identity) && g.matchesVerb(verb) && g.matchesKind(kind) && g.coversName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the user already has everything the rule grants when bound in the
+// namespace, so that they can give it to others
+func (p *rbacPolicy) allowsRule(identity Identity, rule RoleRule, namespace string) bool {
+	ruleVerbs := rule.Verbs
+	if slices.Contains(ruleVerbs, "*") {
+		ruleVerbs = verbs
+	}
+	allKinds := len(rule.Kinds) == 0 || slices.Contains(rule.Kinds, "*")
+	matchesKind := func(g *grant, kind string) bool {
+		if allKinds {
+			return len(g.kinds) == 0 || slices.Contains(g.kinds, "*")
+		}
+		return g.matchesKind(kind)
+	}
+	covers := func(verb string, kind string, path string, withPath bool) bool {
+		for i := range p.grants {
+			g := &p.grants[i]
+			if g.matchesIdentity(identity) && g.matchesVerb(verb) && matchesKind(g, kind) && g.coversTree(path, withPath) {
+				return true
+			}
+		}
+		return false
+	}
+	kinds := rule.Kinds
+	if allKinds {
+		kinds = []string{"*"}
+	}
+	for _, verb := range ruleVerbs {
+		for _, kind := range kinds {
+			if len(rule.Prefixes) == 0 {
+				if !covers(verb, kind, namespace, false) {
+					return false
+				}
+			}
+			for _, prefix := range rule.Prefixes {
+				if !covers(verb, kind, joinName(namespace, prefix), true) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Whether the user can list some objects under the prefix
+func (p *rbacPolicy) allowsSomeUnder(identity Identity, verb string, prefix string) bool {
+	for i := range p.grants {
+		g := &p.grants[i]
+		if g.matchesIdentity(identity) && g.matchesVerb(verb) && g.overlapsPrefix(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// How often to check whether roles or bindings were changed by another
+// process. Changes made through this server apply immediately.
+const policyCheckInterval = time.Second
+
+// Checks requests against the roles and bindings in the database
+type authorizer struct {
+	adminUsers  []string
+	adminGroups []string
+
+	// Loaded on demand, reset when roles or bindings change. Requests only
+	// read it, the mutex is held by the one request checking for changes or
+	// reloading it.
+	policy        atomic.Pointer[rbacPolicy]
+	checked       atomic.Int64
+	checkInterval time.Duration
+	mutex         sync.Mutex
+	tracker       *kindTracker
+}
+
+func newAuthorizer(db database.Database, config AuthorizationConfig) *authorizer {
+	return &authorizer{
+		tracker:       newKindTracker(db),
+		checkInterval: policyCheckInterval,
+		adminUsers:    config.AdminUsers,
+		adminGroups:   config.AdminGroups,
+	}
+}
+
+func (a *authorizer) isAdmin(identity Identity) bool {
+	if slices.Contains(a.adminUsers, identity.User) {
+		return true
+	}
+	for _, group := range identity.Groups {
+		if slices.Contains(a.adminGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *authorizer) recentlyChecked() bool {
+	return time.Since(time.Unix(0, a.checked.Load())) < a.checkInterval
+}
+
+func (a *authorizer) getPolicy(ctx context.Context) (*rbacPolicy, error) {
+	policy := a.policy.Load()
+	if policy != nil {
+		// Use the current policy while another request checks it
+		if a.recentlyChecked() || !a.mutex.TryLock() {
+			return policy, nil
+		}
+	} else {
+		// Wait for the request loading it
+		a.mutex.Lock()
+	}
+	defer a.mutex.Unlock()
+	return a.refresh(ctx)
+}
+
+// Reload the policy if it changed. Must be called with the mutex held.
+func (a *authorizer) refresh(ctx context.Context) (*rbacPolicy, error) {
+	policy := a.policy.Load()
+	if policy != nil {
+		if a.recentlyChecked() {
+			return policy, nil
+		}
+		changed, err := a.tracker.changed(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			a.checked.Store(time.Now().UnixNano())
+			return policy, nil
+		}
+	}
+	err := a.tracker.reset(ctx)
+	if err != nil {
+		return nil, err
+	}
+	policy, err = loadRbacPolicy(ctx, a.tracker)
+	if err != nil {
+		return nil, err
+	}
+	a.policy.Store(policy)
+	a.checked.Store(time.Now().UnixNano())
+	return policy, nil
+}
+
+// Forget the policy after roles or bindings were written, without waiting for
+// the change feed
+func (a *authorizer) invalidate() {
+	// Wait for a reload in progress, which might not include the change
+	a.mutex.Lock()
+	a.policy.Store(nil)
+	a.mutex.Unlock()
+}
+
+// Whether the user can do this to the object. If kind is empty, whether the
+// user can do it to an object of some kind.
+func (a *authorizer) allowed(ctx context.Context, identity Identity, verb string, name string, kind string) (bool, error) {
+	if a.isAdmin(identity) {
+		return true, nil
+	}
+	policy, err := a.getPolicy(ctx)
+	if err != nil {
+		return false, err
+	}
+	return policy.allows(identity, verb, name, kind), nil
+}
+
+func forbidden(identity Identity, verb string, name string) error {
+	return &database.Forbidden{
+		Name:    name,
+		Message: fmt.Sprintf("User %#v can't %v %#v", identity.User, verb, name),
+	}
+}
+
+// Return a *database.Forbidden error unless the user making the request can
+// do this to the object
+func (a *authorizer) check(ctx context.Context, verb string, name string, kind string) error {
+	identity := identityFromContext(ctx)
+	ok, err := a.allowed(ctx, identity, verb, name, kind)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return forbidden(identity, verb, name)
+	}
+	return nil
+}
+
+type readVerbKey struct{}
+
+// Have Get and List check a different verb, e.g. for watches
+func withReadVerb(ctx context.Context, verb string) context.Context {
+	return context.WithValue(ctx, readVerbKey{}, verb)
+}
+
+func readVerbFromContext(ctx context.Context, defaultVerb string) string {
+	verb, ok := ctx.Value(readVerbKey{}).(string)
+	if !ok {
+		return defaultVerb
+	}
+	return verb
+}
+
+// Only gives access to the objects the user making the request is allowed
+// to, going by the identity in the context
+type authorizedDatabase struct {
+	db    database.Database
+	authz *authorizer
+}
+
+func isRbacKind(kind string) bool {
+	return kind == RoleKind || kind == RoleBindingKind
+}
+
+// Check that the user can do this to an existing object. If they can't
+// because of its kind, it is reported as missing, with the same message as
+// the database, so that errors don't reveal objects the user can't see.
+func (d *authorizedDatabase) checkExisting(ctx context.Context, verb string, existing database.Object, message string) error {
+	name := existing.Metadata.Name
+	err := d.authz.check(ctx, verb, name, existing.Kind)
+	var forbidden *database.Forbidden
+	if errors.As(err, &forbidden) {
+		return &database.DoesNotExist{
+			Name:    name,
+			Message: fmt.Sprintf(message, name),
+		}
+	}
+	return err
+}
+
+// Get the existing object, checking first that the user could do something
+// to it, so that errors don't reveal what exists
+func (d *authorizedDatabase) getExisting(ctx context.Context, verb string, name string) (*database.Object, error) {
+	err := d.authz.check(ctx, verb, name, "")
+	if err != nil {
+		return nil, err
+	}
+	object, err := d.db.Get(ctx, name)
+	var doesNotExist *database.DoesNotExist
+	if errors.As(err, &doesNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &object, nil
+}
+
+// Check that a Role or RoleBinding doesn't grant more than the user making
+// the request already has, so that they can't give themselves more
+func (d *authorizedDatabase) checkGrants(ctx context.Context, object database.Object) error {
+	identity := identityFromContext(ctx)
+	if d.authz.isAdmin(identity) {
+		return nil
+	}
+	policy, err := d.authz.getPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	name := object.Metadata.Name
+	namespace := namespaceOf(name)
+	var rules []RoleRule
+	switch object.Kind {
+	case RoleKind:
+		var spec RoleSpec
+		if err := decodeSpec(object, &spec); err != nil {
+			return err
+		}
+		// The role can be bound anywhere under its namespace, where its
+		// prefixes designate different objects, so the user needs its rules
+		// on the whole namespace
+		for _, rule := range spec.Rules {
+			rule.Prefixes = nil
+			rules = append(rules, rule)
+		}
+	case RoleBindingKind:
+		var spec RoleBindingSpec
+		if err := decodeSpec(object, &spec); err != nil {
+			return err
+		}
+		// A role created later is checked then
+		role, _ := policy.findRole(namespace, spec.Role)
+		rules = role.Rules
+	}
+	for _, rule := range rules {
+		if !policy.allowsRule(identity, rule, namespace) {
+			return &database.Forbidden{
+				Name:    name,
+				Message: fmt.Sprintf("User %#v can't grant permissions they don't have with %#v", identity.User, name),
+			}
+		}
+	}
+	return nil
+}
+
+// Validate a Role or RoleBinding and check what it grants
+func (d *authorizedDatabase) checkRbacObject(ctx context.Context, object database.Object) error {
+	if !isRbacKind(object.Kind) {
+		return nil
+	}
+	err := validateRbacObject(object)
+	if err != nil {
+		return err
+	}
+	return d.checkGrants(ctx, object)
+}
+
+// Webhooks are sent the objects being written, so only admins can configure
+// them
+func (d *authorizedDatabase) checkWebhook(ctx context.Context, verb string, name string, kind string) error {
+	identity := identityFromContext(ctx)
+	if isWebhookKind(kind) && !d.authz.isAdmin(identity) {
+		return forbidden(identity, verb, name)
+	}
+	return nil
+}
+
+// Check a create, returns whether the policy might change
+func (d *authorizedDatabase) checkCreate(ctx context.Context, object database.Object, replace bool) (bool, error) {
+	name := object.Metadata.Name
+	err := d.authz.check(ctx, VerbCreate, name, object.Kind)
+	if err == nil {
+		err = d.checkWebhook(ctx, VerbCreate, name, object.Kind)
+	}
+	if err != nil {
+		return false, err
+	}
+	changesPolicy := isRbacKind(object.Kind)
+	if replace {
+		existing, err := d.getExisting(ctx, VerbUpdate, name)
+		if err != nil {
+			return false, err
+		}
+		if existing != nil {
+			// Creating would work if it didn't exist, so there is no point
+			// hiding it
+			err = d.authz.check(ctx, VerbUpdate, name, existing.Kind)
+			if err == nil {
+				err = d.authz.check(ctx, VerbUpdate, name, object.Kind)
+			}
+			if err == nil {
+				err = d.checkWebhook(ctx, VerbUpdate, name, existing.Kind)
+			}
+			if err != nil {
+				return false, err
+			}
+			changesPolicy = changesPolicy || isRbacKind(existing.Kind)
+		}
+	}
+	return changesPolicy, d.checkRbacObject(ctx, object)
+}
+
+// Check an update, returns whether the policy might change
+func (d *authorizedDatabase) checkUpdate(ctx context.Context, object database.Object) (bool, error) {
+	name := object.Metadata.Name
+	err := d.authz.check(ctx, VerbUpdate, name, object.Kind)
+	if err == nil {
+		err = d.checkWebhook(ctx, VerbUpdate, name, object.Kind)
+	}
+	if err != nil {
+		return false, err
+	}
+	existing, err := d.getExisting(ctx, VerbUpdate, name)
+	if err != nil {
+		return false, err
+	}
+	changesPolicy := isRbacKind(object.Kind)
+	if existing != nil {
+		err = d.checkExisting(ctx, VerbUpdate, *existing, "Object %s does not exist, cannot update")
+		if err == nil {
+			err = d.checkWebhook(ctx, VerbUpdate, name, existing.Kind)
+		}
+		if err != nil {
+			return false, err
+		}
+		changesPolicy = changesPolicy || isRbacKind(existing.Kind)
+	}
+	return changesPolicy, d.checkRbacObject(ctx, object)
+}
+
+// Check a delete, returns whether the policy might change
+func (d *authorizedDatabase) checkDelete(ctx context.Context, name string) (bool, error) {
+	existing, err := d.getExisting(ctx, VerbDelete, name)
+	if err != nil || existing == nil {
+		return false, err
+	}
+	err = d.checkExisting(ctx, VerbDelete, *existing, "Object %s does not exist")
+	if err == nil {
+		err = d.checkWebhook(ctx, VerbDelete, name, existing.Kind)
+	}
+	if err != nil {
+		return false, err
+	}
+	return isRbacKind(existing.Kind), nil
+}
+
+// Remove the id and revision of the existing object from a conflict, unless
+// the user can get it. That the object exists can't be hidden, since creating
+// it would work otherwise.
+func (d *authorizedDatabase) hideConflict(ctx context.Context, err error) error {
+	var conflict *database.Conflict
+	if !errors.As(err, &conflict) || conflict.Reason != database.ReasonAlreadyExists {
+		return err
+	}
+	_, getErr := d.Get(withReadVerb(ctx, VerbGet), conflict.Name)
+	if getErr != nil {
+		conflict.ActualId = ""
+		conflict.ActualRevision = ""
+	}
+	return err
+}
+
+func (d *authorizedDatabase) Create(ctx context.Context, object database.Object, replace bool) (database.MetadataResponse, error) {
+	changesPolicy, err := d.checkCreate(ctx, object, replace)
+	if err != nil {
+		return database.MetadataResponse{}, err
+	}
+	if changesPolicy {
+		defer d.authz.invalidate()
+	}
+	response, err := d.db.Create(ctx, object, replace)
+	return response, d.hideConflict(ctx, err)
+}
+
+func (d *authorizedDatabase) Update(ctx context.Context, object database.Object) (database.MetadataResponse, error) {
+	changesPolicy, err := d.checkUpdate(ctx, object)
+	if err != nil {
+		return database.MetadataResponse{}, err
+	}
+	if changesPolicy {
+		defer d.authz.invalidate()
+	}
+	return d.db.Update(ctx, object)
+}
+
+func (d *authorizedDatabase) Get(ctx context.Context, name string) (database.Object, error) {
+	verb := readVerbFromContext(ctx, VerbGet)
+	err := d.authz.check(ctx, verb, name, "")
+	if err != nil {
+		return database.Object{}, err
+	}
+	object, err := d.db.Get(ctx, name)
+	if err != nil {
+		return object, err
+	}
+	err = d.checkExisting(ctx, verb, object, "Object %s does not exist")
+	if err != nil {
+		return database.Object{}, err
+	}
+	return object, nil
+}
+
+// Only returns the objects the user can list, so pages might be smaller than
+// the limit
+func (d *authorizedDatabase) List(ctx context.Context, options database.ListOptions) (database.ListResult, error) {
+	identity := identityFromContext(ctx)
+	verb := readVerbFromContext(ctx, VerbList)
+	if d.authz.isAdmin(identity) {
+		return d.db.List(ctx, options)
+	}
+	policy, err := d.authz.getPolicy(ctx)
+	if err != nil {
+		return database.ListResult{}, err
+	}
+	if !policy.allowsSomeUnder(identity, verb, options.Prefix) {
+		return database.ListResult{}, forbidden(identity, verb, options.Prefix)
+	}
+
+	result, err := d.db.List(ctx, options)
+	if err != nil {
+		return result, err
+	}
+	allowed := make([]database.Object, 0, len(result.Objects))
+	for _, object := range result.Objects {
+		if policy.allows(identity, verb, object.Metadata.Name, object.Kind) {
+			allowed = append(allowed, object)
+		}
+	}
+	result.Objects = allowed
+	return result, nil
+}
+
+func (d *authorizedDatabase) Delete(ctx context.Context, name string, id string, revision string) (database.MetadataResponse, error) {
+	changesPolicy, err := d.checkDelete(ctx, name)
+	if err != nil {
+		return database.MetadataResponse{}, err
+	}
+	if changesPolicy {
+		defer d.authz.invalidate()
+	}
+	return d.db.Delete(ctx, name, id, revision)
+}
+
+func (d *authorizedDatabase) Batch(ctx context.Context, operations []database.BatchOperation) ([]database.MetadataResponse, error) {
+	changesPolicy := false
+	for i, op := range operations {
+		var changes bool
+		var err error
+		switch op.Operation {
+		case database.BatchCreate:
+			changes, err = d.checkCreate(ctx, op.Object, op.Replace)
+		case database.BatchUpdate:
+			changes, err = d.checkUpdate(ctx, op.Object)
+		case database.BatchDelete:
+			changes, err = d.checkDelete(ctx, op.Name)
+		}
+		if err != nil {
+			return nil, &database.BatchError{Index: i, Err: err}
+		}
+		changesPolicy = changesPolicy || changes
+	}
+	if changesPolicy {
+		defer d.authz.invalidate()
+	}
+	responses, err := d.db.Batch(ctx, operations)
+	return responses, d.hideConflict(ctx, err)
+}
+
+// Answer to an access review, whether the user making the request can do
+// something
+type accessReview struct {
+	Verb    string
+	Name    string
+	Kind    string `json:",omitempty" yaml:",omitempty"`
+	User    string
+	Groups  []string `json:",omitempty" yaml:",omitempty"`
+	Allowed bool
+}
+
+func (s *ApiServer) serveCanI(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	identity := identityFromContext(ctx)
+	review := accessReview{
+		Verb:   query.Get("verb"),
+		Name:   query.Get("name"),
+		Kind:   query.Get("kind"),
+		User:   identity.User,
+		Groups: identity.Groups,
+	}
+	if !slices.Contains(verbs, review.Verb) {
+		sendMessage(res, req, 400, fmt.Sprintf("Invalid verb, expected one of %v", strings.Join(verbs, ", ")))
+		return
+	}
+	if err := database.ValidateName(review.Name); err != nil {
+		sendError(res, req, err)
+		return
+	}
+
+	if s.authz == nil {
+		review.Allowed = true
+	} else {
+		var err error
+		review.Allowed, err = s.authz.allowed(ctx, identity, review.Verb, review.Name, review.Kind)
+		if err != nil {
+			sendError(res, req, err)
+			return
+		}
+	}
+	err := sendObject(res, req, 200, review)
+	if err != nil {
+		slog.Info("CAN-I send error", "error", err)
+	}
+}
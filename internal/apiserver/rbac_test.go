@@ -0,0 +1,454 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/remram44/vogon/internal/client"
+	"github.com/remram44/vogon/internal/database"
+)
+
+func rbacObject(kind string, name string, spec any) database.Object {
+	return database.Object{
+		Kind:    kind,
+		Version: "v1",
+		Metadata: database.ObjectMetadata{
+			Name: name,
+		},
+		Spec: spec,
+	}
+}
+
+func TestRbac(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewInMemoryDatabase()
+	authz := newAuthorizer(db, AuthorizationConfig{AdminUsers: []string{"root"}})
+	authorized := &authorizedDatabase{db: db, authz: authz}
+	root := withIdentity(ctx, Identity{User: "root"})
+	alice := withIdentity(ctx, Identity{User: "alice", Groups: []string{"dev"}})
+	bob := withIdentity(ctx, Identity{User: "bob"})
+
+	mustCreate := func(ctx context.Context, object database.Object) {
+		t.Helper()
+		_, err := authorized.Create(ctx, object, false)
+		if err != nil {
+			t.Fatalf("create %v: %v", object.Metadata.Name, err)
+		}
+	}
+	isForbidden := func(err error) bool {
+		var forbidden *database.Forbidden
+		return errors.As(err, &forbidden)
+	}
+	job := func(name string) database.Object {
+		object := testObject(name)
+		object.Kind = "example.org/Job"
+		return object
+	}
+
+	mustCreate(root, testObject("team-a/example"))
+	mustCreate(root, testObject("team-b/example"))
+	mustCreate(root, rbacObject(RoleKind, "reader", map[string]any{
+		"rules": []any{
+			map[string]any{"verbs": []any{"get", "list", "watch"}},
+		},
+	}))
+	mustCreate(root, rbacObject(RoleKind, "team-a/job-editor", map[string]any{
+		"rules": []any{
+			map[string]any{
+				"verbs":    []any{"create", "update", "delete"},
+				"prefixes": []any{"jobs"},
+				"kinds":    []any{"example.org/Job"},
+			},
+		},
+	}))
+	// Uses the role from the top level
+	mustCreate(root, rbacObject(RoleBindingKind, "team-a/readers", map[string]any{
+		"role":   "reader",
+		"groups": []any{"dev"},
+	}))
+	mustCreate(root, rbacObject(RoleBindingKind, "team-a/editors", map[string]any{
+		"role":  "job-editor",
+		"users": []any{"alice"},
+	}))
+
+	// Invalid roles are rejected
+	_, err := authorized.Create(root, rbacObject(RoleKind, "bad", map[string]any{
+		"rules": []any{map[string]any{"verbs": []any{"destroy"}}},
+	}), false)
+	var invalid *database.Invalid
+	if !errors.As(err, &invalid) {
+		t.Fatalf("invalid role: %v", err)
+	}
+
+	// Reading
+	_, err = authorized.Get(alice, "team-a/example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"team-b/example", "team-a", "team-b/missing"} {
+		_, err = authorized.Get(alice, name)
+		if !isForbidden(err) {
+			t.Fatalf("alice get %v: %v", name, err)
+		}
+	}
+	_, err = authorized.Get(bob, "team-a/example")
+	if !isForbidden(err) {
+		t.Fatalf("bob get: %v", err)
+	}
+
+	// Writing, limited to jobs under team-a/jobs
+	_, err = authorized.Create(alice, job("team-a/jobs/one"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authorized.Create(alice, job("team-a/jobs"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range []database.Object{
+		testObject("team-a/jobs/two"),
+		job("team-a/other"),
+		job("team-b/jobs/one"),
+		rbacObject(RoleBindingKind, "team-a/jobs/escalate", map[string]any{"role": "reader"}),
+	} {
+		_, err = authorized.Create(alice, object, true)
+		if !isForbidden(err) {
+			t.Fatalf("alice create %v: %v", object.Metadata.Name, err)
+		}
+	}
+	// Can't replace an object of another kind with a job
+	mustCreate(root, testObject("team-a/jobs/example"))
+	_, err = authorized.Create(alice, job("team-a/jobs/example"), true)
+	if !isForbidden(err) {
+		t.Fatalf("alice replace: %v", err)
+	}
+	// Objects of other kinds look the same as missing ones
+	for _, name := range []string{"team-a/jobs/example", "team-a/jobs/missing"} {
+		_, err = authorized.Delete(alice, name, "", "")
+		var doesNotExist *database.DoesNotExist
+		if !errors.As(err, &doesNotExist) || err.Error() != fmt.Sprintf("Object %s does not exist", name) {
+			t.Fatalf("alice delete %v: %v", name, err)
+		}
+	}
+	_, err = authorized.Update(alice, job("team-a/jobs/example"))
+	var doesNotExist *database.DoesNotExist
+	if !errors.As(err, &doesNotExist) {
+		t.Fatalf("alice update: %v", err)
+	}
+
+	// Batches are checked operation by operation
+	_, err = authorized.Batch(alice, []database.BatchOperation{
+		{Operation: database.BatchCreate, Object: job("team-a/jobs/three")},
+		{Operation: database.BatchDelete, Name: "team-a/example"},
+	})
+	var batchErr *database.BatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 1 || !isForbidden(err) {
+		t.Fatalf("alice batch: %v", err)
+	}
+
+	// Listing only returns allowed objects
+	for prefix, expected := range map[string][]string{
+		"":            {"team-a/editors", "team-a/example", "team-a/job-editor", "team-a/jobs", "team-a/jobs/example", "team-a/jobs/one", "team-a/readers"},
+		"team-a":      {"team-a/editors", "team-a/example", "team-a/job-editor", "team-a/jobs", "team-a/jobs/example", "team-a/jobs/one", "team-a/readers"},
+		"team-a/jobs": {"team-a/jobs/example", "team-a/jobs/one"},
+	} {
+		result, err := authorized.List(alice, database.ListOptions{Prefix: prefix})
+		if err != nil {
+			t.Fatalf("alice list %#v: %v", prefix, err)
+		}
+		var names []string
+		for _, object := range result.Objects {
+			names = append(names, object.Metadata.Name)
+		}
+		if !slices.Equal(names, expected) {
+			t.Fatalf("alice list %#v: %v", prefix, names)
+		}
+	}
+	_, err = authorized.List(alice, database.ListOptions{Prefix: "team-b"})
+	if !isForbidden(err) {
+		t.Fatalf("alice list team-b: %v", err)
+	}
+	_, err = authorized.List(bob, database.ListOptions{})
+	if !isForbidden(err) {
+		t.Fatalf("bob list: %v", err)
+	}
+
+	// Changes to bindings apply immediately
+	_, err = authorized.Delete(root, "team-a/readers", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authorized.Get(alice, "team-a/example")
+	if !isForbidden(err) {
+		t.Fatalf("alice get after unbinding: %v", err)
+	}
+
+	// Conflicts only give the id of objects the user can get
+	for _, test := range []struct {
+		ctx   context.Context
+		name  string
+		hides bool
+	}{
+		{alice, "team-a/jobs/example", true},
+		{alice, "team-a/jobs/one", true},
+		{root, "team-a/jobs/example", false},
+	} {
+		_, err = authorized.Create(test.ctx, job(test.name), false)
+		var conflict *database.Conflict
+		if !errors.As(err, &conflict) || conflict.Reason != database.ReasonAlreadyExists {
+			t.Fatalf("create existing %v: %v", test.name, err)
+		}
+		if (conflict.ActualId == "") != test.hides {
+			t.Fatalf("create existing %v: id %#v", test.name, conflict.ActualId)
+		}
+	}
+	_, err = authorized.Batch(alice, []database.BatchOperation{
+		{Operation: database.BatchCreate, Object: job("team-a/jobs/example")},
+	})
+	var conflict *database.Conflict
+	if !errors.As(err, &conflict) || conflict.ActualId != "" {
+		t.Fatalf("batch create existing: %v", err)
+	}
+}
+
+func TestRbacEscalation(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewInMemoryDatabase()
+	authz := newAuthorizer(db, AuthorizationConfig{AdminUsers: []string{"root"}})
+	authorized := &authorizedDatabase{db: db, authz: authz}
+	root := withIdentity(ctx, Identity{User: "root"})
+	carol := withIdentity(ctx, Identity{User: "carol"})
+
+	everything := map[string]any{
+		"rules": []any{map[string]any{"verbs": []any{"*"}}},
+	}
+	for _, object := range []database.Object{
+		rbacObject(RoleKind, "admin", everything),
+		rbacObject(RoleKind, "team-a/owner", map[string]any{
+			"rules": []any{map[string]any{
+				"verbs": []any{"get", "list", "create", "update", "delete"},
+			}},
+		}),
+		rbacObject(RoleBindingKind, "team-a/carol", map[string]any{
+			"role":  "owner",
+			"users": []any{"carol"},
+		}),
+	} {
+		_, err := authorized.Create(root, object, false)
+		if err != nil {
+			t.Fatalf("create %v: %v", object.Metadata.Name, err)
+		}
+	}
+
+	for _, test := range []struct {
+		object  database.Object
+		allowed bool
+	}{
+		// Can't give herself more than she has
+		{rbacObject(RoleKind, "team-a/everything", everything), false},
+		{rbacObject(RoleKind, "team-a/watcher", map[string]any{
+			"rules": []any{map[string]any{"verbs": []any{"watch"}, "prefixes": []any{"jobs"}}},
+		}), false},
+		{rbacObject(RoleBindingKind, "team-a/escalate", map[string]any{
+			"role":  "admin",
+			"users": []any{"carol"},
+		}), false},
+		// Can give what she has, under her namespace
+		{rbacObject(RoleKind, "team-a/job-editor", map[string]any{
+			"rules": []any{map[string]any{
+				"verbs": []any{"get", "update"},
+				"kinds": []any{"example.org/Job"},
+			}},
+		}), true},
+		{rbacObject(RoleBindingKind, "team-a/sub/dave", map[string]any{
+			"role":  "owner",
+			"users": []any{"dave"},
+		}), true},
+		// A role that doesn't exist yet grants nothing
+		{rbacObject(RoleBindingKind, "team-a/later", map[string]any{
+			"role":  "later",
+			"users": []any{"carol"},
+		}), true},
+		{rbacObject(RoleKind, "team-a/later", everything), false},
+	} {
+		_, err := authorized.Create(carol, test.object, false)
+		var forbidden *database.Forbidden
+		if test.allowed && err != nil {
+			t.Fatalf("create %v: %v", test.object.Metadata.Name, err)
+		} else if !test.allowed && !errors.As(err, &forbidden) {
+			t.Fatalf("create %v: %v", test.object.Metadata.Name, err)
+		}
+	}
+
+	// Same when changing an existing role
+	_, err := authorized.Update(carol, rbacObject(RoleKind, "team-a/job-editor", everything))
+	var forbidden *database.Forbidden
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("update role: %v", err)
+	}
+	_, err = authorized.Get(carol, "team-b/anything")
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("get after escalation attempts: %v", err)
+	}
+}
+
+func TestCanI(t *testing.T) {
+	ctx := context.Background()
+	authenticators, err := newAuthenticators(Config{TokenFile: writeTokenFile(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := database.NewInMemoryDatabase()
+	authz := newAuthorizer(db, AuthorizationConfig{AdminGroups: []string{"admins"}})
+	server := httptest.NewServer(&ApiServer{
+		db:             &authorizedDatabase{db: db, authz: authz},
+		authenticators: authenticators,
+		authz:          authz,
+	})
+	t.Cleanup(server.Close)
+	newClient := func(token string) *client.Client {
+		c, err := client.NewClient(ctx, client.ClientOptions{
+			Uri:   server.URL,
+			Token: token,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	alice := newClient("alice-token")
+	bob := newClient("bob-token")
+
+	for _, object := range []database.Object{
+		rbacObject(RoleKind, "team-a/viewer", map[string]any{
+			"rules": []any{map[string]any{"verbs": []any{"get"}, "kinds": []any{"example.org/Job"}}},
+		}),
+		rbacObject(RoleBindingKind, "team-a/bob", map[string]any{
+			"role":  "viewer",
+			"users": []any{"bob"},
+		}),
+	} {
+		_, err := alice.WriteObject(ctx, object, client.Create)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		client  *client.Client
+		verb    string
+		name    string
+		kind    string
+		allowed bool
+	}{
+		{alice, "delete", "anything", "", true},
+		{bob, "get", "team-a/job", "", true},
+		{bob, "get", "team-a/job", "example.org/Job", true},
+		{bob, "get", "team-a/job", "example.org/Other", false},
+		{bob, "delete", "team-a/job", "", false},
+		{bob, "get", "team-b/job", "", false},
+	} {
+		review, err := test.client.CanI(ctx, test.verb, test.name, test.kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if review.Allowed != test.allowed {
+			t.Errorf("%v %v %v %v: %v", review.User, test.verb, test.name, test.kind, review.Allowed)
+		}
+	}
+
+	// Objects of other kinds look the same as missing ones
+	for _, name := range []string{"team-a/viewer", "team-a/missing"} {
+		_, err = bob.GetObject(ctx, name)
+		var doesNotExist *database.DoesNotExist
+		if !errors.As(err, &doesNotExist) {
+			t.Fatalf("bob get %v: %#v", name, err)
+		}
+	}
+	_, err = bob.CanI(ctx, "destroy", "team-a/job", "")
+	if err == nil {
+		t.Fatal("no error for unknown verb")
+	}
+}
+
+func TestRbacOtherProcess(t *testing.T) {
+	ctx := context.Background()
+	directory := t.TempDir()
+	db, err := database.NewFilesDatabase(directory, database.FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authz := newAuthorizer(db, AuthorizationConfig{})
+	authz.checkInterval = 0
+	authorized := &authorizedDatabase{db: db, authz: authz}
+	alice := withIdentity(ctx, Identity{User: "alice"})
+	_, err = db.Create(ctx, testObject("example"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authorized.Get(alice, "example")
+	var forbidden *database.Forbidden
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("get without binding: %v", err)
+	}
+
+	// Another process sharing the directory grants access
+	other, err := database.NewFilesDatabase(directory, database.FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range []database.Object{
+		rbacObject(RoleKind, "reader", map[string]any{
+			"rules": []any{map[string]any{"verbs": []any{"get"}}},
+		}),
+		rbacObject(RoleBindingKind, "alice", map[string]any{
+			"role":  "reader",
+			"users": []any{"alice"},
+		}),
+	} {
+		_, err = other.Create(ctx, object, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = authorized.Get(alice, "example")
+	if err != nil {
+		t.Fatalf("get after binding: %v", err)
+	}
+
+	// Other writes don't reload the policy, deleting the binding does
+	loaded := authz.policy.Load()
+	_, err = other.Create(ctx, testObject("other"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := authz.getPolicy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy != loaded {
+		t.Fatal("policy was reloaded")
+	}
+
+	// Requests don't wait for another one checking the policy
+	authz.mutex.Lock()
+	_, err = other.Delete(ctx, "alice", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authorized.Get(alice, "example")
+	if err != nil {
+		t.Fatalf("get while checking: %v", err)
+	}
+	authz.mutex.Unlock()
+
+	// Once checked, deleting the binding applies
+	_, err = authorized.Get(alice, "example")
+	if !errors.As(err, &forbidden) {
+		t.Fatalf("get after deleting binding: %v", err)
+	}
+}
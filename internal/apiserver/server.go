@@ -1,21 +1,33 @@
 package apiserver
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/remram44/vogon/internal/codec"
 	"github.com/remram44/vogon/internal/database"
 	"github.com/remram44/vogon/internal/versioning"
 )
 
 type ApiServer struct {
-	db database.Database
+	db             database.Database
+	requestTimeout time.Duration
+	kubernetes     *kubernetesFacade
+	schemas        []KindSchema
+	authenticators []authenticator
+	// Set if authorization is enabled, in which case db checks it
+	authz *authorizer
 }
 
 func runServer(config Config) error {
@@ -26,17 +38,72 @@ func runServer(config Config) error {
 	}
 
 	apiServer := ApiServer{
-		db: db,
+		requestTimeout: config.RequestTimeout,
+		schemas:        config.Schemas,
+	}
+	raw := db
+	// Webhooks only see writes that were authorized
+	db = newAdmissionDatabase(db)
+	if config.Authorization != nil {
+		apiServer.authz = newAuthorizer(raw, *config.Authorization)
+		db = &authorizedDatabase{db: db, authz: apiServer.authz}
+	}
+	if config.Audit != nil {
+		// Outside of authorization, so denied requests are recorded too
+		db, err = newAuditedDatabase(db, *config.Audit)
+		if err != nil {
+			return err
+		}
+	}
+	apiServer.db = db
+	err = validateKindSchemas(config.Schemas)
+	if err != nil {
+		return err
+	}
+	apiServer.authenticators, err = newAuthenticators(config)
+	if err != nil {
+		return err
+	}
+	if config.Kubernetes != nil {
+		apiServer.kubernetes, err = newKubernetesFacade(db, *config.Kubernetes)
+		if err != nil {
+			return err
+		}
 	}
 
+	tlsConfig, err := serverTlsConfig(config)
+	if err != nil {
+		return err
+	}
 	server := http.Server{
-		Addr:    fmt.Sprintf("%v:%v", config.ListenAddr, config.ListenPort),
-		Handler: &apiServer,
+		Addr:      fmt.Sprintf("%v:%v", config.ListenAddr, config.ListenPort),
+		Handler:   &apiServer,
+		TLSConfig: tlsConfig,
+	}
+	listen := server.ListenAndServe
+	if tlsConfig != nil {
+		// Certificates are already in the TLSConfig
+		listen = func() error {
+			return server.ListenAndServeTLS("", "")
+		}
+	}
+	if config.Grpc == nil {
+		return listen()
 	}
-	return server.ListenAndServe()
-}
 
-var pathFormat = regexp.MustCompile("^(/[a-z0-9][a-z0-9-]*)+$")
+	// Stop when either server fails
+	// Watches follow the changes to the underlying database
+	feed, _ := raw.(database.ChangeFeed)
+	grpcServer := newGrpcServer(db, feed, apiServer.authz, *config.Grpc, config.RequestTimeout, apiServer.authenticators, tlsConfig)
+	errs := make(chan error, 2)
+	go func() {
+		errs <- listen()
+	}()
+	go func() {
+		errs <- runGrpcServer(grpcServer, *config.Grpc)
+	}()
+	return <-errs
+}
 
 func sendJson(res http.ResponseWriter, status int, object interface{}) error {
 	res.Header().Set("Content-type", "application/json")
@@ -45,17 +112,17 @@ func sendJson(res http.ResponseWriter, status int, object interface{}) error {
 	return encoder.Encode(object)
 }
 
-func sendMessage(res http.ResponseWriter, status int, message string) {
-	type JsonMessage struct {
-		Message string `json:"message"`
+// Send a response in the format picked from the request's Accept header,
+// falling back to JSON
+func sendObject(res http.ResponseWriter, req *http.Request, status int, object interface{}) error {
+	mediaType, ok := codec.Negotiate(req.Header.Get("Accept"))
+	if !ok {
+		mediaType = codec.Json
 	}
-	res.Header().Set("Content-type", "application/json")
+	res.Header().Set("Content-type", mediaType)
+	res.Header().Add("Vary", "Accept")
 	res.WriteHeader(status)
-	encoder := json.NewEncoder(res)
-	err := encoder.Encode(JsonMessage{Message: message})
-	if err != nil {
-		slog.Info("Error sending JSON message", "error", err)
-	}
+	return codec.Encode(res, mediaType, object)
 }
 
 func boolParam(param string, defaultValue bool) (bool, error) {
@@ -72,11 +139,13 @@ func boolParam(param string, defaultValue bool) (bool, error) {
 }
 
 func (s *ApiServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	identity, authErr := authenticate(req.Context(), s.authenticators, req.Header.Get("Authorization"))
 	slog.Info(
 		"request",
 		"remote_addr", req.RemoteAddr,
 		"method", req.Method,
 		"path", req.URL.Path,
+		"user", identity.User,
 	)
 
 	if req.URL.Path == "/" {
@@ -90,8 +159,40 @@ func (s *ApiServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if authErr != nil {
+		slog.Info("authentication error", "remote_addr", req.RemoteAddr, "error", authErr)
+		res.Header().Set("WWW-Authenticate", `Bearer realm="vogon"`)
+		if s.kubernetes != nil && isKubernetesPath(req.URL.Path) {
+			sendKubernetesStatus(res, http.StatusUnauthorized, "Unauthorized", authErr.Error(), nil)
+		} else {
+			sendMessage(res, req, http.StatusUnauthorized, authErr.Error())
+		}
+		return
+	}
+
+	ctx := withIdentity(req.Context(), identity)
+	ctx = withRequestInfo(ctx, req.RemoteAddr, req.Method)
+	if s.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancel()
+	}
+
+	if s.kubernetes != nil && isKubernetesPath(req.URL.Path) {
+		s.kubernetes.ServeHTTP(ctx, res, req)
+		return
+	}
+
+	if _, ok := codec.Negotiate(req.Header.Get("Accept")); !ok {
+		sendMessage(res, req, http.StatusNotAcceptable, fmt.Sprintf(
+			"Can't produce any of the accepted formats, supported: %v",
+			strings.Join(codec.MediaTypes, ", "),
+		))
+		return
+	}
+
 	if req.URL.Path == "/_version" && req.Method == "GET" {
-		sendJson(res, 200, struct {
+		sendObject(res, req, 200, struct {
 			Version string `json:"version"`
 		}{
 			Version: versioning.NameAndVersionString(),
@@ -99,91 +200,342 @@ func (s *ApiServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if !pathFormat.MatchString(req.URL.Path) {
-		sendMessage(res, 400, "Invalid path")
+	if req.URL.Path == "/_openapi" && req.Method == "GET" {
+		err := sendObject(res, req, 200, openapiDocument(s.schemas))
+		if err != nil {
+			slog.Info("OpenAPI send error", "error", err)
+		}
+		return
+	}
+
+	if req.URL.Path == "/_list" && req.Method == "GET" {
+		s.serveList(ctx, res, req)
+		return
+	}
+
+	if req.URL.Path == "/_batch" && req.Method == "POST" {
+		s.serveBatch(ctx, res, req)
+		return
+	}
+
+	if req.URL.Path == "/_can-i" && req.Method == "GET" {
+		s.serveCanI(ctx, res, req)
 		return
 	}
 
 	name := req.URL.Path[1:]
+	if err := database.ValidateName(name); err != nil {
+		sendError(res, req, err)
+		return
+	}
 
-	if req.Method == "GET" {
-		object, err := s.db.Get(name)
-		if err != nil {
-			if _, ok := err.(*database.DoesNotExist); ok {
-				sendMessage(res, 404, "No such object")
-				return
-			}
+	switch req.Method {
+	case "GET":
+		s.serveGet(ctx, res, req, name)
+	case "PUT":
+		s.servePut(ctx, res, req, name)
+	case "PATCH":
+		s.servePatch(ctx, res, req, name)
+	case "DELETE":
+		s.serveDelete(ctx, res, req, name)
+	default:
+		sendMessage(res, req, 405, "Method not allowed")
+	}
+}
 
-			slog.Error("GET error", "name", name, "error", err)
-			sendMessage(res, 500, "error")
-			return
-		}
+func (s *ApiServer) serveGet(ctx context.Context, res http.ResponseWriter, req *http.Request, name string) {
+	object, err := s.db.Get(ctx, name)
+	if err != nil {
+		sendError(res, req, err)
+		return
+	}
 
-		err = sendJson(res, 200, object)
-		if err != nil {
-			slog.Info("GET send error", "name", name, "error", err)
-		}
-	} else if req.Method == "PUT" {
-		create, err := boolParam(req.URL.Query().Get("create"), true)
+	res.Header().Set("ETag", objectETag(object.Metadata))
+	err = checkPreconditions(req, name, &object)
+	if err == errNotModified {
+		res.WriteHeader(http.StatusNotModified)
+		return
+	} else if err != nil {
+		sendError(res, req, err)
+		return
+	}
+
+	err = sendObject(res, req, 200, object)
+	if err != nil {
+		slog.Info("GET send error", "name", name, "error", err)
+	}
+}
+
+func (s *ApiServer) servePut(ctx context.Context, res http.ResponseWriter, req *http.Request, name string) {
+	create, err := boolParam(req.URL.Query().Get("create"), true)
+	if err != nil {
+		sendMessage(res, req, 400, fmt.Sprintf("invalid query parameter 'create'"))
+		return
+	}
+	replace, err := boolParam(req.URL.Query().Get("replace"), true)
+	if err != nil {
+		sendMessage(res, req, 400, fmt.Sprintf("invalid query parameter 'replace'"))
+		return
+	}
+	if !create && !replace {
+		sendMessage(res, req, 400, "Nothing to do if both create and replace are 0")
+		return
+	}
+
+	mediaType, err := codec.ContentType(req.Header.Get("Content-Type"))
+	if err != nil {
+		sendMessage(res, req, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	var object database.Object
+	err = codec.Decode(req.Body, mediaType, &object)
+	if err != nil {
+		sendMessage(res, req, 400, fmt.Sprintf("error reading input: %v", err))
+		return
+	}
+	if object.Metadata.Name != name {
+		sendErrorDetails(res, req, database.ErrorDetails{
+			Message: "Mismatched name",
+			Reason:  database.ReasonInvalid,
+			Name:    object.Metadata.Name,
+		})
+		return
+	}
+
+	var meta database.MetadataResponse
+	if hasPreconditions(req) {
+		current, err := s.getForPreconditions(ctx, req, name)
 		if err != nil {
-			sendMessage(res, 400, fmt.Sprintf("invalid query parameter 'create'"))
+			sendError(res, req, err)
 			return
 		}
-		replace, err := boolParam(req.URL.Query().Get("replace"), true)
-		if err != nil {
-			sendMessage(res, 400, fmt.Sprintf("invalid query parameter 'replace'"))
-			return
+		if current != nil {
+			if object.Metadata.Id == "" && object.Metadata.Revision == "" {
+				object.Metadata.Id = current.Metadata.Id
+				object.Metadata.Revision = current.Metadata.Revision
+			}
+			if replace {
+				meta, err = s.db.Update(ctx, object)
+			} else {
+				meta, err = s.db.Create(ctx, object, false)
+			}
+		} else if create {
+			meta, err = s.db.Create(ctx, object, false)
+		} else {
+			meta, err = s.db.Update(ctx, object)
 		}
+	} else if create {
+		meta, err = s.db.Create(ctx, object, replace)
+	} else {
+		meta, err = s.db.Update(ctx, object)
+	}
+	if err != nil {
+		slog.Info("PUT error", "name", name, "error", err)
+		sendError(res, req, err)
+		return
+	}
+	res.Header().Set("ETag", metadataETag(meta))
+	err = sendObject(res, req, 200, meta)
+	if err != nil {
+		slog.Info("PUT send error", "name", name, "error", err)
+	}
+}
 
-		var object database.Object
-		decoder := json.NewDecoder(req.Body)
+// Update an object with a JSON merge patch (RFC 7386)
+func (s *ApiServer) servePatch(ctx context.Context, res http.ResponseWriter, req *http.Request, name string) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/merge-patch+json" {
+		sendMessage(res, req, http.StatusUnsupportedMediaType, "Patches should be application/merge-patch+json")
+		return
+	}
+	var patch any
+	err := json.NewDecoder(req.Body).Decode(&patch)
+	if err != nil {
+		sendMessage(res, req, 400, fmt.Sprintf("error reading patch: %v", err))
+		return
+	}
+
+	current, err := s.getForPreconditions(ctx, req, name)
+	if err == nil && current == nil {
+		err = &database.DoesNotExist{
+			Name:    name,
+			Message: fmt.Sprintf("Object %s does not exist", name),
+		}
+	}
+	if err != nil {
+		sendError(res, req, err)
+		return
+	}
+
+	// The patched document keeps the current Id and Revision unless the
+	// patch changes them, so the update fails if the object changed since
+	var document any
+	data, err := json.Marshal(current)
+	if err == nil {
+		err = json.Unmarshal(data, &document)
+	}
+	if err == nil {
+		data, err = json.Marshal(mergePatch(document, patch))
+	}
+	var object database.Object
+	if err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(data))
 		decoder.DisallowUnknownFields()
 		err = decoder.Decode(&object)
+	}
+	if err != nil {
+		sendMessage(res, req, 422, fmt.Sprintf("invalid patch: %v", err))
+		return
+	}
+	if object.Metadata.Name != name {
+		sendErrorDetails(res, req, database.ErrorDetails{
+			Message: "Mismatched name",
+			Reason:  database.ReasonInvalid,
+			Name:    object.Metadata.Name,
+		})
+		return
+	}
+
+	meta, err := s.db.Update(ctx, object)
+	if err != nil {
+		slog.Info("PATCH error", "name", name, "error", err)
+		sendError(res, req, err)
+		return
+	}
+	res.Header().Set("ETag", metadataETag(meta))
+	err = sendObject(res, req, 200, meta)
+	if err != nil {
+		slog.Info("PATCH send error", "name", name, "error", err)
+	}
+}
+
+func (s *ApiServer) serveDelete(ctx context.Context, res http.ResponseWriter, req *http.Request, name string) {
+	id := req.URL.Query().Get("id")
+	revision := req.URL.Query().Get("revision")
+	if hasPreconditions(req) {
+		current, err := s.getForPreconditions(ctx, req, name)
 		if err != nil {
-			sendMessage(res, 400, fmt.Sprintf("error reading input: %v", err))
+			sendError(res, req, err)
 			return
 		}
-		if object.Metadata.Name != name {
-			sendMessage(res, 400, "Mismatched name")
-			return
-		}
-		var meta database.MetadataResponse
-		if create && replace {
-			meta, err = s.db.Create(object, true)
-		} else if create {
-			meta, err = s.db.Create(object, false)
-		} else if replace {
-			meta, err = s.db.Update(object)
-		} else {
-			sendMessage(res, 400, "Nothing to do if both create and replace are 0")
-			return
+		if current != nil && id == "" && revision == "" {
+			id = current.Metadata.Id
+			revision = current.Metadata.Revision
 		}
+	}
+	meta, err := s.db.Delete(ctx, name, id, revision)
+	if err != nil {
+		slog.Info("DELETE error", "name", name, "error", err)
+		sendError(res, req, err)
+		return
+	}
+	err = sendObject(res, req, 200, meta)
+	if err != nil {
+		slog.Info("DELETE send error", "name", name, "error", err)
+	}
+}
+
+const (
+	defaultListLimit = 500
+	maxListLimit     = 5000
+)
+
+// Build a selector from a label selector and a field selector, either can
+// be empty
+func parseSelectors(labels string, fields string) (database.Selector, error) {
+	var selector database.Selector
+	if labels != "" {
+		labelSelector, err := database.ParseLabelSelector(labels)
 		if err != nil {
-			slog.Error("PUT error", "name", name, "error", err)
-			sendMessage(res, 400, fmt.Sprintf("%v", err))
-			return
+			return nil, err
 		}
-		err = sendJson(res, 200, meta)
+		selector = append(selector, labelSelector...)
+	}
+	if fields != "" {
+		fieldSelector, err := database.ParseSelector(fields)
 		if err != nil {
-			slog.Info("PUT send error", "name", name, "error", err)
+			return nil, err
 		}
-	} else if req.Method == "DELETE" {
-		id := req.URL.Query().Get("id")
-		revision := req.URL.Query().Get("revision")
-		meta, err := s.db.Delete(name, id, revision)
-		if err != nil {
-			status := 400
-			if _, ok := err.(*database.DoesNotExist); ok {
-				status = 404
-			} else {
-				slog.Error("DELETE error", "name", name, "error", err)
-			}
-			sendMessage(res, status, fmt.Sprintf("%v", err))
+		selector = append(selector, fieldSelector...)
+	}
+	return selector, nil
+}
+
+func (s *ApiServer) serveList(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	options := database.ListOptions{
+		Prefix:   query.Get("prefix"),
+		Limit:    defaultListLimit,
+		Continue: query.Get("continue"),
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			sendMessage(res, req, 400, "invalid query parameter 'limit'")
 			return
 		}
-		err = sendJson(res, 200, meta)
-		if err != nil {
-			slog.Info("DELETE send error", "name", name, "error", err)
+		options.Limit = min(limit, maxListLimit)
+	}
+	selector, err := parseSelectors(query.Get("labels"), query.Get("fields"))
+	if err != nil {
+		sendError(res, req, err)
+		return
+	}
+	options.Selector = selector
+
+	result, err := s.db.List(ctx, options)
+	if err != nil {
+		slog.Info("LIST error", "prefix", options.Prefix, "error", err)
+		sendError(res, req, err)
+		return
+	}
+	err = sendObject(res, req, 200, result)
+	if err != nil {
+		slog.Info("LIST send error", "prefix", options.Prefix, "error", err)
+	}
+}
+
+const maxBatchOperations = 1000
+
+// Apply several writes atomically
+func (s *ApiServer) serveBatch(ctx context.Context, res http.ResponseWriter, req *http.Request) {
+	mediaType, err := codec.ContentType(req.Header.Get("Content-Type"))
+	if err != nil {
+		sendMessage(res, req, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	var request database.BatchRequest
+	err = codec.Decode(req.Body, mediaType, &request)
+	if err != nil {
+		sendMessage(res, req, 400, fmt.Sprintf("error reading input: %v", err))
+		return
+	}
+	if len(request.Operations) > maxBatchOperations {
+		sendMessage(res, req, 400, fmt.Sprintf("Too many operations, the limit is %d", maxBatchOperations))
+		return
+	}
+
+	response := database.BatchResponse{
+		Results: make([]database.BatchResult, len(request.Operations)),
+	}
+	results, err := s.db.Batch(ctx, request.Operations)
+	if err != nil {
+		var batchErr *database.BatchError
+		if !errors.As(err, &batchErr) {
+			sendError(res, req, err)
+			return
+		}
+		slog.Info("BATCH error", "index", batchErr.Index, "error", batchErr.Err)
+		details := errorDetails(batchErr.Err)
+		response.Results[batchErr.Index].Error = &details
+		err = sendObject(res, req, statusForReason(details.Reason), response)
+	} else {
+		for i, meta := range results {
+			response.Results[i].Metadata = meta
 		}
+		err = sendObject(res, req, 200, response)
+	}
+	if err != nil {
+		slog.Info("BATCH send error", "error", err)
 	}
 }
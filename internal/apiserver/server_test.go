@@ -0,0 +1,494 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/remram44/vogon/internal/client"
+	"github.com/remram44/vogon/internal/codec"
+	"github.com/remram44/vogon/internal/database"
+)
+
+func newTestServer(t *testing.T) (*ApiServer, *client.Client) {
+	apiServer, c, _ := startTestServer(t)
+	return apiServer, c
+}
+
+// Like newTestServer, also returns the URL of the server
+func startTestServer(t *testing.T) (*ApiServer, *client.Client, string) {
+	apiServer := &ApiServer{
+		db: database.NewInMemoryDatabase(),
+	}
+	server := httptest.NewServer(apiServer)
+	t.Cleanup(server.Close)
+	c, err := client.NewClient(context.Background(), client.ClientOptions{
+		Uri: server.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apiServer, c, server.URL
+}
+
+func testObject(name string) database.Object {
+	return database.Object{
+		Kind:    "example.org/Example",
+		Version: "v1",
+		Metadata: database.ObjectMetadata{
+			Name: name,
+		},
+		Spec:   map[string]interface{}{"value": "yay"},
+		Status: map[string]interface{}{},
+	}
+}
+
+func doRequest(t *testing.T, server *ApiServer, method string, target string, body string) (int, database.ErrorDetails) {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	var details database.ErrorDetails
+	if recorder.Code != 200 {
+		err := json.NewDecoder(recorder.Body).Decode(&details)
+		if err != nil {
+			t.Fatalf("%v %v: invalid error body: %v", method, target, err)
+		}
+	}
+	return recorder.Code, details
+}
+
+func TestErrorStatus(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	status, details := doRequest(t, server, "GET", "/one", "")
+	if status != http.StatusNotFound || details.Reason != database.ReasonNotFound || details.Name != "one" {
+		t.Fatalf("GET missing: %v %#v", status, details)
+	}
+
+	object := `{"Kind": "example.org/Example", "Version": "v1", "Metadata": {"Name": "one"}}`
+	status, _ = doRequest(t, server, "PUT", "/one", object)
+	if status != 200 {
+		t.Fatalf("PUT: %v", status)
+	}
+
+	status, details = doRequest(t, server, "PUT", "/one?replace=false", object)
+	if status != http.StatusConflict || details.Reason != database.ReasonAlreadyExists {
+		t.Fatalf("PUT existing: %v %#v", status, details)
+	}
+
+	status, details = doRequest(t, server, "DELETE", "/one?id=wrong", "")
+	if status != http.StatusPreconditionFailed || details.Reason != database.ReasonIdMismatch || details.ExpectedId != "wrong" {
+		t.Fatalf("DELETE wrong id: %v %#v", status, details)
+	}
+
+	status, details = doRequest(t, server, "DELETE", "/one?revision=wrong", "")
+	if status != http.StatusUnprocessableEntity || details.Reason != database.ReasonInvalid {
+		t.Fatalf("DELETE revision without id: %v %#v", status, details)
+	}
+
+	status, details = doRequest(t, server, "PUT", "/two", object)
+	if status != http.StatusUnprocessableEntity || details.Reason != database.ReasonInvalid {
+		t.Fatalf("PUT mismatched name: %v %#v", status, details)
+	}
+
+	status, details = doRequest(t, server, "PUT", "/one?create=maybe", object)
+	if status != http.StatusBadRequest || details.Reason != database.ReasonBadRequest {
+		t.Fatalf("PUT invalid parameter: %v %#v", status, details)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+	_, c := newTestServer(t)
+
+	_, err := c.GetObject(ctx, "one")
+	var doesNotExist *database.DoesNotExist
+	if !errors.As(err, &doesNotExist) || doesNotExist.Name != "one" {
+		t.Fatalf("GET missing: %#v", err)
+	}
+
+	meta, err := c.WriteObject(ctx, testObject("one"), client.Create)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.WriteObject(ctx, testObject("one"), client.Create)
+	var conflict *database.Conflict
+	if !errors.As(err, &conflict) || conflict.Reason != database.ReasonAlreadyExists {
+		t.Fatalf("create existing: %#v", err)
+	}
+
+	object := testObject("one")
+	object.Metadata.Id = meta.Id
+	object.Metadata.Revision = "wrong"
+	_, err = c.WriteObject(ctx, object, client.Replace)
+	if !errors.As(err, &conflict) ||
+		conflict.Reason != database.ReasonRevisionMismatch ||
+		conflict.ExpectedRevision != "wrong" ||
+		conflict.ActualRevision != meta.Revision {
+		t.Fatalf("replace wrong revision: %#v", err)
+	}
+
+	object.Metadata.Id = ""
+	_, err = c.WriteObject(ctx, object, client.Replace)
+	var invalid *database.Invalid
+	if !errors.As(err, &invalid) {
+		t.Fatalf("replace revision without id: %#v", err)
+	}
+
+	_, err = c.DeleteObject(ctx, "one", meta.Id, "wrong")
+	if !errors.As(err, &conflict) || conflict.Reason != database.ReasonRevisionMismatch {
+		t.Fatalf("delete wrong revision: %#v", err)
+	}
+	deleted, err := c.DeleteObject(ctx, "one", meta.Id, meta.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != meta {
+		t.Fatalf("wrong metadata for deleted object: %#v", deleted)
+	}
+	_, err = c.DeleteObject(ctx, "one", "", "")
+	if !errors.As(err, &doesNotExist) {
+		t.Fatalf("delete missing: %#v", err)
+	}
+
+	// Writing back a deleted object creates it, like over gRPC
+	object.Metadata.Id = meta.Id
+	object.Metadata.Revision = meta.Revision
+	_, err = c.WriteObject(ctx, object, client.CreateOrReplace)
+	if err != nil {
+		t.Fatalf("create or replace deleted object: %#v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	server, c := newTestServer(t)
+
+	results, err := c.Batch(ctx, []database.BatchOperation{
+		{Operation: database.BatchCreate, Object: testObject("one")},
+		{Operation: database.BatchCreate, Object: testObject("two")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Id == "" || results[1].Id == "" {
+		t.Fatalf("wrong results: %#v", results)
+	}
+
+	_, err = c.Batch(ctx, []database.BatchOperation{
+		{Operation: database.BatchCreate, Object: testObject("three")},
+		{Operation: database.BatchDelete, Name: "one"},
+		{Operation: database.BatchCreate, Object: testObject("two")},
+	})
+	var batchError *database.BatchError
+	var conflict *database.Conflict
+	if !errors.As(err, &batchError) || batchError.Index != 2 {
+		t.Fatalf("failing batch: %#v", err)
+	}
+	if !errors.As(err, &conflict) || conflict.Reason != database.ReasonAlreadyExists {
+		t.Fatalf("failing batch: %#v", err)
+	}
+	_, err = c.GetObject(ctx, "three")
+	var doesNotExist *database.DoesNotExist
+	if !errors.As(err, &doesNotExist) {
+		t.Fatalf("object from failed batch was created: %#v", err)
+	}
+	_, err = c.GetObject(ctx, "one")
+	if err != nil {
+		t.Fatalf("object from failed batch was deleted: %v", err)
+	}
+
+	operations := strings.Repeat(`{"Operation": "delete", "Name": "one"},`, maxBatchOperations+1)
+	body := `{"Operations": [` + strings.TrimSuffix(operations, ",") + `]}`
+	status, details := doRequest(t, server, "POST", "/_batch", body)
+	if status != http.StatusBadRequest || details.Reason != database.ReasonBadRequest {
+		t.Fatalf("too many operations: %v %#v", status, details)
+	}
+}
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	server, c := newTestServer(t)
+
+	expected := []string{"a", "a/b", "a/c", "b", "c/d"}
+	for _, name := range expected {
+		_, err := c.WriteObject(ctx, testObject(name), client.Create)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	iterator := c.IterateObjects(ctx, database.ListOptions{Limit: 2})
+	for iterator.Next() {
+		names = append(names, iterator.Object().Metadata.Name)
+	}
+	if iterator.Err() != nil {
+		t.Fatal(iterator.Err())
+	}
+	if !slices.Equal(names, expected) {
+		t.Fatalf("wrong objects: %v", names)
+	}
+
+	result, err := c.ListObjects(ctx, database.ListOptions{Prefix: "a", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 1 || result.Objects[0].Metadata.Name != "a/b" || result.Continue == "" {
+		t.Fatalf("wrong page: %#v", result)
+	}
+
+	selector, err := database.ParseSelector("metadata.name in (a,c/d)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = c.ListObjects(ctx, database.ListOptions{Selector: selector})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 2 ||
+		result.Objects[0].Metadata.Name != "a" ||
+		result.Objects[1].Metadata.Name != "c/d" {
+		t.Fatalf("wrong filtered objects: %#v", result)
+	}
+
+	// Values are escaped when sent to the server
+	result, err = c.ListObjects(ctx, database.ListOptions{Selector: database.Selector{
+		{Field: "metadata.name", Operator: database.OpNotIn, Values: []string{"a", "b", "a/b,c/d"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Objects) != 3 || result.Objects[2].Metadata.Name != "c/d" {
+		t.Fatalf("wrong objects with escaped selector: %#v", result)
+	}
+
+	status, details := doRequest(t, server, "GET", "/_list?limit=0", "")
+	if status != http.StatusBadRequest || details.Reason != database.ReasonBadRequest {
+		t.Fatalf("invalid limit: %v %#v", status, details)
+	}
+	status, details = doRequest(t, server, "GET", "/_list?continue=garbage", "")
+	if status != http.StatusUnprocessableEntity || details.Reason != database.ReasonInvalid {
+		t.Fatalf("invalid token: %v %#v", status, details)
+	}
+	status, details = doRequest(t, server, "GET", "/_list?fields=owner%3Dalice", "")
+	if status != http.StatusUnprocessableEntity || details.Reason != database.ReasonInvalid {
+		t.Fatalf("invalid selector: %v %#v", status, details)
+	}
+}
+
+func doConditionalRequest(t *testing.T, server *ApiServer, method string, target string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestConditionalRequests(t *testing.T) {
+	ctx := context.Background()
+	server, c := newTestServer(t)
+
+	object := `{"Kind": "example.org/Example", "Version": "v1", "Metadata": {"Name": "one"}, "Spec": {"a": 1, "b": 2}}`
+	response := doConditionalRequest(t, server, "PUT", "/one", map[string]string{"If-None-Match": "*"}, object)
+	if response.Code != 200 {
+		t.Fatalf("create with If-None-Match: %v", response.Code)
+	}
+	etag := response.Header().Get("ETag")
+	response = doConditionalRequest(t, server, "PUT", "/one", map[string]string{"If-None-Match": "*"}, object)
+	if response.Code != http.StatusPreconditionFailed {
+		t.Fatalf("create existing with If-None-Match: %v", response.Code)
+	}
+	response = doConditionalRequest(t, server, "PUT", "/two", map[string]string{"If-Match": "*"}, strings.Replace(object, `"one"`, `"two"`, 1))
+	if response.Code != http.StatusPreconditionFailed {
+		t.Fatalf("replace missing with If-Match: %v", response.Code)
+	}
+
+	// Conditional GET
+	response = doConditionalRequest(t, server, "GET", "/one", nil, "")
+	if response.Code != 200 || response.Header().Get("ETag") != etag {
+		t.Fatalf("GET: %v %#v", response.Code, response.Header())
+	}
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag} {
+		response = doConditionalRequest(t, server, "GET", "/one", map[string]string{"If-None-Match": header}, "")
+		if response.Code != http.StatusNotModified || response.Body.Len() != 0 {
+			t.Fatalf("GET with If-None-Match %v: %v", header, response.Code)
+		}
+	}
+	response = doConditionalRequest(t, server, "GET", "/one", map[string]string{"If-None-Match": `"other"`}, "")
+	if response.Code != 200 {
+		t.Fatalf("GET with other If-None-Match: %v", response.Code)
+	}
+
+	// Replace, then the old ETag doesn't match anymore
+	response = doConditionalRequest(t, server, "PUT", "/one", map[string]string{"If-Match": etag}, object)
+	if response.Code != 200 || response.Header().Get("ETag") == etag {
+		t.Fatalf("replace with If-Match: %v", response.Code)
+	}
+	newETag := response.Header().Get("ETag")
+	response = doConditionalRequest(t, server, "PUT", "/one", map[string]string{"If-Match": etag}, object)
+	var details database.ErrorDetails
+	json.NewDecoder(response.Body).Decode(&details)
+	if response.Code != http.StatusPreconditionFailed || details.Reason != database.ReasonRevisionMismatch {
+		t.Fatalf("replace with stale If-Match: %v %#v", response.Code, details)
+	}
+	response = doConditionalRequest(t, server, "GET", "/one", map[string]string{"If-Match": "W/" + newETag}, "")
+	if response.Code != http.StatusPreconditionFailed {
+		t.Fatalf("GET with weak If-Match: %v", response.Code)
+	}
+
+	// Merge patch
+	patch := `{"Spec": {"a": null, "c": 3}, "Metadata": {"Labels": {"app": "web"}}}`
+	response = doConditionalRequest(t, server, "PATCH", "/one", map[string]string{"Content-Type": "application/json"}, patch)
+	if response.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("PATCH with wrong type: %v", response.Code)
+	}
+	response = doConditionalRequest(t, server, "PATCH", "/one", map[string]string{
+		"Content-Type": "application/merge-patch+json",
+		"If-Match":     etag,
+	}, patch)
+	if response.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PATCH with stale If-Match: %v", response.Code)
+	}
+	response = doConditionalRequest(t, server, "PATCH", "/one", map[string]string{
+		"Content-Type": "application/merge-patch+json",
+		"If-Match":     newETag,
+	}, patch)
+	if response.Code != 200 {
+		t.Fatalf("PATCH: %v %v", response.Code, response.Body.String())
+	}
+	patched, err := c.GetObject(ctx, "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := patched.Spec.(map[string]any)
+	if _, ok := spec["a"]; ok || spec["b"] != 2.0 || spec["c"] != 3.0 || patched.Metadata.Labels["app"] != "web" {
+		t.Fatalf("wrong patched object: %#v", patched)
+	}
+	response = doConditionalRequest(t, server, "PATCH", "/one", map[string]string{"Content-Type": "application/merge-patch+json"}, `{"Unknown": 1}`)
+	if response.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("PATCH with unknown field: %v", response.Code)
+	}
+
+	// The client sends If-Match
+	meta, err := c.PatchObject(ctx, "one", map[string]any{"Spec": map[string]any{"c": 4}}, patched.Metadata.Id, patched.Metadata.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.PatchObject(ctx, "one", map[string]any{"Spec": nil}, patched.Metadata.Id, patched.Metadata.Revision)
+	var conflict *database.Conflict
+	if !errors.As(err, &conflict) || conflict.Reason != database.ReasonRevisionMismatch || conflict.ActualRevision != meta.Revision {
+		t.Fatalf("PATCH with stale revision: %#v", err)
+	}
+
+	response = doConditionalRequest(t, server, "DELETE", "/one", map[string]string{"If-Match": newETag}, "")
+	if response.Code != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with stale If-Match: %v", response.Code)
+	}
+	response = doConditionalRequest(t, server, "DELETE", "/one", map[string]string{"If-Match": client.ETag(meta.Id, meta.Revision)}, "")
+	if response.Code != 200 {
+		t.Fatalf("DELETE with If-Match: %v", response.Code)
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	ctx := context.Background()
+	apiServer := &ApiServer{
+		db: database.NewInMemoryDatabase(),
+	}
+	server := httptest.NewServer(apiServer)
+	t.Cleanup(server.Close)
+
+	for _, format := range codec.MediaTypes {
+		c, err := client.NewClient(ctx, client.ClientOptions{
+			Uri:    server.URL,
+			Format: format,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name := "formats/" + strings.TrimPrefix(format, "application/")
+		object := testObject(name)
+		object.Metadata.Labels = map[string]string{"format": format}
+		meta, err := c.WriteObject(ctx, object, client.Create)
+		if err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		read, err := c.GetObject(ctx, name)
+		if err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		if read.Metadata.Revision != meta.Revision ||
+			read.Metadata.Labels["format"] != format ||
+			read.Spec.(map[string]any)["value"] != "yay" {
+			t.Fatalf("%v: wrong object: %#v", format, read)
+		}
+		result, err := c.ListObjects(ctx, database.ListOptions{Prefix: "formats"})
+		if err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		if len(result.Objects) == 0 {
+			t.Fatalf("%v: no objects listed", format)
+		}
+		_, err = c.GetObject(ctx, "formats/missing")
+		var doesNotExist *database.DoesNotExist
+		if !errors.As(err, &doesNotExist) || doesNotExist.Name != "formats/missing" {
+			t.Fatalf("%v: GET missing: %#v", format, err)
+		}
+
+		// Unknown fields are rejected in every format
+		body := map[string]any{
+			"Kind":     "example.org/Example",
+			"Metadata": map[string]any{"Name": "unknown"},
+			"Unknown":  1,
+		}
+		if format == codec.Yaml {
+			body = map[string]any{
+				"kind":     "example.org/Example",
+				"metadata": map[string]any{"name": "unknown"},
+				"unknown":  1,
+			}
+		}
+		var encoded strings.Builder
+		err = codec.Encode(&encoded, format, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := doConditionalRequest(t, apiServer, "PUT", "/unknown", map[string]string{
+			"Content-Type": format,
+			"Accept":       format,
+		}, encoded.String())
+		var details database.ErrorDetails
+		err = codec.Decode(response.Body, response.Header().Get("Content-type"), &details)
+		if err != nil {
+			t.Fatalf("%v: invalid error body: %v", format, err)
+		}
+		if response.Code != http.StatusBadRequest || details.Reason != database.ReasonBadRequest {
+			t.Fatalf("%v: PUT unknown field: %v %#v", format, response.Code, details)
+		}
+	}
+
+	response := doConditionalRequest(t, apiServer, "GET", "/formats/json", map[string]string{
+		"Accept": "text/html, application/msgpack;q=0.5, application/yaml;q=0.8",
+	}, "")
+	if response.Code != 200 || response.Header().Get("Content-type") != codec.Yaml {
+		t.Fatalf("GET with weighted Accept: %v %#v", response.Code, response.Header())
+	}
+	response = doConditionalRequest(t, apiServer, "GET", "/formats/json", map[string]string{"Accept": "text/html"}, "")
+	if response.Code != http.StatusNotAcceptable {
+		t.Fatalf("GET with unsupported Accept: %v", response.Code)
+	}
+	response = doConditionalRequest(t, apiServer, "PUT", "/formats/json", map[string]string{"Content-Type": "text/plain"}, "")
+	if response.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("PUT with unsupported Content-Type: %v", response.Code)
+	}
+}
@@ -0,0 +1,54 @@
+package apiserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Build the TLS configuration of the listeners from the config, nil to serve
+// in cleartext
+func serverTlsConfig(config Config) (*tls.Config, error) {
+	if config.TlsCert == "" && config.TlsKey == "" {
+		if config.ClientCa != "" {
+			return nil, fmt.Errorf("Setting client_ca requires tls_cert and tls_key")
+		}
+		return nil, nil
+	}
+	if config.TlsCert == "" || config.TlsKey == "" {
+		return nil, fmt.Errorf("Settings tls_cert and tls_key must be set together")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(config.TlsCert, config.TlsKey)
+	if err != nil {
+		return nil, fmt.Errorf("Loading TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.ClientCa != "" {
+		pool, err := loadCertPool(config.ClientCa)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// Read a bundle of PEM certificates
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %v", filename)
+	}
+	return pool, nil
+}
@@ -0,0 +1,180 @@
+package apiserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/remram44/vogon/internal/client"
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Create a certificate and write it and its key as PEM files, signed by
+// parent or self-signed if nil
+func writeCertificate(t *testing.T, dir string, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(
+		filepath.Join(dir, name+".crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		0o644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(
+		filepath.Join(dir, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}),
+		0o600,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key
+}
+
+// Write a CA, a server certificate for 127.0.0.1 and a client certificate
+func writeTestCertificates(t *testing.T) string {
+	dir := t.TempDir()
+	ca, caKey := writeCertificate(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCertificate(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCertificate(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	return dir
+}
+
+func TestTls(t *testing.T) {
+	ctx := context.Background()
+	dir := writeTestCertificates(t)
+	config := Config{
+		TlsCert:  filepath.Join(dir, "server.crt"),
+		TlsKey:   filepath.Join(dir, "server.key"),
+		ClientCa: filepath.Join(dir, "ca.crt"),
+	}
+	tlsConfig, err := serverTlsConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := database.NewInMemoryDatabase()
+	server := httptest.NewUnstartedServer(&ApiServer{db: db})
+	server.TLS = tlsConfig
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	grpcServer := newGrpcServer(db, db, nil, GrpcConfig{}, 0, nil, tlsConfig)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	for _, uri := range []string{server.URL, client.GrpcTlsScheme + listener.Addr().String()} {
+		options := client.ClientOptions{
+			Uri:      uri,
+			Timeout:  5 * time.Second,
+			CaFile:   filepath.Join(dir, "ca.crt"),
+			CertFile: filepath.Join(dir, "client.crt"),
+			KeyFile:  filepath.Join(dir, "client.key"),
+		}
+		c, err := client.NewClient(ctx, options)
+		if err != nil {
+			t.Fatalf("%v: %v", uri, err)
+		}
+		_, err = c.WriteObject(ctx, testObject("one"), client.CreateOrReplace)
+		c.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", uri, err)
+		}
+
+		// No client certificate
+		noCert := options
+		noCert.CertFile = ""
+		noCert.KeyFile = ""
+		c, err = client.NewClient(ctx, noCert)
+		if err == nil {
+			c.Close()
+			t.Fatalf("%v: connected without client certificate", uri)
+		}
+
+		// Server certificate not trusted
+		noCa := options
+		noCa.CaFile = ""
+		c, err = client.NewClient(ctx, noCa)
+		if err == nil {
+			c.Close()
+			t.Fatalf("%v: connected without trusting the CA", uri)
+		}
+	}
+}
+
+func TestTlsConfig(t *testing.T) {
+	dir := writeTestCertificates(t)
+
+	tlsConfig, err := serverTlsConfig(Config{})
+	if tlsConfig != nil || err != nil {
+		t.Fatalf("no TLS: %v %v", tlsConfig, err)
+	}
+	_, err = serverTlsConfig(Config{TlsCert: filepath.Join(dir, "server.crt")})
+	if err == nil {
+		t.Fatal("no error without tls_key")
+	}
+	_, err = serverTlsConfig(Config{ClientCa: filepath.Join(dir, "ca.crt")})
+	if err == nil {
+		t.Fatal("no error for client_ca without tls_cert")
+	}
+	_, err = serverTlsConfig(Config{
+		TlsCert:  filepath.Join(dir, "server.crt"),
+		TlsKey:   filepath.Join(dir, "server.key"),
+		ClientCa: filepath.Join(dir, "server.key"),
+	})
+	if err == nil {
+		t.Fatal("no error for client_ca without certificates")
+	}
+}
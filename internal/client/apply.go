@@ -0,0 +1,519 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+// An object read from a file, with where it came from for error messages
+type manifest struct {
+	source string
+	object database.Object
+}
+
+// Extensions of the files picked up when applying a directory
+var manifestExtensions = []string{".yaml", ".yml", ".json"}
+
+// Read objects from files and directories, "-" for stdin
+func loadManifests(paths []string, stdin io.Reader) ([]manifest, error) {
+	var manifests []manifest
+	for _, path := range paths {
+		if path == "-" {
+			loaded, err := decodeManifests(stdin, "<stdin>", false)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, loaded...)
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		if info.IsDir() {
+			err = filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !entry.IsDir() && slices.Contains(manifestExtensions, filepath.Ext(filePath)) {
+					files = append(files, filePath)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			files = []string{path}
+		}
+
+		for _, filePath := range files {
+			file, err := os.Open(filePath)
+			if err != nil {
+				return nil, err
+			}
+			loaded, err := decodeManifests(file, filePath, filepath.Ext(filePath) == ".json")
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, loaded...)
+		}
+	}
+	return manifests, nil
+}
+
+// Read all the objects from a stream of YAML documents or JSON values
+func decodeManifests(reader io.Reader, source string, isJson bool) ([]manifest, error) {
+	var decode func(*database.Object) error
+	if isJson {
+		decoder := json.NewDecoder(reader)
+		decoder.DisallowUnknownFields()
+		decode = func(object *database.Object) error { return decoder.Decode(object) }
+	} else {
+		decoder := yaml.NewDecoder(reader)
+		decoder.KnownFields(true)
+		decode = func(object *database.Object) error { return decoder.Decode(object) }
+	}
+
+	var manifests []manifest
+	for document := 1; ; document++ {
+		var object database.Object
+		err := decode(&object)
+		if err == io.EOF {
+			return manifests, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s (document %d): %w", source, document, err)
+		}
+		// Skip empty documents
+		if reflect.DeepEqual(object, database.Object{}) {
+			continue
+		}
+		manifests = append(manifests, manifest{
+			source: fmt.Sprintf("%s (document %d)", source, document),
+			object: object,
+		})
+	}
+}
+
+// Check all the objects, so that we don't apply only some of them
+func validateManifests(manifests []manifest) []error {
+	var errs []error
+	seen := make(map[string]string)
+	for _, manifest := range manifests {
+		object := manifest.object
+		if object.Kind == "" {
+			errs = append(errs, fmt.Errorf("%s: Missing kind", manifest.source))
+		}
+		if object.Metadata.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: Missing name", manifest.source))
+			continue
+		}
+		err := database.ValidateName(object.Metadata.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", manifest.source, err))
+			continue
+		}
+		if previous, ok := seen[object.Metadata.Name]; ok {
+			errs = append(errs, fmt.Errorf(
+				"%s: Object %s is also defined in %s",
+				manifest.source,
+				object.Metadata.Name,
+				previous,
+			))
+		}
+		seen[object.Metadata.Name] = manifest.source
+	}
+	return errs
+}
+
+type ApplyResult string
+
+const (
+	ApplyCreated    ApplyResult = "created"
+	ApplyConfigured ApplyResult = "configured"
+	ApplyUnchanged  ApplyResult = "unchanged"
+	ApplyPruned     ApplyResult = "pruned"
+	ApplyFailed     ApplyResult = "failed"
+)
+
+type applyOptions struct {
+	create        bool
+	replace       bool
+	stripRevision bool
+	concurrency   int
+	dryRun        bool
+	// Objects matching this that were not applied get deleted, if not empty
+	pruneSelector database.Selector
+}
+
+func (o applyOptions) writeMode() WriteMode {
+	if o.create && o.replace {
+		return CreateOrReplace
+	} else if o.create {
+		return Create
+	}
+	return Replace
+}
+
+// Turn a value into what decoding JSON would give, to compare objects
+// decoded from YAML with objects from the server
+func normalizeJson(value any) any {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var result any
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return value
+	}
+	return result
+}
+
+// Whether writing the object would not change anything
+func sameContent(existing database.Object, object database.Object) bool {
+	return existing.Kind == object.Kind &&
+		existing.Version == object.Version &&
+		(len(existing.Metadata.Labels) == 0 && len(object.Metadata.Labels) == 0 ||
+			reflect.DeepEqual(existing.Metadata.Labels, object.Metadata.Labels)) &&
+		reflect.DeepEqual(normalizeJson(existing.Spec), normalizeJson(object.Spec)) &&
+		reflect.DeepEqual(normalizeJson(existing.Status), normalizeJson(object.Status))
+}
+
+// Check the id and revision of the manifest, if set, against the existing
+// object
+func checkPreconditions(existing database.Object, object database.Object) error {
+	name := object.Metadata.Name
+	if object.Metadata.Id != "" && object.Metadata.Id != existing.Metadata.Id {
+		return &database.Conflict{
+			Reason:     database.ReasonIdMismatch,
+			Name:       name,
+			ExpectedId: object.Metadata.Id,
+			ActualId:   existing.Metadata.Id,
+			Message:    fmt.Sprintf("Object %s exists and does not have the expected id", name),
+		}
+	}
+	if object.Metadata.Revision != "" && object.Metadata.Revision != existing.Metadata.Revision {
+		return &database.Conflict{
+			Reason:           database.ReasonRevisionMismatch,
+			Name:             name,
+			ExpectedId:       object.Metadata.Id,
+			ActualId:         existing.Metadata.Id,
+			ExpectedRevision: object.Metadata.Revision,
+			ActualRevision:   existing.Metadata.Revision,
+			Message:          fmt.Sprintf("Object %s exists and does not have the expected revision", name),
+		}
+	}
+	return nil
+}
+
+func applyObject(ctx context.Context, client *Client, object database.Object, options applyOptions) (ApplyResult, error) {
+	if options.stripRevision {
+		object.Metadata.Id = ""
+		object.Metadata.Revision = ""
+	}
+
+	existing, err := client.GetObject(ctx, object.Metadata.Name)
+	exists := true
+	if err != nil {
+		var doesNotExist *database.DoesNotExist
+		if !errors.As(err, &doesNotExist) {
+			return ApplyFailed, err
+		}
+		exists = false
+	}
+	if exists {
+		// The server would reject the write, even if nothing changed
+		err = checkPreconditions(*existing, object)
+		if err != nil {
+			return ApplyFailed, err
+		}
+	}
+	if exists && (!options.replace || sameContent(*existing, object)) {
+		return ApplyUnchanged, nil
+	}
+	if !exists && !options.create {
+		return ApplyFailed, fmt.Errorf("Object %s does not exist", object.Metadata.Name)
+	}
+
+	if !options.dryRun {
+		_, err = client.WriteObject(ctx, object, options.writeMode())
+		if err != nil {
+			return ApplyFailed, err
+		}
+	}
+	if exists {
+		return ApplyConfigured, nil
+	}
+	return ApplyCreated, nil
+}
+
+// Delete the objects matching the selector that were not applied
+func pruneObjects(ctx context.Context, client *Client, applied []manifest, options applyOptions) ([]applyOutcome, error) {
+	keep := make(map[string]bool, len(applied))
+	for _, manifest := range applied {
+		keep[manifest.object.Metadata.Name] = true
+	}
+
+	var outcomes []applyOutcome
+	var objects []database.Object
+	iterator := client.IterateObjects(ctx, database.ListOptions{Selector: options.pruneSelector})
+	for iterator.Next() {
+		object := iterator.Object()
+		if !keep[object.Metadata.Name] {
+			outcomes = append(outcomes, applyOutcome{name: object.Metadata.Name})
+			objects = append(objects, object)
+		}
+	}
+	if iterator.Err() != nil {
+		return nil, iterator.Err()
+	}
+
+	runParallel(len(objects), options.concurrency, func(i int) {
+		outcomes[i].result = ApplyPruned
+		if options.dryRun {
+			return
+		}
+		// Don't delete the object if it was changed since we listed it
+		_, err := client.DeleteObject(
+			ctx,
+			objects[i].Metadata.Name,
+			objects[i].Metadata.Id,
+			objects[i].Metadata.Revision,
+		)
+		var doesNotExist *database.DoesNotExist
+		if err != nil && !errors.As(err, &doesNotExist) {
+			outcomes[i].result = ApplyFailed
+			outcomes[i].err = err
+		}
+	})
+	return outcomes, nil
+}
+
+type applyOutcome struct {
+	name   string
+	result ApplyResult
+	err    error
+}
+
+// Call the function for each index from 0 to n-1, running at most concurrency
+// of them at a time
+func runParallel(n int, concurrency int, f func(i int)) {
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			f(i)
+		}()
+	}
+	wg.Wait()
+}
+
+const defaultApplyConcurrency = 8
+
+// Label added to objects by "apply --applyset <name>", to find the objects
+// to prune
+const ApplySetLabel = "vogon/applyset"
+
+func apply(args []string) error {
+	options := applyOptions{
+		create:      true,
+		replace:     true,
+		concurrency: defaultApplyConcurrency,
+	}
+	var paths []string
+	prune := false
+	applySet := ""
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "--if-not-exists":
+			if !options.create {
+				return fmt.Errorf("Incompatible options")
+			}
+			options.replace = false
+			options.stripRevision = true
+		case "--force-overwrite":
+			if !options.replace {
+				return fmt.Errorf("Incompatible options")
+			}
+			options.stripRevision = true
+		case "--no-create":
+			if !options.replace {
+				return fmt.Errorf("Incompatible options")
+			}
+			options.create = false
+		case "-f", "--filename":
+			if i+1 >= len(args) {
+				return fmt.Errorf("Missing value for %v", args[i])
+			}
+			i++
+			paths = append(paths, args[i])
+		case "--concurrency":
+			if i+1 >= len(args) {
+				return fmt.Errorf("Missing value for --concurrency")
+			}
+			i++
+			var err error
+			options.concurrency, err = strconv.Atoi(args[i])
+			if err != nil || options.concurrency <= 0 {
+				return fmt.Errorf("Invalid concurrency")
+			}
+		case "--prune":
+			prune = true
+		case "-l", "--selector":
+			if i+1 >= len(args) {
+				return fmt.Errorf("Missing value for %v", args[i])
+			}
+			i++
+			selector, err := database.ParseLabelSelector(args[i])
+			if err != nil {
+				return err
+			}
+			options.pruneSelector = append(options.pruneSelector, selector...)
+		case "--applyset":
+			if i+1 >= len(args) {
+				return fmt.Errorf("Missing value for --applyset")
+			}
+			i++
+			applySet = args[i]
+			if applySet == "" {
+				return fmt.Errorf("Invalid apply set name")
+			}
+			options.pruneSelector = append(options.pruneSelector, database.Requirement{
+				Field:    "metadata.labels." + ApplySetLabel,
+				Operator: database.OpEquals,
+				Values:   []string{applySet},
+			})
+		case "--dry-run":
+			options.dryRun = true
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown option: %v", args[i])
+			os.Exit(2)
+		}
+	}
+	if !options.create && !options.replace {
+		return fmt.Errorf("Nothing to do")
+	}
+	if prune && len(options.pruneSelector) == 0 {
+		return fmt.Errorf("--prune requires --selector or --applyset")
+	} else if !prune && applySet == "" && len(options.pruneSelector) > 0 {
+		return fmt.Errorf("--selector is only used with --prune")
+	}
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	manifests, err := loadManifests(paths, os.Stdin)
+	if err != nil {
+		return err
+	}
+	if applySet != "" {
+		for i := range manifests {
+			labels := make(map[string]string, len(manifests[i].object.Metadata.Labels)+1)
+			for key, value := range manifests[i].object.Metadata.Labels {
+				labels[key] = value
+			}
+			labels[ApplySetLabel] = applySet
+			manifests[i].object.Metadata.Labels = labels
+		}
+	}
+	errs := validateManifests(manifests)
+	if prune {
+		// Otherwise the objects would be pruned on the next run
+		for _, manifest := range manifests {
+			if !options.pruneSelector.Matches(manifest.object) {
+				errs = append(errs, fmt.Errorf(
+					"%s: Object %s does not match the prune selector",
+					manifest.source,
+					manifest.object.Metadata.Name,
+				))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+		return fmt.Errorf("%d errors, nothing was applied", len(errs))
+	}
+
+	ctx := context.Background()
+	client, err := GetClientFromEnv(ctx)
+	if err != nil {
+		return err
+	}
+
+	outcomes := make([]applyOutcome, len(manifests))
+	runParallel(len(manifests), options.concurrency, func(i int) {
+		object := manifests[i].object
+		result, err := applyObject(ctx, client, object, options)
+		outcomes[i] = applyOutcome{name: object.Metadata.Name, result: result, err: err}
+	})
+
+	failed := false
+	for _, outcome := range outcomes {
+		failed = failed || outcome.result == ApplyFailed
+	}
+	if prune {
+		if failed {
+			fmt.Fprintf(os.Stderr, "Some objects failed, not pruning\n")
+		} else {
+			pruned, err := pruneObjects(ctx, client, manifests, options)
+			if err != nil {
+				return err
+			}
+			outcomes = append(outcomes, pruned...)
+		}
+	}
+
+	suffix := ""
+	if options.dryRun {
+		suffix = " (dry run)"
+	}
+	counts := make(map[ApplyResult]int)
+	for _, outcome := range outcomes {
+		counts[outcome.result]++
+		if outcome.err != nil {
+			fmt.Printf("%s %s: %s\n", outcome.name, outcome.result, outcome.err)
+		} else {
+			fmt.Printf("%s %s%s\n", outcome.name, outcome.result, suffix)
+		}
+	}
+	results := []ApplyResult{ApplyCreated, ApplyConfigured, ApplyUnchanged}
+	if prune {
+		results = append(results, ApplyPruned)
+	}
+	results = append(results, ApplyFailed)
+	var summary []string
+	for _, result := range results {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[result], result))
+	}
+	fmt.Printf("%s%s\n", strings.Join(summary, ", "), suffix)
+
+	if counts[ApplyFailed] > 0 {
+		return fmt.Errorf("%d objects failed", counts[ApplyFailed])
+	}
+	return nil
+}
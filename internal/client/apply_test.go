@@ -0,0 +1,76 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+func TestLoadManifests(t *testing.T) {
+	directory := t.TempDir()
+	files := map[string]string{
+		"one.yaml": "" +
+			"kind: example.org/Job\n" +
+			"metadata:\n" +
+			"  name: a\n" +
+			"---\n" +
+			"---\n" +
+			"kind: example.org/Job\n" +
+			"metadata:\n" +
+			"  name: b\n",
+		"sub/two.json": "" +
+			`{"Kind": "example.org/Job", "Metadata": {"Name": "c"}}` + "\n" +
+			`{"Kind": "example.org/Job", "Metadata": {"Name": "d"}}` + "\n",
+		"sub/README.md": "not an object\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(directory, name)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stdin := strings.NewReader("kind: example.org/Job\nmetadata:\n  name: e\n")
+	manifests, err := loadManifests([]string{directory, "-"}, stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, manifest := range manifests {
+		names = append(names, manifest.object.Metadata.Name)
+	}
+	if strings.Join(names, ",") != "a,b,c,d,e" {
+		t.Fatalf("wrong objects: %v", names)
+	}
+	if errs := validateManifests(manifests); len(errs) != 0 {
+		t.Fatalf("valid objects were rejected: %v", errs)
+	}
+
+	// Unknown fields are rejected
+	_, err = decodeManifests(strings.NewReader("kind: k\nmetdata: {}\n"), "test", false)
+	if err == nil {
+		t.Fatal("unknown YAML field was accepted")
+	}
+	_, err = decodeManifests(strings.NewReader(`{"Kind": "k", "Metdata": {}}`), "test", true)
+	if err == nil {
+		t.Fatal("unknown JSON field was accepted")
+	}
+
+	// All the problems are reported
+	invalid := append(manifests, []manifest{
+		{source: "x", object: database.Object{Metadata: database.ObjectMetadata{Name: "f"}}},
+		{source: "y", object: database.Object{Kind: "k", Metadata: database.ObjectMetadata{Name: "Bad"}}},
+		{source: "z", object: database.Object{Kind: "k", Metadata: database.ObjectMetadata{Name: "a"}}},
+	}...)
+	if errs := validateManifests(invalid); len(errs) != 3 {
+		t.Fatalf("wrong errors: %v", errs)
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Whether the user can do something, as answered by the server
+type AccessReview struct {
+	Verb    string
+	Name    string
+	Kind    string `json:",omitempty" yaml:",omitempty"`
+	User    string
+	Groups  []string `json:",omitempty" yaml:",omitempty"`
+	Allowed bool
+}
+
+// Ask the server whether we can do this to the object. If kind is empty,
+// whether we can do it to an object of some kind. (HTTP only)
+func (c *Client) CanI(ctx context.Context, verb string, name string, kind string) (AccessReview, error) {
+	if c.grpc != nil {
+		return AccessReview{}, fmt.Errorf("Access reviews are not supported over gRPC")
+	}
+	query := url.Values{}
+	query.Set("verb", verb)
+	query.Set("name", name)
+	if kind != "" {
+		query.Set("kind", kind)
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", c.uri+"/_can-i?"+query.Encode(), nil)
+	if err != nil {
+		return AccessReview{}, err
+	}
+	request.Header.Set("Accept", c.format)
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return AccessReview{}, fmt.Errorf("checking access: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return AccessReview{}, getError(response)
+	}
+	var review AccessReview
+	err = decodeBody(response, &review)
+	if err != nil {
+		return AccessReview{}, fmt.Errorf("parsing response: %w", err)
+	}
+	return review, nil
+}
+
+func auth(args []string) error {
+	if len(args) < 2 || args[1] != "can-i" {
+		return fmt.Errorf("Unknown auth command, expected can-i")
+	}
+	var kind string
+	var positional []string
+	for i := 2; i < len(args); i++ {
+		switch args[i] {
+		case "--kind":
+			if i+1 >= len(args) {
+				return fmt.Errorf("Missing value for --kind")
+			}
+			i++
+			kind = args[i]
+		default:
+			positional = append(positional, args[i])
+		}
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("Expected a verb and an object name")
+	}
+
+	ctx := context.Background()
+	client, err := GetClientFromEnv(ctx)
+	if err != nil {
+		return err
+	}
+	review, err := client.CanI(ctx, positional[0], positional[1], kind)
+	if err != nil {
+		return err
+	}
+	if review.Allowed {
+		fmt.Println("yes")
+	} else {
+		fmt.Println("no")
+		os.Exit(1)
+	}
+	return nil
+}
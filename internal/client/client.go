@@ -2,68 +2,179 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"google.golang.org/grpc"
+
+	"github.com/remram44/vogon/internal/codec"
 	"github.com/remram44/vogon/internal/database"
+	"github.com/remram44/vogon/internal/grpcapi"
 	"github.com/remram44/vogon/internal/versioning"
 )
 
 type ClientOptions struct {
+	// Location of the server, e.g. "https://localhost:7090", or
+	// "grpc://localhost:7091" ("grpcs://" with TLS) to use the gRPC API
 	Uri string
+	// Maximum time for each request, 0 for no limit
+	Timeout time.Duration
+	// Media type of the bodies exchanged with the server, e.g.
+	// "application/cbor", JSON if empty (HTTP only)
+	Format string
+	// PEM bundle of the CAs to trust for the server's certificate, instead
+	// of the system's
+	CaFile string
+	// Certificate and key (PEM files) to present to the server, if it
+	// requires client certificates
+	CertFile string
+	KeyFile  string
+	// Bearer token sent to authenticate, if set
+	Token string
 }
 
 type Client struct {
 	httpClient http.Client
 	uri        string
+	format     string
+	timeout    time.Duration
+	// Set when using the gRPC API
+	conn *grpc.ClientConn
+	grpc grpcapi.VogonClient
 }
 
-func NewClient(options ClientOptions) (*Client, error) {
+func NewClient(ctx context.Context, options ClientOptions) (*Client, error) {
 	// Remove trailing slash
 	uri := options.Uri
 	if len(uri) > 1 && uri[len(uri)-1] == '/' {
 		uri = uri[:len(uri)-1]
 	}
+	format := codec.Json
+	if options.Format != "" {
+		var ok bool
+		format, ok = codec.Lookup(options.Format)
+		if !ok {
+			return nil, &codec.UnsupportedError{MediaType: options.Format}
+		}
+	}
+	tlsConfig, err := clientTlsConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	var roundTripper http.RoundTripper = transport
+	if options.Token != "" {
+		roundTripper = &tokenTransport{token: options.Token, base: transport}
+	}
 	client := &Client{
-		uri: uri,
+		httpClient: http.Client{
+			Timeout:   options.Timeout,
+			Transport: roundTripper,
+		},
+		uri:     uri,
+		format:  format,
+		timeout: options.Timeout,
+	}
+	var conn *grpc.ClientConn
+	if strings.HasPrefix(uri, GrpcScheme) {
+		conn, err = dialGrpc(uri[len(GrpcScheme):], nil, options.Token)
+	} else if strings.HasPrefix(uri, GrpcTlsScheme) {
+		conn, err = dialGrpc(uri[len(GrpcTlsScheme):], tlsConfig, options.Token)
 	}
-	version, err := client.GetVersion()
 	if err != nil {
+		return nil, err
+	}
+	if conn != nil {
+		client.conn = conn
+		client.grpc = grpcapi.NewVogonClient(conn)
+	}
+	version, err := client.GetVersion(ctx)
+	if err != nil {
+		client.Close()
 		return nil, fmt.Errorf("Ping server: %w", err)
 	}
 	if version != versioning.NameAndVersionString() {
+		client.Close()
 		return nil, fmt.Errorf("Unsupported version")
 	}
 	return client, nil
 }
 
+// Release the connection to the server
+func (c *Client) Close() error {
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// Adds the bearer token to every request
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(request)
+}
+
 type serverVersion struct {
 	Version string `json:"version"`
 }
 
-type jsonMessage struct {
-	Message string `json:"message"`
+// An error returned by the server that doesn't come from the database
+type ServerError struct {
+	StatusCode int
+	Details    database.ErrorDetails
 }
 
+func (e *ServerError) Error() string {
+	if e.Details.Message != "" {
+		return fmt.Sprintf("error from server: %v", e.Details.Message)
+	}
+	return fmt.Sprintf("error from server: %v", http.StatusText(e.StatusCode))
+}
+
+// Rebuild the error from the response, using the database error types if
+// possible (*database.Conflict, *database.DoesNotExist, *database.Invalid)
 func getError(response *http.Response) error {
-	if response.Header.Get("Content-type") == "application/json" {
-		decoder := json.NewDecoder(response.Body)
-		var result jsonMessage
-		err := decoder.Decode(&result)
+	if response.Header.Get("Content-type") != "" {
+		var result database.ErrorDetails
+		err := decodeBody(response, &result)
 		if err == nil {
-			slog.Warn("JSON error from server", "status", response.Status, "message", result.Message)
-			return fmt.Errorf("error from server: %v", result.Message)
+			slog.Debug("error from server", "status", response.Status, "reason", result.Reason, "message", result.Message)
+			err = result.DatabaseError()
+			if err != nil {
+				return err
+			}
+			return &ServerError{
+				StatusCode: response.StatusCode,
+				Details:    result,
+			}
 		}
 	}
-	slog.Warn("non-JSON error from server", "status", response.Status)
-	return fmt.Errorf("error: %v", response.Status)
+	slog.Warn("unreadable error from server", "status", response.Status)
+	return &ServerError{
+		StatusCode: response.StatusCode,
+	}
 }
 
-func (c *Client) GetVersion() (string, error) {
-	request, err := http.NewRequest("GET", c.uri+"/_version", nil)
+func (c *Client) GetVersion(ctx context.Context) (string, error) {
+	if c.grpc != nil {
+		return c.grpcGetVersion(ctx)
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", c.uri+"/_version", nil)
 	if err != nil {
 		return "", err
 	}
@@ -72,6 +183,7 @@ func (c *Client) GetVersion() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("getting version: %w", err)
 	}
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
 		return "", getError(response)
 	}
@@ -85,25 +197,34 @@ func (c *Client) GetVersion() (string, error) {
 	return result.Version, nil
 }
 
-func (c *Client) GetObject(name string) (*database.Object, error) {
-	request, err := http.NewRequest("GET", c.uri+"/"+name, nil)
+// Read a response body, in the format the server picked
+func decodeBody(response *http.Response, value any) error {
+	mediaType, err := codec.ContentType(response.Header.Get("Content-type"))
+	if err != nil {
+		return err
+	}
+	return codec.Decode(response.Body, mediaType, value)
+}
+
+func (c *Client) GetObject(ctx context.Context, name string) (*database.Object, error) {
+	if c.grpc != nil {
+		return c.grpcGetObject(ctx, name)
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", c.uri+"/"+name, nil)
 	if err != nil {
 		return nil, err
 	}
-	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Accept", c.format)
 	response, err := c.httpClient.Do(request)
 	if err != nil {
 		return nil, fmt.Errorf("getting object: %w", err)
 	}
-	if response.StatusCode == 404 {
-		return nil, nil
-	}
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
 		return nil, getError(response)
 	}
-	decoder := json.NewDecoder(response.Body)
 	var result database.Object
-	err = decoder.Decode(&result)
+	err = decodeBody(response, &result)
 	if err != nil {
 		return nil, fmt.Errorf("parsing object: %w", err)
 	}
@@ -126,7 +247,10 @@ type bufferCloser struct {
 func (b bufferCloser) Close() {
 }
 
-func (c *Client) WriteObject(object database.Object, mode WriteMode) (database.MetadataResponse, error) {
+func (c *Client) WriteObject(ctx context.Context, object database.Object, mode WriteMode) (database.MetadataResponse, error) {
+	if c.grpc != nil {
+		return c.grpcWriteObject(ctx, object, mode)
+	}
 	var result database.MetadataResponse
 
 	uri := c.uri + "/" + object.Metadata.Name
@@ -137,30 +261,287 @@ func (c *Client) WriteObject(object database.Object, mode WriteMode) (database.M
 	case Replace:
 		uri += "?create=false"
 	}
-	request, err := http.NewRequest("PUT", uri, nil)
+	request, err := http.NewRequestWithContext(ctx, "PUT", uri, nil)
 	if err != nil {
 		return result, err
 	}
-	request.Header.Set("Accept", "application/json")
-	request.Header.Set("Content-type", "application/json")
+	request.Header.Set("Accept", c.format)
+	request.Header.Set("Content-type", c.format)
+	// When creating, the id and revision in the body only apply if the object
+	// exists, the same as over gRPC
+	if mode == Replace && object.Metadata.Id != "" && object.Metadata.Revision != "" {
+		request.Header.Set("If-Match", ETag(object.Metadata.Id, object.Metadata.Revision))
+	}
 
 	var body bytes.Buffer
-	encoder := json.NewEncoder(&body)
-	encoder.Encode(object)
+	err = codec.Encode(&body, c.format, object)
+	if err != nil {
+		return result, err
+	}
 	request.Body = io.NopCloser(&body)
 
 	response, err := c.httpClient.Do(request)
 	if err != nil {
 		return result, fmt.Errorf("sending object: %w", err)
 	}
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
 		return result, getError(response)
 	}
-	decoder := json.NewDecoder(response.Body)
-	err = decoder.Decode(&result)
+	err = decodeBody(response, &result)
 	if err != nil {
 		return result, fmt.Errorf("parsing response: %w", err)
 	}
 
 	return result, nil
 }
+
+// Entity tag of a version of an object, as sent by the server
+func ETag(id string, revision string) string {
+	return strconv.Quote(id + ":" + revision)
+}
+
+// Update an object with a JSON merge patch (RFC 7386), only if it has the
+// given id and revision if they are not empty (HTTP only)
+//
+//	client.PatchObject(ctx, "team-a/job", map[string]any{
+//		"Spec": map[string]any{"replicas": 3},
+//	}, "", "")
+func (c *Client) PatchObject(ctx context.Context, name string, patch any, id string, revision string) (database.MetadataResponse, error) {
+	if c.grpc != nil {
+		return database.MetadataResponse{}, fmt.Errorf("Patching is not supported over gRPC")
+	}
+	var result database.MetadataResponse
+
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return result, err
+	}
+	request, err := http.NewRequestWithContext(ctx, "PATCH", c.uri+"/"+name, bytes.NewReader(data))
+	if err != nil {
+		return result, err
+	}
+	request.Header.Set("Accept", c.format)
+	request.Header.Set("Content-type", "application/merge-patch+json")
+	if id != "" && revision != "" {
+		request.Header.Set("If-Match", ETag(id, revision))
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return result, fmt.Errorf("patching object: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return result, getError(response)
+	}
+	err = decodeBody(response, &result)
+	if err != nil {
+		return result, fmt.Errorf("parsing response: %w", err)
+	}
+
+	return result, nil
+}
+
+// Delete an object, if id and revision are not empty they have to match
+func (c *Client) DeleteObject(ctx context.Context, name string, id string, revision string) (database.MetadataResponse, error) {
+	if c.grpc != nil {
+		return c.grpcDeleteObject(ctx, name, id, revision)
+	}
+	var result database.MetadataResponse
+
+	uri := c.uri + "/" + name
+	if id != "" && revision == "" {
+		uri += "?" + url.Values{"id": {id}}.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, "DELETE", uri, nil)
+	if err != nil {
+		return result, err
+	}
+	request.Header.Set("Accept", c.format)
+	if revision != "" {
+		if id == "" {
+			return result, &database.Invalid{
+				Reason:  database.ReasonInvalid,
+				Name:    name,
+				Message: "Cannot delete with a previous revision but no previous id",
+			}
+		}
+		request.Header.Set("If-Match", ETag(id, revision))
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return result, fmt.Errorf("deleting object: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return result, getError(response)
+	}
+	err = decodeBody(response, &result)
+	if err != nil {
+		return result, fmt.Errorf("parsing response: %w", err)
+	}
+
+	return result, nil
+}
+
+// Apply several writes atomically, see database.Database.Batch (HTTP only)
+//
+// If an operation fails, none are applied and a *database.BatchError is
+// returned.
+func (c *Client) Batch(ctx context.Context, operations []database.BatchOperation) ([]database.MetadataResponse, error) {
+	if c.grpc != nil {
+		return nil, fmt.Errorf("Batches are not supported over gRPC")
+	}
+
+	var body bytes.Buffer
+	err := codec.Encode(&body, c.format, database.BatchRequest{Operations: operations})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", c.uri+"/_batch", &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", c.format)
+	request.Header.Set("Content-type", c.format)
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("sending batch: %w", err)
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	response.Body = io.NopCloser(bytes.NewReader(data))
+	var result database.BatchResponse
+	err = decodeBody(response, &result)
+	if response.StatusCode != 200 {
+		if err == nil {
+			for i, operation := range result.Results {
+				if operation.Error == nil {
+					continue
+				}
+				err := operation.Error.DatabaseError()
+				if err == nil {
+					err = &ServerError{
+						StatusCode: response.StatusCode,
+						Details:    *operation.Error,
+					}
+				}
+				return nil, &database.BatchError{Index: i, Err: err}
+			}
+		}
+		// Not a batch response, e.g. the request was rejected
+		response.Body = io.NopCloser(bytes.NewReader(data))
+		return nil, getError(response)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing response: %w", err)
+	}
+
+	results := make([]database.MetadataResponse, 0, len(result.Results))
+	for _, operation := range result.Results {
+		results = append(results, operation.Metadata)
+	}
+	return results, nil
+}
+
+// Get a single page of objects
+func (c *Client) ListObjects(ctx context.Context, options database.ListOptions) (database.ListResult, error) {
+	if c.grpc != nil {
+		return c.grpcListObjects(ctx, options)
+	}
+	var result database.ListResult
+
+	query := url.Values{}
+	if options.Prefix != "" {
+		query.Set("prefix", options.Prefix)
+	}
+	if options.Limit > 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.Continue != "" {
+		query.Set("continue", options.Continue)
+	}
+	if len(options.Selector) > 0 {
+		query.Set("fields", options.Selector.String())
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", c.uri+"/_list?"+query.Encode(), nil)
+	if err != nil {
+		return result, err
+	}
+	request.Header.Set("Accept", c.format)
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return result, fmt.Errorf("listing objects: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return result, getError(response)
+	}
+	err = decodeBody(response, &result)
+	if err != nil {
+		return result, fmt.Errorf("parsing objects: %w", err)
+	}
+
+	return result, nil
+}
+
+// Iterates over objects, requesting pages from the server as needed
+//
+//	iterator := client.IterateObjects(ctx, database.ListOptions{Prefix: "team-a"})
+//	for iterator.Next() {
+//		object := iterator.Object()
+//	}
+//	if iterator.Err() != nil {
+//		...
+//	}
+type ObjectIterator struct {
+	client  *Client
+	ctx     context.Context
+	options database.ListOptions
+	page    []database.Object
+	object  database.Object
+	done    bool
+	err     error
+}
+
+// List objects, options.Limit is used as the page size
+func (c *Client) IterateObjects(ctx context.Context, options database.ListOptions) *ObjectIterator {
+	return &ObjectIterator{
+		client:  c,
+		ctx:     ctx,
+		options: options,
+	}
+}
+
+// Advance to the next object, returns false when there are no more objects
+// or an error occurred
+func (it *ObjectIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		result, err := it.client.ListObjects(it.ctx, it.options)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.page = result.Objects
+		it.options.Continue = result.Continue
+		it.done = result.Continue == ""
+	}
+	it.object = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+func (it *ObjectIterator) Object() database.Object {
+	return it.object
+}
+
+func (it *ObjectIterator) Err() error {
+	return it.err
+}
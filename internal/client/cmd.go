@@ -1,38 +1,135 @@
 package client
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"gopkg.in/yaml.v3"
-
+	"github.com/remram44/vogon/internal/codec"
 	"github.com/remram44/vogon/internal/commands"
 	"github.com/remram44/vogon/internal/database"
 	"github.com/remram44/vogon/internal/versioning"
 )
 
-func GetClientFromEnv() (*Client, error) {
+// Get a client configured from the config file and environment variables
+func GetClientFromEnv(ctx context.Context) (*Client, error) {
+	options, err := optionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(ctx, options)
+}
+
+func optionsFromEnv() (ClientOptions, error) {
+	config, err := ReadConfig()
+	if err != nil {
+		return ClientOptions{}, err
+	}
 	options := ClientOptions{
-		Uri: os.Getenv("VOGON_SERVER_URI"),
+		Uri:      config.ServerUri,
+		Timeout:  config.Timeout,
+		Format:   config.Format,
+		CaFile:   config.CaFile,
+		CertFile: config.ClientCert,
+		KeyFile:  config.ClientKey,
+		Token:    config.Token,
+	}
+	for variable, option := range map[string]*string{
+		"VOGON_SERVER_URI":  &options.Uri,
+		"VOGON_FORMAT":      &options.Format,
+		"VOGON_CA_FILE":     &options.CaFile,
+		"VOGON_CLIENT_CERT": &options.CertFile,
+		"VOGON_CLIENT_KEY":  &options.KeyFile,
+		"VOGON_TOKEN":       &options.Token,
+	} {
+		if value := os.Getenv(variable); value != "" {
+			*option = value
+		}
+	}
+	timeout := os.Getenv("VOGON_TIMEOUT")
+	if timeout != "" {
+		options.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return ClientOptions{}, fmt.Errorf("Invalid timeout, check $VOGON_TIMEOUT")
+		}
+	}
+	if options.Format != "" {
+		if _, ok := codec.Lookup(options.Format); !ok {
+			return ClientOptions{}, fmt.Errorf("Unsupported format, check $VOGON_FORMAT and the config file")
+		}
+	}
+	return options, nil
+}
+
+func login(args []string) error {
+	var token string
+	switch len(args) {
+	case 1:
+		// Read from stdin, to keep it out of the shell history
+		fmt.Fprintf(os.Stderr, "Token: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		token = strings.TrimSpace(line)
+	case 2:
+		token = args[1]
+	default:
+		return fmt.Errorf("Too many arguments")
+	}
+	if token == "" {
+		return fmt.Errorf("Missing token")
 	}
-	client, err := NewClient(options)
+
+	// Check that the server accepts it
+	ctx := context.Background()
+	options, err := optionsFromEnv()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	options.Token = token
+	client, err := NewClient(ctx, options)
+	if err != nil {
+		return err
+	}
+	client.Close()
+
+	config, err := ReadConfig()
+	if err != nil {
+		return err
 	}
-	return client, nil
+	config.Token = token
+	if config.ServerUri == "" {
+		config.ServerUri = options.Uri
+	}
+	err = WriteConfig(config)
+	if err != nil {
+		return err
+	}
+	if os.Getenv("VOGON_TOKEN") != "" {
+		fmt.Fprintf(os.Stderr, "Warning: $VOGON_TOKEN is set and takes precedence over the stored token\n")
+	}
+	return nil
 }
 
 func version(args []string) error {
+	ctx := context.Background()
+
 	fmt.Printf("Client: %s\n", versioning.NameAndVersionString())
 
-	client, err := GetClientFromEnv()
+	client, err := GetClientFromEnv(ctx)
 	if err != nil {
 		return err
 	}
 
-	version, err := client.GetVersion()
+	version, err := client.GetVersion(ctx)
 	if err != nil {
 		return err
 	}
@@ -48,13 +145,14 @@ func get(args []string) error {
 	}
 
 	name := args[1]
+	ctx := context.Background()
 
-	client, err := GetClientFromEnv()
+	client, err := GetClientFromEnv(ctx)
 	if err != nil {
 		return err
 	}
 
-	object, err := client.GetObject(name)
+	object, err := client.GetObject(ctx, name)
 	if err != nil {
 		return err
 	}
@@ -66,81 +164,91 @@ func get(args []string) error {
 	return nil
 }
 
-func apply(args []string) error {
-	create := true
-	replace := true
-	stripRevision := false
-	for _, opt := range args[1:] {
-		switch opt {
-		case "--if-not-exists":
-			if !create {
-				return fmt.Errorf("Incompatible options")
+func list(args []string) error {
+	options := database.ListOptions{}
+	printJson := false
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "--prefix":
+			if i+1 >= len(args) {
+				return fmt.Errorf("Missing value for --prefix")
+			}
+			i++
+			options.Prefix = args[i]
+		case "--page-size":
+			if i+1 >= len(args) {
+				return fmt.Errorf("Missing value for --page-size")
+			}
+			i++
+			pageSize, err := strconv.Atoi(args[i])
+			if err != nil || pageSize <= 0 {
+				return fmt.Errorf("Invalid page size")
 			}
-			replace = false
-			stripRevision = true
-		case "--force-overwrite":
-			if !replace {
-				return fmt.Errorf("Incompatible options")
+			options.Limit = pageSize
+		case "-l", "--labels":
+			if i+1 >= len(args) {
+				return fmt.Errorf("Missing value for %v", args[i])
 			}
-			stripRevision = true
-		case "--no-create":
-			if !replace {
-				return fmt.Errorf("Incompatible options")
+			i++
+			selector, err := database.ParseLabelSelector(args[i])
+			if err != nil {
+				return err
 			}
-			create = false
+			options.Selector = append(options.Selector, selector...)
+		case "--fields":
+			if i+1 >= len(args) {
+				return fmt.Errorf("Missing value for --fields")
+			}
+			i++
+			selector, err := database.ParseSelector(args[i])
+			if err != nil {
+				return err
+			}
+			options.Selector = append(options.Selector, selector...)
+		case "--json":
+			printJson = true
 		default:
-			fmt.Fprintf(os.Stderr, "Unknown option: %v", opt)
+			fmt.Fprintf(os.Stderr, "Unknown option: %v", args[i])
 			os.Exit(2)
 		}
 	}
 
-	decoder := yaml.NewDecoder(os.Stdin)
-	decoder.KnownFields(true)
-	var object database.Object
-	err := decoder.Decode(&object)
+	ctx := context.Background()
+	client, err := GetClientFromEnv(ctx)
 	if err != nil {
 		return err
 	}
 
-	valid := true
-	if object.Kind == "" {
-		fmt.Fprintf(os.Stderr, "Missing kind\n")
-		valid = false
-	}
-	if object.Metadata.Name == "" {
-		fmt.Fprintf(os.Stderr, "Missing name\n")
-		valid = false
-	}
-	if !valid {
-		return fmt.Errorf("object is not valid")
-	}
-
-	if stripRevision {
-		object.Metadata.Id = ""
-		object.Metadata.Revision = ""
-	}
-
-	var mode WriteMode
-	if create && replace {
-		mode = CreateOrReplace
-	} else if create {
-		mode = Create
-	} else if replace {
-		mode = Replace
-	} else {
-		return fmt.Errorf("Nothing to do")
-	}
-
-	client, err := GetClientFromEnv()
-	if err != nil {
-		return err
+	// Print objects as pages come in
+	encoder := json.NewEncoder(os.Stdout)
+	iterator := client.IterateObjects(ctx, options)
+	for iterator.Next() {
+		object := iterator.Object()
+		if printJson {
+			err = encoder.Encode(object)
+		} else {
+			_, err = fmt.Printf("%s %s %s\n", object.Metadata.Name, object.Kind, object.Version)
+		}
+		if err != nil {
+			return err
+		}
 	}
-
-	_, err = client.WriteObject(object, mode)
-	return err
+	return iterator.Err()
 }
 
 func init() {
+	commands.Register("login", &commands.Command{
+		PrintUsage: func(w io.Writer) {
+			fmt.Fprintf(
+				w,
+				""+
+					"  login [<token>]\n"+
+					"    Check a token with the server and store it in the config file,\n"+
+					"    reading it from stdin if not given\n",
+			)
+		},
+		Run: login,
+	})
 	commands.Register("version", &commands.Command{
 		PrintUsage: func(w io.Writer) {
 			fmt.Fprintf(
@@ -163,13 +271,50 @@ func init() {
 		},
 		Run: get,
 	})
+	commands.Register("list", &commands.Command{
+		PrintUsage: func(w io.Writer) {
+			fmt.Fprintf(
+				w,
+				""+
+					"  list [--prefix <name>] [--page-size <n>] [--json]\n"+
+					"       [-l|--labels <selector>] [--fields <selector>]\n"+
+					"    List objects from the API, printing name, kind, and version\n"+
+					"    or one JSON object per line\n"+
+					"    Selectors are comma-separated requirements, for example:\n"+
+					"      --labels 'app=web,tier in (frontend,backend),!canary'\n"+
+					"      --fields 'kind=example.org/Job,spec.priority>=5,status.phase!=Done'\n"+
+					"    A backslash escapes special characters in values, e.g. 'a\\,b'\n",
+			)
+		},
+		Run: list,
+	})
+	commands.Register("auth", &commands.Command{
+		PrintUsage: func(w io.Writer) {
+			fmt.Fprintf(
+				w,
+				""+
+					"  auth can-i <verb> <name> [--kind <kind>]\n"+
+					"    Check whether you can get, list, watch, create, update, or\n"+
+					"    delete an object, printing yes or no\n",
+			)
+		},
+		Run: auth,
+	})
 	commands.Register("apply", &commands.Command{
 		PrintUsage: func(w io.Writer) {
 			fmt.Fprintf(
 				w,
 				""+
-					"  apply\n"+
-					"    Create/replace/update object(s) from JSON on stdin\n",
+					"  apply [-f <path>]... [--concurrency <n>]\n"+
+					"        [--if-not-exists | --force-overwrite | --no-create]\n"+
+					"        [--prune (-l|--selector <selector> | --applyset <name>)]\n"+
+					"        [--dry-run]\n"+
+					"    Create/replace/update objects from YAML or JSON files,\n"+
+					"    directories (recursively), or stdin (\"-\", the default)\n"+
+					"    All objects are validated before any is written\n"+
+					"    With --prune, objects matching the label selector that are\n"+
+					"    not in the input are deleted. --applyset labels the objects\n"+
+					"    with vogon/applyset=<name> and prunes using that label\n",
 			)
 		},
 		Run: apply,
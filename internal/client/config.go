@@ -0,0 +1,95 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings of the command-line client, read from $VOGON_CONFIG or
+// ~/.config/vogon/config.yaml. The environment variables take precedence.
+type ClientConfig struct {
+	ServerUri  string        `yaml:"server_uri,omitempty"`
+	Timeout    time.Duration `yaml:"timeout,omitempty"`
+	Format     string        `yaml:"format,omitempty"`
+	CaFile     string        `yaml:"ca_file,omitempty"`
+	ClientCert string        `yaml:"client_cert,omitempty"`
+	ClientKey  string        `yaml:"client_key,omitempty"`
+	Token      string        `yaml:"token,omitempty"`
+}
+
+// Location of the client's config file
+func ConfigPath() (string, error) {
+	if path := os.Getenv("VOGON_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "vogon", "config.yaml"), nil
+}
+
+// Read the client's config file, returns an empty config if it doesn't exist
+func ReadConfig() (ClientConfig, error) {
+	var config ClientConfig
+	path, err := ConfigPath()
+	if err != nil {
+		return config, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return config, fmt.Errorf("Reading config file %v: %w", path, err)
+	}
+	return config, nil
+}
+
+// Replace the client's config file, which is only readable by the user as it
+// can contain a token
+func WriteConfig(config ClientConfig) error {
+	path, err := ConfigPath()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so it is never truncated
+	f, err := os.CreateTemp(filepath.Dir(path), ".config-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv("VOGON_CONFIG", filename)
+
+	config, err := ReadConfig()
+	if err != nil || config != (ClientConfig{}) {
+		t.Fatalf("missing file: %#v %v", config, err)
+	}
+
+	err = os.WriteFile(filename, []byte(""+
+		"server_uri: https://vogon.example.org\n"+
+		"timeout: 30s\n"+
+		"token: abc\n",
+	), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ClientConfig{
+		ServerUri: "https://vogon.example.org",
+		Timeout:   30 * time.Second,
+		Token:     "abc",
+	}
+	if config != expected {
+		t.Fatalf("wrong config: %#v", config)
+	}
+
+	err = os.WriteFile(filename, []byte("password: abc\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadConfig()
+	if err == nil {
+		t.Fatal("no error for unknown key")
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "vogon", "config.yaml")
+	t.Setenv("VOGON_CONFIG", filename)
+
+	config := ClientConfig{
+		ServerUri: "grpcs://vogon.example.org:7091",
+		Timeout:   time.Minute,
+		Token:     "abc",
+	}
+	err := WriteConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("config file is readable by others: %v", info.Mode())
+	}
+	read, err := ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != config {
+		t.Fatalf("wrong config: %#v", read)
+	}
+}
@@ -0,0 +1,272 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/remram44/vogon/internal/database"
+	"github.com/remram44/vogon/internal/grpcapi"
+)
+
+// URI schemes selecting the gRPC API, e.g. "grpc://localhost:7091", in
+// cleartext or over TLS
+const (
+	GrpcScheme    = "grpc://"
+	GrpcTlsScheme = "grpcs://"
+)
+
+// Connect in cleartext if tlsConfig is nil, sending the token if not empty
+func dialGrpc(target string, tlsConfig *tls.Config, token string) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	options := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(tokenCredentials(token)))
+	}
+	return grpc.NewClient(target, options...)
+}
+
+// Sends a bearer token with every call
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// Allow cleartext connections, like the HTTP client does
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// Rebuild the error from a gRPC status, using the database error types if
+// possible, like getError
+func getGrpcError(err error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	details, ok := grpcapi.DetailsFromStatus(s)
+	if !ok {
+		return fmt.Errorf("error from server: %w", err)
+	}
+	if dbErr := details.DatabaseError(); dbErr != nil {
+		return dbErr
+	}
+	return &ServerError{
+		Details: details,
+	}
+}
+
+// Apply the client's timeout to a unary call
+func (c *Client) grpcContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout > 0 {
+		return context.WithTimeout(ctx, c.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (c *Client) grpcGetVersion(ctx context.Context) (string, error) {
+	ctx, cancel := c.grpcContext(ctx)
+	defer cancel()
+	response, err := c.grpc.GetVersion(ctx, &grpcapi.GetVersionRequest{})
+	if err != nil {
+		return "", getGrpcError(err)
+	}
+	return response.Version, nil
+}
+
+func (c *Client) grpcGetObject(ctx context.Context, name string) (*database.Object, error) {
+	ctx, cancel := c.grpcContext(ctx)
+	defer cancel()
+	response, err := c.grpc.Get(ctx, &grpcapi.GetRequest{Name: name})
+	if err != nil {
+		return nil, getGrpcError(err)
+	}
+	object := grpcapi.ToObject(response)
+	return &object, nil
+}
+
+func (c *Client) grpcWriteObject(ctx context.Context, object database.Object, mode WriteMode) (database.MetadataResponse, error) {
+	ctx, cancel := c.grpcContext(ctx)
+	defer cancel()
+	converted, err := grpcapi.FromObject(object)
+	if err != nil {
+		return database.MetadataResponse{}, err
+	}
+	var response *grpcapi.MetadataResponse
+	switch mode {
+	case CreateOrReplace:
+		response, err = c.grpc.Create(ctx, &grpcapi.CreateRequest{Object: converted, Replace: true})
+	case Create:
+		response, err = c.grpc.Create(ctx, &grpcapi.CreateRequest{Object: converted})
+	case Replace:
+		response, err = c.grpc.Update(ctx, &grpcapi.UpdateRequest{Object: converted})
+	}
+	if err != nil {
+		return database.MetadataResponse{}, getGrpcError(err)
+	}
+	return grpcapi.ToMetadata(response), nil
+}
+
+func (c *Client) grpcDeleteObject(ctx context.Context, name string, id string, revision string) (database.MetadataResponse, error) {
+	ctx, cancel := c.grpcContext(ctx)
+	defer cancel()
+	response, err := c.grpc.Delete(ctx, &grpcapi.DeleteRequest{
+		Name:     name,
+		Id:       id,
+		Revision: revision,
+	})
+	if err != nil {
+		return database.MetadataResponse{}, getGrpcError(err)
+	}
+	return grpcapi.ToMetadata(response), nil
+}
+
+func (c *Client) grpcListObjects(ctx context.Context, options database.ListOptions) (database.ListResult, error) {
+	ctx, cancel := c.grpcContext(ctx)
+	defer cancel()
+	request := &grpcapi.ListRequest{
+		Prefix:   options.Prefix,
+		Limit:    int32(options.Limit),
+		Continue: options.Continue,
+	}
+	if len(options.Selector) > 0 {
+		request.Fields = options.Selector.String()
+	}
+	response, err := c.grpc.List(ctx, request)
+	if err != nil {
+		return database.ListResult{}, getGrpcError(err)
+	}
+	result := database.ListResult{
+		Objects:  make([]database.Object, 0, len(response.Objects)),
+		Continue: response.Continue,
+	}
+	for _, object := range response.Objects {
+		result.Objects = append(result.Objects, grpcapi.ToObject(object))
+	}
+	return result, nil
+}
+
+type WatchEventType string
+
+const (
+	Added    WatchEventType = "ADDED"
+	Modified WatchEventType = "MODIFIED"
+	Deleted  WatchEventType = "DELETED"
+)
+
+type WatchEvent struct {
+	Type WatchEventType
+	// The new version of the object, or the last one seen if it was deleted
+	Object database.Object
+	// Pass this to WatchObjects to resume after this event, 0 if the watch
+	// can't be resumed from here
+	Sequence uint64
+}
+
+// Receives the objects that exist, then the changes to them
+//
+//	watcher, err := client.WatchObjects(ctx, database.ListOptions{Prefix: "team-a"}, 0)
+//	if err != nil {
+//		...
+//	}
+//	defer watcher.Close()
+//	for watcher.Next() {
+//		event := watcher.Event()
+//	}
+//	if watcher.Err() != nil {
+//		...
+//	}
+type ObjectWatcher struct {
+	stream grpcapi.Vogon_WatchClient
+	cancel context.CancelFunc
+	event  WatchEvent
+	err    error
+}
+
+// Watch objects, options.Limit and options.Continue are ignored
+//
+// If since is not 0, the watch resumes after the event with that sequence
+// number instead of starting with the objects that exist. Objects deleted
+// since are only sent with their name. The watcher ends with a
+// *database.Expired error if the server no longer has the changes, in which
+// case the objects have to be watched again from 0.
+//
+// This is only supported over gRPC.
+func (c *Client) WatchObjects(ctx context.Context, options database.ListOptions, since uint64) (*ObjectWatcher, error) {
+	if c.grpc == nil {
+		return nil, fmt.Errorf("Watching is only supported over gRPC")
+	}
+	request := &grpcapi.WatchRequest{
+		Prefix: options.Prefix,
+		Since:  since,
+	}
+	if len(options.Selector) > 0 {
+		request.Fields = options.Selector.String()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.grpc.Watch(ctx, request)
+	if err != nil {
+		cancel()
+		return nil, getGrpcError(err)
+	}
+	return &ObjectWatcher{
+		stream: stream,
+		cancel: cancel,
+	}, nil
+}
+
+var watchEventTypes = map[grpcapi.WatchEvent_Type]WatchEventType{
+	grpcapi.WatchEvent_ADDED:    Added,
+	grpcapi.WatchEvent_MODIFIED: Modified,
+	grpcapi.WatchEvent_DELETED:  Deleted,
+}
+
+// Wait for the next event, returns false when the watch ends or an error
+// occurred
+func (w *ObjectWatcher) Next() bool {
+	if w.err != nil {
+		return false
+	}
+	event, err := w.stream.Recv()
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			w.err = getGrpcError(err)
+		}
+		return false
+	}
+	eventType, ok := watchEventTypes[event.Type]
+	if !ok {
+		w.err = fmt.Errorf("Unknown event type %v", event.Type)
+		return false
+	}
+	w.event = WatchEvent{
+		Type:     eventType,
+		Object:   grpcapi.ToObject(event.Object),
+		Sequence: event.Sequence,
+	}
+	return true
+}
+
+func (w *ObjectWatcher) Event() WatchEvent {
+	return w.event
+}
+
+func (w *ObjectWatcher) Err() error {
+	return w.err
+}
+
+// Stop watching
+func (w *ObjectWatcher) Close() {
+	w.cancel()
+}
@@ -0,0 +1,184 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	Json    = "application/json"
+	Yaml    = "application/yaml"
+	Cbor    = "application/cbor"
+	Msgpack = "application/msgpack"
+)
+
+// Supported media types, in order of preference when the client accepts
+// several of them equally
+var MediaTypes = []string{Json, Yaml, Cbor, Msgpack}
+
+// Other names in use for the same formats
+var aliases = map[string]string{
+	"application/x-yaml":      Yaml,
+	"text/yaml":               Yaml,
+	"application/x-msgpack":   Msgpack,
+	"application/vnd.msgpack": Msgpack,
+}
+
+// The unsupported media type given by the client
+type UnsupportedError struct {
+	MediaType string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("Unsupported media type %v", e.MediaType)
+}
+
+var cborEncMode, cborDecMode = func() (cbor.EncMode, cbor.DecMode) {
+	encMode, err := cbor.EncOptions{
+		Time: cbor.TimeRFC3339Nano,
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	decMode, err := cbor.DecOptions{
+		DefaultMapType:    reflect.TypeOf(map[string]any(nil)),
+		ExtraReturnErrors: cbor.ExtraDecErrorUnknownField,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return encMode, decMode
+}()
+
+// Get the supported media type with that name, without parameters
+func Lookup(mediaType string) (string, bool) {
+	mediaType = strings.ToLower(mediaType)
+	if canonical, ok := aliases[mediaType]; ok {
+		return canonical, true
+	}
+	for _, supported := range MediaTypes {
+		if mediaType == supported {
+			return supported, true
+		}
+	}
+	return "", false
+}
+
+// Get the format of a body from its Content-Type header, JSON if it is
+// not set
+func ContentType(header string) (string, error) {
+	if header == "" {
+		return Json, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", &UnsupportedError{MediaType: header}
+	}
+	supported, ok := Lookup(mediaType)
+	if !ok {
+		return "", &UnsupportedError{MediaType: mediaType}
+	}
+	return supported, nil
+}
+
+// Pick the format of a response from the Accept header, JSON if it is not
+// set, false if the client accepts none of the supported formats
+func Negotiate(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return Json, true
+	}
+	best := ""
+	bestQuality := 0.0
+	bestRank := len(MediaTypes)
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		var candidate string
+		if mediaType == "*/*" || mediaType == "application/*" {
+			candidate = Json
+		} else if supported, ok := Lookup(mediaType); ok {
+			candidate = supported
+		} else {
+			continue
+		}
+		rank := 0
+		for rank < len(MediaTypes) && MediaTypes[rank] != candidate {
+			rank++
+		}
+		if quality > bestQuality || (quality == bestQuality && rank < bestRank) {
+			best = candidate
+			bestQuality = quality
+			bestRank = rank
+		}
+	}
+	return best, best != ""
+}
+
+// Write a value in the given format
+func Encode(w io.Writer, mediaType string, value any) error {
+	switch mediaType {
+	case Json:
+		return json.NewEncoder(w).Encode(value)
+	case Yaml:
+		encoder := yaml.NewEncoder(w)
+		err := encoder.Encode(value)
+		if err != nil {
+			return err
+		}
+		return encoder.Close()
+	case Cbor:
+		return cborEncMode.NewEncoder(w).Encode(value)
+	case Msgpack:
+		encoder := msgpack.NewEncoder(w)
+		encoder.SetCustomStructTag("json")
+		encoder.UseCompactInts(true)
+		return encoder.Encode(value)
+	default:
+		return &UnsupportedError{MediaType: mediaType}
+	}
+}
+
+// Read a value in the given format, failing on fields that don't exist in
+// the destination
+func Decode(r io.Reader, mediaType string, value any) error {
+	switch mediaType {
+	case Json:
+		decoder := json.NewDecoder(r)
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(value)
+	case Yaml:
+		decoder := yaml.NewDecoder(r)
+		decoder.KnownFields(true)
+		return decoder.Decode(value)
+	case Cbor:
+		return cborDecMode.NewDecoder(r).Decode(value)
+	case Msgpack:
+		decoder := msgpack.NewDecoder(r)
+		decoder.SetCustomStructTag("json")
+		decoder.DisallowUnknownFields(true)
+		return decoder.Decode(value)
+	default:
+		return &UnsupportedError{MediaType: mediaType}
+	}
+}
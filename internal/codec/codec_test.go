@@ -0,0 +1,29 @@
+package codec
+
+import (
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	for _, test := range []struct {
+		accept    string
+		mediaType string
+		ok        bool
+	}{
+		{"", Json, true},
+		{"*/*", Json, true},
+		{"application/cbor", Cbor, true},
+		{"application/x-msgpack", Msgpack, true},
+		{"text/html, application/*;q=0.9", Json, true},
+		{"application/msgpack;q=0.5, application/yaml;q=0.8", Yaml, true},
+		{"application/cbor, application/json", Json, true},
+		{"application/json;q=0, application/cbor;q=0.1", Cbor, true},
+		{"text/html", "", false},
+		{"application/json;q=0", "", false},
+	} {
+		mediaType, ok := Negotiate(test.accept)
+		if mediaType != test.mediaType || ok != test.ok {
+			t.Errorf("%q: got %q %v, expected %q %v", test.accept, mediaType, ok, test.mediaType, test.ok)
+		}
+	}
+}
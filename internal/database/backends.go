@@ -0,0 +1,47 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"slices"
+)
+
+// A database backend, registered under a type name
+//
+// The "database" section of the apiserver config selects a backend with its
+// "type" key, the other keys are decoded into the struct returned by
+// NewConfig.
+type Backend struct {
+	// Return a pointer to a new configuration struct, with "yaml" tags
+	NewConfig func() any
+	// Open a database from the configuration struct returned by NewConfig
+	Connect func(config any) (Database, error)
+}
+
+var backends = make(map[string]*Backend)
+
+// Register a backend, usually from an init() function
+//
+// Backends from other packages are made available by importing them from
+// cmd/vogon.
+func RegisterBackend(name string, backend *Backend) {
+	_, present := backends[name]
+	if present {
+		fmt.Fprintf(os.Stderr, "internal error: duplicate database backend %#v\n", name)
+		os.Exit(2)
+	}
+	backends[name] = backend
+}
+
+func GetBackend(name string) *Backend {
+	return backends[name]
+}
+
+func BackendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
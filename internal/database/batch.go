@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+type BatchOperationType string
+
+const (
+	BatchCreate BatchOperationType = "create"
+	BatchUpdate BatchOperationType = "update"
+	BatchDelete BatchOperationType = "delete"
+)
+
+// One of the writes of a batch, with the same preconditions as the
+// corresponding Database method
+type BatchOperation struct {
+	Operation BatchOperationType
+	// Object to create or update
+	Object Object
+	// Replace the object if it exists (create only)
+	Replace bool
+	// Object to delete, only if it has the Id and Revision if they are set
+	Name     string
+	Id       string
+	Revision string
+}
+
+// Returned by Batch when an operation failed, in which case none of them
+// were applied
+type BatchError struct {
+	// Position of the operation that failed
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("Operation %d of batch: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// The name of the object an operation writes
+func (op *BatchOperation) name() string {
+	if op.Operation == BatchDelete {
+		return op.Name
+	}
+	return op.Object.Metadata.Name
+}
+
+// A write that passed its preconditions, to be applied to the store
+type preparedWrite struct {
+	name string
+	// The object to write, nil to delete
+	object *Object
+}
+
+func (db *KvDatabase) Batch(ctx context.Context, operations []BatchOperation) ([]MetadataResponse, error) {
+	for i, op := range operations {
+		switch op.Operation {
+		case BatchCreate, BatchUpdate, BatchDelete:
+		default:
+			return nil, &BatchError{Index: i, Err: &Invalid{
+				Reason:  ReasonInvalid,
+				Message: fmt.Sprintf("Invalid operation %#v", op.Operation),
+			}}
+		}
+		if err := ValidateName(op.name()); err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+	}
+	if err := db.mutex.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer db.mutex.Unlock()
+
+	// Check every precondition against the state left by the previous
+	// operations, before writing anything
+	original := make(map[string]*Object)
+	current := make(map[string]*Object)
+	writes := make([]preparedWrite, 0, len(operations))
+	results := make([]MetadataResponse, 0, len(operations))
+	for i, op := range operations {
+		name := op.name()
+		previous, seen := current[name]
+		if !seen {
+			var err error
+			previous, err = db.readExisting(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			original[name] = previous
+		}
+
+		var object *Object
+		var err error
+		switch op.Operation {
+		case BatchCreate:
+			var prepared Object
+			prepared, err = db.prepareCreate(op.Object, op.Replace, previous)
+			object = &prepared
+		case BatchUpdate:
+			var prepared Object
+			prepared, err = db.prepareUpdate(op.Object, previous)
+			object = &prepared
+		case BatchDelete:
+			err = checkDelete(name, op.Id, op.Revision, previous)
+		}
+		if err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+
+		current[name] = object
+		writes = append(writes, preparedWrite{name: name, object: object})
+		var result MetadataResponse
+		if object != nil {
+			result = MetadataResponse{
+				Id:       object.Metadata.Id,
+				Revision: object.Metadata.Revision,
+			}
+		} else {
+			result = MetadataResponse{
+				Id:       previous.Metadata.Id,
+				Revision: previous.Metadata.Revision,
+			}
+		}
+		result.setPrevious(previous)
+		results = append(results, result)
+	}
+
+	for i, write := range writes {
+		err := db.applyWrite(ctx, write)
+		if err != nil {
+			db.rollback(ctx, writes[:i+1], original)
+			return nil, &BatchError{Index: i, Err: err}
+		}
+	}
+	return results, nil
+}
+
+// Write or delete an object and update the indexes. Must be called with the
+// lock held.
+func (db *KvDatabase) applyWrite(ctx context.Context, write preparedWrite) error {
+	if write.object == nil {
+		err := db.store.Delete(ctx, write.name)
+		if err != nil {
+			return err
+		}
+		db.indexDelete(write.name)
+	} else {
+		err := db.store.Write(ctx, write.name, *write.object)
+		if err != nil {
+			return err
+		}
+		db.indexWrite(*write.object)
+	}
+	return nil
+}
+
+// Put back the objects as they were before the batch, after some of its
+// writes were applied. Must be called with the lock held.
+func (db *KvDatabase) rollback(ctx context.Context, applied []preparedWrite, original map[string]*Object) {
+	// Finish even if the request was cancelled, to not leave the batch half
+	// applied
+	ctx = context.WithoutCancel(ctx)
+
+	restored := make(map[string]bool)
+	for i := len(applied) - 1; i >= 0; i-- {
+		name := applied[i].name
+		if restored[name] {
+			continue
+		}
+		restored[name] = true
+		err := db.applyWrite(ctx, preparedWrite{name: name, object: original[name]})
+		if _, ok := err.(*DoesNotExist); ok {
+			err = nil
+		}
+		if err != nil {
+			slog.Error("error rolling back batch", "name", name, "error", err)
+		}
+	}
+}
+
+// Body of a batch request to the API
+type BatchRequest struct {
+	Operations []BatchOperation
+}
+
+// Response to a batch request, with one result per operation. If it failed,
+// no Metadata is set and only the operation that caused the failure has an
+// Error.
+type BatchResponse struct {
+	Results []BatchResult
+}
+
+type BatchResult struct {
+	Metadata MetadataResponse
+	Error    *ErrorDetails `json:",omitempty" yaml:",omitempty"`
+}
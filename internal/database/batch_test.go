@@ -0,0 +1,107 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// A store that fails to write one of the keys
+type failingKv struct {
+	KeyValueStore
+	failKey string
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (kv *failingKv) Write(ctx context.Context, key string, value Object) error {
+	if key == kv.failKey {
+		return errDiskFull
+	}
+	return kv.KeyValueStore.Write(ctx, key, value)
+}
+
+func TestBatchRollback(t *testing.T) {
+	ctx := context.Background()
+	directory := t.TempDir()
+	filesDb, err := NewFilesDatabase(directory, FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, db := range map[string]*KvDatabase{
+		"inmemory": NewInMemoryDatabase(),
+		"files":    filesDb,
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, name := range []string{"a", "b"} {
+				_, err := db.Create(ctx, Object{
+					Kind:     "example.org/Example",
+					Metadata: ObjectMetadata{Name: name},
+					Spec:     map[string]any{"value": name},
+				}, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			a, err := db.Get(ctx, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			store := db.store
+			db.store = &failingKv{KeyValueStore: store, failKey: "c"}
+			_, err = db.Batch(ctx, []BatchOperation{
+				{Operation: BatchUpdate, Object: Object{
+					Kind:     "example.org/Example",
+					Metadata: ObjectMetadata{Name: "a"},
+					Spec:     map[string]any{"value": "changed"},
+				}},
+				{Operation: BatchDelete, Name: "b"},
+				{Operation: BatchCreate, Object: Object{
+					Kind:     "example.org/Example",
+					Metadata: ObjectMetadata{Name: "c"},
+				}},
+			})
+			var batchErr *BatchError
+			if !errors.As(err, &batchErr) || batchErr.Index != 2 || !errors.Is(err, errDiskFull) {
+				t.Fatalf("batch didn't fail on the third operation: %#v", err)
+			}
+
+			// The first two operations were rolled back
+			db.store = store
+			check := func(db *KvDatabase) {
+				t.Helper()
+				result, err := db.List(ctx, ListOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(result.Objects) != 2 ||
+					result.Objects[0].Metadata.Revision != a.Metadata.Revision ||
+					result.Objects[0].Spec.(map[string]any)["value"] != "a" ||
+					result.Objects[1].Metadata.Name != "b" {
+					t.Fatalf("batch was not rolled back: %#v", result.Objects)
+				}
+				selector, err := ParseSelector("kind=example.org/Example")
+				if err != nil {
+					t.Fatal(err)
+				}
+				result, err = db.List(ctx, ListOptions{Selector: selector})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(result.Objects) != 2 {
+					t.Fatalf("indexes were not rolled back: %#v", result.Objects)
+				}
+			}
+			check(db)
+			if name == "files" {
+				reopened, err := NewFilesDatabase(directory, FilesOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				check(reopened)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Implemented by databases that number their changes, so that watchers can
+// follow them without listing every object, and resume where they left off
+type ChangeFeed interface {
+	// Sequence number of the last change, 0 if there was none
+	LastSequence(ctx context.Context) (uint64, error)
+
+	// Get the changes after the sequence number, in order, including those
+	// made by other processes. Returns an *Expired error if some of them are
+	// no longer available, for example after the journal was compacted.
+	ChangesSince(ctx context.Context, since uint64) ([]JournalEntry, error)
+}
+
+// Implemented by stores that record their changes. Called with the lock held.
+type changeLog interface {
+	lastSequence() (uint64, error)
+	changesSince(since uint64) ([]JournalEntry, error)
+}
+
+// Number of recent changes kept in memory
+const maxRecentChanges = 10000
+
+// The last changes, so watchers that are keeping up don't need to read the
+// journal file
+type recentChanges struct {
+	entries []JournalEntry
+}
+
+func (r *recentChanges) add(entry JournalEntry) {
+	r.entries = append(r.entries, entry)
+	if len(r.entries) > maxRecentChanges {
+		// Drop the oldest half, so we don't copy on every change
+		r.entries = slices.Clone(r.entries[len(r.entries)-maxRecentChanges/2:])
+	}
+}
+
+// Whether all the changes after the sequence number are here
+func (r *recentChanges) covers(since uint64) bool {
+	return len(r.entries) > 0 && r.entries[0].Sequence <= since+1
+}
+
+func (r *recentChanges) clear() {
+	r.entries = nil
+}
+
+func expiredChanges(since uint64) error {
+	return &Expired{
+		Message: fmt.Sprintf("Changes since %d are no longer available", since),
+	}
+}
+
+// Select the entries after the sequence number, failing if deletions might be
+// missing because the journal was compacted. Compaction markers are not
+// returned.
+func changesAfter(entries []JournalEntry, since uint64) ([]JournalEntry, error) {
+	index, _ := slices.BinarySearchFunc(entries, since, func(entry JournalEntry, since uint64) int {
+		if entry.Sequence <= since {
+			return -1
+		}
+		return 1
+	})
+	changes := make([]JournalEntry, 0, len(entries)-index)
+	for _, entry := range entries[index:] {
+		if entry.Operation == JournalCompact {
+			// Nothing is missing if we had seen everything before it
+			if entry.Sequence > since+1 {
+				return nil, expiredChanges(since)
+			}
+			continue
+		}
+		changes = append(changes, entry)
+	}
+	return changes, nil
+}
+
+func (db *KvDatabase) changeLog() (changeLog, error) {
+	store, ok := db.store.(changeLog)
+	if !ok {
+		return nil, fmt.Errorf("This store doesn't record changes")
+	}
+	return store, nil
+}
+
+func (db *KvDatabase) LastSequence(ctx context.Context) (uint64, error) {
+	store, err := db.changeLog()
+	if err != nil {
+		return 0, err
+	}
+	if err := db.mutex.Lock(ctx); err != nil {
+		return 0, err
+	}
+	defer db.mutex.Unlock()
+
+	return store.lastSequence()
+}
+
+func (db *KvDatabase) ChangesSince(ctx context.Context, since uint64) ([]JournalEntry, error) {
+	store, err := db.changeLog()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.mutex.Lock(ctx); err != nil {
+		return nil, err
+	}
+	defer db.mutex.Unlock()
+
+	return store.changesSince(since)
+}
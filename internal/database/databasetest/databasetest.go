@@ -0,0 +1,1414 @@
+// Package databasetest implements a conformance test suite for
+// implementations of database.Database.
+//
+// Backends and wrappers can run it from their own tests to check that they
+// behave exactly like the built-in databases:
+//
+//	func TestConformance(t *testing.T) {
+//		databasetest.Run(t, func(t *testing.T) database.Database {
+//			return NewMyDatabase(t.TempDir())
+//		})
+//	}
+package databasetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Run the conformance tests against databases returned by the factory
+//
+// The factory is called multiple times and should return a new empty database
+// every time.
+func Run(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	tests := []struct {
+		name string
+		test func(*testing.T, func(*testing.T) database.Database)
+	}{
+		{"Create", testCreate},
+		{"CreateReplace", testCreateReplace},
+		{"Update", testUpdate},
+		{"Delete", testDelete},
+		{"ConcurrentCreate", testConcurrentCreate},
+		{"ConcurrentUpdate", testConcurrentUpdate},
+		{"PreviousRevision", testPreviousRevision},
+		{"Names", testNames},
+		{"InvalidNames", testInvalidNames},
+		{"List", testList},
+		{"ListPagination", testListPagination},
+		{"ListSelector", testListSelector},
+		{"Batch", testBatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) { test.test(t, newDatabase) })
+	}
+}
+
+func fakeSpec(value string) interface{} {
+	result := make(map[string]interface{})
+	result["value"] = value
+	return result
+}
+
+func testCreate(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	for _, replace := range []bool{false, true} {
+		db := newDatabase(t)
+		meta, err := db.Create(
+			ctx,
+			database.Object{
+				Kind:    "example.org/Example",
+				Version: "v1",
+				Metadata: database.ObjectMetadata{
+					Name:     "one",
+					Id:       "12345",
+					Revision: "67890",
+				},
+				Spec:   fakeSpec("yay"),
+				Status: struct{}{},
+			},
+			replace,
+		)
+		if err != nil {
+			t.Fatalf("%#v", err)
+		}
+
+		object, err := db.Get(ctx, "one")
+		if err != nil {
+			t.Fatalf("%#v", err)
+		}
+		if object.Metadata.Id != meta.Id ||
+			object.Metadata.Revision != meta.Revision {
+			t.Fatalf("MetadataResponse invalid")
+		}
+		if object.Metadata.Name != "one" ||
+			object.Metadata.Id == "12345" ||
+			object.Metadata.Id == "" ||
+			object.Metadata.Revision == "67890" ||
+			object.Metadata.Revision == "" {
+			t.Fatalf("object has invalid metadata: %#v", object.Metadata)
+		}
+		if object.Spec.(map[string]interface{})["value"] != "yay" {
+			t.Fatal("object has invalid spec")
+		}
+	}
+}
+
+func testCreateReplace(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	db := newDatabase(t)
+	// Put in a first object, will be replaced
+	meta, err := db.Create(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:     "one",
+				Id:       "12345",
+				Revision: "67890",
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	previous, err := db.Get(ctx, "one")
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+
+	// Replace with wrong ID
+	meta, err = db.Create(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:     "one",
+				Id:       "12345",
+				Revision: "",
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+		true,
+	)
+	if err == nil {
+		t.Fatal("replace with wrong id didn't fail")
+	}
+	if conflict, ok := err.(*database.Conflict); !ok || conflict.Reason != database.ReasonIdMismatch || conflict.Name != "one" {
+		t.Fatal("replace with wrong id didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("replace failed but MetadataResponse is set")
+	}
+
+	// Replace with wrong revision
+	meta, err = db.Create(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:     "one",
+				Id:       previous.Metadata.Id,
+				Revision: "567890",
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+		true,
+	)
+	if err == nil {
+		t.Fatal("replace with wrong revision didn't fail")
+	}
+	if conflict, ok := err.(*database.Conflict); !ok || conflict.Reason != database.ReasonRevisionMismatch || conflict.Name != "one" {
+		t.Fatal("replace with wrong revision didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("replace failed but MetadataResponse is set")
+	}
+
+	// Replace with revision but no id
+	meta, err = db.Create(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:     "one",
+				Id:       "",
+				Revision: previous.Metadata.Revision,
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+		true,
+	)
+	if err == nil || err.Error() != "Cannot replace with a previous revision but no previous id" {
+		t.Fatal("replace with revision but no id didn't fail")
+	}
+	if _, ok := err.(*database.Invalid); !ok {
+		t.Fatal("replace with revision but no id didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("replace failed but MetadataResponse is set")
+	}
+
+	// Replace with id and revision
+	meta, err = db.Create(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:     "one",
+				Id:       previous.Metadata.Id,
+				Revision: previous.Metadata.Revision,
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+		true,
+	)
+	if err != nil {
+		t.Fatal("replace with correct id and revision didn't work")
+	}
+	object, err := db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal("replace with correct id and revision didn't work")
+	}
+	if object.Metadata.Id != meta.Id ||
+		object.Metadata.Revision != meta.Revision {
+		t.Fatalf("MetadataResponse invalid")
+	}
+
+	// Replace with id
+	meta, err = db.Create(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name: "one",
+				Id:   previous.Metadata.Id,
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+		true,
+	)
+	if err != nil {
+		t.Fatal("replace with correct id didn't work")
+	}
+	object, err = db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal("replace with correct id didn't work")
+	}
+	if object.Metadata.Id != meta.Id ||
+		object.Metadata.Revision != meta.Revision {
+		t.Fatalf("MetadataResponse invalid")
+	}
+
+	// Replace with no previous fields
+	meta, err = db.Create(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name: "one",
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+		true,
+	)
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+
+	object, err = db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal("replace didn't work")
+	}
+	if object.Metadata.Id != meta.Id ||
+		object.Metadata.Revision != meta.Revision {
+		t.Fatalf("MetadataResponse invalid")
+	}
+	if object.Metadata.Name != "one" ||
+		object.Metadata.Id == "12345" ||
+		object.Metadata.Id == "" ||
+		object.Metadata.Revision == "67890" ||
+		object.Metadata.Revision == "" {
+		t.Fatalf("object has invalid metadata: %#v", object.Metadata)
+	}
+	if object.Metadata.Id != previous.Metadata.Id {
+		t.Fatal("object id changed")
+	}
+	if object.Metadata.Revision == previous.Metadata.Revision {
+		t.Fatal("object revision didn't change")
+	}
+}
+
+func testUpdate(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	db := newDatabase(t)
+	// Update missing object
+	meta, err := db.Update(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name: "one",
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+	)
+	if err == nil {
+		t.Fatal("update missing object didn't fail")
+	}
+	if _, ok := err.(*database.DoesNotExist); !ok {
+		t.Fatal("update missing object didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("update failed but MetadataResponse is set")
+	}
+
+	// Put in a first object, will be updated
+	meta, err = db.Create(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:     "one",
+				Id:       "12345",
+				Revision: "67890",
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	previous, err := db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal("create didn't work")
+	}
+
+	// Update with wrong ID
+	meta, err = db.Update(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:     "one",
+				Id:       "12345",
+				Revision: previous.Metadata.Revision,
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+	)
+	if err == nil {
+		t.Fatal("update with wrong id didn't fail")
+	}
+	if conflict, ok := err.(*database.Conflict); !ok || conflict.Reason != database.ReasonIdMismatch || conflict.Name != "one" {
+		t.Fatal("update with wrong id didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("update failed but MetadataResponse is set")
+	}
+
+	// Update with wrong revision
+	meta, err = db.Update(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:     "one",
+				Id:       previous.Metadata.Id,
+				Revision: "567890",
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+	)
+	if err == nil {
+		t.Fatal("update with wrong revision didn't fail")
+	}
+	if conflict, ok := err.(*database.Conflict); !ok || conflict.Reason != database.ReasonRevisionMismatch || conflict.Name != "one" {
+		t.Fatal("update with wrong revision didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("update failed but MetadataResponse is set")
+	}
+
+	// Update with revision but no id
+	meta, err = db.Update(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:     "one",
+				Id:       "",
+				Revision: previous.Metadata.Revision,
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+	)
+	if err == nil || err.Error() != "Cannot update with a previous revision but no previous id" {
+		t.Fatal("update with revision but no id didn't fail")
+	}
+	if _, ok := err.(*database.Invalid); !ok {
+		t.Fatal("update with revision but no id didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("update failed but MetadataResponse is set")
+	}
+
+	// Update with id and revision
+	meta, err = db.Update(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:     "one",
+				Id:       previous.Metadata.Id,
+				Revision: previous.Metadata.Revision,
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+	)
+	if err != nil {
+		t.Fatal("update with correct id and revision didn't work")
+	}
+	object, err := db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal("update with correct id and revision didn't work")
+	}
+	if object.Metadata.Id != meta.Id ||
+		object.Metadata.Revision != meta.Revision {
+		t.Fatalf("MetadataResponse invalid")
+	}
+
+	// Update with id
+	meta, err = db.Update(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name: "one",
+				Id:   previous.Metadata.Id,
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		},
+	)
+	if err != nil {
+		t.Fatal("update with correct id didn't work")
+	}
+	object, err = db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal("update with correct id didn't work")
+	}
+	if object.Metadata.Id != meta.Id ||
+		object.Metadata.Revision != meta.Revision {
+		t.Fatalf("MetadataResponse invalid")
+	}
+
+	// Update with no previous fields
+	meta, err = db.Update(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name: "one",
+			},
+			Spec:   fakeSpec("yay"),
+			Status: struct{}{},
+		},
+	)
+	if err != nil {
+		t.Fatal("update with no comparison didn't work")
+	}
+	object, err = db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal("update with no comparison didn't work")
+	}
+	if object.Metadata.Id != meta.Id ||
+		object.Metadata.Revision != meta.Revision {
+		t.Fatalf("MetadataResponse invalid")
+	}
+
+	object, err = db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal("get didn't work")
+	}
+	if object.Metadata.Name != "one" ||
+		object.Metadata.Id == "" ||
+		object.Metadata.Revision == "" {
+		t.Fatalf("object has invalid metadata: %#v", object.Metadata)
+	}
+	if object.Spec.(map[string]interface{})["value"] != "yay" {
+		t.Fatal("object has invalid spec")
+	}
+}
+
+func testDelete(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	getDb := func() (database.Database, database.MetadataResponse) {
+		db := newDatabase(t)
+		// Put in a first object, will be deleted
+		meta, err := db.Create(
+			ctx,
+			database.Object{
+				Kind:    "example.org/Example",
+				Version: "v1",
+				Metadata: database.ObjectMetadata{
+					Name:     "one",
+					Id:       "12345",
+					Revision: "67890",
+				},
+				Spec:   struct{}{},
+				Status: struct{}{},
+			},
+			false,
+		)
+		if err != nil {
+			t.Fatalf("%#v", err)
+		}
+		_, err = db.Get(ctx, "one")
+		if err != nil {
+			t.Fatal("create didn't work")
+		}
+
+		return db, meta
+	}
+
+	// Delete missing object
+	db := newDatabase(t)
+	meta, err := db.Delete(ctx, "one", "123456", "")
+	if err == nil {
+		t.Fatal("delete didn't fail")
+	}
+	if _, ok := err.(*database.DoesNotExist); !ok {
+		t.Fatal("delete didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("delete failed but MetadataResponse is set")
+	}
+
+	meta, err = db.Delete(ctx, "one", "", "")
+	if err == nil {
+		t.Fatal("delete didn't fail")
+	}
+	if _, ok := err.(*database.DoesNotExist); !ok {
+		t.Fatal("delete didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("delete failed but MetadataResponse is set")
+	}
+
+	// Delete by name
+	db, _ = getDb()
+	meta, err = db.Delete(ctx, "one", "", "")
+	if err != nil {
+		t.Fatal("delete by name didn't work")
+	}
+
+	// Delete with wrong id
+	db, _ = getDb()
+	meta, err = db.Delete(ctx, "one", "12345", "")
+	if err == nil {
+		t.Fatal("delete with wrong id didn't fail")
+	}
+	if conflict, ok := err.(*database.Conflict); !ok || conflict.Reason != database.ReasonIdMismatch || conflict.Name != "one" {
+		t.Fatal("delete with wrong id didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("delete failed but MetadataResponse is set")
+	}
+
+	// Delete with id
+	db, createMeta := getDb()
+	meta, err = db.Delete(ctx, "one", createMeta.Id, "")
+	if err != nil {
+		t.Fatal("delete with id didn't work")
+	}
+
+	// Delete with revision but no id
+	db, createMeta = getDb()
+	meta, err = db.Delete(ctx, "one", "", createMeta.Revision)
+	if err == nil || err.Error() != "Cannot delete with a previous revision but no previous id" {
+		t.Fatal("delete with revision but no id didn't fail")
+	}
+	if _, ok := err.(*database.Invalid); !ok {
+		t.Fatal("delete with revision but no id didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("delete failed but MetadataResponse is set")
+	}
+
+	// Delete with wrong revision
+	db, createMeta = getDb()
+	meta, err = db.Delete(ctx, "one", createMeta.Id, "4567")
+	if err == nil {
+		t.Fatal("delete with wrong revision didn't fail")
+	}
+	if conflict, ok := err.(*database.Conflict); !ok || conflict.Reason != database.ReasonRevisionMismatch || conflict.Name != "one" {
+		t.Fatal("delete with wrong revision didn't fail")
+	}
+	if meta.Id != "" || meta.Revision != "" {
+		t.Fatal("delete failed but MetadataResponse is set")
+	}
+
+	// Delete with revision
+	db, createMeta = getDb()
+	meta, err = db.Delete(ctx, "one", createMeta.Id, createMeta.Revision)
+	if err != nil {
+		t.Fatal("delete with revision didn't work")
+	}
+}
+
+const concurrency = 16
+
+func testConcurrentCreate(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	db := newDatabase(t)
+
+	var wait sync.WaitGroup
+	errs := make([]error, concurrency)
+	metas := make([]database.MetadataResponse, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			metas[i], errs[i] = db.Create(
+				ctx,
+				database.Object{
+					Kind:    "example.org/Example",
+					Version: "v1",
+					Metadata: database.ObjectMetadata{
+						Name: "one",
+					},
+					Spec:   fakeSpec("yay"),
+					Status: struct{}{},
+				},
+				false,
+			)
+		}(i)
+	}
+	wait.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			if winner != -1 {
+				t.Fatal("multiple concurrent creates succeeded")
+			}
+			winner = i
+		} else if conflict, ok := err.(*database.Conflict); !ok || conflict.Reason != database.ReasonAlreadyExists {
+			t.Fatalf("concurrent create failed with unexpected error: %#v", err)
+		}
+	}
+	if winner == -1 {
+		t.Fatal("no concurrent create succeeded")
+	}
+
+	object, err := db.Get(ctx, "one")
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if object.Metadata.Id != metas[winner].Id ||
+		object.Metadata.Revision != metas[winner].Revision {
+		t.Fatal("object doesn't match the successful create")
+	}
+}
+
+func testConcurrentUpdate(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	db := newDatabase(t)
+
+	previous, err := db.Create(
+		ctx,
+		database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name: "one",
+			},
+			Spec:   fakeSpec("initial"),
+			Status: struct{}{},
+		},
+		false,
+	)
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+
+	// All updates expect the same revision, only one can win
+	var wait sync.WaitGroup
+	errs := make([]error, concurrency)
+	metas := make([]database.MetadataResponse, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			metas[i], errs[i] = db.Update(
+				ctx,
+				database.Object{
+					Kind:    "example.org/Example",
+					Version: "v1",
+					Metadata: database.ObjectMetadata{
+						Name:     "one",
+						Id:       previous.Id,
+						Revision: previous.Revision,
+					},
+					Spec:   fakeSpec(string(rune('a' + i))),
+					Status: struct{}{},
+				},
+			)
+		}(i)
+	}
+	wait.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			if winner != -1 {
+				t.Fatal("multiple conflicting updates succeeded")
+			}
+			winner = i
+		} else if conflict, ok := err.(*database.Conflict); !ok ||
+			conflict.Reason != database.ReasonRevisionMismatch ||
+			conflict.ExpectedRevision != previous.Revision {
+			t.Fatalf("conflicting update failed with unexpected error: %#v", err)
+		}
+	}
+	if winner == -1 {
+		t.Fatal("no conflicting update succeeded")
+	}
+
+	object, err := db.Get(ctx, "one")
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if object.Metadata.Id != previous.Id ||
+		object.Metadata.Revision != metas[winner].Revision {
+		t.Fatal("object doesn't match the successful update")
+	}
+	if object.Spec.(map[string]interface{})["value"] != string(rune('a'+winner)) {
+		t.Fatal("object doesn't have the spec of the successful update")
+	}
+}
+
+func testPreviousRevision(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	db := newDatabase(t)
+
+	object := database.Object{
+		Kind:    "example.org/Example",
+		Version: "v1",
+		Metadata: database.ObjectMetadata{
+			Name: "one",
+		},
+		Spec:   fakeSpec("initial"),
+		Status: struct{}{},
+	}
+	created, err := db.Create(ctx, object, false)
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if created.PreviousRevision != "" || created.PreviousKind != "" {
+		t.Fatalf("previous object on create: %#v", created)
+	}
+
+	// Each update replaced a different revision, even when they race
+	var wait sync.WaitGroup
+	errs := make([]error, concurrency)
+	metas := make([]database.MetadataResponse, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			metas[i], errs[i] = db.Update(ctx, object)
+		}(i)
+	}
+	wait.Wait()
+
+	replaced := make(map[string]string)
+	for i, meta := range metas {
+		if errs[i] != nil {
+			t.Fatalf("%#v", errs[i])
+		}
+		if meta.PreviousKind != object.Kind {
+			t.Fatalf("wrong previous kind: %#v", meta)
+		}
+		if _, ok := replaced[meta.PreviousRevision]; ok {
+			t.Fatalf("revision %v replaced twice", meta.PreviousRevision)
+		}
+		replaced[meta.PreviousRevision] = meta.Revision
+	}
+	// They form a chain from the created revision
+	revision := created.Revision
+	for range metas {
+		next, ok := replaced[revision]
+		if !ok {
+			t.Fatalf("revision %v was not replaced", revision)
+		}
+		revision = next
+	}
+
+	deleted, err := db.Delete(ctx, "one", "", "")
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if deleted.PreviousRevision != revision || deleted.PreviousKind != object.Kind {
+		t.Fatalf("wrong previous object on delete: %#v", deleted)
+	}
+
+	results, err := db.Batch(ctx, []database.BatchOperation{
+		{Operation: database.BatchCreate, Object: object},
+		{Operation: database.BatchUpdate, Object: object},
+	})
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if results[0].PreviousRevision != "" || results[1].PreviousRevision != results[0].Revision {
+		t.Fatalf("wrong previous revisions in batch: %#v", results)
+	}
+}
+
+func testNames(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	db := newDatabase(t)
+
+	// Names that share prefixes, and objects that are also namespaces
+	names := []string{
+		"a",
+		"a-b",
+		"a/b",
+		"a/b/c",
+		"a/b-c",
+		"ab",
+		"0",
+		"9-9/8-8/7-7",
+		"x/y/z/w/v/u/t/s/r/q/p",
+		"long-name-0123456789-abcdefghijklmnopqrstuvwxyz/0123456789-abcdefghijklmnopqrstuvwxyz-0123456789",
+	}
+	for _, name := range names {
+		_, err := db.Create(
+			ctx,
+			database.Object{
+				Kind:    "example.org/Example",
+				Version: "v1",
+				Metadata: database.ObjectMetadata{
+					Name: name,
+				},
+				Spec:   fakeSpec(name),
+				Status: struct{}{},
+			},
+			false,
+		)
+		if err != nil {
+			t.Fatalf("create %v: %#v", name, err)
+		}
+	}
+
+	checkAll := func(deleted map[string]bool) {
+		for _, name := range names {
+			object, err := db.Get(ctx, name)
+			if deleted[name] {
+				if _, ok := err.(*database.DoesNotExist); !ok {
+					t.Fatalf("get deleted %v: %#v", name, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("get %v: %#v", name, err)
+			}
+			if object.Metadata.Name != name {
+				t.Fatalf("get %v returned %v", name, object.Metadata.Name)
+			}
+			if object.Spec.(map[string]interface{})["value"] != name {
+				t.Fatalf("get %v returned the wrong object", name)
+			}
+		}
+	}
+	checkAll(nil)
+
+	// Deleting a parent doesn't delete children, and vice versa
+	deleted := map[string]bool{"a/b": true, "a": true, "a/b/c": true}
+	for name := range deleted {
+		_, err := db.Delete(ctx, name, "", "")
+		if err != nil {
+			t.Fatalf("delete %v: %#v", name, err)
+		}
+	}
+	checkAll(deleted)
+
+	// Get children of a missing parent
+	_, err := db.Get(ctx, "missing/child")
+	if _, ok := err.(*database.DoesNotExist); !ok {
+		t.Fatalf("get missing/child: %#v", err)
+	}
+}
+
+func testInvalidNames(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	db := newDatabase(t)
+
+	names := []string{
+		"",
+		"/",
+		"/one",
+		"one/",
+		"one//two",
+		".",
+		"..",
+		"../one",
+		"one/../two",
+		"one/./two",
+		"_lock",
+		"_journal",
+		"one.json",
+		"One",
+		"-one",
+		"one/-two",
+		"one two",
+		"one\\two",
+		"one\x00two",
+		"caf\u00e9",
+		longName(database.MaxNameLength + 1),
+		strings.Repeat("a", database.MaxNameSegmentLength+1),
+		strings.Repeat("a/", database.MaxNameDepth) + "a",
+	}
+
+	checkInvalid := func(operation string, name string, err error) {
+		if invalid, ok := err.(*database.Invalid); !ok || invalid.Reason != database.ReasonInvalidName {
+			t.Fatalf("%v %#v didn't fail: %#v", operation, name, err)
+		}
+	}
+
+	for _, name := range names {
+		object := database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name: name,
+			},
+			Spec:   struct{}{},
+			Status: struct{}{},
+		}
+		_, err := db.Create(ctx, object, false)
+		checkInvalid("create", name, err)
+		_, err = db.Create(ctx, object, true)
+		checkInvalid("replace", name, err)
+		_, err = db.Update(ctx, object)
+		checkInvalid("update", name, err)
+		_, err = db.Get(ctx, name)
+		checkInvalid("get", name, err)
+		_, err = db.Delete(ctx, name, "", "")
+		checkInvalid("delete", name, err)
+	}
+
+	// Limits are inclusive
+	for _, name := range []string{
+		longName(database.MaxNameLength),
+		strings.Repeat("a", database.MaxNameSegmentLength),
+		strings.Repeat("a/", database.MaxNameDepth-1) + "a",
+	} {
+		_, err := db.Create(
+			ctx,
+			database.Object{
+				Kind:    "example.org/Example",
+				Version: "v1",
+				Metadata: database.ObjectMetadata{
+					Name: name,
+				},
+				Spec:   struct{}{},
+				Status: struct{}{},
+			},
+			false,
+		)
+		if err != nil {
+			t.Fatalf("create %#v: %#v", name, err)
+		}
+	}
+}
+
+// Build a name of the given length out of segments of the maximum length
+func longName(length int) string {
+	var name strings.Builder
+	for name.Len() < length {
+		if name.Len() > 0 {
+			name.WriteByte('/')
+		}
+		segment := min(length-name.Len(), database.MaxNameSegmentLength)
+		name.WriteString(strings.Repeat("a", segment))
+	}
+	return name.String()
+}
+
+func createObjects(t *testing.T, db database.Database, names ...string) {
+	for _, name := range names {
+		_, err := db.Create(
+			context.Background(),
+			database.Object{
+				Kind:    "example.org/Example",
+				Version: "v1",
+				Metadata: database.ObjectMetadata{
+					Name: name,
+				},
+				Spec:   fakeSpec(name),
+				Status: struct{}{},
+			},
+			false,
+		)
+		if err != nil {
+			t.Fatalf("create %v: %#v", name, err)
+		}
+	}
+}
+
+func objectNames(objects []database.Object) []string {
+	names := make([]string, 0, len(objects))
+	for _, object := range objects {
+		names = append(names, object.Metadata.Name)
+	}
+	return names
+}
+
+func testList(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	db := newDatabase(t)
+
+	// Empty database
+	result, err := db.List(ctx, database.ListOptions{})
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if len(result.Objects) != 0 || result.Continue != "" {
+		t.Fatalf("list empty database: %#v", result)
+	}
+
+	createObjects(t, db, "b", "a/d", "a", "a/b/c", "a-b", "c/x", "a/b")
+
+	// Everything
+	result, err = db.List(ctx, database.ListOptions{})
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	names := objectNames(result.Objects)
+	if !slices.Equal(names, []string{"a", "a-b", "a/b", "a/b/c", "a/d", "b", "c/x"}) {
+		t.Fatalf("list all: %v", names)
+	}
+	if result.Continue != "" {
+		t.Fatal("list all returned a continue token")
+	}
+	if result.Objects[0].Spec.(map[string]interface{})["value"] != "a" {
+		t.Fatal("list returned invalid objects")
+	}
+
+	// Prefix
+	result, err = db.List(ctx, database.ListOptions{Prefix: "a"})
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	names = objectNames(result.Objects)
+	if !slices.Equal(names, []string{"a/b", "a/b/c", "a/d"}) {
+		t.Fatalf("list prefix: %v", names)
+	}
+	result, err = db.List(ctx, database.ListOptions{Prefix: "a/b"})
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	names = objectNames(result.Objects)
+	if !slices.Equal(names, []string{"a/b/c"}) {
+		t.Fatalf("list nested prefix: %v", names)
+	}
+	result, err = db.List(ctx, database.ListOptions{Prefix: "missing"})
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if len(result.Objects) != 0 {
+		t.Fatalf("list missing prefix: %v", objectNames(result.Objects))
+	}
+
+	// Invalid parameters
+	_, err = db.List(ctx, database.ListOptions{Prefix: "../a"})
+	if invalid, ok := err.(*database.Invalid); !ok || invalid.Reason != database.ReasonInvalidName {
+		t.Fatalf("list with invalid prefix didn't fail: %#v", err)
+	}
+	_, err = db.List(ctx, database.ListOptions{Continue: "garbage!"})
+	if _, ok := err.(*database.Invalid); !ok {
+		t.Fatalf("list with invalid token didn't fail: %#v", err)
+	}
+}
+
+func testListPagination(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	db := newDatabase(t)
+
+	createObjects(t, db, "b", "d", "f", "h", "j", "l")
+
+	// Exact number of objects
+	result, err := db.List(ctx, database.ListOptions{Limit: 6})
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if len(result.Objects) != 6 || result.Continue != "" {
+		t.Fatalf("list with exact limit: %v %#v", objectNames(result.Objects), result.Continue)
+	}
+
+	// Write while paginating
+	var names []string
+	options := database.ListOptions{Limit: 2}
+	for page := 0; ; page++ {
+		if page > 10 {
+			t.Fatal("too many pages")
+		}
+		result, err := db.List(ctx, options)
+		if err != nil {
+			t.Fatalf("%#v", err)
+		}
+		if len(result.Objects) > 2 {
+			t.Fatalf("page is over the limit: %v", objectNames(result.Objects))
+		}
+		names = append(names, objectNames(result.Objects)...)
+		if result.Continue == "" {
+			break
+		}
+		options.Continue = result.Continue
+
+		if page == 0 {
+			// Before the cursor, won't be seen
+			createObjects(t, db, "a")
+			// After the cursor, will be seen
+			createObjects(t, db, "e")
+			// Deleted after the cursor, won't be seen
+			_, err = db.Delete(ctx, "j", "", "")
+			if err != nil {
+				t.Fatalf("%#v", err)
+			}
+			// Deleted before the cursor, was already seen
+			_, err = db.Delete(ctx, "b", "", "")
+			if err != nil {
+				t.Fatalf("%#v", err)
+			}
+		}
+	}
+	if !slices.Equal(names, []string{"b", "d", "e", "f", "h", "l"}) {
+		t.Fatalf("paginated list: %v", names)
+	}
+}
+
+func testListSelector(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+
+	db := newDatabase(t)
+
+	objects := []database.Object{
+		{
+			Kind:    "example.org/Job",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:   "a",
+				Labels: map[string]string{"app": "web", "tier": "frontend"},
+			},
+			Spec:   map[string]interface{}{"priority": 10, "owner": "alice"},
+			Status: map[string]interface{}{"phase": "Running"},
+		},
+		{
+			Kind:    "example.org/Job",
+			Version: "v2",
+			Metadata: database.ObjectMetadata{
+				Name:   "b",
+				Labels: map[string]string{"app": "web", "tier": "backend"},
+			},
+			Spec: map[string]interface{}{
+				"priority": 2,
+				"owner":    "bob",
+				"tags":     []interface{}{"urgent"},
+			},
+			Status: map[string]interface{}{"phase": "Succeeded"},
+		},
+		{
+			Kind:    "example.org/Service",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name:   "c",
+				Labels: map[string]string{"app": "db"},
+			},
+			Spec:   map[string]interface{}{"port": 5432},
+			Status: struct{}{},
+		},
+	}
+	for _, object := range objects {
+		_, err := db.Create(ctx, object, false)
+		if err != nil {
+			t.Fatalf("%#v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		labels   string
+		fields   string
+		expected []string
+	}{
+		{"app=web", "", []string{"a", "b"}},
+		{"app!=web", "", []string{"c"}},
+		{"tier", "", []string{"a", "b"}},
+		{"!tier", "", []string{"c"}},
+		{"tier in (backend, other)", "", []string{"b"}},
+		{"tier notin (backend)", "", []string{"a", "c"}},
+		{"", "kind=example.org/Job", []string{"a", "b"}},
+		{"", "kind==example.org/Job,version=v2", []string{"b"}},
+		{"", "spec.priority>5", []string{"a"}},
+		{"", "spec.priority<=10", []string{"a", "b"}},
+		{"", "spec.priority>=3", []string{"a"}},
+		{"", "spec.priority<10", []string{"b"}},
+		{"", "spec.owner in (alice,carol)", []string{"a"}},
+		{"", "status.phase!=Succeeded", []string{"a", "c"}},
+		{"", "!status.phase", []string{"c"}},
+		{"", "spec.tags.0=urgent", []string{"b"}},
+		{"", "spec.port=5432", []string{"c"}},
+		{"", "metadata.labels.app=db", []string{"c"}},
+		{"app=web", "spec.priority>5", []string{"a"}},
+	} {
+		var selector database.Selector
+		labels, err := database.ParseLabelSelector(test.labels)
+		if err != nil {
+			t.Fatalf("%v: %#v", test.labels, err)
+		}
+		selector = append(selector, labels...)
+		fields, err := database.ParseSelector(test.fields)
+		if err != nil {
+			t.Fatalf("%v: %#v", test.fields, err)
+		}
+		selector = append(selector, fields...)
+		result, err := db.List(ctx, database.ListOptions{Selector: selector})
+		if err != nil {
+			t.Fatalf("%#v", err)
+		}
+		if !slices.Equal(objectNames(result.Objects), test.expected) {
+			t.Fatalf(
+				"list with labels %#v fields %#v: %v",
+				test.labels, test.fields, objectNames(result.Objects),
+			)
+		}
+	}
+
+	// Pages are filled even when few objects match
+	db = newDatabase(t)
+	var names []string
+	for i := 0; i < 250; i++ {
+		names = append(names, fmt.Sprintf("obj-%03d", i))
+	}
+	createObjects(t, db, names...)
+	selector, err := database.ParseSelector("spec.value in (obj-010,obj-120,obj-130,obj-240)")
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	result, err := db.List(ctx, database.ListOptions{Limit: 2, Selector: selector})
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if !slices.Equal(objectNames(result.Objects), []string{"obj-010", "obj-120"}) || result.Continue == "" {
+		t.Fatalf("first page: %v %#v", objectNames(result.Objects), result.Continue)
+	}
+	result, err = db.List(ctx, database.ListOptions{Limit: 2, Selector: selector, Continue: result.Continue})
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if !slices.Equal(objectNames(result.Objects), []string{"obj-130", "obj-240"}) || result.Continue != "" {
+		t.Fatalf("second page: %v %#v", objectNames(result.Objects), result.Continue)
+	}
+}
+
+func testBatch(t *testing.T, newDatabase func(t *testing.T) database.Database) {
+	ctx := context.Background()
+	db := newDatabase(t)
+	createObjects(t, db, "a", "b")
+	b, err := db.Get(ctx, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newObject := func(name string, value string) database.Object {
+		return database.Object{
+			Kind:    "example.org/Example",
+			Version: "v1",
+			Metadata: database.ObjectMetadata{
+				Name: name,
+			},
+			Spec:   fakeSpec(value),
+			Status: struct{}{},
+		}
+	}
+	checkNames := func(expected ...string) {
+		t.Helper()
+		result, err := db.List(ctx, database.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := objectNames(result.Objects); !slices.Equal(names, expected) {
+			t.Fatalf("wrong objects: %v", names)
+		}
+	}
+
+	// A failing operation prevents all the others
+	for i, operations := range [][]database.BatchOperation{
+		{
+			{Operation: database.BatchCreate, Object: newObject("c", "c")},
+			{Operation: database.BatchCreate, Object: newObject("a", "a")},
+		},
+		{
+			{Operation: database.BatchDelete, Name: "a"},
+			{Operation: database.BatchDelete, Name: "b", Id: b.Metadata.Id, Revision: "wrong"},
+		},
+		{
+			{Operation: database.BatchUpdate, Object: newObject("a", "changed")},
+			{Operation: database.BatchUpdate, Object: newObject("c", "c")},
+		},
+		{
+			{Operation: database.BatchCreate, Object: newObject("c", "c")},
+			{Operation: "frobnicate", Name: "a"},
+		},
+		{
+			{Operation: database.BatchCreate, Object: newObject("c", "c")},
+			{Operation: database.BatchDelete, Name: "Invalid Name"},
+		},
+	} {
+		_, err := db.Batch(ctx, operations)
+		var batchErr *database.BatchError
+		if !errors.As(err, &batchErr) || batchErr.Index != 1 {
+			t.Fatalf("batch %d didn't fail on the second operation: %#v", i, err)
+		}
+		checkNames("a", "b")
+		a, err := db.Get(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Spec.(map[string]any)["value"] != "a" {
+			t.Fatalf("batch %d changed an object", i)
+		}
+	}
+	_, err = db.Batch(ctx, []database.BatchOperation{
+		{Operation: database.BatchDelete, Name: "b", Id: b.Metadata.Id, Revision: "wrong"},
+	})
+	var conflict *database.Conflict
+	if !errors.As(err, &conflict) || conflict.Reason != database.ReasonRevisionMismatch {
+		t.Fatalf("batch error doesn't wrap the conflict: %#v", err)
+	}
+
+	// Operations see the result of the previous ones
+	results, err := db.Batch(ctx, []database.BatchOperation{
+		{Operation: database.BatchCreate, Object: newObject("c", "c")},
+		{Operation: database.BatchUpdate, Object: newObject("c", "changed")},
+		{Operation: database.BatchDelete, Name: "a"},
+		{Operation: database.BatchCreate, Object: newObject("a", "new"), Replace: true},
+		{Operation: database.BatchDelete, Name: "b", Id: b.Metadata.Id, Revision: b.Metadata.Revision},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 ||
+		results[0].Id != results[1].Id ||
+		results[0].Revision == results[1].Revision ||
+		results[4].Id != b.Metadata.Id ||
+		results[4].Revision != b.Metadata.Revision {
+		t.Fatalf("wrong results: %#v", results)
+	}
+	checkNames("a", "c")
+	c, err := db.Get(ctx, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Metadata.Revision != results[1].Revision || c.Spec.(map[string]any)["value"] != "changed" {
+		t.Fatalf("wrong object c: %#v", c)
+	}
+	a, err := db.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Metadata.Id != results[3].Id || results[3].Id == results[2].Id {
+		t.Fatalf("a was not created again: %#v", a)
+	}
+}
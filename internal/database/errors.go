@@ -0,0 +1,182 @@
+package database
+
+import (
+	"errors"
+)
+
+// Machine-readable reason for an error, sent over the API
+type Reason string
+
+const (
+	ReasonNotFound         Reason = "NotFound"
+	ReasonAlreadyExists    Reason = "AlreadyExists"
+	ReasonIdMismatch       Reason = "IdMismatch"
+	ReasonRevisionMismatch Reason = "RevisionMismatch"
+	// The object didn't match the conditions of an HTTP request (If-Match
+	// or If-None-Match)
+	ReasonPreconditionFailed Reason = "PreconditionFailed"
+	ReasonInvalid            Reason = "Invalid"
+	ReasonInvalidName        Reason = "InvalidName"
+
+	// Errors that don't come from the database
+	ReasonBadRequest Reason = "BadRequest"
+	// The request doesn't have valid credentials
+	ReasonUnauthorized Reason = "Unauthorized"
+	// The user is not allowed to make the request
+	ReasonForbidden Reason = "Forbidden"
+	// The changes requested are no longer available
+	ReasonExpired       Reason = "Expired"
+	ReasonTimeout       Reason = "Timeout"
+	ReasonCancelled     Reason = "Cancelled"
+	ReasonInternalError Reason = "InternalError"
+)
+
+// The object exists but is not in the expected state
+type Conflict struct {
+	// ReasonAlreadyExists, ReasonIdMismatch, ReasonRevisionMismatch, or
+	// ReasonPreconditionFailed
+	Reason           Reason
+	Name             string
+	ExpectedId       string
+	ActualId         string
+	ExpectedRevision string
+	ActualRevision   string
+	Message          string
+}
+
+func (e *Conflict) Error() string {
+	return e.Message
+}
+
+type DoesNotExist struct {
+	Name    string
+	Message string
+}
+
+func (e *DoesNotExist) Error() string {
+	return e.Message
+}
+
+// The request can't be satisfied whatever the state of the database
+type Invalid struct {
+	Reason  Reason
+	Name    string
+	Message string
+}
+
+func (e *Invalid) Error() string {
+	return e.Message
+}
+
+// The user making the request is not allowed to access the object
+type Forbidden struct {
+	Name    string
+	Message string
+}
+
+func (e *Forbidden) Error() string {
+	return e.Message
+}
+
+// The changes a watcher asked for are no longer available, it has to list the
+// objects again
+type Expired struct {
+	Message string
+}
+
+func (e *Expired) Error() string {
+	return e.Message
+}
+
+// Serialized form of an error, as sent by the API
+type ErrorDetails struct {
+	Message          string `json:"message" yaml:"message"`
+	Reason           Reason `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Name             string `json:"name,omitempty" yaml:"name,omitempty"`
+	ExpectedId       string `json:"expected_id,omitempty" yaml:"expected_id,omitempty"`
+	ActualId         string `json:"actual_id,omitempty" yaml:"actual_id,omitempty"`
+	ExpectedRevision string `json:"expected_revision,omitempty" yaml:"expected_revision,omitempty"`
+	ActualRevision   string `json:"actual_revision,omitempty" yaml:"actual_revision,omitempty"`
+}
+
+// Serialize a database error, returns false if it is not one
+func GetErrorDetails(err error) (ErrorDetails, bool) {
+	var conflict *Conflict
+	var doesNotExist *DoesNotExist
+	var invalid *Invalid
+	var forbidden *Forbidden
+	var expired *Expired
+	if errors.As(err, &conflict) {
+		return ErrorDetails{
+			Message:          conflict.Message,
+			Reason:           conflict.Reason,
+			Name:             conflict.Name,
+			ExpectedId:       conflict.ExpectedId,
+			ActualId:         conflict.ActualId,
+			ExpectedRevision: conflict.ExpectedRevision,
+			ActualRevision:   conflict.ActualRevision,
+		}, true
+	} else if errors.As(err, &doesNotExist) {
+		return ErrorDetails{
+			Message: doesNotExist.Message,
+			Reason:  ReasonNotFound,
+			Name:    doesNotExist.Name,
+		}, true
+	} else if errors.As(err, &invalid) {
+		return ErrorDetails{
+			Message: invalid.Message,
+			Reason:  invalid.Reason,
+			Name:    invalid.Name,
+		}, true
+	} else if errors.As(err, &forbidden) {
+		return ErrorDetails{
+			Message: forbidden.Message,
+			Reason:  ReasonForbidden,
+			Name:    forbidden.Name,
+		}, true
+	} else if errors.As(err, &expired) {
+		return ErrorDetails{
+			Message: expired.Message,
+			Reason:  ReasonExpired,
+		}, true
+	}
+	return ErrorDetails{}, false
+}
+
+// Rebuild the database error, returns nil if the reason is not from the
+// database
+func (d ErrorDetails) DatabaseError() error {
+	switch d.Reason {
+	case ReasonAlreadyExists, ReasonIdMismatch, ReasonRevisionMismatch, ReasonPreconditionFailed:
+		return &Conflict{
+			Reason:           d.Reason,
+			Name:             d.Name,
+			ExpectedId:       d.ExpectedId,
+			ActualId:         d.ActualId,
+			ExpectedRevision: d.ExpectedRevision,
+			ActualRevision:   d.ActualRevision,
+			Message:          d.Message,
+		}
+	case ReasonNotFound:
+		return &DoesNotExist{
+			Name:    d.Name,
+			Message: d.Message,
+		}
+	case ReasonInvalid, ReasonInvalidName:
+		return &Invalid{
+			Reason:  d.Reason,
+			Name:    d.Name,
+			Message: d.Message,
+		}
+	case ReasonForbidden:
+		return &Forbidden{
+			Name:    d.Name,
+			Message: d.Message,
+		}
+	case ReasonExpired:
+		return &Expired{
+			Message: d.Message,
+		}
+	}
+	return nil
+}
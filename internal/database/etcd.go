@@ -0,0 +1,32 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+type EtcdConfig struct {
+	Hostname   string `yaml:"hostname"`
+	CaCert     string `yaml:"ca_cert"`
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+}
+
+func (c *EtcdConfig) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("hostname", c.Hostname),
+		slog.String("ca_cert", c.CaCert),
+		slog.String("client_cert", c.ClientCert),
+		slog.String("client_key", c.ClientKey),
+	)
+}
+
+func init() {
+	RegisterBackend("etcd", &Backend{
+		NewConfig: func() any { return &EtcdConfig{} },
+		Connect: func(config any) (Database, error) {
+			slog.Debug("open EtcdDatabase", "config", config)
+			return nil, fmt.Errorf("Not implemented")
+		},
+	})
+}
@@ -1,78 +1,372 @@
 package database
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 type fileLocker struct {
-	file *os.File
+	// flock() doesn't exclude other goroutines using the same file descriptor
+	mutex *mutexLocker
+	file  *os.File
+}
+
+func newFileLocker(file *os.File) *fileLocker {
+	return &fileLocker{
+		mutex: newMutexLocker(),
+		file:  file,
+	}
 }
 
-func (l *fileLocker) Lock() {
-	syscall.Flock(int(l.file.Fd()), syscall.LOCK_EX)
+// How often to retry while another process holds the lock
+const fileLockPollInterval = 10 * time.Millisecond
+
+func (l *fileLocker) Lock(ctx context.Context) error {
+	err := l.mutex.Lock(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A blocking flock() can't be interrupted, so poll instead
+	ticker := time.NewTicker(fileLockPollInterval)
+	defer ticker.Stop()
+	for {
+		err = syscall.Flock(int(l.file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		} else if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			l.mutex.Unlock()
+			return fmt.Errorf("locking database: %w", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			l.mutex.Unlock()
+			return ctx.Err()
+		}
+	}
 }
 
 func (l *fileLocker) Unlock() {
 	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.mutex.Unlock()
+}
+
+type FileFormat string
+
+const (
+	// Compact JSON, the default
+	FormatJson FileFormat = "json"
+	// Indented YAML with stable key order, meant to be edited by hand
+	FormatYaml FileFormat = "yaml"
+)
+
+type FilesOptions struct {
+	Format FileFormat
+	// Fields to index in addition to kind and labels, see KvDatabase.AddIndex
+	Indexes []string
 }
 
 type directoryKv struct {
 	directory string
+	format    FileFormat
+	journal   *journal
+
+	// Used to update the metadata of objects modified outside of vogon
+	now         func() time.Time
+	newId       func() string
+	newRevision func() string
+}
+
+// Turn an object name into a file path inside the directory
+//
+// Names are validated by KvDatabase, but we also make sure here that they
+// can't escape the directory or collide with our own files: characters other
+// than lowercase letters, digits, and dashes are percent-encoded, so that a
+// segment can't be "..", contain a separator, or start with an underscore.
+func (db *directoryKv) filePath(name string) (string, error) {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			return "", &Invalid{
+				Reason:  ReasonInvalidName,
+				Name:    name,
+				Message: "Empty segment in name",
+			}
+		}
+		var encoded strings.Builder
+		for _, b := range []byte(segment) {
+			if (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' {
+				encoded.WriteByte(b)
+			} else {
+				fmt.Fprintf(&encoded, "%%%02X", b)
+			}
+		}
+		segments[i] = encoded.String()
+	}
+	return filepath.Join(db.directory, filepath.Join(segments...)+"."+string(db.format)), nil
+}
+
+// Turn a file path back into an object name, returns false if the file is not
+// an object
+func (db *directoryKv) nameFromPath(filePath string) (string, bool) {
+	relative, err := filepath.Rel(db.directory, filePath)
+	if err != nil {
+		return "", false
+	}
+	relative, ok := strings.CutSuffix(relative, "."+string(db.format))
+	if !ok {
+		return "", false
+	}
+	segments := strings.Split(relative, string(filepath.Separator))
+	for i, segment := range segments {
+		segments[i], err = url.PathUnescape(segment)
+		if err != nil {
+			return "", false
+		}
+	}
+	name := strings.Join(segments, "/")
+	if ValidateName(name) != nil {
+		return "", false
+	}
+	return name, true
+}
+
+func (db *directoryKv) encode(object Object) ([]byte, error) {
+	var buffer bytes.Buffer
+	switch db.format {
+	case FormatYaml:
+		encoder := yaml.NewEncoder(&buffer)
+		encoder.SetIndent(2)
+		err := encoder.Encode(object)
+		if err != nil {
+			return nil, err
+		}
+		err = encoder.Close()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		encoder := json.NewEncoder(&buffer)
+		err := encoder.Encode(object)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+func (db *directoryKv) decode(data []byte) (Object, error) {
+	var object Object
+	switch db.format {
+	case FormatYaml:
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err := decoder.Decode(&object)
+		if err != nil {
+			return object, err
+		}
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&object)
+		if err != nil {
+			return object, err
+		}
+	}
+	return object, nil
 }
 
-func (db *directoryKv) Read(name string) (Object, error) {
+func hashFile(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func (db *directoryKv) Read(ctx context.Context, name string) (Object, error) {
 	var object Object
 
-	file, err := os.Open(path.Join(db.directory, name+".json"))
+	filePath, err := db.filePath(name)
+	if err != nil {
+		return object, err
+	}
+	lastWrite, known, err := db.journal.lastWrite(name)
+	if err != nil {
+		return object, err
+	}
+	data, err := os.ReadFile(filePath)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
+			if known {
+				// Deleted outside of vogon
+				slog.Info("object file was deleted", "name", name)
+				db.journal.markChanged(name)
+				err = db.journal.append(JournalDelete, name, "", "")
+				if err != nil {
+					return object, err
+				}
+			}
 			return object, &DoesNotExist{
-				s: "No such file",
+				Name:    name,
+				Message: "No such file",
 			}
 		}
 		return object, err
 	}
-	decoder := json.NewDecoder(file)
-	decoder.DisallowUnknownFields()
-	err = decoder.Decode(&object)
+	object, err = db.decode(data)
+	if err != nil {
+		return object, fmt.Errorf("reading %v: %w", filePath, err)
+	}
+
+	hash := hashFile(data)
+	if known && (lastWrite.Hash == hash ||
+		// Journal written before hashes were recorded
+		lastWrite.Hash == "" && lastWrite.Revision == object.Metadata.Revision) {
+		return object, nil
+	}
+
+	// The file was edited outside of vogon, assign a new revision so that
+	// clients notice the change
+	slog.Info("object file was modified", "name", name)
+	db.journal.markChanged(name)
+	object.Metadata.Name = name
+	if object.Metadata.Id == "" {
+		object.Metadata.Id = db.newId()
+	}
+	if object.Metadata.CreationTime.IsZero() {
+		object.Metadata.CreationTime = db.now()
+	}
+	object.Metadata.Revision = db.newRevision()
+	err = db.Write(ctx, name, object)
 	if err != nil {
 		return object, err
 	}
 	return object, nil
 }
 
-func (db *directoryKv) Write(name string, object Object) error {
-	filePath := path.Join(db.directory, name+".json")
-	parentPath := path.Dir(filePath)
-	os.MkdirAll(parentPath, 0666)
-	file, err := os.Create(filePath)
+func (db *directoryKv) Write(ctx context.Context, name string, object Object) error {
+	filePath, err := db.filePath(name)
+	if err != nil {
+		return err
+	}
+	data, err := db.encode(object)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(filePath), 0700)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filePath, data, 0600)
 	if err != nil {
 		return err
 	}
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(object)
+	return db.journal.append(JournalWrite, name, object.Metadata.Revision, hashFile(data))
 }
 
-func (db *directoryKv) Delete(name string) error {
-	err := os.Remove(path.Join(db.directory, name+".json"))
+func (db *directoryKv) Delete(ctx context.Context, name string) error {
+	filePath, err := db.filePath(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filePath)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			return &DoesNotExist{
-				s: "No such file",
+				Name:    name,
+				Message: "No such file",
 			}
 		}
 		return err
 	}
-	return nil
+	return db.journal.append(JournalDelete, name, "", "")
+}
+
+func (db *directoryKv) List(ctx context.Context, prefix string, after string, limit int) ([]Object, error) {
+	root := db.directory
+	if prefix != "" {
+		prefixPath, err := db.filePath(prefix)
+		if err != nil {
+			return nil, err
+		}
+		root = strings.TrimSuffix(prefixPath, "."+string(db.format))
+	}
+
+	var names []string
+	err := filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return ctx.Err()
+		}
+		name, ok := db.nameFromPath(filePath)
+		if ok && name > after && HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+
+	objects := make([]Object, 0)
+	for _, name := range names {
+		if limit > 0 && len(objects) >= limit {
+			break
+		}
+		object, err := db.Read(ctx, name)
+		if err != nil {
+			if _, ok := err.(*DoesNotExist); ok {
+				continue
+			}
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func (db *directoryKv) Changes(ctx context.Context) ([]string, bool, error) {
+	return db.journal.changes()
+}
+
+func (db *directoryKv) lastSequence() (uint64, error) {
+	return db.journal.currentSequence()
 }
 
-func NewFilesDatabase(directory string) (*KvDatabase, error) {
+func (db *directoryKv) changesSince(since uint64) ([]JournalEntry, error) {
+	return db.journal.changesSince(since)
+}
+
+func NewFilesDatabase(directory string, options FilesOptions) (*KvDatabase, error) {
+	switch options.Format {
+	case "":
+		options.Format = FormatJson
+	case FormatJson, FormatYaml:
+	default:
+		return nil, fmt.Errorf("Unknown file format %v", options.Format)
+	}
 	err := os.Mkdir(directory, 0700)
 	if err != nil && !os.IsExist(err) {
 		return nil, fmt.Errorf("Error creating database directory: %w", err)
@@ -81,12 +375,64 @@ func NewFilesDatabase(directory string) (*KvDatabase, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error opening lock file: %w", err)
 	}
-	return NewKvDatabase(
-		&fileLocker{
-			file: lockFile,
-		},
-		&directoryKv{
-			directory: directory,
+	journal, err := openJournal(directory)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening journal: %w", err)
+	}
+	store := &directoryKv{
+		directory: directory,
+		format:    options.Format,
+		journal:   journal,
+	}
+	db := NewKvDatabase(newFileLocker(lockFile), store)
+	store.now = func() time.Time { return db.Now() }
+	store.newId = func() string { return db.NewId() }
+	store.newRevision = func() string { return db.NewRevision() }
+	for _, field := range options.Indexes {
+		err = db.AddIndex(field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = db.RebuildIndexes(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("Error building indexes: %w", err)
+	}
+	return db, nil
+}
+
+type FilesConfig struct {
+	Directory string `yaml:"directory"`
+	// "json" (default) or "yaml"
+	Format FileFormat `yaml:"format"`
+	// Fields to index in addition to kind and labels, e.g. "spec.owner"
+	Indexes []string `yaml:"indexes"`
+}
+
+func (c *FilesConfig) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("directory", c.Directory),
+		slog.String("format", string(c.Format)),
+	)
+}
+
+func init() {
+	RegisterBackend("files", &Backend{
+		NewConfig: func() any { return &FilesConfig{} },
+		Connect: func(config any) (Database, error) {
+			slog.Debug("open FilesDatabase", "config", config)
+			filesConfig := config.(*FilesConfig)
+			db, err := NewFilesDatabase(
+				filesConfig.Directory,
+				FilesOptions{
+					Format:  filesConfig.Format,
+					Indexes: filesConfig.Indexes,
+				},
+			)
+			if err != nil {
+				return nil, err
+			}
+			return db, nil
 		},
-	), nil
+	})
 }
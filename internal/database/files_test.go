@@ -0,0 +1,175 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilePath(t *testing.T) {
+	kv := &directoryKv{directory: "/data", format: FormatJson}
+	for name, expected := range map[string]string{
+		"one":         "/data/one.json",
+		"one/two-2":   "/data/one/two-2.json",
+		"..":          "/data/%2E%2E.json",
+		"../../etc":   "/data/%2E%2E/%2E%2E/etc.json",
+		"_lock":       "/data/%5Flock.json",
+		"one.json":    "/data/one%2Ejson.json",
+		"One\\two":    "/data/%4Fne%5Ctwo.json",
+		"/etc/passwd": "",
+		"one//two":    "",
+	} {
+		filePath, err := kv.filePath(name)
+		if expected == "" {
+			if _, ok := err.(*Invalid); !ok {
+				t.Fatalf("%#v: expected error, got %#v", name, filePath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%#v: %v", name, err)
+		}
+		if filePath != expected {
+			t.Fatalf("%#v: %v != %v", name, filePath, expected)
+		}
+		if !strings.HasPrefix(filePath, "/data/") {
+			t.Fatalf("%#v: escapes the directory: %v", name, filePath)
+		}
+	}
+}
+
+func TestExternalEdit(t *testing.T) {
+	ctx := context.Background()
+	directory := t.TempDir()
+	db, err := NewFilesDatabase(directory, FilesOptions{Format: FormatYaml})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := db.Create(
+		ctx,
+		Object{
+			Kind:     "example.org/Example",
+			Version:  "v1",
+			Metadata: ObjectMetadata{Name: "one"},
+			Spec:     map[string]interface{}{"value": "yay", "alpha": 1},
+			Status:   map[string]interface{}{},
+		},
+		false,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := filepath.Join(directory, "one.yaml")
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "spec:\n  alpha: 1\n  value: yay\n") {
+		t.Fatalf("unexpected YAML:\n%s", data)
+	}
+
+	// Reading doesn't change the revision
+	object, err := db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Metadata.Revision != meta.Revision {
+		t.Fatal("revision changed without edits")
+	}
+
+	// Edit the file by hand
+	data = []byte(strings.Replace(string(data), "value: yay", "value: edited", 1))
+	err = os.WriteFile(filePath, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object, err = db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Spec.(map[string]interface{})["value"] != "edited" {
+		t.Fatal("edit not visible")
+	}
+	if object.Metadata.Id != meta.Id || object.Metadata.Revision == meta.Revision {
+		t.Fatalf("edit didn't bump the revision: %#v", object.Metadata)
+	}
+	edited := object.Metadata.Revision
+
+	entries, err := ReadJournal(directory, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Revision != edited {
+		t.Fatalf("edit not recorded in the journal: %#v", entries)
+	}
+
+	// Updating with the old revision fails
+	_, err = db.Update(
+		ctx,
+		Object{
+			Kind:     "example.org/Example",
+			Version:  "v1",
+			Metadata: ObjectMetadata{Name: "one", Id: meta.Id, Revision: meta.Revision},
+		},
+	)
+	if _, ok := err.(*Conflict); !ok {
+		t.Fatalf("update with stale revision didn't fail: %#v", err)
+	}
+
+	// A new database notices edits made while it was not running
+	err = os.WriteFile(filePath, []byte(strings.Replace(string(data), "value: edited", "value: offline", 1)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewFilesDatabase(directory, FilesOptions{Format: FormatYaml})
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err = db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Metadata.Revision == edited {
+		t.Fatal("offline edit didn't bump the revision")
+	}
+
+	// Objects can be created by hand
+	err = os.WriteFile(
+		filepath.Join(directory, "two.yaml"),
+		[]byte("kind: example.org/Example\nversion: v1\nspec:\n  value: manual\n"),
+		0600,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err = db.Get(ctx, "two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Metadata.Name != "two" || object.Metadata.Id == "" || object.Metadata.Revision == "" {
+		t.Fatalf("manual object didn't get metadata: %#v", object.Metadata)
+	}
+
+	// And deleted by hand
+	err = os.Remove(filepath.Join(directory, "two.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Get(ctx, "two")
+	if _, ok := err.(*DoesNotExist); !ok {
+		t.Fatalf("manually deleted object still exists: %#v", err)
+	}
+	entries, err = ReadJournal(directory, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := entries[len(entries)-1]
+	if last.Operation != JournalDelete || last.Name != "two" {
+		t.Fatalf("manual delete not recorded in the journal: %#v", last)
+	}
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var uuidMutex sync.Mutex
+var uuidLastMillis int64
+var uuidCounter uint16
+
+// Generate a UUIDv7 (RFC 9562) for the given time
+//
+// Those are made of a millisecond timestamp followed by random bits, so they
+// sort by creation time. The 12 bits after the timestamp are used as a
+// counter, so identifiers generated by this process are strictly increasing,
+// even within the same millisecond or if the clock goes backwards.
+func NewUUIDv7(now time.Time) string {
+	var random [10]byte
+	_, err := rand.Read(random[:])
+	if err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+
+	uuidMutex.Lock()
+	millis := now.UnixMilli()
+	if millis > uuidLastMillis {
+		uuidLastMillis = millis
+		// Start the counter in the lower half, leaving room to increment
+		uuidCounter = binary.BigEndian.Uint16(random[0:2]) & 0x7ff
+	} else {
+		millis = uuidLastMillis
+		uuidCounter++
+		if uuidCounter > 0xfff {
+			uuidLastMillis++
+			millis = uuidLastMillis
+			uuidCounter = 0
+		}
+	}
+	counter := uuidCounter
+	uuidMutex.Unlock()
+
+	var uuid [16]byte
+	uuid[0] = byte(millis >> 40)
+	uuid[1] = byte(millis >> 32)
+	uuid[2] = byte(millis >> 24)
+	uuid[3] = byte(millis >> 16)
+	uuid[4] = byte(millis >> 8)
+	uuid[5] = byte(millis)
+	uuid[6] = 0x70 | byte(counter>>8) // Version 7
+	uuid[7] = byte(counter)
+	copy(uuid[8:], random[2:])
+	uuid[8] = 0x80 | (uuid[8] & 0x3f) // Variant 10
+	return fmt.Sprintf(
+		"%x-%x-%x-%x-%x",
+		uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16],
+	)
+}
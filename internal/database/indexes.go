@@ -0,0 +1,273 @@
+package database
+
+import (
+	"context"
+	"slices"
+	"strings"
+)
+
+// Implemented by stores that can be modified by other processes, or outside
+// of vogon, so that KvDatabase can keep its indexes up to date
+type ChangeTracker interface {
+	// Return the names of the objects that changed since the last call, or
+	// all=true if the indexes have to be rebuilt. Called with the lock held.
+	Changes(ctx context.Context) (names []string, all bool, err error)
+}
+
+// Secondary indexes, mapping the values of fields to the names of the objects
+// that have them
+//
+// The kind and all labels are always indexed, JSON paths into the spec and
+// status can be added with KvDatabase.AddIndex.
+type indexes struct {
+	// Indexed fields, in addition to kind and labels
+	fields []string
+	// field -> value -> set of names
+	values map[string]map[string]map[string]struct{}
+	// name -> field -> value, to remove the entries when an object changes
+	objects map[string]map[string]string
+	// Whether the indexes cover all the objects in the store
+	built bool
+}
+
+func newIndexes() *indexes {
+	return &indexes{
+		values:  make(map[string]map[string]map[string]struct{}),
+		objects: make(map[string]map[string]string),
+	}
+}
+
+func (idx *indexes) isIndexed(field string) bool {
+	return field == "kind" ||
+		strings.HasPrefix(field, "metadata.labels.") ||
+		slices.Contains(idx.fields, field)
+}
+
+func (idx *indexes) clear() {
+	idx.values = make(map[string]map[string]map[string]struct{})
+	idx.objects = make(map[string]map[string]string)
+	idx.built = false
+}
+
+// Get the indexed values of an object
+func (idx *indexes) entries(object Object) map[string]string {
+	entries := make(map[string]string, 1+len(object.Metadata.Labels)+len(idx.fields))
+	entries["kind"] = object.Kind
+	for key, value := range object.Metadata.Labels {
+		entries["metadata.labels."+key] = value
+	}
+	for _, field := range idx.fields {
+		value, exists := FieldValue(object, field)
+		if exists {
+			entries[field] = valueString(value)
+		}
+	}
+	return entries
+}
+
+func (idx *indexes) remove(name string) {
+	for field, value := range idx.objects[name] {
+		names := idx.values[field][value]
+		delete(names, name)
+		if len(names) == 0 {
+			delete(idx.values[field], value)
+			if len(idx.values[field]) == 0 {
+				delete(idx.values, field)
+			}
+		}
+	}
+	delete(idx.objects, name)
+}
+
+func (idx *indexes) update(object Object) {
+	name := object.Metadata.Name
+	idx.remove(name)
+	entries := idx.entries(object)
+	for field, value := range entries {
+		values, ok := idx.values[field]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			idx.values[field] = values
+		}
+		names, ok := values[value]
+		if !ok {
+			names = make(map[string]struct{})
+			values[value] = names
+		}
+		names[name] = struct{}{}
+	}
+	idx.objects[name] = entries
+}
+
+// Get the names of the objects that might match the selector, or false if the
+// selector doesn't use any index
+//
+// Only equality and set membership on indexed fields are used, the objects
+// still have to be checked against the full selector.
+func (idx *indexes) lookup(selector Selector) (map[string]struct{}, bool) {
+	var result map[string]struct{}
+	found := false
+	for _, requirement := range selector {
+		if !idx.isIndexed(requirement.Field) {
+			continue
+		}
+		if requirement.Operator != OpEquals && requirement.Operator != OpIn {
+			continue
+		}
+		names := make(map[string]struct{})
+		for _, value := range requirement.Values {
+			for name := range idx.values[requirement.Field][value] {
+				if !found || hasName(result, name) {
+					names[name] = struct{}{}
+				}
+			}
+		}
+		result = names
+		found = true
+	}
+	return result, found
+}
+
+func hasName(names map[string]struct{}, name string) bool {
+	_, ok := names[name]
+	return ok
+}
+
+// Add an index on a field, in the syntax used by selectors (for example
+// "spec.owner"), so that lists selecting on it don't have to read every
+// object. The kind and labels are always indexed.
+func (db *KvDatabase) AddIndex(field string) error {
+	if err := validateField(field); err != nil {
+		return err
+	}
+	if err := db.mutex.Lock(context.Background()); err != nil {
+		return err
+	}
+	defer db.mutex.Unlock()
+
+	if !db.indexes.isIndexed(field) {
+		db.indexes.fields = append(db.indexes.fields, field)
+		db.indexes.clear()
+	}
+	return nil
+}
+
+// Rebuild the indexes by reading every object
+func (db *KvDatabase) RebuildIndexes(ctx context.Context) error {
+	if err := db.mutex.Lock(ctx); err != nil {
+		return err
+	}
+	defer db.mutex.Unlock()
+
+	return db.rebuildIndexes(ctx)
+}
+
+func (db *KvDatabase) rebuildIndexes(ctx context.Context) error {
+	db.indexes.clear()
+	if tracker, ok := db.store.(ChangeTracker); ok {
+		// Everything is about to be read anyway
+		_, _, err := tracker.Changes(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	objects, err := db.store.List(ctx, "", "", 0)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		db.indexes.update(object)
+	}
+	db.indexes.built = true
+	return nil
+}
+
+// Bring the indexes up to date with changes made by others. Must be called
+// with the lock held.
+func (db *KvDatabase) syncIndexes(ctx context.Context) error {
+	if !db.indexes.built {
+		return db.rebuildIndexes(ctx)
+	}
+	tracker, ok := db.store.(ChangeTracker)
+	if !ok {
+		return nil
+	}
+	names, all, err := tracker.Changes(ctx)
+	if err != nil {
+		return err
+	}
+	if all {
+		return db.rebuildIndexes(ctx)
+	}
+	for _, name := range names {
+		object, err := db.store.Read(ctx, name)
+		if err != nil {
+			if _, ok := err.(*DoesNotExist); ok {
+				db.indexes.remove(name)
+				continue
+			}
+			return err
+		}
+		db.indexes.update(object)
+	}
+	return nil
+}
+
+// Update the indexes after writing an object. Must be called with the lock
+// held.
+func (db *KvDatabase) indexWrite(object Object) {
+	if db.indexes.built {
+		db.indexes.update(object)
+	}
+}
+
+// Update the indexes after deleting an object. Must be called with the lock
+// held.
+func (db *KvDatabase) indexDelete(name string) {
+	if db.indexes.built {
+		db.indexes.remove(name)
+	}
+}
+
+// List using the indexes, returns false if the selector doesn't use any.
+// Must be called with the lock held.
+func (db *KvDatabase) listIndexed(ctx context.Context, options ListOptions, after string) ([]Object, bool, error) {
+	if len(options.Selector) == 0 {
+		return nil, false, nil
+	}
+	err := db.syncIndexes(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	candidates, ok := db.indexes.lookup(options.Selector)
+	if !ok {
+		return nil, false, nil
+	}
+
+	names := make([]string, 0, len(candidates))
+	for name := range candidates {
+		if name > after && HasPrefix(name, options.Prefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	objects := make([]Object, 0)
+	for _, name := range names {
+		// Get one more object to know whether this is the last page
+		if options.Limit > 0 && len(objects) > options.Limit {
+			break
+		}
+		object, err := db.store.Read(ctx, name)
+		if err != nil {
+			if _, ok := err.(*DoesNotExist); ok {
+				continue
+			}
+			return nil, false, err
+		}
+		if options.Selector.Matches(object) {
+			objects = append(objects, object)
+		}
+	}
+	return objects, true, nil
+}
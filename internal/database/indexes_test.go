@@ -0,0 +1,179 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func listNames(t testing.TB, db *KvDatabase, selector string) []string {
+	parsed, err := ParseSelector(selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.List(context.Background(), ListOptions{Selector: parsed})
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	names := make([]string, 0, len(result.Objects))
+	for _, object := range result.Objects {
+		names = append(names, object.Metadata.Name)
+	}
+	return names
+}
+
+func labeledObject(name string, labels map[string]string) Object {
+	return Object{
+		Kind:     "example.org/Example",
+		Version:  "v1",
+		Metadata: ObjectMetadata{Name: name, Labels: labels},
+		Spec:     map[string]interface{}{"value": name},
+		Status:   struct{}{},
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryDatabase()
+
+	for _, object := range []Object{
+		labeledObject("a", map[string]string{"app": "web"}),
+		labeledObject("b", map[string]string{"app": "web"}),
+		labeledObject("c", map[string]string{"app": "db"}),
+	} {
+		_, err := db.Create(ctx, object, false)
+		if err != nil {
+			t.Fatalf("%#v", err)
+		}
+	}
+	if names := listNames(t, db, "metadata.labels.app=web"); !slices.Equal(names, []string{"a", "b"}) {
+		t.Fatalf("wrong objects: %v", names)
+	}
+
+	// Writes update the indexes
+	_, err := db.Update(ctx, labeledObject("a", map[string]string{"app": "db"}))
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	_, err = db.Delete(ctx, "c", "", "")
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if names := listNames(t, db, "metadata.labels.app in (web,db)"); !slices.Equal(names, []string{"a", "b"}) {
+		t.Fatalf("wrong objects after writes: %v", names)
+	}
+	if names := listNames(t, db, "metadata.labels.app=db"); !slices.Equal(names, []string{"a"}) {
+		t.Fatalf("wrong objects after writes: %v", names)
+	}
+	if len(db.indexes.values["metadata.labels.app"]) != 2 {
+		t.Fatalf("stale index entries: %#v", db.indexes.values)
+	}
+
+	// Adding an index rebuilds them
+	err = db.AddIndex("spec.value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(t, db, "spec.value=b"); !slices.Equal(names, []string{"b"}) {
+		t.Fatalf("wrong objects with new index: %v", names)
+	}
+	if _, ok := db.indexes.lookup(Selector{{"spec.value", OpEquals, []string{"b"}}}); !ok {
+		t.Fatal("new index not used")
+	}
+
+	err = db.AddIndex("owner")
+	if _, ok := err.(*Invalid); !ok {
+		t.Fatalf("invalid index was added: %#v", err)
+	}
+}
+
+func TestFilesIndexesSync(t *testing.T) {
+	ctx := context.Background()
+	directory := t.TempDir()
+	other, err := NewFilesDatabase(directory, FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.Create(ctx, labeledObject("a", map[string]string{"app": "web"}), false)
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+
+	// Built on startup
+	db, err := NewFilesDatabase(directory, FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(t, db, "metadata.labels.app=web"); !slices.Equal(names, []string{"a"}) {
+		t.Fatalf("wrong objects on startup: %v", names)
+	}
+
+	// Changes from another process are picked up from the journal
+	_, err = other.Create(ctx, labeledObject("b", map[string]string{"app": "web"}), false)
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	_, err = other.Delete(ctx, "a", "", "")
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	if names := listNames(t, db, "metadata.labels.app=web"); !slices.Equal(names, []string{"b"}) {
+		t.Fatalf("wrong objects after external changes: %v", names)
+	}
+
+	// And after compaction
+	_, err = other.Create(ctx, labeledObject("c", map[string]string{"app": "web"}), false)
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	err = CompactJournal(ctx, directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(t, db, "metadata.labels.app=web"); !slices.Equal(names, []string{"b", "c"}) {
+		t.Fatalf("wrong objects after compaction: %v", names)
+	}
+}
+
+func benchmarkList(b *testing.B, db *KvDatabase) {
+	ctx := context.Background()
+	for i := 0; i < 2000; i++ {
+		object := labeledObject(
+			fmt.Sprintf("obj-%04d", i),
+			map[string]string{"group": fmt.Sprintf("g%d", i%100)},
+		)
+		_, err := db.Create(ctx, object, false)
+		if err != nil {
+			b.Fatalf("%#v", err)
+		}
+	}
+
+	b.Run("Indexed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if names := listNames(b, db, "metadata.labels.group=g42"); len(names) != 20 {
+				b.Fatalf("wrong objects: %v", names)
+			}
+		}
+	})
+	// Same query, but comparisons don't use the index
+	b.Run("Scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if names := listNames(b, db, "metadata.labels.group>=g42,metadata.labels.group<=g42"); len(names) != 20 {
+				b.Fatalf("wrong objects: %v", names)
+			}
+		}
+	})
+}
+
+func BenchmarkListInMemory(b *testing.B) {
+	benchmarkList(b, NewInMemoryDatabase())
+}
+
+func BenchmarkListFiles(b *testing.B) {
+	db, err := NewFilesDatabase(b.TempDir(), FilesOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkList(b, db)
+}
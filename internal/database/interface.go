@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"time"
 )
 
@@ -30,45 +31,75 @@ type ObjectMetadata struct {
 type MetadataResponse struct {
 	Id       string
 	Revision string
+	// The object that was replaced or deleted, read while writing, for the
+	// audit log. Empty if there was none. Not sent to clients.
+	PreviousKind     string `json:"-" yaml:"-"`
+	PreviousRevision string `json:"-" yaml:"-"`
 }
 
-type Conflict struct {
-	s string
+// Record the object that was replaced or deleted, nil if there was none
+func (m *MetadataResponse) setPrevious(previous *Object) {
+	if previous != nil {
+		m.PreviousKind = previous.Kind
+		m.PreviousRevision = previous.Metadata.Revision
+	}
 }
 
-func (e *Conflict) Error() string {
-	return e.s
+type ListOptions struct {
+	// Only list objects under this path, e.g. "team-a" matches "team-a/job"
+	// and "team-a/sub/job", but not "team-a" itself
+	Prefix string
+	// Maximum number of objects to return, 0 for no limit
+	Limit int
+	// Token returned by a previous call, to get the next page
+	Continue string
+	// Only list objects matching all those requirements
+	Selector Selector
 }
 
-type DoesNotExist struct {
-	s string
-}
-
-func (e *DoesNotExist) Error() string {
-	return e.s
+type ListResult struct {
+	Objects []Object
+	// Token to get the next page, empty if there are no more objects
+	Continue string
 }
 
+// A database of objects
+//
+// Methods give up and return the context's error if it is done before they
+// could acquire the necessary locks.
 type Database interface {
 	// Create an object
 	//
 	// If replace is false, returns an error if it exists.
 	// If replace is true and Id or Revision are not empty, returns an error if
 	// they don't match.
-	Create(object Object, replace bool) (MetadataResponse, error)
+	Create(ctx context.Context, object Object, replace bool) (MetadataResponse, error)
 
 	// Update an existing object
 	//
 	// If Id or Revision are not empty, returns an error if they don't match.
-	Update(object Object) (MetadataResponse, error)
+	Update(ctx context.Context, object Object) (MetadataResponse, error)
 
 	// Get a single object by name
-	Get(name string) (Object, error)
+	Get(ctx context.Context, name string) (Object, error)
 
-	//List(???) ([]Object, error)
+	// List objects, in name order
+	//
+	// Results are paginated using the Continue token, which stays valid while
+	// objects are written: every object that exists for the whole iteration is
+	// returned exactly once.
+	List(ctx context.Context, options ListOptions) (ListResult, error)
 
 	// Delete an object
 	//
 	// If previousRevision is not empty, returns an error if it doesn't match
 	// the revision on the server.
-	Delete(name string, id string, revision string) (MetadataResponse, error)
+	Delete(ctx context.Context, name string, id string, revision string) (MetadataResponse, error)
+
+	// Apply several writes atomically, in order
+	//
+	// Each operation sees the result of the previous ones. If any of them
+	// fails, none are applied and a *BatchError is returned. Otherwise the
+	// result has the metadata of each object written or deleted.
+	Batch(ctx context.Context, operations []BatchOperation) ([]MetadataResponse, error)
 }
@@ -0,0 +1,372 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+)
+
+// The journal is an append-only log of the changes made to a files database,
+// stored as one JSON object per line in the "_journal" file. It is written
+// while holding the database lock, so sequence numbers are strictly increasing
+// even if multiple processes share the directory.
+
+type JournalOperation string
+
+const (
+	JournalWrite  JournalOperation = "write"
+	JournalDelete JournalOperation = "delete"
+	// Marker written by CompactJournal, deletions before it are not recorded
+	JournalCompact JournalOperation = "compact"
+)
+
+type JournalEntry struct {
+	Sequence  uint64           `json:"seq"`
+	Operation JournalOperation `json:"op"`
+	Name      string           `json:"name,omitempty"`
+	Revision  string           `json:"revision,omitempty"`
+	// SHA-256 of the file that was written, to detect changes made outside
+	// of vogon
+	Hash string `json:"hash,omitempty"`
+}
+
+const journalFileName = "_journal"
+
+type journal struct {
+	path string
+	file *os.File
+	// End of the last complete entry we read
+	offset       int64
+	lastSequence uint64
+	// Last write of each existing object
+	objects map[string]JournalEntry
+	// Objects changed by other processes or outside of vogon, and whether
+	// the journal was replaced, since the last call to changes()
+	changed  map[string]struct{}
+	replaced bool
+	// Last entries, for changesSince()
+	recent recentChanges
+}
+
+func openJournal(directory string) (*journal, error) {
+	journalPath := path.Join(directory, journalFileName)
+	file, err := os.OpenFile(journalPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{
+		path:    journalPath,
+		file:    file,
+		objects: make(map[string]JournalEntry),
+		changed: make(map[string]struct{}),
+	}, nil
+}
+
+// Read the entries that were appended since we last looked, possibly by other
+// processes. Must be called with the lock held.
+func (j *journal) catchUp() error {
+	// If the journal was compacted, the file was replaced
+	current, err := os.Stat(j.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	ours, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+	if current == nil || !os.SameFile(current, ours) {
+		file, err := os.OpenFile(j.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		j.file.Close()
+		j.file = file
+		j.offset = 0
+		j.lastSequence = 0
+		j.objects = make(map[string]JournalEntry)
+		j.replaced = true
+		j.recent.clear()
+	}
+
+	_, err = j.file.Seek(j.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return readJournalEntries(j.file, func(entry JournalEntry, length int64) {
+		j.offset += length
+		j.record(entry)
+		if entry.Name != "" {
+			j.changed[entry.Name] = struct{}{}
+		}
+	})
+}
+
+// Record that an object was changed outside of vogon
+func (j *journal) markChanged(name string) {
+	j.changed[name] = struct{}{}
+}
+
+// Get the objects changed by others since the last call, or true if the
+// journal was replaced and anything might have changed. Must be called with
+// the lock held.
+func (j *journal) changes() ([]string, bool, error) {
+	err := j.catchUp()
+	if err != nil {
+		return nil, false, fmt.Errorf("reading journal: %w", err)
+	}
+	names := make([]string, 0, len(j.changed))
+	for name := range j.changed {
+		names = append(names, name)
+	}
+	replaced := j.replaced
+	j.changed = make(map[string]struct{})
+	j.replaced = false
+	return names, replaced, nil
+}
+
+func (j *journal) record(entry JournalEntry) {
+	j.lastSequence = entry.Sequence
+	j.recent.add(entry)
+	switch entry.Operation {
+	case JournalWrite:
+		j.objects[entry.Name] = entry
+	case JournalDelete:
+		delete(j.objects, entry.Name)
+	}
+}
+
+// Get the sequence number of the last entry. Must be called with the lock
+// held.
+func (j *journal) currentSequence() (uint64, error) {
+	err := j.catchUp()
+	if err != nil {
+		return 0, fmt.Errorf("reading journal: %w", err)
+	}
+	return j.lastSequence, nil
+}
+
+// Get the entries after the sequence number, see ChangeFeed. Must be called
+// with the lock held.
+func (j *journal) changesSince(since uint64) ([]JournalEntry, error) {
+	err := j.catchUp()
+	if err != nil {
+		return nil, fmt.Errorf("reading journal: %w", err)
+	}
+	if since > j.lastSequence {
+		// From another journal, or one that was reset
+		return nil, expiredChanges(since)
+	} else if since == j.lastSequence {
+		return nil, nil
+	}
+	if j.recent.covers(since) {
+		return changesAfter(j.recent.entries, since)
+	}
+	// Too old to be in memory, for example a watcher resuming after a
+	// restart
+	entries, err := ReadJournal(path.Dir(j.path), since)
+	if err != nil {
+		return nil, fmt.Errorf("reading journal: %w", err)
+	}
+	return changesAfter(entries, since)
+}
+
+// Get the last write to an object. Must be called with the lock held.
+func (j *journal) lastWrite(name string) (JournalEntry, bool, error) {
+	err := j.catchUp()
+	if err != nil {
+		return JournalEntry{}, false, fmt.Errorf("reading journal: %w", err)
+	}
+	entry, ok := j.objects[name]
+	return entry, ok, nil
+}
+
+// Append an entry to the journal. Must be called with the lock held.
+func (j *journal) append(operation JournalOperation, name string, revision string, hash string) error {
+	err := j.catchUp()
+	if err != nil {
+		return fmt.Errorf("reading journal: %w", err)
+	}
+
+	// Drop a partial entry left behind by a crash
+	info, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > j.offset {
+		err = j.file.Truncate(j.offset)
+		if err != nil {
+			return fmt.Errorf("truncating journal: %w", err)
+		}
+	}
+
+	entry := JournalEntry{
+		Sequence:  j.lastSequence + 1,
+		Operation: operation,
+		Name:      name,
+		Revision:  revision,
+		Hash:      hash,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	_, err = j.file.Write(line)
+	if err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	j.offset += int64(len(line))
+	j.record(entry)
+	return nil
+}
+
+// Call the function for each complete entry, with the number of bytes read
+// since the previous entry.
+func readJournalEntries(reader io.Reader, callback func(entry JournalEntry, length int64)) error {
+	buffered := bufio.NewReader(reader)
+	for {
+		line, err := buffered.ReadBytes('\n')
+		if err == io.EOF {
+			// Ignore partial entry at the end
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var entry JournalEntry
+		err = json.Unmarshal(bytes.TrimSpace(line), &entry)
+		if err != nil {
+			return fmt.Errorf("invalid journal entry: %w", err)
+		}
+		callback(entry, int64(len(line)))
+	}
+}
+
+func readJournalFile(journalPath string) ([]JournalEntry, error) {
+	file, err := os.Open(journalPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	var entries []JournalEntry
+	err = readJournalEntries(file, func(entry JournalEntry, length int64) {
+		entries = append(entries, entry)
+	})
+	return entries, err
+}
+
+// Read the journal entries of a files database that come after the given
+// sequence number
+//
+// This is how watchers catch up on the changes they missed, for example
+// across a server restart, see KvDatabase.ChangesSince. If the journal has
+// been compacted since, deletions that happened before the compaction are not
+// reported; this is signaled by a JournalCompact entry.
+func ReadJournal(directory string, since uint64) ([]JournalEntry, error) {
+	entries, err := readJournalFile(path.Join(directory, journalFileName))
+	if err != nil {
+		return nil, err
+	}
+	index, _ := slices.BinarySearchFunc(entries, since, func(entry JournalEntry, since uint64) int {
+		if entry.Sequence <= since {
+			return -1
+		}
+		return 1
+	})
+	return entries[index:], nil
+}
+
+// Replay journal entries, returning the last write for each object that
+// currently exists
+func ReplayJournal(entries []JournalEntry) map[string]JournalEntry {
+	objects := make(map[string]JournalEntry)
+	for _, entry := range entries {
+		switch entry.Operation {
+		case JournalWrite:
+			objects[entry.Name] = entry
+		case JournalDelete:
+			delete(objects, entry.Name)
+		}
+	}
+	return objects
+}
+
+// Compact the journal of a files database
+//
+// Only the last write of each existing object is kept, followed by a
+// JournalCompact marker. Sequence numbers are preserved.
+func CompactJournal(ctx context.Context, directory string) error {
+	lockFile, err := os.OpenFile(path.Join(directory, "_lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("Error opening lock file: %w", err)
+	}
+	defer lockFile.Close()
+	locker := newFileLocker(lockFile)
+	err = locker.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer locker.Unlock()
+
+	journalPath := path.Join(directory, journalFileName)
+	entries, err := readJournalFile(journalPath)
+	if err != nil {
+		return err
+	}
+	var lastSequence uint64
+	if len(entries) > 0 {
+		lastSequence = entries[len(entries)-1].Sequence
+	}
+
+	objects := ReplayJournal(entries)
+	compacted := make([]JournalEntry, 0, len(objects)+1)
+	for _, entry := range objects {
+		compacted = append(compacted, entry)
+	}
+	slices.SortFunc(compacted, func(a, b JournalEntry) int {
+		if a.Sequence < b.Sequence {
+			return -1
+		} else if a.Sequence > b.Sequence {
+			return 1
+		}
+		return 0
+	})
+	compacted = append(compacted, JournalEntry{
+		Sequence:  lastSequence + 1,
+		Operation: JournalCompact,
+	})
+
+	tmpPath := journalPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, entry := range compacted {
+		err = encoder.Encode(entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, journalPath)
+}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	ctx := context.Background()
+	directory := t.TempDir()
+	db, err := NewFilesDatabase(directory, FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"one", "two", "three"} {
+		_, err = db.Create(
+			ctx,
+			Object{
+				Kind:     "example.org/Example",
+				Version:  "v1",
+				Metadata: ObjectMetadata{Name: name},
+				Spec:     struct{}{},
+				Status:   struct{}{},
+			},
+			false,
+		)
+		if err != nil {
+			t.Fatalf("%#v", err)
+		}
+	}
+	meta, err := db.Update(
+		ctx,
+		Object{
+			Kind:     "example.org/Example",
+			Version:  "v1",
+			Metadata: ObjectMetadata{Name: "one"},
+			Spec:     map[string]interface{}{"value": "updated"},
+			Status:   struct{}{},
+		},
+	)
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+
+	// A second database on the same directory continues the sequence
+	other, err := NewFilesDatabase(directory, FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.Delete(ctx, "two", "", "")
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+
+	entries, err := ReadJournal(directory, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		op   JournalOperation
+		name string
+	}{
+		{JournalWrite, "one"},
+		{JournalWrite, "two"},
+		{JournalWrite, "three"},
+		{JournalWrite, "one"},
+		{JournalDelete, "two"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("wrong number of entries: %#v", entries)
+	}
+	for i, entry := range entries {
+		if entry.Sequence != uint64(i+1) ||
+			entry.Operation != expected[i].op ||
+			entry.Name != expected[i].name {
+			t.Fatalf("invalid entry %d: %#v", i, entry)
+		}
+	}
+	if entries[3].Revision != meta.Revision {
+		t.Fatal("journal has wrong revision")
+	}
+
+	// Catch up from a sequence number
+	entries, err = ReadJournal(directory, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Sequence != 4 {
+		t.Fatalf("invalid entries after 3: %#v", entries)
+	}
+
+	// Replay
+	objects := ReplayJournal(entries)
+	if len(objects) != 1 || objects["one"].Revision != meta.Revision {
+		t.Fatalf("invalid replay: %#v", objects)
+	}
+
+	// Compact
+	err = CompactJournal(ctx, directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = ReadJournal(directory, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 ||
+		entries[0].Sequence != 3 || entries[0].Name != "three" ||
+		entries[1].Sequence != 4 || entries[1].Name != "one" ||
+		entries[2].Sequence != 6 || entries[2].Operation != JournalCompact {
+		t.Fatalf("invalid compacted journal: %#v", entries)
+	}
+
+	// Writes after compaction go to the new journal
+	_, err = db.Delete(ctx, "three", "", "")
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	entries, err = ReadJournal(directory, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 ||
+		entries[0].Sequence != 7 ||
+		entries[0].Operation != JournalDelete ||
+		entries[0].Name != "three" {
+		t.Fatalf("invalid entries after compaction: %#v", entries)
+	}
+}
+
+func TestChangeFeed(t *testing.T) {
+	ctx := context.Background()
+	directory := t.TempDir()
+	db, err := NewFilesDatabase(directory, FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewFilesDatabase(directory, FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := NewInMemoryDatabase()
+
+	create := func(db *KvDatabase, name string) {
+		t.Helper()
+		_, err := db.Create(
+			ctx,
+			Object{
+				Kind:     "example.org/Example",
+				Version:  "v1",
+				Metadata: ObjectMetadata{Name: name},
+				Spec:     struct{}{},
+				Status:   struct{}{},
+			},
+			false,
+		)
+		if err != nil {
+			t.Fatalf("%#v", err)
+		}
+	}
+	checkChanges := func(db *KvDatabase, since uint64, names ...string) {
+		t.Helper()
+		entries, err := db.ChangesSince(ctx, since)
+		if err != nil {
+			t.Fatalf("changes since %d: %v", since, err)
+		}
+		if len(entries) != len(names) {
+			t.Fatalf("wrong changes since %d: %#v", since, entries)
+		}
+		for i, entry := range entries {
+			if entry.Name != names[i] || entry.Sequence != since+uint64(i)+1 {
+				t.Fatalf("wrong changes since %d: %#v", since, entries)
+			}
+		}
+	}
+	isExpired := func(err error) bool {
+		var expired *Expired
+		return errors.As(err, &expired)
+	}
+
+	for _, db := range []*KvDatabase{db, memory} {
+		checkChanges(db, 0)
+		create(db, "one")
+		create(db, "two")
+		checkChanges(db, 0, "one", "two")
+		checkChanges(db, 1, "two")
+		checkChanges(db, 2)
+		sequence, err := db.LastSequence(ctx)
+		if err != nil || sequence != 2 {
+			t.Fatalf("wrong last sequence: %v %v", sequence, err)
+		}
+		_, err = db.ChangesSince(ctx, 3)
+		if !isExpired(err) {
+			t.Fatalf("no error for future sequence: %v", err)
+		}
+	}
+
+	// Changes made by other processes are seen
+	_, err = other.Delete(ctx, "one", "", "")
+	if err != nil {
+		t.Fatalf("%#v", err)
+	}
+	checkChanges(db, 2, "one")
+
+	// Watchers that are behind get an error after compaction
+	err = CompactJournal(ctx, directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(db, 3)
+	_, err = db.ChangesSince(ctx, 1)
+	if !isExpired(err) {
+		t.Fatalf("no error after compaction: %v", err)
+	}
+	create(db, "three")
+	checkChanges(db, 4, "three")
+
+	// A new process can resume from the journal
+	other, err = NewFilesDatabase(directory, FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkChanges(other, 4, "three")
+}
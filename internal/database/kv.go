@@ -1,156 +1,300 @@
 package database
 
 import (
-	"crypto/rand"
-	"errors"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"math/big"
+	"strings"
 	"time"
 )
 
 type Locker interface {
-	Lock()
+	// Acquire the lock, or return the context's error if it is done first
+	Lock(ctx context.Context) error
 	Unlock()
 }
 
 type KeyValueStore interface {
-	Read(key string) (Object, error)
-	Write(key string, value Object) error
-	Delete(key string) error
+	Read(ctx context.Context, key string) (Object, error)
+	Write(ctx context.Context, key string, value Object) error
+	Delete(ctx context.Context, key string) error
+	// Return objects with keys under the prefix (see ListOptions) that sort
+	// after the given key, in order, at most limit of them (0 for no limit)
+	List(ctx context.Context, prefix string, after string, limit int) ([]Object, error)
 }
 
 type KvDatabase struct {
-	mutex Locker
-	store KeyValueStore
+	mutex   Locker
+	store   KeyValueStore
+	indexes *indexes
+
+	// Current time, used for CreationTime
+	Now func() time.Time
+	// Generate the Id of a new object, defaults to a UUIDv7
+	NewId func() string
+	// Generate a new Revision on each write, defaults to a UUIDv7
+	NewRevision func() string
 }
 
 func NewKvDatabase(mutex Locker, store KeyValueStore) *KvDatabase {
-	return &KvDatabase{
-		mutex: mutex,
-		store: store,
+	db := &KvDatabase{
+		mutex:   mutex,
+		store:   store,
+		indexes: newIndexes(),
+		Now:     time.Now,
+	}
+	db.NewId = func() string {
+		return NewUUIDv7(db.Now())
+	}
+	db.NewRevision = func() string {
+		return NewUUIDv7(db.Now())
 	}
+	return db
 }
 
-func (db *KvDatabase) Create(object Object, replace bool) (MetadataResponse, error) {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-
-	previous, err := db.store.Read(object.Metadata.Name)
-	exists := true
+// Read an object from the store, nil if it doesn't exist. Must be called
+// with the lock held.
+func (db *KvDatabase) readExisting(ctx context.Context, name string) (*Object, error) {
+	object, err := db.store.Read(ctx, name)
 	if err != nil {
 		if _, ok := err.(*DoesNotExist); ok {
-			exists = false
-		} else {
-			return MetadataResponse{}, err
+			return nil, nil
 		}
+		return nil, err
 	}
-	if exists {
+	return &object, nil
+}
+
+// Check the preconditions of Create against the current object (nil if it
+// doesn't exist), and get the object to write
+func (db *KvDatabase) prepareCreate(object Object, replace bool, previous *Object) (Object, error) {
+	if previous != nil {
 		if !replace {
-			return MetadataResponse{}, &Conflict{
-				s: fmt.Sprintf("Object %s already exists, cannot create", object.Metadata.Name),
+			return Object{}, &Conflict{
+				Reason:   ReasonAlreadyExists,
+				Name:     object.Metadata.Name,
+				ActualId: previous.Metadata.Id,
+				Message:  fmt.Sprintf("Object %s already exists, cannot create", object.Metadata.Name),
 			}
 		}
 		if object.Metadata.Id != "" {
 			if previous.Metadata.Id != object.Metadata.Id {
-				return MetadataResponse{}, &Conflict{
-					s: fmt.Sprintf("Object %s exists and does not have the expected id, cannot replace", object.Metadata.Name),
+				return Object{}, &Conflict{
+					Reason:     ReasonIdMismatch,
+					Name:       object.Metadata.Name,
+					ExpectedId: object.Metadata.Id,
+					ActualId:   previous.Metadata.Id,
+					Message:    fmt.Sprintf("Object %s exists and does not have the expected id, cannot replace", object.Metadata.Name),
 				}
 			}
 		}
 
 		if object.Metadata.Revision != "" {
 			if object.Metadata.Id == "" {
-				return MetadataResponse{}, errors.New("Cannot replace with a previous revision but no previous id")
+				return Object{}, &Invalid{
+					Reason:  ReasonInvalid,
+					Name:    object.Metadata.Name,
+					Message: "Cannot replace with a previous revision but no previous id",
+				}
 			}
 			if previous.Metadata.Revision != object.Metadata.Revision {
-				return MetadataResponse{}, &Conflict{
-					s: fmt.Sprintf("Object %s exists and does not have the expected revision, cannot replace", object.Metadata.Name),
+				return Object{}, &Conflict{
+					Reason:           ReasonRevisionMismatch,
+					Name:             object.Metadata.Name,
+					ExpectedId:       object.Metadata.Id,
+					ActualId:         previous.Metadata.Id,
+					ExpectedRevision: object.Metadata.Revision,
+					ActualRevision:   previous.Metadata.Revision,
+					Message:          fmt.Sprintf("Object %s exists and does not have the expected revision, cannot replace", object.Metadata.Name),
 				}
 			}
 		}
 
 		object.Metadata.CreationTime = previous.Metadata.CreationTime
 		object.Metadata.Id = previous.Metadata.Id
-		object.Metadata.Revision = RandomString()
+		object.Metadata.Revision = db.NewRevision()
 	} else {
-		object.Metadata.CreationTime = time.Now()
-		object.Metadata.Id = RandomString()
-		object.Metadata.Revision = RandomString()
+		object.Metadata.CreationTime = db.Now()
+		object.Metadata.Id = db.NewId()
+		object.Metadata.Revision = db.NewRevision()
 	}
-
-	err = db.store.Write(object.Metadata.Name, object)
-	if err != nil {
-		return MetadataResponse{}, err
-	}
-
-	return MetadataResponse{
-		Id:       object.Metadata.Id,
-		Revision: object.Metadata.Revision,
-	}, nil
+	return object, nil
 }
 
-func (db *KvDatabase) Update(object Object) (MetadataResponse, error) {
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-
-	previous, err := db.store.Read(object.Metadata.Name)
-	exists := true
-	if err != nil {
-		if _, ok := err.(*DoesNotExist); ok {
-			exists = false
-		} else {
-			return MetadataResponse{}, err
-		}
-	}
-	if !exists {
-		return MetadataResponse{}, &DoesNotExist{
-			s: fmt.Sprintf("Object %s does not exist, cannot update", object.Metadata.Name),
+// Check the preconditions of Update against the current object (nil if it
+// doesn't exist), and get the object to write
+func (db *KvDatabase) prepareUpdate(object Object, previous *Object) (Object, error) {
+	if previous == nil {
+		return Object{}, &DoesNotExist{
+			Name:    object.Metadata.Name,
+			Message: fmt.Sprintf("Object %s does not exist, cannot update", object.Metadata.Name),
 		}
 	}
 
 	if object.Metadata.Id != "" {
 		if previous.Metadata.Id != object.Metadata.Id {
-			return MetadataResponse{}, &Conflict{
-				s: fmt.Sprintf("Object %s does not have the expected id, cannot update", object.Metadata.Name),
+			return Object{}, &Conflict{
+				Reason:     ReasonIdMismatch,
+				Name:       object.Metadata.Name,
+				ExpectedId: object.Metadata.Id,
+				ActualId:   previous.Metadata.Id,
+				Message:    fmt.Sprintf("Object %s does not have the expected id, cannot update", object.Metadata.Name),
 			}
 		}
 	}
 
 	if object.Metadata.Revision != "" {
 		if object.Metadata.Id == "" {
-			return MetadataResponse{}, errors.New("Cannot update with a previous revision but no previous id")
+			return Object{}, &Invalid{
+				Reason:  ReasonInvalid,
+				Name:    object.Metadata.Name,
+				Message: "Cannot update with a previous revision but no previous id",
+			}
 		}
 		if previous.Metadata.Revision != object.Metadata.Revision {
-			return MetadataResponse{}, &Conflict{
-				s: fmt.Sprintf("Object %s does not have the expected revision, cannot update", object.Metadata.Name),
+			return Object{}, &Conflict{
+				Reason:           ReasonRevisionMismatch,
+				Name:             object.Metadata.Name,
+				ExpectedId:       object.Metadata.Id,
+				ActualId:         previous.Metadata.Id,
+				ExpectedRevision: object.Metadata.Revision,
+				ActualRevision:   previous.Metadata.Revision,
+				Message:          fmt.Sprintf("Object %s does not have the expected revision, cannot update", object.Metadata.Name),
 			}
 		}
 	}
 
 	object.Metadata.CreationTime = previous.Metadata.CreationTime
 	object.Metadata.Id = previous.Metadata.Id
-	object.Metadata.Revision = RandomString()
+	object.Metadata.Revision = db.NewRevision()
+	return object, nil
+}
+
+// Check the preconditions of Delete against the current object (nil if it
+// doesn't exist)
+func checkDelete(name string, id string, revision string, previous *Object) error {
+	if previous == nil {
+		return &DoesNotExist{
+			Name:    name,
+			Message: fmt.Sprintf("Object %s does not exist", name),
+		}
+	}
 
-	err = db.store.Write(object.Metadata.Name, object)
+	if id != "" {
+		if previous.Metadata.Id != id {
+			return &Conflict{
+				Reason:     ReasonIdMismatch,
+				Name:       name,
+				ExpectedId: id,
+				ActualId:   previous.Metadata.Id,
+				Message:    fmt.Sprintf("Object %s does not have the expected id, cannot delete", name),
+			}
+		}
+	}
+
+	if revision != "" {
+		if id == "" {
+			return &Invalid{
+				Reason:  ReasonInvalid,
+				Name:    name,
+				Message: "Cannot delete with a previous revision but no previous id",
+			}
+		}
+		if previous.Metadata.Revision != revision {
+			return &Conflict{
+				Reason:           ReasonRevisionMismatch,
+				Name:             name,
+				ExpectedId:       id,
+				ActualId:         previous.Metadata.Id,
+				ExpectedRevision: revision,
+				ActualRevision:   previous.Metadata.Revision,
+				Message:          fmt.Sprintf("Object %s does not have the expected revision, cannot delete", name),
+			}
+		}
+	}
+	return nil
+}
+
+func (db *KvDatabase) Create(ctx context.Context, object Object, replace bool) (MetadataResponse, error) {
+	if err := ValidateName(object.Metadata.Name); err != nil {
+		return MetadataResponse{}, err
+	}
+	if err := db.mutex.Lock(ctx); err != nil {
+		return MetadataResponse{}, err
+	}
+	defer db.mutex.Unlock()
+
+	previous, err := db.readExisting(ctx, object.Metadata.Name)
+	if err != nil {
+		return MetadataResponse{}, err
+	}
+	object, err = db.prepareCreate(object, replace, previous)
 	if err != nil {
 		return MetadataResponse{}, err
 	}
 
-	return MetadataResponse{
+	err = db.store.Write(ctx, object.Metadata.Name, object)
+	if err != nil {
+		return MetadataResponse{}, err
+	}
+	db.indexWrite(object)
+
+	response := MetadataResponse{
 		Id:       object.Metadata.Id,
 		Revision: object.Metadata.Revision,
-	}, nil
+	}
+	response.setPrevious(previous)
+	return response, nil
 }
 
-func (db *KvDatabase) Get(name string) (Object, error) {
-	db.mutex.Lock()
+func (db *KvDatabase) Update(ctx context.Context, object Object) (MetadataResponse, error) {
+	if err := ValidateName(object.Metadata.Name); err != nil {
+		return MetadataResponse{}, err
+	}
+	if err := db.mutex.Lock(ctx); err != nil {
+		return MetadataResponse{}, err
+	}
 	defer db.mutex.Unlock()
 
-	object, err := db.store.Read(name)
+	previous, err := db.readExisting(ctx, object.Metadata.Name)
+	if err != nil {
+		return MetadataResponse{}, err
+	}
+	object, err = db.prepareUpdate(object, previous)
+	if err != nil {
+		return MetadataResponse{}, err
+	}
+
+	err = db.store.Write(ctx, object.Metadata.Name, object)
+	if err != nil {
+		return MetadataResponse{}, err
+	}
+	db.indexWrite(object)
+
+	response := MetadataResponse{
+		Id:       object.Metadata.Id,
+		Revision: object.Metadata.Revision,
+	}
+	response.setPrevious(previous)
+	return response, nil
+}
+
+func (db *KvDatabase) Get(ctx context.Context, name string) (Object, error) {
+	if err := ValidateName(name); err != nil {
+		return Object{}, err
+	}
+	if err := db.mutex.Lock(ctx); err != nil {
+		return Object{}, err
+	}
+	defer db.mutex.Unlock()
+
+	object, err := db.store.Read(ctx, name)
 	if err != nil {
 		if _, ok := err.(*DoesNotExist); ok {
 			return Object{}, &DoesNotExist{
-				s: fmt.Sprintf("Object %s does not exist", name),
+				Name:    name,
+				Message: fmt.Sprintf("Object %s does not exist", name),
 			}
 		} else {
 			return object, err
@@ -160,55 +304,143 @@ func (db *KvDatabase) Get(name string) (Object, error) {
 	return object, nil
 }
 
-func (db *KvDatabase) Delete(name string, id string, revision string) (MetadataResponse, error) {
-	db.mutex.Lock()
+func (db *KvDatabase) Delete(ctx context.Context, name string, id string, revision string) (MetadataResponse, error) {
+	if err := ValidateName(name); err != nil {
+		return MetadataResponse{}, err
+	}
+	if err := db.mutex.Lock(ctx); err != nil {
+		return MetadataResponse{}, err
+	}
 	defer db.mutex.Unlock()
 
-	previous, err := db.store.Read(name)
+	previous, err := db.readExisting(ctx, name)
 	if err != nil {
-		if _, ok := err.(*DoesNotExist); ok {
-			return MetadataResponse{}, &DoesNotExist{
-				s: fmt.Sprintf("Object %s does not exist", name),
-			}
-		} else {
-			return MetadataResponse{}, err
-		}
+		return MetadataResponse{}, err
+	}
+	err = checkDelete(name, id, revision, previous)
+	if err != nil {
+		return MetadataResponse{}, err
 	}
 
-	if id != "" {
-		if previous.Metadata.Id != id {
-			return MetadataResponse{}, &Conflict{
-				s: fmt.Sprintf("Object %s does not have the expected id, cannot delete", name),
-			}
-		}
+	err = db.store.Delete(ctx, name)
+	if err != nil {
+		return MetadataResponse{}, err
 	}
+	db.indexDelete(name)
 
-	if revision != "" {
-		if id == "" {
-			return MetadataResponse{}, errors.New("Cannot delete with a previous revision but no previous id")
+	response := MetadataResponse{
+		Id:       previous.Metadata.Id,
+		Revision: previous.Metadata.Revision,
+	}
+	response.setPrevious(previous)
+	return response, nil
+}
+
+type continueToken struct {
+	After string `json:"after"`
+}
+
+func encodeContinueToken(after string) string {
+	data, err := json.Marshal(continueToken{After: after})
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeContinueToken(token string) (string, error) {
+	invalid := &Invalid{
+		Reason:  ReasonInvalid,
+		Message: "Invalid continue token",
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", invalid
+	}
+	var decoded continueToken
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		return "", invalid
+	}
+	return decoded.After, nil
+}
+
+// Number of objects to read from the store at a time when filtering
+const minSelectorBatch = 100
+
+func (db *KvDatabase) List(ctx context.Context, options ListOptions) (ListResult, error) {
+	if options.Prefix != "" {
+		if err := ValidateName(options.Prefix); err != nil {
+			return ListResult{}, err
 		}
-		if previous.Metadata.Revision != revision {
-			return MetadataResponse{}, &Conflict{
-				s: fmt.Sprintf("Object %s does not have the expected revision, cannot delete", name),
-			}
+	}
+	after := ""
+	if options.Continue != "" {
+		var err error
+		after, err = decodeContinueToken(options.Continue)
+		if err != nil {
+			return ListResult{}, err
 		}
 	}
 
-	err = db.store.Delete(name)
+	if err := db.mutex.Lock(ctx); err != nil {
+		return ListResult{}, err
+	}
+	defer db.mutex.Unlock()
+
+	objects, indexed, err := db.listIndexed(ctx, options, after)
 	if err != nil {
-		return MetadataResponse{}, err
+		return ListResult{}, err
+	}
+	if !indexed {
+		objects, err = db.listScan(ctx, options, after)
+		if err != nil {
+			return ListResult{}, err
+		}
 	}
 
-	return MetadataResponse{
-		Id:       previous.Metadata.Id,
-		Revision: previous.Metadata.Revision,
-	}, nil
+	result := ListResult{
+		Objects: objects,
+	}
+	if options.Limit > 0 && len(objects) > options.Limit {
+		result.Objects = objects[:options.Limit]
+		result.Continue = encodeContinueToken(objects[options.Limit-1].Metadata.Name)
+	}
+	return result, nil
 }
 
-func RandomString() string {
-	num, err := rand.Int(rand.Reader, big.NewInt(0x100000000))
-	if err != nil {
-		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+// List by reading all the objects from the store. Must be called with the
+// lock held.
+func (db *KvDatabase) listScan(ctx context.Context, options ListOptions, after string) ([]Object, error) {
+	// Get one more object to know whether this is the last page. When
+	// filtering, keep reading batches until we have enough matches
+	limit := 0
+	if options.Limit > 0 {
+		limit = options.Limit + 1
+		if len(options.Selector) > 0 {
+			limit = max(limit, minSelectorBatch)
+		}
 	}
-	return fmt.Sprintf("%x", num)
+	objects := make([]Object, 0)
+	for {
+		batch, err := db.store.List(ctx, options.Prefix, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range batch {
+			if options.Selector.Matches(object) {
+				objects = append(objects, object)
+			}
+		}
+		if limit == 0 || len(batch) < limit || len(objects) > options.Limit {
+			break
+		}
+		after = batch[len(batch)-1].Metadata.Name
+	}
+	return objects, nil
+}
+
+// Whether the name is under the prefix, see ListOptions
+func HasPrefix(name string, prefix string) bool {
+	return prefix == "" || strings.HasPrefix(name, prefix+"/")
 }
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestLockCancellation(t *testing.T) {
+	emptyFilesDb := func(t *testing.T) *KvDatabase {
+		db, err := NewFilesDatabase(t.TempDir(), FilesOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	for name, db := range map[string]*KvDatabase{
+		"inmemory": NewInMemoryDatabase(),
+		"files":    emptyFilesDb(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := db.mutex.Lock(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err = db.Get(ctx, "one")
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("get with lock held didn't time out: %#v", err)
+			}
+
+			db.mutex.Unlock()
+			_, err = db.Get(context.Background(), "one")
+			if _, ok := err.(*DoesNotExist); !ok {
+				t.Fatalf("get after unlock failed: %#v", err)
+			}
+		})
+	}
+}
+
+func TestFileLockCancellation(t *testing.T) {
+	// Another process holds the lock
+	directory := t.TempDir()
+	db, err := NewFilesDatabase(directory, FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewFilesDatabase(directory, FilesOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = other.mutex.Lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = db.Get(ctx, "one")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("get with lock held didn't time out: %#v", err)
+	}
+
+	other.mutex.Unlock()
+	_, err = db.Get(context.Background(), "one")
+	if _, ok := err.(*DoesNotExist); !ok {
+		t.Fatalf("get after unlock failed: %#v", err)
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	ctx := context.Background()
+	db := NewInMemoryDatabase()
+	clock := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time { return clock }
+	counter := 0
+	db.NewId = func() string {
+		counter++
+		return fmt.Sprintf("id-%d", counter)
+	}
+	db.NewRevision = func() string {
+		counter++
+		return fmt.Sprintf("rev-%d", counter)
+	}
+
+	meta, err := db.Create(
+		ctx,
+		Object{
+			Kind:     "example.org/Example",
+			Version:  "v1",
+			Metadata: ObjectMetadata{Name: "one"},
+		},
+		false,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Id != "id-1" || meta.Revision != "rev-2" {
+		t.Fatalf("create didn't use generators: %#v", meta)
+	}
+
+	clock = clock.Add(time.Hour)
+	meta, err = db.Update(
+		ctx,
+		Object{
+			Kind:     "example.org/Example",
+			Version:  "v1",
+			Metadata: ObjectMetadata{Name: "one"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Id != "id-1" || meta.Revision != "rev-3" {
+		t.Fatalf("update didn't use generators: %#v", meta)
+	}
+
+	object, err := db.Get(ctx, "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !object.Metadata.CreationTime.Equal(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("wrong creation time: %v", object.Metadata.CreationTime)
+	}
+}
+
+var uuidFormat = regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$")
+
+func TestUUIDv7(t *testing.T) {
+	now := time.Now()
+	previous := ""
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		// Same millisecond, then clock going backwards
+		clock := now
+		if i >= 5000 {
+			clock = now.Add(-time.Second)
+		}
+		uuid := NewUUIDv7(clock)
+		if !uuidFormat.MatchString(uuid) {
+			t.Fatalf("invalid UUIDv7: %v", uuid)
+		}
+		if uuid <= previous {
+			t.Fatalf("UUIDv7 not increasing: %v <= %v", uuid, previous)
+		}
+		if seen[uuid] {
+			t.Fatalf("duplicate UUIDv7: %v", uuid)
+		}
+		seen[uuid] = true
+		previous = uuid
+	}
+
+	later := NewUUIDv7(now.Add(time.Hour))
+	if later <= previous {
+		t.Fatal("UUIDv7 doesn't sort by time")
+	}
+}
@@ -1,57 +1,143 @@
 package database
 
 import (
-	"sync"
+	"context"
+	"log/slog"
+	"slices"
 )
 
+// A mutex whose acquisition can be cancelled
 type mutexLocker struct {
-	mutex sync.Mutex
+	held chan struct{}
 }
 
-func (l *mutexLocker) Lock() {
-	l.mutex.Lock()
+func newMutexLocker() *mutexLocker {
+	return &mutexLocker{
+		held: make(chan struct{}, 1),
+	}
+}
+
+func (l *mutexLocker) Lock(ctx context.Context) error {
+	select {
+	case l.held <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (l *mutexLocker) Unlock() {
-	l.mutex.Unlock()
+	<-l.held
 }
 
 type inMemoryKv struct {
 	objects map[string]Object
+	// Changes are numbered like in the journal of the files backend
+	sequence uint64
+	recent   recentChanges
+}
+
+func (m *inMemoryKv) addChange(operation JournalOperation, key string, revision string) {
+	m.sequence++
+	m.recent.add(JournalEntry{
+		Sequence:  m.sequence,
+		Operation: operation,
+		Name:      key,
+		Revision:  revision,
+	})
 }
 
-func (m *inMemoryKv) Read(key string) (Object, error) {
+func (m *inMemoryKv) Read(ctx context.Context, key string) (Object, error) {
 	object, exists := m.objects[key]
 	if !exists {
 		return object, &DoesNotExist{
-			s: "no such key in memory",
+			Name:    key,
+			Message: "no such key in memory",
 		}
 	}
 	return object, nil
 }
 
-func (m *inMemoryKv) Write(key string, value Object) error {
+func (m *inMemoryKv) Write(ctx context.Context, key string, value Object) error {
 	m.objects[key] = value
+	m.addChange(JournalWrite, key, value.Metadata.Revision)
 	return nil
 }
 
-func (m *inMemoryKv) Delete(key string) error {
+func (m *inMemoryKv) Delete(ctx context.Context, key string) error {
 	_, exists := m.objects[key]
 	if !exists {
 		return &DoesNotExist{
-			s: "no such key in memory",
+			Name:    key,
+			Message: "no such key in memory",
 		}
 	}
 
 	delete(m.objects, key)
+	m.addChange(JournalDelete, key, "")
 	return nil
 }
 
+func (m *inMemoryKv) List(ctx context.Context, prefix string, after string, limit int) ([]Object, error) {
+	keys := make([]string, 0)
+	for key := range m.objects {
+		if key > after && HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	objects := make([]Object, 0, len(keys))
+	for _, key := range keys {
+		objects = append(objects, m.objects[key])
+	}
+	return objects, nil
+}
+
+func (m *inMemoryKv) lastSequence() (uint64, error) {
+	return m.sequence, nil
+}
+
+// Only the recent changes are available, there is no journal to fall back on
+func (m *inMemoryKv) changesSince(since uint64) ([]JournalEntry, error) {
+	if since == m.sequence {
+		return nil, nil
+	} else if since > m.sequence || !m.recent.covers(since) {
+		return nil, expiredChanges(since)
+	}
+	return changesAfter(m.recent.entries, since)
+}
+
 func NewInMemoryDatabase() *KvDatabase {
 	return NewKvDatabase(
-		&mutexLocker{},
+		newMutexLocker(),
 		&inMemoryKv{
 			objects: make(map[string]Object),
 		},
 	)
 }
+
+type InMemoryConfig struct {
+	// Fields to index in addition to kind and labels, e.g. "spec.owner"
+	Indexes []string `yaml:"indexes"`
+}
+
+func init() {
+	RegisterBackend("in_memory", &Backend{
+		NewConfig: func() any { return &InMemoryConfig{} },
+		Connect: func(config any) (Database, error) {
+			slog.Debug("open InMemoryDatabase")
+			db := NewInMemoryDatabase()
+			for _, field := range config.(*InMemoryConfig).Indexes {
+				err := db.AddIndex(field)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return db, nil
+		},
+	})
+}
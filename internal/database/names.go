@@ -0,0 +1,50 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	MaxNameLength        = 253
+	MaxNameSegmentLength = 63
+	MaxNameDepth         = 16
+)
+
+var nameSegmentFormat = regexp.MustCompile("^[a-z0-9][a-z0-9-]*$")
+
+// Check that an object name is valid
+//
+// Names are made of segments separated by slashes, representing nested
+// namespaces. Each segment starts with a lowercase letter or a digit, followed
+// by lowercase letters, digits, and dashes.
+func ValidateName(name string) error {
+	invalid := func(message string) error {
+		return &Invalid{
+			Reason:  ReasonInvalidName,
+			Name:    name,
+			Message: fmt.Sprintf("Invalid name %#v: %s", name, message),
+		}
+	}
+
+	if name == "" {
+		return invalid("empty name")
+	}
+	if len(name) > MaxNameLength {
+		return invalid(fmt.Sprintf("longer than %d characters", MaxNameLength))
+	}
+	segments := strings.Split(name, "/")
+	if len(segments) > MaxNameDepth {
+		return invalid(fmt.Sprintf("more than %d levels", MaxNameDepth))
+	}
+	for _, segment := range segments {
+		if len(segment) > MaxNameSegmentLength {
+			return invalid(fmt.Sprintf("segment longer than %d characters", MaxNameSegmentLength))
+		}
+		if !nameSegmentFormat.MatchString(segment) {
+			return invalid("segments should be lowercase letters, digits, and dashes, not starting with a dash")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,461 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type Operator string
+
+const (
+	OpEquals       Operator = "="
+	OpNotEquals    Operator = "!="
+	OpLess         Operator = "<"
+	OpLessEqual    Operator = "<="
+	OpGreater      Operator = ">"
+	OpGreaterEqual Operator = ">="
+	OpExists       Operator = "exists"
+	OpNotExists    Operator = "!exists"
+	OpIn           Operator = "in"
+	OpNotIn        Operator = "notin"
+)
+
+// A condition on a field of objects
+//
+// Fields are "kind", "version", "metadata.name", "metadata.id",
+// "metadata.revision", "metadata.labels.<key>", or a path into the spec or
+// status such as "spec.owner" or "status.conditions.0.type".
+type Requirement struct {
+	Field    string
+	Operator Operator
+	Values   []string
+}
+
+// A list of requirements that must all be met
+type Selector []Requirement
+
+var setFormat = regexp.MustCompile(`^((?:[^\s\\]|\\.)+)\s+(in|notin)\s*\((.*)\)$`)
+
+// Characters that have to be escaped in fields and values
+const selectorSpecial = `\,()!=<>`
+
+func invalidSelector(message string) error {
+	return &Invalid{
+		Reason:  ReasonInvalid,
+		Message: fmt.Sprintf("Invalid selector: %s", message),
+	}
+}
+
+// Parse a selector on fields
+//
+// The syntax is a comma-separated list of requirements, such as
+// "kind=example.org/Job,status.phase!=Succeeded,spec.priority>=5,spec.owner in (alice,bob),!status.error".
+// Labels can be selected with "metadata.labels.<key>". A backslash escapes the
+// character that follows it, e.g. "spec.title=Hello\, world".
+func ParseSelector(selector string) (Selector, error) {
+	return parseSelector(selector, func(field string) (string, error) {
+		err := validateField(field)
+		if err != nil {
+			return "", err
+		}
+		return field, nil
+	})
+}
+
+// Parse a selector on labels
+//
+// This is the same syntax as ParseSelector, but keys are label names, e.g.
+// "app=web,tier in (frontend,backend)".
+func ParseLabelSelector(selector string) (Selector, error) {
+	return parseSelector(selector, func(label string) (string, error) {
+		return "metadata.labels." + label, nil
+	})
+}
+
+func parseSelector(selector string, parseField func(string) (string, error)) (Selector, error) {
+	var result Selector
+	for _, term := range splitSelector(selector) {
+		term = trimSelector(term)
+		if term == "" {
+			continue
+		}
+		requirement, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		requirement.Field, err = parseField(requirement.Field)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, requirement)
+	}
+	return result, nil
+}
+
+// Split on commas that are not in parentheses or escaped
+func splitSelector(selector string) []string {
+	var terms []string
+	depth := 0
+	start := 0
+	escaped := false
+	for i, c := range selector {
+		if escaped {
+			escaped = false
+			continue
+		}
+		switch c {
+		case '\\':
+			escaped = true
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, selector[start:])
+}
+
+// Whether the string ends with a backslash that escapes what follows
+func endsEscaped(s string) bool {
+	count := 0
+	for count < len(s) && s[len(s)-1-count] == '\\' {
+		count++
+	}
+	return count%2 == 1
+}
+
+// Remove the whitespace around a term or value, unless it is escaped
+func trimSelector(s string) string {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	for s != "" {
+		last, size := utf8.DecodeLastRuneInString(s)
+		if !unicode.IsSpace(last) || endsEscaped(s[:len(s)-size]) {
+			break
+		}
+		s = s[:len(s)-size]
+	}
+	return s
+}
+
+// Find the first of the characters that is not escaped, or -1
+func indexUnescaped(s string, chars string) int {
+	escaped := false
+	for i, c := range s {
+		if escaped {
+			escaped = false
+		} else if c == '\\' {
+			escaped = true
+		} else if strings.ContainsRune(chars, c) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Remove the backslashes, keeping the characters they escape
+func unescapeSelector(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var result strings.Builder
+	escaped := false
+	for _, c := range s {
+		if !escaped && c == '\\' {
+			escaped = true
+			continue
+		}
+		escaped = false
+		result.WriteRune(c)
+	}
+	return result.String()
+}
+
+// Escape a field or value so that ParseSelector reads it back unchanged
+func escapeSelector(s string) string {
+	var result strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(selectorSpecial, c) || unicode.IsSpace(c) {
+			result.WriteByte('\\')
+		}
+		result.WriteRune(c)
+	}
+	return result.String()
+}
+
+func parseRequirement(term string) (Requirement, error) {
+	if match := setFormat.FindStringSubmatch(term); match != nil && !endsEscaped(match[3]) {
+		var values []string
+		for _, value := range splitSelector(match[3]) {
+			value = trimSelector(value)
+			if value != "" {
+				values = append(values, unescapeSelector(value))
+			}
+		}
+		if len(values) == 0 {
+			return Requirement{}, invalidSelector(fmt.Sprintf("empty set in %#v", term))
+		}
+		return Requirement{
+			Field:    unescapeSelector(match[1]),
+			Operator: Operator(match[2]),
+			Values:   values,
+		}, nil
+	}
+
+	if strings.HasPrefix(term, "!") && indexUnescaped(term[1:], "!=<>") == -1 {
+		return Requirement{
+			Field:    unescapeSelector(trimSelector(term[1:])),
+			Operator: OpNotExists,
+		}, nil
+	}
+
+	index := indexUnescaped(term, "!=<>")
+	if index == -1 {
+		if indexUnescaped(term, " \t()") != -1 {
+			return Requirement{}, invalidSelector(fmt.Sprintf("invalid requirement %#v", term))
+		}
+		return Requirement{
+			Field:    unescapeSelector(term),
+			Operator: OpExists,
+		}, nil
+	}
+	field := trimSelector(term[:index])
+	rest := term[index:]
+	var operator Operator
+	for _, op := range []string{"!=", "==", ">=", "<=", "=", ">", "<"} {
+		if strings.HasPrefix(rest, op) {
+			operator = Operator(op)
+			rest = rest[len(op):]
+			break
+		}
+	}
+	if operator == "==" {
+		operator = OpEquals
+	}
+	if operator == "" || field == "" || indexUnescaped(field, " \t()") != -1 {
+		return Requirement{}, invalidSelector(fmt.Sprintf("invalid requirement %#v", term))
+	}
+	return Requirement{
+		Field:    unescapeSelector(field),
+		Operator: operator,
+		Values:   []string{unescapeSelector(trimSelector(rest))},
+	}, nil
+}
+
+func validateField(field string) error {
+	switch field {
+	case "kind", "version", "metadata.name", "metadata.id", "metadata.revision", "spec", "status":
+		return nil
+	}
+	for _, prefix := range []string{"metadata.labels.", "spec.", "status."} {
+		if strings.HasPrefix(field, prefix) && len(field) > len(prefix) {
+			return nil
+		}
+	}
+	return invalidSelector(fmt.Sprintf("unknown field %#v", field))
+}
+
+// Format the selector, in the syntax understood by ParseSelector
+func (s Selector) String() string {
+	terms := make([]string, 0, len(s))
+	for _, requirement := range s {
+		field := escapeSelector(requirement.Field)
+		values := make([]string, len(requirement.Values))
+		for i, value := range requirement.Values {
+			values[i] = escapeSelector(value)
+		}
+		switch requirement.Operator {
+		case OpExists:
+			terms = append(terms, field)
+		case OpNotExists:
+			terms = append(terms, "!"+field)
+		case OpIn, OpNotIn:
+			terms = append(terms, fmt.Sprintf(
+				"%s %s (%s)",
+				field,
+				requirement.Operator,
+				strings.Join(values, ","),
+			))
+		default:
+			terms = append(terms, fmt.Sprintf(
+				"%s%s%s",
+				field,
+				requirement.Operator,
+				strings.Join(values, ","),
+			))
+		}
+	}
+	return strings.Join(terms, ",")
+}
+
+// Check whether an object meets all the requirements
+func (s Selector) Matches(object Object) bool {
+	for _, requirement := range s {
+		if !requirement.Matches(object) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Requirement) Matches(object Object) bool {
+	value, exists := FieldValue(object, r.Field)
+	switch r.Operator {
+	case OpExists:
+		return exists
+	case OpNotExists:
+		return !exists
+	case OpEquals:
+		return exists && valueString(value) == r.Values[0]
+	case OpNotEquals:
+		return !exists || valueString(value) != r.Values[0]
+	case OpIn, OpNotIn:
+		found := false
+		if exists {
+			str := valueString(value)
+			for _, v := range r.Values {
+				if str == v {
+					found = true
+					break
+				}
+			}
+		}
+		return found == (r.Operator == OpIn)
+	case OpLess, OpLessEqual, OpGreater, OpGreaterEqual:
+		if !exists {
+			return false
+		}
+		cmp := compareValues(value, r.Values[0])
+		switch r.Operator {
+		case OpLess:
+			return cmp < 0
+		case OpLessEqual:
+			return cmp <= 0
+		case OpGreater:
+			return cmp > 0
+		default:
+			return cmp >= 0
+		}
+	}
+	return false
+}
+
+// Get the value of a field from an object, see Requirement for the syntax
+func FieldValue(object Object, field string) (any, bool) {
+	switch field {
+	case "kind":
+		return object.Kind, true
+	case "version":
+		return object.Version, true
+	case "metadata.name":
+		return object.Metadata.Name, true
+	case "metadata.id":
+		return object.Metadata.Id, true
+	case "metadata.revision":
+		return object.Metadata.Revision, true
+	}
+	if label, ok := strings.CutPrefix(field, "metadata.labels."); ok {
+		value, exists := object.Metadata.Labels[label]
+		return value, exists
+	}
+	var root any
+	var path string
+	if field == "spec" || strings.HasPrefix(field, "spec.") {
+		root = object.Spec
+		path = strings.TrimPrefix(field[4:], ".")
+	} else if field == "status" || strings.HasPrefix(field, "status.") {
+		root = object.Status
+		path = strings.TrimPrefix(field[6:], ".")
+	} else {
+		return nil, false
+	}
+	return lookupPath(normalizeValue(root), path)
+}
+
+// Turn arbitrary Go values into what decoding JSON would give
+func normalizeValue(value any) any {
+	switch value.(type) {
+	case nil, string, bool, float64, map[string]any, []any:
+		return value
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var result any
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil
+	}
+	return result
+}
+
+func lookupPath(value any, path string) (any, bool) {
+	if path == "" {
+		return value, value != nil
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch v := normalizeValue(value).(type) {
+		case map[string]any:
+			var ok bool
+			value, ok = v[key]
+			if !ok {
+				return nil, false
+			}
+		case []any:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func valueString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(v)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// Compare numerically if both sides are numbers, as strings otherwise
+func compareValues(value any, reference string) int {
+	str := valueString(value)
+	a, errA := strconv.ParseFloat(str, 64)
+	b, errB := strconv.ParseFloat(reference, 64)
+	if errA == nil && errB == nil {
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(str, reference)
+}
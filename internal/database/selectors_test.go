@@ -0,0 +1,87 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	selector, err := ParseSelector("kind=example.org/Job, spec.priority >= 5,status.phase!=Done,spec.owner in (alice, bob),!status.error,metadata.labels.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Selector{
+		{"kind", OpEquals, []string{"example.org/Job"}},
+		{"spec.priority", OpGreaterEqual, []string{"5"}},
+		{"status.phase", OpNotEquals, []string{"Done"}},
+		{"spec.owner", OpIn, []string{"alice", "bob"}},
+		{"status.error", OpNotExists, nil},
+		{"metadata.labels.app", OpExists, nil},
+	}
+	if !reflect.DeepEqual(selector, expected) {
+		t.Fatalf("wrong selector: %#v", selector)
+	}
+
+	// String() gives back the same selector
+	reparsed, err := ParseSelector(selector.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reparsed, expected) {
+		t.Fatalf("wrong selector after formatting: %#v", reparsed)
+	}
+
+	// Values with special characters are escaped
+	expected = Selector{
+		{"spec.title", OpEquals, []string{"Hello, world (again)"}},
+		{"spec.owner", OpIn, []string{"a,b", "c)", ` d\ `}},
+		{"spec.expression", OpNotEquals, []string{"=x<y!"}},
+		{"spec.empty", OpEquals, []string{""}},
+		{"spec.odd field", OpNotExists, nil},
+	}
+	reparsed, err = ParseSelector(expected.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reparsed, expected) {
+		t.Fatalf("wrong selector after escaping: %#v", reparsed)
+	}
+	selector, err = ParseSelector(`spec.title = Hello\, world ,spec.owner in (a\,b, c)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = Selector{
+		{"spec.title", OpEquals, []string{"Hello, world"}},
+		{"spec.owner", OpIn, []string{"a,b", "c"}},
+	}
+	if !reflect.DeepEqual(selector, expected) {
+		t.Fatalf("wrong escaped selector: %#v", selector)
+	}
+
+	selector, err = ParseLabelSelector("app.example.org/name=web,tier notin (db)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = Selector{
+		{"metadata.labels.app.example.org/name", OpEquals, []string{"web"}},
+		{"metadata.labels.tier", OpNotIn, []string{"db"}},
+	}
+	if !reflect.DeepEqual(selector, expected) {
+		t.Fatalf("wrong label selector: %#v", selector)
+	}
+
+	for _, invalid := range []string{
+		"owner=alice",
+		"spec.=1",
+		"=1",
+		"spec.owner in ()",
+		"spec owner",
+		"spec.owner ~ alice",
+		`spec.owner in (alice\)`,
+	} {
+		_, err := ParseSelector(invalid)
+		if _, ok := err.(*Invalid); !ok {
+			t.Fatalf("no error for %#v: %#v", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package grpcapi
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Convert the spec or status of an object, which has to be a JSON object
+// (or nil) to fit in a Struct
+func toStruct(field string, value any) (*structpb.Struct, error) {
+	if value == nil {
+		return nil, nil
+	}
+	// Normalize the value through JSON, so that it only contains types
+	// that structpb knows
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var normalized any
+	err = json.Unmarshal(data, &normalized)
+	if err != nil {
+		return nil, err
+	}
+	switch normalized := normalized.(type) {
+	case nil:
+		return nil, nil
+	case map[string]any:
+		return structpb.NewStruct(normalized)
+	default:
+		return nil, fmt.Errorf("%v is not an object", field)
+	}
+}
+
+func fromStruct(value *structpb.Struct) any {
+	if value == nil {
+		return nil
+	}
+	return value.AsMap()
+}
+
+func FromObject(object database.Object) (*Object, error) {
+	spec, err := toStruct("Spec", object.Spec)
+	if err != nil {
+		return nil, err
+	}
+	status, err := toStruct("Status", object.Status)
+	if err != nil {
+		return nil, err
+	}
+	result := &Object{
+		Kind:    object.Kind,
+		Version: object.Version,
+		Metadata: &ObjectMetadata{
+			Name:     object.Metadata.Name,
+			Labels:   object.Metadata.Labels,
+			Id:       object.Metadata.Id,
+			Revision: object.Metadata.Revision,
+		},
+		Spec:   spec,
+		Status: status,
+	}
+	if !object.Metadata.CreationTime.IsZero() {
+		result.Metadata.CreationTime = timestamppb.New(object.Metadata.CreationTime)
+	}
+	return result, nil
+}
+
+func ToObject(object *Object) database.Object {
+	result := database.Object{
+		Kind:    object.GetKind(),
+		Version: object.GetVersion(),
+		Spec:    fromStruct(object.GetSpec()),
+		Status:  fromStruct(object.GetStatus()),
+	}
+	if metadata := object.GetMetadata(); metadata != nil {
+		result.Metadata = database.ObjectMetadata{
+			Name:     metadata.Name,
+			Labels:   metadata.Labels,
+			Id:       metadata.Id,
+			Revision: metadata.Revision,
+		}
+		if metadata.CreationTime != nil {
+			result.Metadata.CreationTime = metadata.CreationTime.AsTime()
+		}
+	}
+	return result
+}
+
+func FromMetadata(metadata database.MetadataResponse) *MetadataResponse {
+	return &MetadataResponse{
+		Id:       metadata.Id,
+		Revision: metadata.Revision,
+	}
+}
+
+func ToMetadata(metadata *MetadataResponse) database.MetadataResponse {
+	return database.MetadataResponse{
+		Id:       metadata.GetId(),
+		Revision: metadata.GetRevision(),
+	}
+}
@@ -0,0 +1,80 @@
+package grpcapi
+
+import (
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/remram44/vogon/internal/database"
+)
+
+// Domain of the ErrorInfo attached to errors
+const ErrorDomain = "vogon"
+
+var reasonCodes = map[database.Reason]codes.Code{
+	database.ReasonNotFound:           codes.NotFound,
+	database.ReasonAlreadyExists:      codes.AlreadyExists,
+	database.ReasonIdMismatch:         codes.FailedPrecondition,
+	database.ReasonRevisionMismatch:   codes.FailedPrecondition,
+	database.ReasonPreconditionFailed: codes.FailedPrecondition,
+	database.ReasonInvalid:            codes.InvalidArgument,
+	database.ReasonInvalidName:        codes.InvalidArgument,
+	database.ReasonBadRequest:         codes.InvalidArgument,
+	database.ReasonUnauthorized:       codes.Unauthenticated,
+	database.ReasonForbidden:          codes.PermissionDenied,
+	database.ReasonExpired:            codes.OutOfRange,
+	database.ReasonTimeout:            codes.DeadlineExceeded,
+	database.ReasonCancelled:          codes.Canceled,
+	database.ReasonInternalError:      codes.Internal,
+}
+
+// Build the gRPC status for an error, with the details in an ErrorInfo
+func StatusFromDetails(details database.ErrorDetails) *status.Status {
+	code, ok := reasonCodes[details.Reason]
+	if !ok {
+		code = codes.Internal
+	}
+	result := status.New(code, details.Message)
+	metadata := make(map[string]string)
+	for key, value := range map[string]string{
+		"name":              details.Name,
+		"expected_id":       details.ExpectedId,
+		"actual_id":         details.ActualId,
+		"expected_revision": details.ExpectedRevision,
+		"actual_revision":   details.ActualRevision,
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	withDetails, err := result.WithDetails(&errdetails.ErrorInfo{
+		Reason:   string(details.Reason),
+		Domain:   ErrorDomain,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return result
+	}
+	return withDetails
+}
+
+// Get the error details from a gRPC status, returns false if it didn't
+// come from the server
+func DetailsFromStatus(s *status.Status) (database.ErrorDetails, bool) {
+	for _, detail := range s.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != ErrorDomain {
+			continue
+		}
+		return database.ErrorDetails{
+			Message:          s.Message(),
+			Reason:           database.Reason(info.Reason),
+			Name:             info.Metadata["name"],
+			ExpectedId:       info.Metadata["expected_id"],
+			ActualId:         info.Metadata["actual_id"],
+			ExpectedRevision: info.Metadata["expected_revision"],
+			ActualRevision:   info.Metadata["actual_revision"],
+		}, true
+	}
+	return database.ErrorDetails{}, false
+}
@@ -0,0 +1,389 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Returned by Verify when no key in the set matches the token, which
+// might mean the set needs to be fetched again
+var ErrUnknownKey = errors.New("No key matches the token")
+
+// The claims of a token
+type Claims map[string]any
+
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyId     string `json:"kid"`
+	Type      string `json:"typ"`
+}
+
+type algorithm struct {
+	keyType string
+	hash    crypto.Hash
+	pss     bool
+	// For ECDSA
+	curve elliptic.Curve
+}
+
+var algorithms = map[string]algorithm{
+	"RS256": {keyType: "RSA", hash: crypto.SHA256},
+	"RS384": {keyType: "RSA", hash: crypto.SHA384},
+	"RS512": {keyType: "RSA", hash: crypto.SHA512},
+	"PS256": {keyType: "RSA", hash: crypto.SHA256, pss: true},
+	"PS384": {keyType: "RSA", hash: crypto.SHA384, pss: true},
+	"PS512": {keyType: "RSA", hash: crypto.SHA512, pss: true},
+	"ES256": {keyType: "EC", hash: crypto.SHA256, curve: elliptic.P256()},
+	"ES384": {keyType: "EC", hash: crypto.SHA384, curve: elliptic.P384()},
+	"ES512": {keyType: "EC", hash: crypto.SHA512, curve: elliptic.P521()},
+	"EdDSA": {keyType: "OKP"},
+}
+
+// A public key from a JWKS document
+type key struct {
+	id        string
+	algorithm string
+	public    crypto.PublicKey
+}
+
+// The keys to verify tokens with, from a JWKS document
+type KeySet struct {
+	keys []key
+}
+
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+func decodeBase64(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// Parse a JWKS document. Keys that are not for signatures or have an
+// unsupported type are ignored.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &document)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWKS: %w", err)
+	}
+	set := &KeySet{}
+	for i, jwk := range document.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		public, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %d in JWKS: %w", i, err)
+		}
+		if public == nil {
+			continue
+		}
+		set.keys = append(set.keys, key{
+			id:        jwk.KeyId,
+			algorithm: jwk.Algorithm,
+			public:    public,
+		})
+	}
+	if len(set.keys) == 0 {
+		return nil, fmt.Errorf("No usable key in JWKS")
+	}
+	return set, nil
+}
+
+// Smaller RSA keys can be factored, so tokens signed with them can be forged
+const minRsaKeyBits = 2048
+
+// Returns nil if the key type is not supported
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBase64(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("Invalid RSA key")
+		}
+		modulus := new(big.Int).SetBytes(n)
+		if modulus.BitLen() < minRsaKeyBits {
+			return nil, fmt.Errorf("RSA key is too small, %d bits, at least %d required", modulus.BitLen(), minRsaKeyBits)
+		}
+		return &rsa.PublicKey{
+			N: modulus,
+			E: int(exponent.Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var ecdhCurve ecdh.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, nil
+		}
+		x, err := decodeBase64(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, fmt.Errorf("Invalid EC key")
+		}
+		// Check that the point is on the curve
+		point := append([]byte{4}, append(x, y...)...)
+		if _, err := ecdhCurve.NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("Invalid EC key: %w", err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, nil
+		}
+		x, err := decodeBase64(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil
+	}
+}
+
+// Split a token in compact serialization, without verifying it
+func parse(token string) (header, Claims, []byte, []byte, error) {
+	var h header
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return h, nil, nil, nil, fmt.Errorf("Not a JWT")
+	}
+	data, err := decodeBase64(parts[0])
+	if err != nil {
+		return h, nil, nil, nil, fmt.Errorf("Invalid JWT header")
+	}
+	err = json.Unmarshal(data, &h)
+	if err != nil {
+		return h, nil, nil, nil, fmt.Errorf("Invalid JWT header")
+	}
+	data, err = decodeBase64(parts[1])
+	if err != nil {
+		return h, nil, nil, nil, fmt.Errorf("Invalid JWT payload")
+	}
+	var claims Claims
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	err = decoder.Decode(&claims)
+	if err != nil || claims == nil {
+		return h, nil, nil, nil, fmt.Errorf("Invalid JWT payload")
+	}
+	signature, err := decodeBase64(parts[2])
+	if err != nil {
+		return h, nil, nil, nil, fmt.Errorf("Invalid JWT signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	return h, claims, signed, signature, nil
+}
+
+// Whether the string looks like a JWT, to tell them apart from other tokens
+func IsJwt(token string) bool {
+	_, _, _, _, err := parse(token)
+	return err == nil
+}
+
+// Get the claims of a token without verifying it
+func UnverifiedClaims(token string) (Claims, error) {
+	_, claims, _, _, err := parse(token)
+	return claims, err
+}
+
+// Check the signature of a token and return its claims. The claims are not
+// validated, see Claims.Validate.
+func (s *KeySet) Verify(token string) (Claims, error) {
+	h, claims, signed, signature, err := parse(token)
+	if err != nil {
+		return nil, err
+	}
+	alg, ok := algorithms[h.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported JWT algorithm %#v", h.Algorithm)
+	}
+
+	found := false
+	for _, key := range s.keys {
+		if h.KeyId != "" && key.id != h.KeyId {
+			continue
+		}
+		if key.algorithm != "" && key.algorithm != h.Algorithm {
+			continue
+		}
+		if !alg.matches(key.public) {
+			continue
+		}
+		found = true
+		if alg.verify(key.public, signed, signature) {
+			return claims, nil
+		}
+	}
+	if !found {
+		return nil, ErrUnknownKey
+	}
+	return nil, fmt.Errorf("Invalid JWT signature")
+}
+
+func (alg algorithm) matches(public crypto.PublicKey) bool {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return alg.keyType == "RSA"
+	case *ecdsa.PublicKey:
+		return alg.keyType == "EC" && public.Curve == alg.curve
+	case ed25519.PublicKey:
+		return alg.keyType == "OKP"
+	default:
+		return false
+	}
+}
+
+func (alg algorithm) verify(public crypto.PublicKey, signed []byte, signature []byte) bool {
+	if alg.keyType == "OKP" {
+		return ed25519.Verify(public.(ed25519.PublicKey), signed, signature)
+	}
+
+	hasher := alg.hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if alg.pss {
+			return rsa.VerifyPSS(public, alg.hash, digest, signature, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(public, alg.hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// Signatures are the two integers concatenated, not ASN.1
+		size := (public.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(public, digest, r, s)
+	default:
+		return false
+	}
+}
+
+// Maximum difference allowed between our clock and the issuer's
+const clockSkew = time.Minute
+
+// Get a time claim, returns false if it is missing
+func (c Claims) time(name string) (time.Time, bool, error) {
+	value, ok := c[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("Invalid %#v claim", name)
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("Invalid %#v claim", name)
+	}
+	return time.Unix(0, 0).Add(time.Duration(seconds * float64(time.Second))), true, nil
+}
+
+// Get a string claim, returns an empty string if it is missing or not a
+// string
+func (c Claims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// Get a claim that is a string or list of strings
+func (c Claims) Strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		result := make([]string, 0, len(value))
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// Check the issuer, audience, and validity period of the token
+func (c Claims) Validate(issuer string, audience string, now time.Time) error {
+	if c.String("iss") != issuer {
+		return fmt.Errorf("Wrong JWT issuer")
+	}
+	if !slices.Contains(c.Strings("aud"), audience) {
+		return fmt.Errorf("Wrong JWT audience")
+	}
+	expiry, ok, err := c.time("exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("JWT has no expiry")
+	}
+	if now.After(expiry.Add(clockSkew)) {
+		return fmt.Errorf("JWT is expired")
+	}
+	notBefore, ok, err := c.time("nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(clockSkew).Before(notBefore) {
+		return fmt.Errorf("JWT is not valid yet")
+	}
+	return nil
+}
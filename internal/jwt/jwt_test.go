@@ -0,0 +1,181 @@
+package jwt_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/remram44/vogon/internal/jwt"
+	"github.com/remram44/vogon/internal/jwt/jwttest"
+)
+
+func TestVerify(t *testing.T) {
+	issuer := jwttest.NewIssuer(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add the RSA and Ed25519 keys to the issuer's JWKS
+	var document struct {
+		Keys []map[string]any `json:"keys"`
+	}
+	err = json.Unmarshal(issuer.Jwks(), &document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	document.Keys = append(
+		document.Keys,
+		map[string]any{
+			"kty": "RSA",
+			"kid": "rsa",
+			"n":   encode(rsaKey.N.Bytes()),
+			"e":   encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		map[string]any{
+			"kty": "OKP",
+			"kid": "ed",
+			"crv": "Ed25519",
+			"x":   encode(edPublic),
+		},
+		// Ignored
+		map[string]any{"kty": "oct", "k": "c2VjcmV0"},
+		map[string]any{"kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	)
+	data, err := json.Marshal(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := jwt.ParseKeySet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := jwt.Claims{"sub": "alice"}
+	for name, token := range map[string]string{
+		"ES256":  issuer.Sign(t, claims),
+		"RS256":  jwttest.Sign(t, rsaKey, "RS256", "rsa", claims),
+		"EdDSA":  jwttest.Sign(t, edKey, "EdDSA", "ed", claims),
+		"no kid": jwttest.Sign(t, rsaKey, "RS256", "", claims),
+	} {
+		verified, err := keys.Verify(token)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+		} else if verified.String("sub") != "alice" {
+			t.Errorf("%v: wrong claims %#v", name, verified)
+		}
+	}
+
+	token := issuer.Sign(t, claims)
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + encode([]byte(`{"sub":"mallory"}`)) + "." + parts[2]
+	noneHeader := encode([]byte(`{"alg":"none"}`))
+	otherKey := jwttest.NewIssuer(t)
+	for name, token := range map[string]string{
+		"forged":        forged,
+		"alg none":      noneHeader + "." + parts[1] + ".",
+		"wrong key":     jwttest.Sign(t, rsaKey, "EdDSA", "ed", claims),
+		"wrong alg":     jwttest.Sign(t, rsaKey, "RS512", "rsa", claims),
+		"not a jwt":     "abcdef",
+		"bad signature": parts[0] + "." + parts[1] + "." + encode([]byte("nope")),
+	} {
+		_, err := keys.Verify(token)
+		if err == nil {
+			t.Errorf("%v: no error", name)
+		}
+	}
+
+	_, err = keys.Verify(otherKey.Sign(t, claims))
+	if err == nil {
+		t.Fatal("token signed by another key with the same id was accepted")
+	}
+}
+
+func TestWeakKey(t *testing.T) {
+	encode := base64.RawURLEncoding.EncodeToString
+	for _, bits := range []int{512, 1024, 2040} {
+		modulus := make([]byte, bits/8)
+		for i := range modulus {
+			modulus[i] = 0xff
+		}
+		data, err := json.Marshal(map[string]any{
+			"keys": []any{map[string]any{
+				"kty": "RSA",
+				"n":   encode(modulus),
+				"e":   encode(big.NewInt(65537).Bytes()),
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = jwt.ParseKeySet(data)
+		if err == nil || !strings.Contains(err.Error(), "too small") {
+			t.Fatalf("%d-bit key: %v", bits, err)
+		}
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	issuer := jwttest.NewIssuer(t)
+	keys, err := jwt.ParseKeySet(issuer.Jwks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := jwttest.NewIssuer(t)
+	other.KeyId = "other-key"
+	_, err = keys.Verify(other.Sign(t, jwt.Claims{}))
+	if !errors.Is(err, jwt.ErrUnknownKey) {
+		t.Fatalf("wrong error: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	valid := jwt.Claims{
+		"iss": "https://idp.example.org",
+		"aud": []any{"other", "vogon"},
+		"exp": json.Number("1700000600"),
+		"nbf": json.Number("1699999900"),
+	}
+	err := valid.Validate("https://idp.example.org", "vogon", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, change := range map[string]jwt.Claims{
+		"issuer":     {"iss": "https://evil.example.org"},
+		"audience":   {"aud": "other"},
+		"expired":    {"exp": json.Number("1699999000")},
+		"not before": {"nbf": json.Number("1700001000")},
+		"no expiry":  {"exp": nil},
+		"bad expiry": {"exp": "tomorrow"},
+	} {
+		claims := jwt.Claims{}
+		for key, value := range valid {
+			claims[key] = value
+		}
+		for key, value := range change {
+			if value == nil {
+				delete(claims, key)
+			} else {
+				claims[key] = value
+			}
+		}
+		err := claims.Validate("https://idp.example.org", "vogon", now)
+		if err == nil {
+			t.Errorf("%v: no error", name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Package jwttest issues tokens signed with throwaway keys, to test the
+// verification of JWTs without an identity provider:
+//
+//	issuer := jwttest.NewIssuer(t)
+//	os.WriteFile(jwksFile, issuer.Jwks(), 0o644)
+//	token := issuer.Sign(t, jwt.Claims{"iss": "https://idp.example.org", ...})
+package jwttest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/remram44/vogon/internal/jwt"
+)
+
+// Signs tokens with an ES256 key
+type Issuer struct {
+	KeyId string
+	key   *ecdsa.PrivateKey
+}
+
+func NewIssuer(t *testing.T) *Issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Issuer{
+		KeyId: "test-key",
+		key:   key,
+	}
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// The JWKS document with the public key
+func (i *Issuer) Jwks() []byte {
+	data, _ := json.Marshal(map[string]any{
+		"keys": []any{
+			map[string]any{
+				"kty": "EC",
+				"kid": i.KeyId,
+				"use": "sig",
+				"alg": "ES256",
+				"crv": "P-256",
+				"x":   encode(i.key.X.FillBytes(make([]byte, 32))),
+				"y":   encode(i.key.Y.FillBytes(make([]byte, 32))),
+			},
+		},
+	})
+	return data
+}
+
+// Issue a token with these claims
+func (i *Issuer) Sign(t *testing.T, claims jwt.Claims) string {
+	return Sign(t, i.key, "ES256", i.KeyId, claims)
+}
+
+// Issue a token with a P-256, RSA, or Ed25519 key, for the ES256, RS256, or
+// EdDSA algorithm. The algorithm in the header is not checked against the
+// key.
+func Sign(t *testing.T, key crypto.Signer, algorithm string, keyId string, claims jwt.Claims) string {
+	header, err := json.Marshal(map[string]string{
+		"alg": algorithm,
+		"kid": keyId,
+		"typ": "JWT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		// JWS uses the two integers concatenated, not ASN.1
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	default:
+		t.Fatalf("Unsupported key type %T", key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + encode(signature)
+}